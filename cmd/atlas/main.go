@@ -1,13 +1,14 @@
-package main
-
-import (
-	"log"
-
-	"github.com/IYouKnow/atlas-drive/internal/cli"
-)
-
-func main() {
-	if err := cli.Execute(); err != nil {
-		log.Fatal(err)
-	}
-}
+package main
+
+import (
+	"os"
+
+	"github.com/IYouKnow/atlas-drive/internal/cli"
+)
+
+func main() {
+	if err := cli.Execute(); err != nil {
+		// cobra has already printed the error.
+		os.Exit(1)
+	}
+}
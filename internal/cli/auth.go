@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/IYouKnow/atlas-drive/internal/server"
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+	"github.com/spf13/viper"
+)
+
+// openAuth sets up the authenticators listed in "auth", tried in that order: local
+// (the user store) and ldap.
+func openAuth(store user.Store) (user.Authenticator, error) {
+	var chain user.Chain
+	for _, name := range splitList(viper.GetStringSlice("auth")) {
+		switch name {
+		case "local":
+			chain = append(chain, user.Local{Users: store, OnRehash: logRehash})
+		case "ldap":
+			l, err := user.NewLDAP(user.LDAPConfig{
+				URL:          viper.GetString("ldap_url"),
+				StartTLS:     viper.GetBool("ldap_start_tls"),
+				CAFile:       viper.GetString("ldap_ca_file"),
+				BindDN:       viper.GetString("ldap_bind_dn"),
+				BindPassword: viper.GetString("ldap_bind_password"),
+				BaseDN:       viper.GetString("ldap_base_dn"),
+				UserFilter:   viper.GetString("ldap_user_filter"),
+				AdminGroups:  dnList("ldap_admin_groups"),
+				UserGroups:   dnList("ldap_user_groups"),
+			})
+			if err != nil {
+				return nil, err
+			}
+			var auth user.Authenticator = l
+			if ttl := viper.GetDuration("ldap_cache_ttl"); ttl > 0 {
+				auth = user.NewCache(l, ttl)
+			}
+			chain = append(chain, auth)
+			slog.Info("LDAP authentication enabled", "url", viper.GetString("ldap_url"), "base_dn", viper.GetString("ldap_base_dn"))
+		default:
+			return nil, fmt.Errorf("unknown authenticator %q (want local or ldap)", name)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no authenticator configured (want local and/or ldap)")
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// logRehash reports passwords moved to a current hash at login.
+func logRehash(username string, err error) {
+	if err != nil {
+		slog.Error("Failed to save rehashed password", "user", username, "error", err)
+		return
+	}
+	slog.Info("Password rehashed", "user", username)
+}
+
+// openTokenAuth sets up bearer token authentication if a JWKS is configured, and
+// returns nil otherwise.
+func openTokenAuth() (user.TokenAuthenticator, error) {
+	jwks := viper.GetString("oidc_jwks")
+	if jwks == "" {
+		return nil, nil
+	}
+	o, err := user.NewOIDC(user.OIDCConfig{
+		JWKS:          jwks,
+		Issuer:        viper.GetString("oidc_issuer"),
+		Audience:      viper.GetString("oidc_audience"),
+		UsernameClaim: viper.GetString("oidc_username_claim"),
+		GroupsClaim:   viper.GetString("oidc_groups_claim"),
+		AdminGroups:   splitList(viper.GetStringSlice("oidc_admin_groups")),
+		UserGroups:    splitList(viper.GetStringSlice("oidc_user_groups")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Bearer token authentication enabled", "issuer", viper.GetString("oidc_issuer"), "jwks", jwks)
+	return o, nil
+}
+
+// openClientCerts sets up client certificate authentication if a client CA is
+// configured, and returns nil otherwise.
+func openClientCerts() (*server.ClientCertAuth, error) {
+	caFile := viper.GetString("client_ca")
+	if caFile == "" {
+		return nil, nil
+	}
+	pool, err := server.LoadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &server.ClientCertAuth{
+		CAs:           pool,
+		UserField:     viper.GetString("client_cert_user"),
+		AdminPassword: viper.GetBool("client_cert_admin_password"),
+	}
+	switch mode := viper.GetString("client_cert"); mode {
+	case "require":
+		c.Required = true
+	case "optional":
+	default:
+		return nil, fmt.Errorf("unknown client certificate mode %q (want require or optional)", mode)
+	}
+	slog.Info("Client certificate authentication enabled", "ca_file", caFile, "required", c.Required, "user_field", c.UserField)
+	return c, nil
+}
+
+// dnList reads a list of DNs: repeated flags, or ";"-separated in the environment,
+// since DNs contain commas.
+func dnList(key string) []string {
+	var values []string
+	switch v := viper.Get(key).(type) {
+	case []string:
+		values = v
+	case string:
+		values = strings.Split(v, ";")
+	}
+	var out []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck [path]",
+	Short: "Verify stored files against their checksums",
+	Long: `Reads every file below path (default: everything) and compares it with the
+SHA-256 recorded when it was written. Files whose content changed although they were
+not rewritten are reported as corrupt (bit rot, a failing disk); files that changed
+after their checksum was recorded were modified outside Atlas.
+
+Open the store with the same settings as the server (--storage, --replica, --encrypt,
+--compress, or their ATLAS_ variables). Write-back uploads still waiting in the
+server's cache are not checked. Exits with an error if any problem remains.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		applyFlags(cmd, map[string]string{
+			"storage":             "storage",
+			"encrypt":             "encrypt",
+			"encryption-key-file": "encryption_key_file",
+			"encrypt-names":       "encrypt_names",
+			"compress":            "compress",
+		})
+		if dirs, _ := cmd.Flags().GetStringSlice("replica"); len(dirs) > 0 {
+			viper.Set("replicas", dirs)
+		}
+		viper.Set("checksum", "sha256")
+
+		dataDir, _ := filepath.Abs(dataDirFlag(cmd))
+		stack, err := openDriver(dataDir, false)
+		if err != nil {
+			return err
+		}
+		defer stack.Close(cmd.Context())
+		c := stack.Checksums
+		ctx := cmd.Context()
+
+		prefix := ""
+		if len(args) == 1 {
+			if prefix, err = storage.CleanKey(args[0]); err != nil {
+				return err
+			}
+		}
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		update, _ := cmd.Flags().GetBool("update")
+		accept, _ := cmd.Flags().GetBool("accept-changes")
+
+		fixed := 0
+		sum, err := c.Scrub(ctx, prefix, func(r storage.CheckResult) {
+			fix := (update && r.Status == storage.CheckMissing) || (accept && r.Status == storage.CheckModified)
+			switch {
+			case r.Status == storage.CheckOK:
+				if verbose {
+					fmt.Printf("ok          %s\n", r.Key)
+				}
+				return
+			case r.Status == storage.CheckMissing && !fix:
+				if verbose {
+					fmt.Printf("no checksum %s\n", r.Key)
+				}
+				return
+			case r.Err != nil:
+				fmt.Printf("%s: %s: %v\n", r.Key, r.Status, r.Err)
+			case r.Status == storage.CheckMissing:
+				fmt.Printf("%s: %s\n", r.Key, r.Status)
+			default:
+				fmt.Printf("%s: %s (stored %s, read %s)\n", r.Key, r.Status, r.Want, r.Got)
+			}
+			if fix {
+				if err := c.Update(ctx, r.Key); err != nil {
+					fmt.Printf("  failed to record checksum: %v\n", err)
+					return
+				}
+				fmt.Println("  checksum recorded")
+				fixed++
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("fsck incomplete after %d files: %w", sum.Checked, err)
+		}
+
+		fmt.Printf("\nChecked %d files (%s): %d ok, %d without checksum, %d corrupt, %d modified outside Atlas, %d unreadable.\n",
+			sum.Checked, formatBytes(sum.Bytes), sum.OK, sum.Missing, sum.Corrupt, sum.Modified, sum.Unreadable)
+		if fixed > 0 {
+			fmt.Printf("Recorded %d new checksums.\n", fixed)
+		}
+		if sum.Missing > 0 && !update {
+			fmt.Println("Run with --update to record checksums for files stored without one.")
+		}
+
+		problems := sum.Problems()
+		if accept {
+			problems -= sum.Modified
+		}
+		if problems > 0 {
+			return fmt.Errorf("%d files failed verification", problems)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fsckCmd)
+
+	fsckCmd.Flags().StringP("data-dir", "d", "", "Data directory (default: ATLAS_DATA_DIR or ./data)")
+	fsckCmd.Flags().String("storage", "", "Storage backend of the data directory (default: ATLAS_STORAGE or disk)")
+	fsckCmd.Flags().StringSlice("replica", nil, "Replica directory the store is mirrored to (repeatable; default: ATLAS_REPLICAS)")
+	fsckCmd.Flags().Bool("encrypt", false, "The store is encrypted (default: ATLAS_ENCRYPT)")
+	fsckCmd.Flags().String("encryption-key-file", "", "Key file of an encrypted store (default: ATLAS_ENCRYPTION_KEY_FILE)")
+	fsckCmd.Flags().Bool("encrypt-names", false, "The store uses encrypted names (default: ATLAS_ENCRYPT_NAMES)")
+	fsckCmd.Flags().String("compress", "", "Compression the store was written with (default: ATLAS_COMPRESS or none)")
+	fsckCmd.Flags().BoolP("verbose", "v", false, "List every file, not just the problems")
+	fsckCmd.Flags().Bool("update", false, "Record checksums for files stored without one")
+	fsckCmd.Flags().Bool("accept-changes", false, "Record new checksums for files modified outside Atlas, accepting their current content")
+}
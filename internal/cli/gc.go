@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Reclaim unreferenced chunks from a deduplicating store",
+	Long: `Removes chunks that no file references any more (left behind by deleted and
+overwritten files, crashes or interrupted uploads) from a data directory served with
+--storage dedup. The server doesn't remove chunks itself, so run this regularly.
+
+It is safe to run while the server is up: chunks touched within the grace period
+are kept, so uploads in progress are not affected. An upload that takes longer than
+the grace period may fail if gc collects its first chunks meanwhile, but it never
+stores a file whose chunks are gone. Downloads hold a lease on their chunks (a file
+under leases/ in the data directory), so they keep them however long they take, even
+if the file is overwritten or deleted meanwhile.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dataDir, _ := filepath.Abs(dataDirFlag(cmd))
+		if !storage.IsDedupStore(dataDir) {
+			return fmt.Errorf("%s is not a deduplicating store (start the server with --storage dedup)", dataDir)
+		}
+
+		grace, _ := cmd.Flags().GetDuration("grace")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		d, err := storage.NewDedupDriver(dataDir)
+		if err != nil {
+			return err
+		}
+
+		res, err := d.GC(cmd.Context(), grace, dryRun)
+		if err != nil {
+			return fmt.Errorf("gc failed: %w", err)
+		}
+
+		verb := "Removed"
+		if dryRun {
+			verb = "Would remove"
+		}
+		fmt.Printf("%s %d orphaned chunks (%s) and %d stale temp files.\n",
+			verb, res.ChunksRemoved, formatBytes(res.BytesFreed), res.TempRemoved)
+
+		stats, err := d.Stats(cmd.Context())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Objects:  %d\n", stats.Objects)
+		fmt.Printf("Logical:  %s\n", formatBytes(stats.LogicalBytes))
+		fmt.Printf("Physical: %s in %d chunks\n", formatBytes(stats.PhysicalBytes), stats.Chunks)
+		fmt.Printf("Dedup ratio: %.2fx\n", stats.Ratio())
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+
+	gcCmd.Flags().StringP("data-dir", "d", "", "Data directory of the deduplicating store (default: ATLAS_DATA_DIR or ./data)")
+	gcCmd.Flags().Duration("grace", time.Hour, "Keep unreferenced chunks younger than this (protects in-flight uploads)")
+	gcCmd.Flags().Bool("dry-run", false, "Report what would be removed without deleting anything")
+}
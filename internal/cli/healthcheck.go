@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var healthcheckCmd = &cobra.Command{
+	Use:   "healthcheck",
+	Short: "Check that a running server is ready to serve requests",
+	Long: `Queries the /readyz endpoint of the server on this machine and exits with
+status 0 when it is ready, 1 otherwise. It is meant for Docker's HEALTHCHECK in
+images without curl or wget:
+
+  HEALTHCHECK CMD ["/atlas", "healthcheck"]`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		url, _ := cmd.Flags().GetString("url")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		client := &http.Client{Timeout: timeout}
+		if url == "" {
+			url = "http://127.0.0.1:" + healthcheckPort(cmd) + "/readyz"
+			if viper.GetString("tls_cert") != "" {
+				// The certificate is for the server's public name, not 127.0.0.1.
+				url = "https" + strings.TrimPrefix(url, "http")
+				client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+			}
+		}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			return fmt.Errorf("health check failed: %w", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("health check failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		fmt.Println("ok")
+		return nil
+	},
+}
+
+// healthcheckPort returns the port the server listens on: --port, else the "port"
+// setting (ATLAS_PORT), so the check finds the server started in the same container.
+func healthcheckPort(cmd *cobra.Command) string {
+	if f := cmd.Flags().Lookup("port"); f != nil && f.Changed {
+		return f.Value.String()
+	}
+	if port := viper.GetString("port"); port != "" {
+		return port
+	}
+	return "8080"
+}
+
+func init() {
+	rootCmd.AddCommand(healthcheckCmd)
+
+	healthcheckCmd.Flags().StringP("port", "p", "", "Port of the server (default: ATLAS_PORT or 8080)")
+	healthcheckCmd.Flags().String("url", "", "Readiness URL to query instead of http://127.0.0.1:<port>/readyz")
+	healthcheckCmd.Flags().Duration("timeout", 5*time.Second, "Give up after this long")
+}
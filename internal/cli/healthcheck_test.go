@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// healthcheck runs 'atlas healthcheck' with args and reports whether it exits with 0.
+func healthcheck(t *testing.T, args ...string) bool {
+	t.Helper()
+	rootCmd.SetArgs(append([]string{"healthcheck", "--url=", "--timeout=5s"}, args...))
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SetErr(io.Discard)
+	return rootCmd.Execute() == nil
+}
+
+func TestHealthcheck(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/readyz":
+			w.WriteHeader(int(status.Load()))
+		case "/slow":
+			time.Sleep(time.Second)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !healthcheck(t, "--url", ts.URL+"/readyz") {
+		t.Error("ready server: exit status 1, want 0")
+	}
+	// Without --url, /readyz on 127.0.0.1 at --port.
+	if !healthcheck(t, "--port", u.Port()) {
+		t.Error("ready server found by its port: exit status 1, want 0")
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	if healthcheck(t, "--url", ts.URL+"/readyz") {
+		t.Error("server not ready: exit status 0, want 1")
+	}
+	if healthcheck(t, "--url", ts.URL+"/slow", "--timeout", "50ms") {
+		t.Error("server not answering in time: exit status 0, want 1")
+	}
+	ts.Close()
+	if healthcheck(t, "--url", ts.URL+"/readyz") {
+		t.Error("server down: exit status 0, want 1")
+	}
+}
@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/IYouKnow/atlas-drive/internal/atomicfile"
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage encryption-at-rest keys",
+	Long:  `Generate master keys and rotate the key used to encrypt stored files.`,
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate a new master key",
+	Long: `Prints a new random master key, or writes it to a new key file with --key-file.
+Keep a copy somewhere safe: files encrypted with it cannot be recovered without it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := storage.GenerateKey()
+		if err != nil {
+			return err
+		}
+
+		path, _ := cmd.Flags().GetString("key-file")
+		if path == "" {
+			fmt.Println(key)
+			return nil
+		}
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists; use 'atlas keys rotate' to add a key to it", path)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+			return err
+		}
+		fmt.Printf("Key written to %s.\n", path)
+		return nil
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Add a new master key and re-encrypt all files with it",
+	Long: `Appends a new key to the key file, making it the active key, then re-encrypts every
+file that still uses an older key. Older keys stay in the file so nothing becomes
+unreadable if the run is interrupted; finish an interrupted rotation with
+--reencrypt-only.
+
+With --encrypt-names, file names stay encrypted with the first key in the file:
+rotation doesn't change them, so that key can never be removed and rotating away
+from a compromised first key doesn't protect names.
+
+Stop the server before rotating: it only reads the key file at startup.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		applyFlags(cmd, map[string]string{
+			"storage":       "storage",
+			"key-file":      "encryption_key_file",
+			"encrypt-names": "encrypt_names",
+		})
+
+		path := viper.GetString("encryption_key_file")
+		if path == "" {
+			return errors.New("rotation needs a key file (--key-file or ATLAS_ENCRYPTION_KEY_FILE); keys from ATLAS_ENCRYPTION_KEY cannot be updated in place")
+		}
+
+		reencryptOnly, _ := cmd.Flags().GetBool("reencrypt-only")
+		if !reencryptOnly {
+			if _, err := loadKeyring(); err != nil {
+				return err
+			}
+			key, err := storage.GenerateKey()
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			content := string(data)
+			if !strings.HasSuffix(content, "\n") {
+				content += "\n"
+			}
+			// The new key must be on disk before anything is encrypted with it.
+			if err := atomicfile.WriteFile(path, []byte(content+key+"\n"), 0600); err != nil {
+				return fmt.Errorf("failed to update key file: %w", err)
+			}
+		}
+
+		keys, err := loadKeyring()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Active key: %s\n", keys.Active().ID)
+		if viper.GetBool("encrypt_names") {
+			fmt.Fprintf(os.Stderr, "Warning: file names stay encrypted with the first key (%s). It can never be removed from the key file, and anyone who has it can still read the names.\n", keys.Keys()[0].ID)
+		}
+
+		dataDir, _ := filepath.Abs(dataDirFlag(cmd))
+		base, err := openBaseDriver(dataDir)
+		if err != nil {
+			return err
+		}
+		enc := storage.NewEncryptedDriver(base, keys, viper.GetBool("encrypt_names"))
+
+		n, err := enc.Reencrypt(cmd.Context(), func(key string) {
+			fmt.Println("re-encrypted", key)
+		})
+		if err != nil {
+			return fmt.Errorf("rotation incomplete after %d files (run again with --reencrypt-only): %w", n, err)
+		}
+		fmt.Printf("Rotation complete: %d files re-encrypted.\n", n)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysGenerateCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+
+	keysGenerateCmd.Flags().String("key-file", "", "Write the key to this (new) file instead of printing it")
+
+	keysRotateCmd.Flags().StringP("data-dir", "d", "", "Data directory (default: ATLAS_DATA_DIR or ./data)")
+	keysRotateCmd.Flags().String("storage", "", "Storage backend of the data directory (default: ATLAS_STORAGE or disk)")
+	keysRotateCmd.Flags().String("key-file", "", "Key file to rotate (default: ATLAS_ENCRYPTION_KEY_FILE)")
+	keysRotateCmd.Flags().Bool("encrypt-names", false, "The store uses encrypted names (default: ATLAS_ENCRYPT_NAMES)")
+	keysRotateCmd.Flags().Bool("reencrypt-only", false, "Do not add a key; finish re-encrypting with the current active key")
+}
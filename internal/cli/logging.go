@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/IYouKnow/atlas-drive/internal/server"
+	"github.com/spf13/viper"
+)
+
+// setupLogging installs the default slog logger from the "log_level" and "log_format"
+// settings. Records logged while handling a request carry its request_id.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(viper.GetString("log_level"))); err != nil {
+		return fmt.Errorf("invalid log level %q (want debug, info, warn or error)", viper.GetString("log_level"))
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format := viper.GetString("log_format"); format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (want text or json)", format)
+	}
+	slog.SetDefault(slog.New(server.NewLogHandler(h)))
+	return nil
+}
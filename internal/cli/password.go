@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+// setupPasswords configures how passwords are hashed and the policy new passwords
+// must satisfy.
+func setupPasswords() error {
+	hashing := user.Hashing{
+		Algorithm:    viper.GetString("password_hash"),
+		BcryptCost:   viper.GetInt("bcrypt_cost"),
+		Argon2Memory: viper.GetUint32("argon2_memory"),
+		Argon2Time:   viper.GetUint32("argon2_time"),
+	}
+	if err := hashing.Validate(); err != nil {
+		return err
+	}
+	user.PasswordHashing = hashing
+
+	user.PasswordPolicy.MinLength = viper.GetInt("password_min_length")
+	file := viper.GetString("password_breached_list")
+	if file == "" {
+		return nil
+	}
+	if err := user.PasswordPolicy.LoadBreached(file); err != nil {
+		return fmt.Errorf("breached password list: %w", err)
+	}
+	slog.Debug("Loaded breached password list", "file", file, "passwords", user.PasswordPolicy.Breached())
+	return nil
+}
+
+// newPassword gets a new password for a command: the first line of stdin with
+// --password-stdin, or typed twice at a hidden prompt. It is never taken from the
+// arguments, which shell history and ps would show.
+func newPassword(cmd *cobra.Command) (string, error) {
+	if fromStdin, _ := cmd.Flags().GetBool("password-stdin"); fromStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+			return "", fmt.Errorf("reading the password from stdin: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("stdin is not a terminal; use --password-stdin to read the password from it")
+	}
+	password, err := promptPassword(fd, "New password: ")
+	if err != nil {
+		return "", err
+	}
+	if err := user.PasswordPolicy.Check(password); err != nil {
+		return "", err
+	}
+	again, err := promptPassword(fd, "Retype new password: ")
+	if err != nil {
+		return "", err
+	}
+	if again != password {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+func promptPassword(fd int, prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("reading the password: %w", err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var replicaCmd = &cobra.Command{
+	Use:   "replica",
+	Short: "Inspect and repair mirrored data directories",
+	Long: `Works on a data directory served with one or more --replica directories. Use the
+same --data-dir, --replica and --storage settings as the server.`,
+}
+
+var replicaStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show queued repairs and differences between replicas",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		m, err := openReplicaSet(cmd)
+		if err != nil {
+			return err
+		}
+		ctx := cmd.Context()
+
+		dirs := replicaSetDirs(cmd)
+		for i, h := range m.Probe(ctx) {
+			role := "replica"
+			if i == 0 {
+				role = "primary"
+			}
+			state := "ok"
+			if !h.Healthy {
+				state = h.LastError
+			}
+			fmt.Printf("[%d] %-7s %s (%s)\n", i, role, dirs[i], state)
+		}
+
+		queue := m.Queue()
+		fmt.Printf("\n%d repairs queued\n", len(queue))
+		for _, it := range queue {
+			fmt.Printf("  %s: copy from [%d] to %v, queued %s", it.Key, it.Source, it.Targets, it.Added.Format(time.RFC3339))
+			if it.LastError != "" {
+				fmt.Printf(", %d failed attempts (%s)", it.Attempts, it.LastError)
+			}
+			fmt.Println()
+		}
+
+		if quick, _ := cmd.Flags().GetBool("queue-only"); quick {
+			return nil
+		}
+		verify, _ := cmd.Flags().GetBool("verify")
+		n := 0
+		err = m.Reconcile(ctx, verify, false, func(d storage.Divergence) {
+			if n == 0 {
+				fmt.Println("\nDifferences from the primary:")
+			}
+			n++
+			fmt.Printf("  [%d] %s: %s\n", d.Replica, d.Key, d.Problem)
+		})
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Println("\nAll replicas match the primary.")
+		} else {
+			fmt.Printf("\n%d differences; run 'atlas replica repair' to fix them.\n", n)
+		}
+		return nil
+	},
+}
+
+var replicaRepairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Process the repair queue and make every replica match the primary",
+	Long: `Replays the queued repairs first (they record which replica holds the latest
+version of a key), then copies anything that still differs from the primary, the
+first data directory, to the other replicas and removes what the primary doesn't have.
+
+The server drains the queue by itself every 30 seconds; stop it before running a
+repair so the two don't update the queue at the same time.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		m, err := openReplicaSet(cmd)
+		if err != nil {
+			return err
+		}
+		ctx := cmd.Context()
+
+		repaired, pending := m.ProcessQueue(ctx)
+		fmt.Printf("Queued repairs: %d done, %d still pending.\n", repaired, pending)
+		if pending > 0 {
+			for _, it := range m.Queue() {
+				fmt.Printf("  %s: %s\n", it.Key, it.LastError)
+			}
+			return errors.New("some queued repairs failed; fix the replica and run again")
+		}
+
+		verify, _ := cmd.Flags().GetBool("verify")
+		n := 0
+		err = m.Reconcile(ctx, verify, true, func(d storage.Divergence) {
+			n++
+			fmt.Printf("  [%d] %s: %s (fixed)\n", d.Replica, d.Key, d.Problem)
+		})
+		if err != nil {
+			return fmt.Errorf("repair incomplete after %d fixes: %w", n, err)
+		}
+		fmt.Printf("Repair complete: %d differences fixed.\n", n)
+		return nil
+	},
+}
+
+// openReplicaSet opens the mirrored store described by the flags and settings.
+func openReplicaSet(cmd *cobra.Command) (*storage.MirrorDriver, error) {
+	applyFlags(cmd, map[string]string{"storage": "storage"})
+	if dirs, _ := cmd.Flags().GetStringSlice("replica"); len(dirs) > 0 {
+		viper.Set("replicas", dirs)
+	}
+	if len(replicaDirs()) == 0 {
+		return nil, errors.New("no replicas configured (use --replica or ATLAS_REPLICAS)")
+	}
+	dataDir, _ := filepath.Abs(dataDirFlag(cmd))
+	return openMirror(dataDir)
+}
+
+// replicaSetDirs lists the primary and replica directories in replica order.
+func replicaSetDirs(cmd *cobra.Command) []string {
+	dataDir, _ := filepath.Abs(dataDirFlag(cmd))
+	return append([]string{dataDir}, replicaDirs()...)
+}
+
+func init() {
+	rootCmd.AddCommand(replicaCmd)
+	replicaCmd.AddCommand(replicaStatusCmd)
+	replicaCmd.AddCommand(replicaRepairCmd)
+
+	replicaCmd.PersistentFlags().StringP("data-dir", "d", "", "Primary data directory (default: ATLAS_DATA_DIR or ./data)")
+	replicaCmd.PersistentFlags().StringSlice("replica", nil, "Replica directory (repeatable; default: ATLAS_REPLICAS)")
+	replicaCmd.PersistentFlags().String("storage", "", "Storage backend of the data directories (default: ATLAS_STORAGE or disk)")
+	replicaCmd.PersistentFlags().Bool("verify", false, "Compare file contents, not just sizes and checksums (reads everything)")
+
+	replicaStatusCmd.Flags().Bool("queue-only", false, "Only show the repair queue, skip comparing the replicas")
+}
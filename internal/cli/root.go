@@ -1,61 +1,86 @@
-package cli
-
-import (
-	"fmt"
-	"os"
-	"strings"
-
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-)
-
-var (
-	cfgFile string
-)
-
-// Execute executes the root command.
-func Execute() error {
-	return rootCmd.Execute()
-}
-
-var rootCmd = &cobra.Command{
-	Use:   "atlas",
-	Short: "Atlas Storage Server",
-	Long:  `Atlas is a headless storage server supporting WebDAV and HTTP file serving.`,
-}
-
-func init() {
-	cobra.OnInitialize(initConfig)
-
-	// Global flags
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.atlas.yaml)")
-
-	// Bind flags to environment variables
-	// We want to support ATLAS_PORT, ATLAS_DATA_DIR, etc.
-	// Viper auto-env prefix
-	viper.SetEnvPrefix("ATLAS")
-	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
-	viper.AutomaticEnv()
-}
-
-func initConfig() {
-	if cfgFile != "" {
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Find home directory.
-		home, err := os.UserHomeDir()
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		// Search config in home directory with name ".atlas" (without extension).
-		viper.AddConfigPath(home)
-		viper.AddConfigPath(".")
-		viper.SetConfigName(".atlas")
-	}
-
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
-	}
-}
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/IYouKnow/atlas-drive/internal/server"
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	cfgFile string
+)
+
+// Execute executes the root command.
+func Execute() error {
+	return rootCmd.Execute()
+}
+
+var rootCmd = &cobra.Command{
+	Use:     "atlas",
+	Short:   "Atlas Storage Server",
+	Long:    `Atlas is a headless storage server supporting WebDAV and HTTP file serving.`,
+	Version: server.Version,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return setupLogging()
+	},
+}
+
+func init() {
+	cobra.OnInitialize(initConfig)
+
+	// Global flags
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.atlas.yaml)")
+	rootCmd.PersistentFlags().String("log-level", "info", "Log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().String("log-format", "text", "Log format: text or json")
+	viper.BindPFlag("log_level", rootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("log_format", rootCmd.PersistentFlags().Lookup("log-format"))
+	rootCmd.PersistentFlags().String("user-store", "json", "User store backend: json (users.json) or sqlite (users.db, an SQLite database)")
+	viper.BindPFlag("user_store", rootCmd.PersistentFlags().Lookup("user-store"))
+	rootCmd.PersistentFlags().Int("password-min-length", user.DefaultMinLength, "Shortest password allowed for new passwords")
+	rootCmd.PersistentFlags().String("password-breached-list", "", "File of breached passwords (or their SHA1 digests), one per line, to refuse as new passwords")
+	viper.BindPFlag("password_min_length", rootCmd.PersistentFlags().Lookup("password-min-length"))
+	viper.BindPFlag("password_breached_list", rootCmd.PersistentFlags().Lookup("password-breached-list"))
+	rootCmd.PersistentFlags().String("password-hash", user.HashBcrypt, "Hash for new passwords: bcrypt or argon2id. Passwords hashed otherwise are rehashed at login")
+	rootCmd.PersistentFlags().Int("bcrypt-cost", bcrypt.DefaultCost, "bcrypt work factor; passwords with a lower one are rehashed at login")
+	rootCmd.PersistentFlags().Uint32("argon2-memory", user.DefaultArgon2Memory, "argon2id memory in KiB")
+	rootCmd.PersistentFlags().Uint32("argon2-time", user.DefaultArgon2Time, "argon2id passes over the memory")
+	viper.BindPFlag("password_hash", rootCmd.PersistentFlags().Lookup("password-hash"))
+	viper.BindPFlag("bcrypt_cost", rootCmd.PersistentFlags().Lookup("bcrypt-cost"))
+	viper.BindPFlag("argon2_memory", rootCmd.PersistentFlags().Lookup("argon2-memory"))
+	viper.BindPFlag("argon2_time", rootCmd.PersistentFlags().Lookup("argon2-time"))
+
+	// Bind flags to environment variables
+	// We want to support ATLAS_PORT, ATLAS_DATA_DIR, etc.
+	// Viper auto-env prefix
+	viper.SetEnvPrefix("ATLAS")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+}
+
+func initConfig() {
+	if cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+	} else {
+		// Find home directory.
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// Search config in home directory with name ".atlas" (without extension).
+		viper.AddConfigPath(home)
+		viper.AddConfigPath(".")
+		viper.SetConfigName(".atlas")
+	}
+
+	if err := viper.ReadInConfig(); err == nil {
+		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	}
+}
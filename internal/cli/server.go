@@ -1,122 +1,336 @@
-package cli
-
-import (
-	"context"
-	"fmt"
-	"log"
-	"os"
-	"os/signal"
-	"path/filepath"
-	"strconv"
-	"strings"
-	"syscall"
-	"time"
-
-	"github.com/IYouKnow/atlas-drive/internal/server"
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-)
-
-var serverCmd = &cobra.Command{
-	Use:   "server",
-	Short: "Start the Atlas storage server",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		// Load config
-		port := viper.GetString("port")
-		if port == "" {
-			port = "8080"
-		}
-		addr := ":" + port
-
-		dataDir := viper.GetString("data_dir")
-		if dataDir == "" {
-			// Default to ./data
-			dataDir = "data"
-		}
-
-		// Resolve absolute paths for clarity
-		absDataDir, _ := filepath.Abs(dataDir)
-
-		// Get User Store
-		store, err := getUserStore()
-		if err != nil {
-			return fmt.Errorf("failed to load user store: %w", err)
-		}
-
-		if len(store.Users) == 0 {
-			log.Println("WARNING: No users defined. Server will reject all connections. Use 'atlas user add' to create a user.")
-		}
-
-		quotaBytes := parseQuotaBytes(viper.GetString("quota"))
-		if quotaBytes > 0 {
-			log.Printf("Quota: %d bytes (%.2f GB) — drive will report this size to clients", quotaBytes, float64(quotaBytes)/(1<<30))
-		}
-
-		srv := server.New(addr, absDataDir, store, quotaBytes)
-
-		// Graceful Shutdown Channel
-		stop := make(chan os.Signal, 1)
-		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-
-		go func() {
-			if err := srv.Start(); err != nil {
-				log.Fatalf("Server failed: %v", err)
-			}
-		}()
-
-		<-stop
-		log.Println("Shutting down server...")
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		if err := srv.Shutdown(ctx); err != nil {
-			return fmt.Errorf("shutdown error: %w", err)
-		}
-
-		log.Println("Server stopped gracefully")
-		return nil
-	},
-}
-
-func init() {
-	rootCmd.AddCommand(serverCmd)
-
-	// Flags
-	serverCmd.Flags().StringP("port", "p", "8080", "Port to listen on")
-	serverCmd.Flags().StringP("data-dir", "d", "data", "Directory to store data files")
-	serverCmd.Flags().String("quota", "", "Storage quota to report to clients (e.g. 2G, 512M). If set, the mapped drive shows this size instead of the host disk.")
-
-	// Bind flags to viper
-	viper.BindPFlag("port", serverCmd.Flags().Lookup("port"))
-	viper.BindPFlag("data_dir", serverCmd.Flags().Lookup("data-dir"))
-	viper.BindPFlag("quota", serverCmd.Flags().Lookup("quota"))
-}
-
-// parseQuotaBytes parses a size string like "2G", "512M", "1G" into bytes. Returns 0 for empty or invalid.
-func parseQuotaBytes(s string) uint64 {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return 0
-	}
-	s = strings.ToUpper(s)
-	var mult uint64 = 1
-	if strings.HasSuffix(s, "B") && (strings.HasSuffix(s, "GB") || strings.HasSuffix(s, "MB") || strings.HasSuffix(s, "KB")) {
-		s = s[:len(s)-1]
-	}
-	if strings.HasSuffix(s, "G") {
-		mult = 1 << 30
-		s = s[:len(s)-1]
-	} else if strings.HasSuffix(s, "M") {
-		mult = 1 << 20
-		s = s[:len(s)-1]
-	} else if strings.HasSuffix(s, "K") {
-		mult = 1 << 10
-		s = s[:len(s)-1]
-	}
-	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
-	if err != nil {
-		return 0
-	}
-	return n * mult
-}
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/server"
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var serverCmd = &cobra.Command{
+	Use:   "server",
+	Short: "Start the Atlas storage server",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Load config
+		port := viper.GetString("port")
+		if port == "" {
+			port = "8080"
+		}
+		addr := ":" + port
+
+		dataDir := viper.GetString("data_dir")
+		if dataDir == "" {
+			// Default to ./data
+			dataDir = "data"
+		}
+
+		// Resolve absolute paths for clarity
+		absDataDir, _ := filepath.Abs(dataDir)
+
+		if err := setupPasswords(); err != nil {
+			return err
+		}
+
+		// Get User Store
+		store, err := getUserStore()
+		if err != nil {
+			return fmt.Errorf("failed to load user store: %w", err)
+		}
+		defer store.Close()
+
+		if names, err := store.List(); err != nil {
+			return fmt.Errorf("failed to load user store: %w", err)
+		} else if len(names) == 0 && !slices.Contains(splitList(viper.GetStringSlice("auth")), "ldap") && viper.GetString("oidc_jwks") == "" {
+			slog.Warn("No users defined. Server will reject all connections. Use 'atlas user add' to create a user.")
+		}
+
+		quotaBytes := parseQuotaBytes(viper.GetString("quota"))
+		if quotaBytes > 0 {
+			slog.Info("Quota set, drive will report this size to clients", "bytes", quotaBytes, "size", formatBytes(int64(quotaBytes)))
+		}
+
+		srv := server.New(addr, absDataDir, store, quotaBytes)
+		if srv.Auth, err = openAuth(store); err != nil {
+			return err
+		}
+		if srv.TokenAuth, err = openTokenAuth(); err != nil {
+			return err
+		}
+		srv.TLSCertFile = viper.GetString("tls_cert")
+		srv.TLSKeyFile = viper.GetString("tls_key")
+		if srv.ClientCerts, err = openClientCerts(); err != nil {
+			return err
+		}
+
+		stack, err := openDriver(absDataDir, true)
+		if err != nil {
+			return fmt.Errorf("failed to open storage: %w", err)
+		}
+		srv.Driver = stack.Driver
+		srv.Staging = stack.Staging
+		srv.UploadExpiry = viper.GetDuration("upload_expiry")
+
+		trusted, err := server.ParseTrustedProxies(splitList(viper.GetStringSlice("trusted_proxies")))
+		if err != nil {
+			return err
+		}
+		srv.TrustedProxies = trusted
+		srv.QuietNotFound = splitList(viper.GetStringSlice("quiet_not_found"))
+		accessLog, closeAccessLog, err := openAccessLog()
+		if err != nil {
+			return err
+		}
+		defer closeAccessLog()
+		srv.AccessLog = accessLog
+
+		bgCtx, stopBackground := context.WithCancel(context.Background())
+		defer stopBackground()
+
+		// Pick up changes made to users.json with 'atlas user' while the server runs, or
+		// on SIGHUP. The sqlite store reads the database on every lookup instead.
+		if js, ok := store.(*user.JSONStore); ok {
+			watchUsers(bgCtx, js)
+		}
+
+		if addr := viper.GetString("metrics_addr"); addr != "" {
+			srv.Metrics = server.NewMetrics()
+			stack.registerMetrics(srv.Metrics.Registry)
+			go func() {
+				if err := server.ServeMetrics(bgCtx, addr, srv.Metrics); err != nil {
+					slog.Error("Metrics listener failed", "err", err)
+				}
+			}()
+			slog.Info("Serving Prometheus metrics", "url", "http://"+addr+"/metrics")
+		}
+
+		// Graceful Shutdown Channel
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+		go func() {
+			if err := srv.Start(); err != nil {
+				slog.Error("Server failed", "err", err)
+				os.Exit(1)
+			}
+		}()
+
+		<-stop
+		slog.Info("Shutting down server...")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			return fmt.Errorf("shutdown error: %w", err)
+		}
+		stack.Close(ctx)
+
+		slog.Info("Server stopped gracefully")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serverCmd)
+
+	// Flags
+	serverCmd.Flags().StringP("port", "p", "8080", "Port to listen on")
+	serverCmd.Flags().StringP("data-dir", "d", "data", "Directory to store data files")
+	serverCmd.Flags().String("quota", "", "Storage quota to report to clients (e.g. 2G, 512M). If set, the mapped drive shows this size instead of the host disk.")
+	serverCmd.Flags().String("storage", "disk", "Storage backend: disk (plain files) or dedup (content-addressable, stores identical data once)")
+	serverCmd.Flags().Bool("encrypt", false, "Encrypt file contents at rest (keys from --encryption-key-file or ATLAS_ENCRYPTION_KEY)")
+	serverCmd.Flags().String("encryption-key-file", "", "File with the base64 master keys, one per line; the last one encrypts new data")
+	serverCmd.Flags().Bool("encrypt-names", false, "Also encrypt file and directory names (requires --encrypt)")
+	serverCmd.Flags().StringSlice("replica", nil, "Additional data directory to mirror every write to (repeatable); reads come from the first healthy copy")
+	serverCmd.Flags().String("cache-dir", "", "Keep recently used files in this local directory (for slow or remote storage)")
+	serverCmd.Flags().String("cache-size", "1G", "Maximum size of the --cache-dir cache (e.g. 10G, 512M)")
+	serverCmd.Flags().String("cache-mode", "write-through", "Cache writes as write-through (stored before acknowledging) or write-back (uploaded in the background)")
+	serverCmd.Flags().String("compress", "none", "Compress stored files transparently: none, zstd or gzip (already-compressed types are skipped)")
+	serverCmd.Flags().String("checksum", "sha256", "Record a checksum of every stored file and verify it on full reads: sha256 or none")
+	serverCmd.Flags().Duration("scrub-interval", 0, "Verify every stored file against its checksum this often (e.g. 24h); 0 disables the scrubber")
+	serverCmd.Flags().Duration("upload-expiry", server.DefaultUploadExpiry, "Discard unfinished resumable (tus) uploads this long after their last chunk")
+	serverCmd.Flags().String("metrics-addr", "", "Serve Prometheus metrics at /metrics on this address (e.g. 127.0.0.1:9464); off when empty")
+	serverCmd.Flags().String("access-log", "", "Log every request to stdout or to this file (rotated by size); off when empty")
+	serverCmd.Flags().String("access-log-format", server.AccessLogCombined, "Access log format: combined (Apache/nginx style) or json (one object per line)")
+	serverCmd.Flags().String("access-log-max-size", "100M", "Rotate the access log file when it reaches this size")
+	serverCmd.Flags().Int("access-log-max-backups", 5, "Number of rotated access log files to keep (0 keeps all)")
+	serverCmd.Flags().StringSlice("trusted-proxy", nil, "Reverse proxy address or CIDR range whose X-Forwarded-For header is trusted for client addresses (repeatable)")
+	serverCmd.Flags().StringSlice("quiet-not-found", server.DefaultQuietNotFound, "File name patterns whose \"not found\" errors are only logged at debug level (repeatable)")
+	serverCmd.Flags().StringSlice("auth", []string{"local"}, "Where logins are checked, tried in order: local (the user store) and/or ldap")
+	serverCmd.Flags().String("ldap-url", "", "LDAP server: ldap://host[:port] or ldaps://host[:port]")
+	serverCmd.Flags().Bool("ldap-start-tls", false, "Upgrade the ldap:// connection with StartTLS")
+	serverCmd.Flags().String("ldap-ca-file", "", "PEM file with the CA certificates to trust for the LDAP server (default: the system ones)")
+	serverCmd.Flags().String("ldap-bind-dn", "", "DN of the service account that searches for users; empty searches anonymously")
+	serverCmd.Flags().String("ldap-bind-password", "", "Password of --ldap-bind-dn (prefer ATLAS_LDAP_BIND_PASSWORD)")
+	serverCmd.Flags().String("ldap-base-dn", "", "Where to search for users, e.g. ou=people,dc=example,dc=com")
+	serverCmd.Flags().String("ldap-user-filter", "(uid=%s)", "Filter that finds a user, %s being the username; (sAMAccountName=%s) for Active Directory")
+	serverCmd.Flags().StringArray("ldap-admin-group", nil, "DN of a group whose members get the admin role (repeatable)")
+	serverCmd.Flags().StringArray("ldap-user-group", nil, "DN of a group whose members may log in (repeatable); everyone found may if none is set")
+	serverCmd.Flags().Duration("ldap-cache-ttl", 5*time.Minute, "Remember successful LDAP logins this long; 0 asks the server on every request")
+	serverCmd.Flags().String("tls-cert", "", "Serve HTTPS with this PEM certificate (chain); needs --tls-key")
+	serverCmd.Flags().String("tls-key", "", "PEM private key of --tls-cert")
+	serverCmd.Flags().String("client-ca", "", "PEM file with the CAs of client certificates; enables certificate logins (needs --tls-cert)")
+	serverCmd.Flags().String("client-cert", "require", "With --client-ca: require a client certificate, or make it optional (passwords and tokens still work)")
+	serverCmd.Flags().String("client-cert-user", server.CertUserCN, "Certificate field that holds the username: cn, email (SAN) or dns (SAN)")
+	serverCmd.Flags().Bool("client-cert-admin-password", false, "Make admins send their password as well as their certificate")
+	serverCmd.Flags().String("oidc-jwks", "", "Accept OIDC/JWT bearer tokens signed by the keys in this JWKS file or http(s) URL; off when empty")
+	serverCmd.Flags().String("oidc-issuer", "", "Required \"iss\" claim of bearer tokens")
+	serverCmd.Flags().String("oidc-audience", "", "Required \"aud\" claim of bearer tokens (e.g. the client ID)")
+	serverCmd.Flags().String("oidc-username-claim", "preferred_username", "Claim holding the Atlas username")
+	serverCmd.Flags().String("oidc-groups-claim", "groups", "Claim holding the user's groups")
+	serverCmd.Flags().StringSlice("oidc-admin-group", nil, "Group whose members get the admin role (repeatable)")
+	serverCmd.Flags().StringSlice("oidc-user-group", nil, "Group whose members may use bearer tokens (repeatable); everyone may if none is set")
+
+	// Bind flags to viper
+	viper.BindPFlag("port", serverCmd.Flags().Lookup("port"))
+	viper.BindPFlag("data_dir", serverCmd.Flags().Lookup("data-dir"))
+	viper.BindPFlag("quota", serverCmd.Flags().Lookup("quota"))
+	viper.BindPFlag("storage", serverCmd.Flags().Lookup("storage"))
+	viper.BindPFlag("encrypt", serverCmd.Flags().Lookup("encrypt"))
+	viper.BindPFlag("encryption_key_file", serverCmd.Flags().Lookup("encryption-key-file"))
+	viper.BindPFlag("encrypt_names", serverCmd.Flags().Lookup("encrypt-names"))
+	viper.BindPFlag("replicas", serverCmd.Flags().Lookup("replica"))
+	viper.BindPFlag("cache_dir", serverCmd.Flags().Lookup("cache-dir"))
+	viper.BindPFlag("cache_size", serverCmd.Flags().Lookup("cache-size"))
+	viper.BindPFlag("cache_mode", serverCmd.Flags().Lookup("cache-mode"))
+	viper.BindPFlag("compress", serverCmd.Flags().Lookup("compress"))
+	viper.BindPFlag("checksum", serverCmd.Flags().Lookup("checksum"))
+	viper.BindPFlag("scrub_interval", serverCmd.Flags().Lookup("scrub-interval"))
+	viper.BindPFlag("upload_expiry", serverCmd.Flags().Lookup("upload-expiry"))
+	viper.BindPFlag("metrics_addr", serverCmd.Flags().Lookup("metrics-addr"))
+	viper.BindPFlag("access_log", serverCmd.Flags().Lookup("access-log"))
+	viper.BindPFlag("access_log_format", serverCmd.Flags().Lookup("access-log-format"))
+	viper.BindPFlag("access_log_max_size", serverCmd.Flags().Lookup("access-log-max-size"))
+	viper.BindPFlag("access_log_max_backups", serverCmd.Flags().Lookup("access-log-max-backups"))
+	viper.BindPFlag("trusted_proxies", serverCmd.Flags().Lookup("trusted-proxy"))
+	viper.BindPFlag("quiet_not_found", serverCmd.Flags().Lookup("quiet-not-found"))
+	viper.BindPFlag("auth", serverCmd.Flags().Lookup("auth"))
+	viper.BindPFlag("ldap_url", serverCmd.Flags().Lookup("ldap-url"))
+	viper.BindPFlag("ldap_start_tls", serverCmd.Flags().Lookup("ldap-start-tls"))
+	viper.BindPFlag("ldap_ca_file", serverCmd.Flags().Lookup("ldap-ca-file"))
+	viper.BindPFlag("ldap_bind_dn", serverCmd.Flags().Lookup("ldap-bind-dn"))
+	viper.BindPFlag("ldap_bind_password", serverCmd.Flags().Lookup("ldap-bind-password"))
+	viper.BindPFlag("ldap_base_dn", serverCmd.Flags().Lookup("ldap-base-dn"))
+	viper.BindPFlag("ldap_user_filter", serverCmd.Flags().Lookup("ldap-user-filter"))
+	viper.BindPFlag("ldap_admin_groups", serverCmd.Flags().Lookup("ldap-admin-group"))
+	viper.BindPFlag("ldap_user_groups", serverCmd.Flags().Lookup("ldap-user-group"))
+	viper.BindPFlag("ldap_cache_ttl", serverCmd.Flags().Lookup("ldap-cache-ttl"))
+	viper.BindPFlag("tls_cert", serverCmd.Flags().Lookup("tls-cert"))
+	viper.BindPFlag("tls_key", serverCmd.Flags().Lookup("tls-key"))
+	viper.BindPFlag("client_ca", serverCmd.Flags().Lookup("client-ca"))
+	viper.BindPFlag("client_cert", serverCmd.Flags().Lookup("client-cert"))
+	viper.BindPFlag("client_cert_user", serverCmd.Flags().Lookup("client-cert-user"))
+	viper.BindPFlag("client_cert_admin_password", serverCmd.Flags().Lookup("client-cert-admin-password"))
+	viper.BindPFlag("oidc_jwks", serverCmd.Flags().Lookup("oidc-jwks"))
+	viper.BindPFlag("oidc_issuer", serverCmd.Flags().Lookup("oidc-issuer"))
+	viper.BindPFlag("oidc_audience", serverCmd.Flags().Lookup("oidc-audience"))
+	viper.BindPFlag("oidc_username_claim", serverCmd.Flags().Lookup("oidc-username-claim"))
+	viper.BindPFlag("oidc_groups_claim", serverCmd.Flags().Lookup("oidc-groups-claim"))
+	viper.BindPFlag("oidc_admin_groups", serverCmd.Flags().Lookup("oidc-admin-group"))
+	viper.BindPFlag("oidc_user_groups", serverCmd.Flags().Lookup("oidc-user-group"))
+}
+
+// parseQuotaBytes parses a size string like "2G", "512M", "1G" into bytes. Returns 0 for empty or invalid.
+func parseQuotaBytes(s string) uint64 {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+	s = strings.ToUpper(s)
+	var mult uint64 = 1
+	if strings.HasSuffix(s, "B") && (strings.HasSuffix(s, "GB") || strings.HasSuffix(s, "MB") || strings.HasSuffix(s, "KB")) {
+		s = s[:len(s)-1]
+	}
+	if strings.HasSuffix(s, "G") {
+		mult = 1 << 30
+		s = s[:len(s)-1]
+	} else if strings.HasSuffix(s, "M") {
+		mult = 1 << 20
+		s = s[:len(s)-1]
+	} else if strings.HasSuffix(s, "K") {
+		mult = 1 << 10
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n * mult
+}
+
+// openAccessLog sets up the access log from the "access_log" settings: nil when it is
+// off, stdout for "stdout" or "-", otherwise a file rotated by size. The returned
+// function closes the file.
+func openAccessLog() (*server.AccessLogger, func() error, error) {
+	dest := viper.GetString("access_log")
+	if dest == "" {
+		return nil, func() error { return nil }, nil
+	}
+	var w io.Writer = os.Stdout
+	closeFn := func() error { return nil }
+	if dest != "stdout" && dest != "-" {
+		maxSize := parseQuotaBytes(viper.GetString("access_log_max_size"))
+		if maxSize == 0 {
+			return nil, nil, fmt.Errorf("invalid access log size %q", viper.GetString("access_log_max_size"))
+		}
+		f := &lumberjack.Logger{
+			Filename:   dest,
+			MaxSize:    max(int(maxSize>>20), 1), // megabytes
+			MaxBackups: viper.GetInt("access_log_max_backups"),
+		}
+		w, closeFn = f, f.Close
+	}
+	l, err := server.NewAccessLogger(w, viper.GetString("access_log_format"))
+	if err != nil {
+		closeFn()
+		return nil, nil, err
+	}
+	slog.Info("Access log enabled", "dest", dest, "format", viper.GetString("access_log_format"))
+	return l, closeFn, nil
+}
+
+// watchUsers reloads the user file when it changes or on SIGHUP, until ctx is done.
+func watchUsers(ctx context.Context, store *user.JSONStore) {
+	if err := store.Watch(ctx, logUserReload); err != nil {
+		slog.Warn("Not watching the user file for changes; send SIGHUP to reload it", "err", err)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				logUserReload(store.Reload())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// logUserReload reports a reload of the user file.
+func logUserReload(d user.Diff, err error) {
+	if err != nil {
+		slog.Error("Failed to reload users, keeping the previous ones", "err", err)
+		return
+	}
+	if d.Empty() {
+		slog.Debug("Users reloaded, nothing changed")
+		return
+	}
+	slog.Info("Users reloaded", "added", d.Added, "removed", d.Removed, "changed", d.Changed)
+}
@@ -0,0 +1,359 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// driverStack is the server's storage stack, with handles on the layers that run
+// background work.
+type driverStack struct {
+	storage.Driver // top of the stack, what the server uses
+	Mirror         *storage.MirrorDriver
+	Cache          *storage.CachedDriver
+	Checksums      *storage.ChecksumDriver
+	Staging        storage.Driver // partial uploads, encrypted like the share (server only)
+	stop           context.CancelFunc
+}
+
+// openDriver builds the server's storage stack from the settings: the backend selected by
+// "storage" (mirrored, with a background repair worker, if "replicas" are set), behind a
+// local cache when "cache_dir" is set, wrapped in encryption when "encrypt" is set, in
+// compression when "compress" is set and in checksums unless "checksum" is none.
+// Compression goes above encryption so it sees plaintext; ciphertext doesn't compress.
+// The cache sits below encryption so it only holds ciphertext. Checksums go on top so
+// they describe what clients stored. Partial uploads are staged in <dataDir>/.atlas/staging,
+// encrypted as well when "encrypt" is set.
+//
+// Maintenance commands pass server=false: no cache, no repair worker and no scrubber.
+func openDriver(dataDir string, server bool) (*driverStack, error) {
+	d, err := openBaseDriver(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	stack := &driverStack{stop: stop}
+	if m, ok := d.(*storage.MirrorDriver); ok {
+		stack.Mirror = m
+		if server {
+			go m.RunRepairs(ctx, replicaRepairInterval)
+		}
+	}
+
+	if dir := viper.GetString("cache_dir"); dir != "" && server {
+		mode, err := storage.ParseCacheMode(viper.GetString("cache_mode"))
+		if err != nil {
+			return nil, err
+		}
+		size := parseQuotaBytes(viper.GetString("cache_size"))
+		if size == 0 {
+			return nil, fmt.Errorf("invalid cache size %q", viper.GetString("cache_size"))
+		}
+		abs, _ := filepath.Abs(dir)
+		c, err := storage.NewCachedDriver(d, abs, int64(size), mode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open cache: %w", err)
+		}
+		stack.Cache, d = c, c
+		slog.Info("Cache enabled", "dir", abs, "size", formatBytes(int64(size)), "mode", mode, "pending_uploads", c.Stats().Dirty)
+	}
+
+	if viper.GetBool("encrypt_names") && !viper.GetBool("encrypt") {
+		return nil, errors.New("--encrypt-names requires --encrypt")
+	}
+	if server {
+		stack.Staging = storage.NewDiskDriver(filepath.Join(dataDir, ".atlas", "staging"))
+	}
+	if viper.GetBool("encrypt") {
+		keys, err := loadKeyring()
+		if err != nil {
+			return nil, err
+		}
+		d = storage.NewEncryptedDriver(d, keys, viper.GetBool("encrypt_names"))
+		if stack.Staging != nil {
+			stack.Staging = storage.NewEncryptedDriver(stack.Staging, keys, false)
+		}
+		slog.Info("Encryption at rest enabled", "active_key", keys.Active().ID, "keys", len(keys.Keys()))
+	}
+
+	switch algo := viper.GetString("compress"); algo {
+	case "", "none":
+	default:
+		if d, err = storage.NewCompressedDriver(d, algo); err != nil {
+			return nil, err
+		}
+		slog.Info("Transparent compression enabled", "algorithm", algo)
+	}
+
+	switch algo := viper.GetString("checksum"); algo {
+	case "none":
+	case "", "sha256":
+		c := storage.NewChecksumDriver(d)
+		c.OnMismatch = func(ctx context.Context, r storage.CheckResult) {
+			slog.ErrorContext(ctx, "Checksum mismatch", "path", r.Key, "stored", r.Want, "read", r.Got)
+		}
+		stack.Checksums, d = c, c
+	default:
+		return nil, fmt.Errorf("unknown checksum %q (want sha256 or none)", algo)
+	}
+	if interval := viper.GetDuration("scrub_interval"); interval > 0 && server {
+		if stack.Checksums == nil {
+			return nil, errors.New("--scrub-interval requires checksums (--checksum sha256)")
+		}
+		go stack.Checksums.RunScrubber(ctx, interval, logScrubProblem, logScrubSummary)
+		slog.Info("Scrubber enabled", "interval", interval)
+	}
+
+	stack.Driver = d
+	return stack, nil
+}
+
+func logScrubProblem(r storage.CheckResult) {
+	if r.Err != nil {
+		slog.Error("Scrub problem", "path", r.Key, "status", r.Status, "err", r.Err)
+		return
+	}
+	slog.Error("Scrub problem", "path", r.Key, "status", r.Status, "stored", r.Want, "read", r.Got)
+}
+
+func logScrubSummary(sum storage.ScrubSummary, err error) {
+	if err != nil {
+		slog.Error("Scrub failed", "checked", sum.Checked, "err", err)
+		return
+	}
+	slog.Info("Scrub finished", "checked", sum.Checked, "size", formatBytes(sum.Bytes),
+		"duration", sum.Finished.Sub(sum.Started).Round(time.Second), "ok", sum.OK, "no_checksum", sum.Missing,
+		"corrupt", sum.Corrupt, "modified", sum.Modified, "unreadable", sum.Unreadable)
+	if sum.Problems() > 0 {
+		slog.Warn("Scrub found problems; run 'atlas fsck' for details", "problems", sum.Problems())
+	}
+}
+
+// Close stops the background work. Pending write-back uploads get until ctx is done;
+// whatever is left is uploaded after the next start.
+func (s *driverStack) Close(ctx context.Context) {
+	s.stop()
+	if s.Cache == nil {
+		return
+	}
+	if err := s.Cache.Flush(ctx); err != nil {
+		slog.Warn("Cache uploads still pending, they resume at next start", "pending_uploads", s.Cache.Stats().Dirty, "err", err)
+	}
+	s.Cache.Close()
+	stats := s.Cache.Stats()
+	slog.Info("Cache closed", "hits", stats.Hits, "misses", stats.Misses,
+		"hit_ratio", fmt.Sprintf("%.1f%%", 100*stats.HitRatio()), "evictions", stats.Evictions)
+}
+
+// registerMetrics exposes the state of the stack's layers: cache efficiency, the
+// replica repair queue and the outcome of the last scrub.
+func (s *driverStack) registerMetrics(reg prometheus.Registerer) {
+	gauge := func(name, help string, labels prometheus.Labels, fn func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help, ConstLabels: labels}, fn)
+	}
+	counter := func(name, help string, fn func() float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, fn)
+	}
+
+	if c := s.Cache; c != nil {
+		reg.MustRegister(
+			counter("atlas_cache_hits_total", "Reads served from the local cache.", func() float64 { return float64(c.Stats().Hits) }),
+			counter("atlas_cache_misses_total", "Reads that went to the backend.", func() float64 { return float64(c.Stats().Misses) }),
+			counter("atlas_cache_evictions_total", "Entries evicted from the cache.", func() float64 { return float64(c.Stats().Evictions) }),
+			gauge("atlas_cache_hit_ratio", "Share of reads served from the cache since start.", nil, func() float64 { return c.Stats().HitRatio() }),
+			gauge("atlas_cache_bytes", "Bytes held in the cache.", nil, func() float64 { return float64(c.Stats().Bytes) }),
+			gauge("atlas_cache_entries", "Objects held in the cache.", nil, func() float64 { return float64(c.Stats().Entries) }),
+			gauge("atlas_cache_dirty", "Write-back uploads not yet stored in the backend.", nil, func() float64 { return float64(c.Stats().Dirty) }),
+		)
+	}
+
+	if m := s.Mirror; m != nil {
+		reg.MustRegister(gauge("atlas_replica_repair_queue", "Repairs waiting to be applied to a replica.", nil,
+			func() float64 { return float64(len(m.Queue())) }))
+		for i := range m.Health() {
+			reg.MustRegister(gauge("atlas_replica_healthy", "Whether the replica answers (1) or is failing (0).",
+				prometheus.Labels{"replica": strconv.Itoa(i)}, func() float64 {
+					if m.Health()[i].Healthy {
+						return 1
+					}
+					return 0
+				}))
+		}
+	}
+
+	if c := s.Checksums; c != nil {
+		last := func(fn func(storage.ScrubSummary) float64) func() float64 {
+			return func() float64 {
+				sum, ok := c.LastScrub()
+				if !ok {
+					return 0
+				}
+				return fn(sum)
+			}
+		}
+		reg.MustRegister(
+			gauge("atlas_scrub_last_completion_timestamp_seconds", "When the last scrub finished (0 if none has).", nil,
+				last(func(s storage.ScrubSummary) float64 { return float64(s.Finished.Unix()) })),
+			gauge("atlas_scrub_checked_files", "Files verified by the last scrub.", nil,
+				last(func(s storage.ScrubSummary) float64 { return float64(s.Checked) })),
+		)
+		for status, fn := range map[string]func(storage.ScrubSummary) float64{
+			"corrupt":    func(s storage.ScrubSummary) float64 { return float64(s.Corrupt) },
+			"modified":   func(s storage.ScrubSummary) float64 { return float64(s.Modified) },
+			"unreadable": func(s storage.ScrubSummary) float64 { return float64(s.Unreadable) },
+			"missing":    func(s storage.ScrubSummary) float64 { return float64(s.Missing) },
+		} {
+			reg.MustRegister(gauge("atlas_scrub_files", "Files found by the last scrub in each failed state.",
+				prometheus.Labels{"status": status}, last(fn)))
+		}
+	}
+}
+
+// replicaRepairInterval is how often the server retries queued replica repairs.
+const replicaRepairInterval = 30 * time.Second
+
+// openBaseDriver opens the backend selected by the "storage" setting, mirrored to the
+// "replicas" directories if there are any.
+func openBaseDriver(dataDir string) (storage.Driver, error) {
+	if len(replicaDirs()) == 0 {
+		return openBackend(dataDir)
+	}
+	m, err := openMirror(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// openMirror opens dataDir and every replica directory with the same backend and mirrors
+// writes across them. The repair queue lives in the primary's .atlas directory.
+func openMirror(dataDir string) (*storage.MirrorDriver, error) {
+	dirs := append([]string{dataDir}, replicaDirs()...)
+	drivers := make([]storage.Driver, len(dirs))
+	for i, dir := range dirs {
+		d, err := openBackend(dir)
+		if err != nil {
+			return nil, fmt.Errorf("replica %s: %w", dir, err)
+		}
+		drivers[i] = d
+	}
+	m, err := storage.NewMirrorDriver(drivers, filepath.Join(dataDir, ".atlas", "replica-queue.json"))
+	if err != nil {
+		return nil, err
+	}
+	m.OnQueueError = func(err error) {
+		slog.Error("Repairs queued since the last save will be lost on restart", "err", err)
+	}
+	slog.Info("Mirroring writes to replicas", "replicas", len(dirs), "repairs_queued", len(m.Queue()))
+	return m, nil
+}
+
+// replicaDirs returns the absolute replica directories from the "replicas" setting,
+// which may be given as a list or comma-separated (ATLAS_REPLICAS=/mnt/a,/mnt/b).
+func replicaDirs() []string {
+	var dirs []string
+	for _, dir := range splitList(viper.GetStringSlice("replicas")) {
+		abs, _ := filepath.Abs(dir)
+		dirs = append(dirs, abs)
+	}
+	return dirs
+}
+
+// splitList flattens a list setting whose values may also be comma-separated, as they
+// are when they come from an environment variable, dropping empty entries.
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				out = append(out, e)
+			}
+		}
+	}
+	return out
+}
+
+// openBackend opens a single data directory with the backend selected by "storage".
+func openBackend(dataDir string) (storage.Driver, error) {
+	switch backend := viper.GetString("storage"); backend {
+	case "", "disk":
+		return storage.NewDiskDriver(dataDir), nil
+	case "dedup":
+		d, err := storage.NewDedupDriver(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		if stats, err := d.Stats(context.Background()); err == nil {
+			slog.Info("Dedup store opened", "objects", stats.Objects, "logical", formatBytes(stats.LogicalBytes),
+				"on_disk", formatBytes(stats.PhysicalBytes), "ratio", fmt.Sprintf("%.2fx", stats.Ratio()))
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (want disk or dedup)", backend)
+	}
+}
+
+// loadKeyring reads the master keys from the key file ("encryption_key_file") or,
+// failing that, from ATLAS_ENCRYPTION_KEY.
+func loadKeyring() (*storage.Keyring, error) {
+	if path := viper.GetString("encryption_key_file"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		return storage.ParseKeyring(string(data))
+	}
+	if keys := viper.GetString("encryption_key"); keys != "" {
+		return storage.ParseKeyring(keys)
+	}
+	return nil, errors.New("encryption is enabled but no key is configured: set --encryption-key-file or ATLAS_ENCRYPTION_KEY (create one with 'atlas keys generate')")
+}
+
+// applyFlags lets maintenance commands override settings that are normally bound to
+// `atlas server` flags (viper binds each setting to a single flag), so e.g.
+// `atlas keys rotate --storage dedup` opens the store the same way the server does.
+func applyFlags(cmd *cobra.Command, settings map[string]string) {
+	for flag, key := range settings {
+		if f := cmd.Flags().Lookup(flag); f != nil && f.Changed {
+			viper.Set(key, f.Value.String())
+		}
+	}
+}
+
+// dataDirFlag returns the data directory for commands other than `server`, which define
+// their own --data-dir flag: the flag wins, then config/env (ATLAS_DATA_DIR), then ./data.
+func dataDirFlag(cmd *cobra.Command) string {
+	if f := cmd.Flags().Lookup("data-dir"); f != nil && f.Changed {
+		return f.Value.String()
+	}
+	if dir := viper.GetString("data_dir"); dir != "" {
+		return dir
+	}
+	return "data"
+}
+
+// formatBytes renders a byte count for humans (e.g. "1.50 GB").
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
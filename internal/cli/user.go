@@ -1,113 +1,388 @@
-package cli
-
-import (
-	"fmt"
-	"path/filepath"
-
-	"github.com/IYouKnow/atlas-drive/pkg/user"
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-)
-
-var userCmd = &cobra.Command{
-	Use:   "user",
-	Short: "Manage users",
-	Long:  `Add, remove, and list users for the Atlas server.`,
-}
-
-var userAddCmd = &cobra.Command{
-	Use:   "add [username] [password]",
-	Short: "Add a new user",
-	Args:  cobra.ExactArgs(2),
-	RunE: func(cmd *cobra.Command, args []string) error {
-		store, err := getUserStore()
-		if err != nil {
-			return err
-		}
-
-		username := args[0]
-		password := args[1]
-
-		if err := store.Add(username, password); err != nil {
-			return err
-		}
-
-		if err := store.Save(); err != nil {
-			return fmt.Errorf("failed to save user: %w", err)
-		}
-
-		fmt.Printf("User %s created successfully.\n", username)
-		return nil
-	},
-}
-
-var userRmCmd = &cobra.Command{
-	Use:   "rm [username]",
-	Short: "Remove a user",
-	Args:  cobra.ExactArgs(1),
-	RunE: func(cmd *cobra.Command, args []string) error {
-		store, err := getUserStore()
-		if err != nil {
-			return err
-		}
-
-		username := args[0]
-		store.Delete(username)
-
-		if err := store.Save(); err != nil {
-			return fmt.Errorf("failed to save changes: %w", err)
-		}
-
-		fmt.Printf("User %s removed (if existed).\n", username)
-		return nil
-	},
-}
-
-var userLsCmd = &cobra.Command{
-	Use:   "ls",
-	Short: "List all users",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		store, err := getUserStore()
-		if err != nil {
-			return err
-		}
-
-		users := store.List()
-		if len(users) == 0 {
-			fmt.Println("No users found.")
-			return nil
-		}
-
-		fmt.Println("Users:")
-		for _, u := range users {
-			fmt.Println("-", u)
-		}
-		return nil
-	},
-}
-
-func init() {
-	rootCmd.AddCommand(userCmd)
-	userCmd.AddCommand(userAddCmd)
-	userCmd.AddCommand(userRmCmd)
-	userCmd.AddCommand(userLsCmd)
-
-	// Define flags for config location if distinct from global config?
-	// We reuse global config or env vars.
-}
-
-func getUserStore() (*user.Store, error) {
-	configDir := viper.GetString("config_dir")
-	if configDir == "" {
-		// Default to current directory or /var/lib/atlas depending on design.
-		// For now simple default relative or absolute.
-		// Prefer picking up a generic flag or env var "ATLAS_CONFIG_DIR"
-		configDir = "."
-	}
-
-	// Create dir if not exists?
-	// The user store expects the full path to file? No, NewStore takes simple path.
-	// Let's decide on a standard file name.
-	dbPath := filepath.Join(configDir, "users.json")
-	return user.NewStore(dbPath)
-}
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage users",
+	Long:  `Add, remove, and list users for the Atlas server.`,
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add [username]",
+	Short: "Add a new user",
+	Long: `Adds a user. The password is asked for twice without showing it, or read from the
+first line of stdin with --password-stdin:
+
+  printf '%s\n' "$PASSWORD" | atlas user add alice --password-stdin
+
+It must satisfy the password policy (--password-min-length, --password-breached-list).
+The password can't be given as an argument, where shell history and ps would show it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupPasswords(); err != nil {
+			return err
+		}
+		store, err := getUserStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		username := args[0]
+		if _, err := store.Get(username); err == nil {
+			return fmt.Errorf("user %s already exists", username)
+		}
+		password, err := newPassword(cmd)
+		if err != nil {
+			return err
+		}
+
+		admin, _ := cmd.Flags().GetBool("admin")
+		err = store.Update(func(tx user.Tx) error {
+			if err := user.Add(tx, username, password); err != nil {
+				return err
+			}
+			if admin {
+				return user.SetRole(tx, username, user.RoleAdmin)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("User %s created successfully.\n", username)
+		return nil
+	},
+}
+
+var userPasswdCmd = &cobra.Command{
+	Use:   "passwd [username]",
+	Short: "Change the password of a user",
+	Long: `Sets a new password for a user, asked for twice without showing it, or read from
+the first line of stdin with --password-stdin.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupPasswords(); err != nil {
+			return err
+		}
+		store, err := getUserStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		username := args[0]
+		if _, err := store.Get(username); errors.Is(err, user.ErrNotFound) {
+			return fmt.Errorf("user %s: no such user", username)
+		}
+		password, err := newPassword(cmd)
+		if err != nil {
+			return err
+		}
+		err = store.Update(func(tx user.Tx) error {
+			return user.SetPassword(tx, username, password)
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Password of %s changed.\n", username)
+		return nil
+	},
+}
+
+var userResetCmd = &cobra.Command{
+	Use:   "reset [username]",
+	Short: "Give a user a new random password",
+	Long:  `Replaces the password of a user with a random one, which is printed once.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := setupPasswords(); err != nil {
+			return err
+		}
+		store, err := getUserStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		username := args[0]
+		var password string
+		err = store.Update(func(tx user.Tx) error {
+			password, err = user.ResetPassword(tx, username)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("New password of %s: %s\n", username, password)
+		return nil
+	},
+}
+
+var userRmCmd = &cobra.Command{
+	Use:   "rm [username]",
+	Short: "Remove a user",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := getUserStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		username := args[0]
+		err = store.Update(func(tx user.Tx) error {
+			return tx.Delete(username)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to save changes: %w", err)
+		}
+
+		fmt.Printf("User %s removed (if existed).\n", username)
+		return nil
+	},
+}
+
+var userLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List all users",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := getUserStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		users, err := store.List()
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			fmt.Println("No users found.")
+			return nil
+		}
+
+		fmt.Println("Users:")
+		for _, u := range users {
+			if user.IsAdmin(store, u) {
+				fmt.Println("-", u, "(admin)")
+				continue
+			}
+			fmt.Println("-", u)
+		}
+		return nil
+	},
+}
+
+var userRoleCmd = &cobra.Command{
+	Use:   "role [username] [admin|user]",
+	Short: "Change the role of a user",
+	Long:  `Admins can use the admin API under /api/admin/ in addition to the files.`,
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := getUserStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		username, role := args[0], args[1]
+		err = store.Update(func(tx user.Tx) error {
+			return user.SetRole(tx, username, role)
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("User %s is now %s.\n", username, role)
+		return nil
+	},
+}
+
+var userMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copy all users from one user store backend to another",
+	Long: `Copies every user, with their password hash and role, from one backend to the
+other, for example before switching the server to --user-store sqlite:
+
+  atlas user migrate --from json --to sqlite
+
+The source is left as it is. The destination must not have any users yet.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, _ := cmd.Flags().GetString("from")
+		to, _ := cmd.Flags().GetString("to")
+		if from == to {
+			return fmt.Errorf("--from and --to are both %s", from)
+		}
+		src, err := openUserStore(from)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := openUserStore(to)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+
+		var n int
+		err = dst.Update(func(tx user.Tx) error {
+			existing, err := tx.List()
+			if err != nil {
+				return err
+			}
+			if len(existing) > 0 {
+				return fmt.Errorf("the %s user store already has %d users; not migrating over them", to, len(existing))
+			}
+			n, err = user.Copy(tx, src)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Migrated %d users from %s to %s.\n", n, from, to)
+		if to != viper.GetString("user_store") {
+			fmt.Printf("Start the server with --user-store %s (or ATLAS_USER_STORE=%s) to use them.\n", to, to)
+		}
+		return nil
+	},
+}
+
+var userImportCmd = &cobra.Command{
+	Use:   "import --htpasswd FILE",
+	Short: "Import users from an Apache htpasswd file",
+	Long: `Adds the users of an htpasswd file to the user store, with their password hashes:
+
+  atlas user import --htpasswd /etc/apache2/.htpasswd
+
+bcrypt entries (htpasswd -B) are used as they are. SHA1 (htpasswd -s) and MD5
+(htpasswd -m, the default) entries are accepted at login and hashed again, as
+--password-hash says, the first time each user logs in. Other entries can't be
+verified and are skipped.
+
+Users that already exist are skipped too, unless --replace is given, which replaces
+their password but keeps their role.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, _ := cmd.Flags().GetString("htpasswd")
+		replace, _ := cmd.Flags().GetBool("replace")
+		if path == "" {
+			return fmt.Errorf("--htpasswd is required")
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		entries, skipped, err := user.ParseHtpasswd(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		store, err := getUserStore()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		var added, replaced int
+		var exists []string
+		err = store.Update(func(tx user.Tx) error {
+			added, replaced, exists = 0, 0, nil
+			for _, e := range entries {
+				cur, err := tx.Get(e.Username)
+				switch {
+				case errors.Is(err, user.ErrNotFound):
+					added++
+				case err != nil:
+					return err
+				case !replace:
+					exists = append(exists, e.Username)
+					continue
+				default:
+					e.Role = cur.Role
+					replaced++
+				}
+				if err := tx.Put(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range skipped {
+			fmt.Printf("Skipped %s\n", msg)
+		}
+		for _, name := range exists {
+			fmt.Printf("Skipped %s: already exists (use --replace to overwrite)\n", name)
+		}
+		fmt.Printf("Imported %d users (%d new, %d replaced) from %s.\n", added+replaced, added, replaced, path)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userAddCmd)
+	userCmd.AddCommand(userPasswdCmd)
+	userCmd.AddCommand(userResetCmd)
+	userCmd.AddCommand(userRmCmd)
+	userCmd.AddCommand(userLsCmd)
+	userCmd.AddCommand(userRoleCmd)
+	userCmd.AddCommand(userMigrateCmd)
+	userCmd.AddCommand(userImportCmd)
+
+	userAddCmd.Flags().Bool("admin", false, "Give the user the admin role (access to the admin API)")
+	userAddCmd.Flags().Bool("password-stdin", false, "Read the password from the first line of stdin instead of prompting")
+	userPasswdCmd.Flags().Bool("password-stdin", false, "Read the password from the first line of stdin instead of prompting")
+	userMigrateCmd.Flags().String("from", "json", "Backend to copy the users from: json or sqlite")
+	userMigrateCmd.Flags().String("to", "sqlite", "Backend to copy the users to: json or sqlite")
+	userImportCmd.Flags().String("htpasswd", "", "htpasswd file to import the users of")
+	userImportCmd.Flags().Bool("replace", false, "Replace the passwords of users that already exist")
+
+	// Define flags for config location if distinct from global config?
+	// We reuse global config or env vars.
+}
+
+// getUserStore opens the user store selected with --user-store.
+func getUserStore() (user.Store, error) {
+	return openUserStore(viper.GetString("user_store"))
+}
+
+// openUserStore opens the given user store backend, kept in the config directory.
+func openUserStore(backend string) (user.Store, error) {
+	configDir := viper.GetString("config_dir")
+	if configDir == "" {
+		// Default to current directory or /var/lib/atlas depending on design.
+		// For now simple default relative or absolute.
+		// Prefer picking up a generic flag or env var "ATLAS_CONFIG_DIR"
+		configDir = "."
+	}
+
+	switch backend {
+	case "json", "":
+		return user.NewJSONStore(filepath.Join(configDir, "users.json"))
+	case "sqlite":
+		return user.NewSQLiteStore(filepath.Join(configDir, "users.db"))
+	default:
+		return nil, fmt.Errorf("unknown user store %q (want json or sqlite)", backend)
+	}
+}
@@ -0,0 +1,24 @@
+package cli
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// Passwords given as arguments would show in shell history and ps, so they are refused
+// before anything is read or stored.
+func TestUserPasswordNotAnArgument(t *testing.T) {
+	for _, args := range [][]string{
+		{"user", "add", "bob", "secret123"},
+		{"user", "passwd", "bob", "secret123"},
+	} {
+		rootCmd.SetArgs(args)
+		rootCmd.SetOut(io.Discard)
+		rootCmd.SetErr(io.Discard)
+		err := rootCmd.Execute()
+		if err == nil || !strings.Contains(err.Error(), "accepts 1 arg") {
+			t.Errorf("atlas %s: %v, want the extra argument refused", strings.Join(args, " "), err)
+		}
+	}
+}
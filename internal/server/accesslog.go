@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats.
+const (
+	// AccessLogCombined is the Apache/nginx combined log format, followed by the
+	// quoted Destination header, the duration in milliseconds and the request ID.
+	AccessLogCombined = "combined"
+	// AccessLogJSON writes one JSON object per request.
+	AccessLogJSON = "json"
+)
+
+// AccessLogger writes a line per request.
+type AccessLogger struct {
+	format string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAccessLogger logs to w in format (AccessLogCombined or AccessLogJSON).
+func NewAccessLogger(w io.Writer, format string) (*AccessLogger, error) {
+	if format != AccessLogCombined && format != AccessLogJSON {
+		return nil, fmt.Errorf("unknown access log format %q (want combined or json)", format)
+	}
+	return &AccessLogger{format: format, w: w}, nil
+}
+
+// accessEntry is what gets logged about a request.
+type accessEntry struct {
+	Time        time.Time `json:"time"`
+	RemoteAddr  string    `json:"remote_addr"`
+	User        string    `json:"user,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Proto       string    `json:"proto"`
+	Destination string    `json:"destination,omitempty"`
+	Status      int       `json:"status"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	DurationMS  float64   `json:"duration_ms"`
+	Referer     string    `json:"referer,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	RequestID   string    `json:"request_id,omitempty"`
+}
+
+func (l *AccessLogger) log(e *accessEntry) {
+	var line []byte
+	if l.format == AccessLogJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = fmt.Appendf(nil, "%s - %s [%s] %s %d %s %s %s %s %.3f %s\n",
+			e.RemoteAddr, orDash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(e.Method+" "+e.Path+" "+e.Proto), e.Status, bytesField(e.BytesOut),
+			quoteField(e.Referer), quoteField(e.UserAgent), quoteField(e.Destination), e.DurationMS, orDash(e.RequestID))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func quoteField(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+func bytesField(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// accessLogMiddleware logs every request once it has been handled. It sits outside
+// authentication so rejected requests are logged too.
+func (s *Server) accessLogMiddleware(next http.Handler) http.Handler {
+	l := s.AccessLog
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		l.log(&accessEntry{
+			Time:        start,
+			RemoteAddr:  s.clientIP(r),
+			User:        requestUser(r),
+			Method:      r.Method,
+			Path:        r.URL.RequestURI(),
+			Proto:       r.Proto,
+			Destination: r.Header.Get("Destination"),
+			Status:      rec.status,
+			BytesIn:     body.n,
+			BytesOut:    rec.n,
+			DurationMS:  float64(time.Since(start).Microseconds()) / 1000,
+			Referer:     r.Referer(),
+			UserAgent:   r.UserAgent(),
+			RequestID:   RequestID(r.Context()),
+		})
+	})
+}
+
+// clientIP returns the address of the client. Behind one of TrustedProxies, it is taken
+// from X-Forwarded-For (the last address not belonging to a trusted proxy) or X-Real-IP;
+// those headers are ignored from anyone else, since clients can set them to anything.
+// A hop that isn't an IP address wasn't added by a proxy of ours, so the walk stops
+// there, at the last address a trusted proxy vouched for; X-Real-IP is only used if
+// X-Forwarded-For gives none.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !s.trustedProxy(host) {
+		return host
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		addr := host
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			ip, err := netip.ParseAddr(hop)
+			if err != nil {
+				break
+			}
+			addr = ip.String()
+			if !s.trustedProxy(addr) {
+				return addr
+			}
+		}
+		if addr != host {
+			return addr
+		}
+	}
+	if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return ip.String()
+	}
+	return host
+}
+
+func (s *Server) trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range s.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses addresses and CIDR ranges ("10.0.0.1", "10.0.0.0/8").
+func ParseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", v, err)
+			}
+			out = append(out, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", v, err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
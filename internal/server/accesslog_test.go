@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{TrustedProxies: proxies}
+
+	for _, tt := range []struct {
+		name   string
+		peer   string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "", "203.0.113.5"},
+		{"untrusted peer forging XFF", "203.0.113.5:1234", []string{"198.51.100.7"}, "", "203.0.113.5"},
+		{"untrusted peer forging X-Real-IP", "203.0.113.5:1234", nil, "198.51.100.7", "203.0.113.5"},
+		{"untrusted IPv6 peer", "[2001:db8::1]:443", []string{"198.51.100.7"}, "", "2001:db8::1"},
+		{"one proxy", "10.0.0.1:1234", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"trusted IPv6 proxy", "[fd00::1]:1234", []string{"2001:db8::7"}, "", "2001:db8::7"},
+		{"several trusted hops", "10.0.0.1:1234", []string{"198.51.100.7, 10.1.1.1, 192.168.1.1"}, "", "198.51.100.7"},
+		{"hops in several headers", "10.0.0.1:1234", []string{"198.51.100.7", "10.1.1.1"}, "", "198.51.100.7"},
+		{"client forging the first hop", "10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.7, 10.1.1.1"}, "", "198.51.100.7"},
+		{"every hop trusted", "10.0.0.1:1234", []string{"10.2.2.2, 10.1.1.1"}, "", "10.2.2.2"},
+		{"empty hops", "10.0.0.1:1234", []string{"198.51.100.7,, "}, "", "198.51.100.7"},
+		{"X-Real-IP", "10.0.0.1:1234", nil, " 198.51.100.9 ", "198.51.100.9"},
+		{"XFF before X-Real-IP", "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.9", "198.51.100.7"},
+		{"garbage hop", "10.0.0.1:1234", []string{"garbage"}, "", "10.0.0.1"},
+		{"host:port hop", "10.0.0.1:1234", []string{"198.51.100.7:4711"}, "", "10.0.0.1"},
+		{"garbage before a client", "10.0.0.1:1234", []string{"garbage, 198.51.100.7"}, "", "198.51.100.7"},
+		{"garbage behind a proxy", "10.0.0.1:1234", []string{"198.51.100.7, garbage, 10.1.1.1"}, "", "10.1.1.1"},
+		{"garbage XFF, X-Real-IP", "10.0.0.1:1234", []string{"garbage"}, "198.51.100.9", "198.51.100.9"},
+		{"garbage X-Real-IP", "10.0.0.1:1234", nil, "garbage", "10.0.0.1"},
+		{"host:port X-Real-IP", "10.0.0.1:1234", nil, "198.51.100.9:4711", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.peer
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := s.clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, tt := range []struct {
+		list []string
+		want []string
+	}{
+		{[]string{"10.0.0.1"}, []string{"10.0.0.1/32"}},
+		{[]string{"10.0.0.0/8", " 172.16.0.0/12 "}, []string{"10.0.0.0/8", "172.16.0.0/12"}},
+		{[]string{"10.1.2.3/8"}, []string{"10.0.0.0/8"}},
+		{[]string{"::1", "fd00::/8"}, []string{"::1/128", "fd00::/8"}},
+		{[]string{"::ffff:10.0.0.1"}, []string{"10.0.0.1/32"}},
+		{[]string{"", "  "}, nil},
+	} {
+		prefixes, err := ParseTrustedProxies(tt.list)
+		if err != nil {
+			t.Errorf("ParseTrustedProxies(%q): %v", tt.list, err)
+			continue
+		}
+		var got []string
+		for _, p := range prefixes {
+			got = append(got, p.String())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseTrustedProxies(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+
+	for _, v := range []string{"garbage", "10.0.0.256", "10.0.0.0/33", "10.0.0.1:80", "proxy.example.com"} {
+		if _, err := ParseTrustedProxies([]string{"10.0.0.1", v}); err == nil {
+			t.Errorf("ParseTrustedProxies accepted %q", v)
+		}
+	}
+}
+
+// logRequest sends a PUT through a server that logs in format, and returns the log.
+func logRequest(t *testing.T, format string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	l, err := NewAccessLogger(&buf, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, plain := newTestServer(t, 0)
+	plain.Close()
+	s.AccessLog = l
+	s.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+
+	resp, _ := request(t, ts, "bob", http.MethodPut, "/a.txt?x=1", strings.NewReader("hello"), http.Header{
+		"User-Agent":      {"test-agent"},
+		"Referer":         {"https://example.com/"},
+		"X-Request-Id":    {"req-1"},
+		"X-Forwarded-For": {"198.51.100.7"},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: %s", resp.Status)
+	}
+	return buf.String()
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	line := logRequest(t, AccessLogCombined)
+	re := regexp.MustCompile(`^198\.51\.100\.7 - bob \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "PUT /a\.txt\?x=1 HTTP/1\.1" 201 \S+ "https://example\.com/" "test-agent" "-" \d+\.\d{3} req-1\n$`)
+	if !re.MatchString(line) {
+		t.Errorf("combined log line: %q", line)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	line := logRequest(t, AccessLogJSON)
+	var e accessEntry
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatalf("%q: %v", line, err)
+	}
+	if e.RemoteAddr != "198.51.100.7" || e.User != "bob" || e.Method != http.MethodPut || e.Path != "/a.txt?x=1" ||
+		e.Status != http.StatusCreated || e.BytesIn != 5 || e.UserAgent != "test-agent" ||
+		e.Referer != "https://example.com/" || e.RequestID != "req-1" || e.Time.IsZero() {
+		t.Errorf("JSON log entry: %+v", e)
+	}
+	if strings.Count(line, "\n") != 1 {
+		t.Errorf("JSON log is not one line: %q", line)
+	}
+
+	if _, err := NewAccessLogger(&bytes.Buffer{}, "apache"); err == nil {
+		t.Error("NewAccessLogger accepted an unknown format")
+	}
+}
@@ -0,0 +1,529 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+)
+
+// The admin API lives under adminPrefix and is reserved for users with the admin role.
+// It is described by openapi.yaml, which is served at adminPrefix + "openapi.yaml".
+const adminPrefix = "/api/admin/"
+
+//go:embed openapi.yaml
+var adminOpenAPI []byte
+
+// maxAdminBody bounds the JSON bodies the admin API accepts.
+const maxAdminBody = 1 << 20
+
+// sessionIdle is how long after its last request a client still counts as active.
+const sessionIdle = 15 * time.Minute
+
+// adminMiddleware serves the admin API to admins and passes everything else on.
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/admin/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(adminOpenAPI)
+	})
+	mux.HandleFunc("GET /api/admin/users", s.adminListUsers)
+	mux.HandleFunc("POST /api/admin/users", s.adminCreateUser)
+	mux.HandleFunc("GET /api/admin/users/{name}", s.adminGetUser)
+	mux.HandleFunc("PATCH /api/admin/users/{name}", s.adminUpdateUser)
+	mux.HandleFunc("DELETE /api/admin/users/{name}", s.adminDeleteUser)
+	mux.HandleFunc("POST /api/admin/users/{name}/reset-password", s.adminResetPassword)
+	mux.HandleFunc("GET /api/admin/quota", s.adminGetQuota)
+	mux.HandleFunc("PUT /api/admin/quota", s.adminSetQuota)
+	mux.HandleFunc("DELETE /api/admin/quota", s.adminResetQuota)
+	mux.HandleFunc("GET /api/admin/locks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.locks.list(time.Now()))
+	})
+	mux.HandleFunc("GET /api/admin/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.sessions.list(time.Now()))
+	})
+	mux.HandleFunc("GET /api/admin/stats", s.adminStats)
+	mux.HandleFunc("/api/admin/", func(w http.ResponseWriter, r *http.Request) {
+		adminError(w, http.StatusNotFound, "no such endpoint: "+r.Method+" "+r.URL.Path)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, adminPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if u, ok := authUser(r); !ok || u.EffectiveRole() != user.RoleAdmin {
+			adminError(w, http.StatusForbidden, "admin role required")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func adminError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// decodeAdminBody reads a JSON request body into v, refusing unknown fields so typos
+// don't go unnoticed.
+func decodeAdminBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		adminError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// adminUser is a user as the admin API shows it.
+type adminUser struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+func (s *Server) adminListUsers(w http.ResponseWriter, r *http.Request) {
+	names, err := s.UserStore.List()
+	if err != nil {
+		s.adminStoreError(w, r, err)
+		return
+	}
+	users := make([]adminUser, 0, len(names))
+	for _, name := range names {
+		u, err := s.UserStore.Get(name)
+		if errors.Is(err, user.ErrNotFound) {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			s.adminStoreError(w, r, err)
+			return
+		}
+		users = append(users, adminUser{Username: name, Role: u.EffectiveRole()})
+	}
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (s *Server) adminGetUser(w http.ResponseWriter, r *http.Request) {
+	u, err := s.UserStore.Get(r.PathValue("name"))
+	if err != nil {
+		s.adminStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, adminUser{Username: u.Username, Role: u.EffectiveRole()})
+}
+
+func (s *Server) adminCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if !decodeAdminBody(w, r, &req) {
+		return
+	}
+	if req.Role == "" {
+		req.Role = user.RoleUser
+	}
+	switch {
+	case req.Password == "":
+		adminError(w, http.StatusBadRequest, "password is required")
+		return
+	case !user.ValidRole(req.Role):
+		adminError(w, http.StatusBadRequest, fmt.Sprintf("unknown role %q", req.Role))
+		return
+	}
+	ok := s.updateUsers(w, r, func(tx user.Tx) error {
+		if _, err := tx.Get(req.Username); err == nil {
+			return &httpError{http.StatusConflict, "user already exists"}
+		}
+		if err := user.Add(tx, req.Username, req.Password); err != nil {
+			return &httpError{http.StatusBadRequest, err.Error()}
+		}
+		return user.SetRole(tx, req.Username, req.Role)
+	})
+	if !ok {
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin: user created", "admin", requestUser(r), "user", req.Username, "role", req.Role)
+	w.Header().Set("Location", adminPrefix+"users/"+req.Username)
+	writeJSON(w, http.StatusCreated, adminUser{Username: req.Username, Role: req.Role})
+}
+
+// adminUpdateUser resets the password and/or changes the role of a user.
+func (s *Server) adminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req struct {
+		Password *string `json:"password"`
+		Role     *string `json:"role"`
+	}
+	if !decodeAdminBody(w, r, &req) {
+		return
+	}
+	switch {
+	case req.Password != nil && *req.Password == "":
+		adminError(w, http.StatusBadRequest, "password must not be empty")
+		return
+	case req.Role != nil && !user.ValidRole(*req.Role):
+		adminError(w, http.StatusBadRequest, fmt.Sprintf("unknown role %q", *req.Role))
+		return
+	}
+	var role string
+	ok := s.updateUsers(w, r, func(tx user.Tx) error {
+		u, err := tx.Get(name)
+		if err != nil {
+			return err
+		}
+		role = u.EffectiveRole()
+		if req.Role != nil && *req.Role != user.RoleAdmin && role == user.RoleAdmin {
+			if n, err := adminCount(tx); err != nil {
+				return err
+			} else if n == 1 {
+				return &httpError{http.StatusConflict, "cannot demote the last admin"}
+			}
+		}
+		if req.Password != nil {
+			if err := user.SetPassword(tx, name, *req.Password); err != nil {
+				return err
+			}
+		}
+		if req.Role != nil {
+			role = *req.Role
+			return user.SetRole(tx, name, role)
+		}
+		return nil
+	})
+	if !ok {
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin: user updated", "admin", requestUser(r), "user", name,
+		"password_reset", req.Password != nil, "role", role)
+	writeJSON(w, http.StatusOK, adminUser{Username: name, Role: role})
+}
+
+// adminResetPassword gives a user a new random password, which is returned once.
+func (s *Server) adminResetPassword(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var password string
+	ok := s.updateUsers(w, r, func(tx user.Tx) error {
+		var err error
+		password, err = user.ResetPassword(tx, name)
+		return err
+	})
+	if !ok {
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin: password reset", "admin", requestUser(r), "user", name)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"username": name, "password": password})
+}
+
+func (s *Server) adminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	ok := s.updateUsers(w, r, func(tx user.Tx) error {
+		u, err := tx.Get(name)
+		if err != nil {
+			return err
+		}
+		if u.EffectiveRole() == user.RoleAdmin {
+			if n, err := adminCount(tx); err != nil {
+				return err
+			} else if n == 1 {
+				return &httpError{http.StatusConflict, "cannot delete the last admin"}
+			}
+		}
+		return tx.Delete(name)
+	})
+	if !ok {
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin: user deleted", "admin", requestUser(r), "user", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminCount(users user.Reader) (int, error) {
+	names, err := users.List()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range names {
+		if user.IsAdmin(users, name) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// httpError is an error with the status code to answer it with.
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e *httpError) Error() string { return e.msg }
+
+// updateUsers applies fn to the users in one transaction of the user store, which
+// keeps 'atlas user' and other writers out meanwhile. On failure it answers the
+// request and returns false.
+func (s *Server) updateUsers(w http.ResponseWriter, r *http.Request, fn func(tx user.Tx) error) bool {
+	err := s.UserStore.Update(fn)
+	if err == nil {
+		return true
+	}
+	s.adminStoreError(w, r, err)
+	return false
+}
+
+// adminStoreError answers a request that failed on the user store.
+func (s *Server) adminStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	var he *httpError
+	switch {
+	case errors.As(err, &he):
+		adminError(w, he.code, he.msg)
+	case errors.Is(err, user.ErrNotFound):
+		adminError(w, http.StatusNotFound, "no such user")
+	case errors.Is(err, user.ErrWeakPassword):
+		adminError(w, http.StatusBadRequest, err.Error())
+	default:
+		slog.ErrorContext(r.Context(), "User store failed", "err", err)
+		adminError(w, http.StatusInternalServerError, "user store failed")
+	}
+}
+
+// adminQuota describes the quota in effect and the space used against it.
+type adminQuota struct {
+	QuotaBytes      uint64 `json:"quota_bytes"`
+	ConfiguredBytes uint64 `json:"configured_bytes"`
+	Overridden      bool   `json:"overridden"`
+	UsedBytes       uint64 `json:"used_bytes"`
+	FreeBytes       uint64 `json:"free_bytes"`
+}
+
+func (s *Server) quotaState() (adminQuota, error) {
+	free, used, err := s.usage()
+	if err != nil {
+		return adminQuota{}, err
+	}
+	s.quotaMu.RLock()
+	overridden := s.quotaOverride != nil
+	s.quotaMu.RUnlock()
+	return adminQuota{
+		QuotaBytes:      s.quota(),
+		ConfiguredBytes: s.QuotaBytes,
+		Overridden:      overridden,
+		UsedBytes:       used,
+		FreeBytes:       free,
+	}, nil
+}
+
+func (s *Server) adminGetQuota(w http.ResponseWriter, r *http.Request) {
+	q, err := s.quotaState()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, q)
+}
+
+// adminSetQuota replaces the quota until it is reset; 0 reports the filesystem's space.
+func (s *Server) adminSetQuota(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		QuotaBytes *uint64 `json:"quota_bytes"`
+	}
+	if !decodeAdminBody(w, r, &req) {
+		return
+	}
+	if req.QuotaBytes == nil {
+		adminError(w, http.StatusBadRequest, "quota_bytes is required")
+		return
+	}
+	if err := s.setQuota(req.QuotaBytes); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save quota", "err", err)
+		adminError(w, http.StatusInternalServerError, "failed to save quota")
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin: quota set", "admin", requestUser(r), "bytes", *req.QuotaBytes)
+	s.adminGetQuota(w, r)
+}
+
+// adminResetQuota goes back to the quota the server was started with.
+func (s *Server) adminResetQuota(w http.ResponseWriter, r *http.Request) {
+	if err := s.setQuota(nil); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to reset quota", "err", err)
+		adminError(w, http.StatusInternalServerError, "failed to reset quota")
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin: quota reset", "admin", requestUser(r), "bytes", s.QuotaBytes)
+	s.adminGetQuota(w, r)
+}
+
+func (s *Server) adminStats(w http.ResponseWriter, r *http.Request) {
+	q, err := s.quotaState()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	names, err := s.UserStore.List()
+	if err != nil {
+		s.adminStoreError(w, r, err)
+		return
+	}
+	admins, err := adminCount(s.UserStore)
+	if err != nil {
+		s.adminStoreError(w, r, err)
+		return
+	}
+	now := time.Now()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version":        Version,
+		"started":        s.started,
+		"uptime_seconds": int64(now.Sub(s.started).Seconds()),
+		"users":          len(names),
+		"admins":         admins,
+		"sessions":       len(s.sessions.list(now)),
+		"locks":          s.locks.count(now),
+		"storage":        q,
+	})
+}
+
+// quota returns the quota in effect: the one set through the admin API if any, else
+// QuotaBytes.
+func (s *Server) quota() uint64 {
+	s.quotaMu.RLock()
+	defer s.quotaMu.RUnlock()
+	if s.quotaOverride != nil {
+		return *s.quotaOverride
+	}
+	return s.QuotaBytes
+}
+
+// quotaFile keeps the quota set through the admin API across restarts.
+func (s *Server) quotaFile() string {
+	return filepath.Join(s.DataDir, ".atlas", "quota.json")
+}
+
+type quotaSetting struct {
+	QuotaBytes uint64 `json:"quota_bytes"`
+}
+
+// loadQuota picks up the quota saved by the admin API, which takes precedence over
+// the configured one.
+func (s *Server) loadQuota() error {
+	data, err := os.ReadFile(s.quotaFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var q quotaSetting
+	if err := json.Unmarshal(data, &q); err != nil {
+		return fmt.Errorf("%s: %w", s.quotaFile(), err)
+	}
+	s.quotaMu.Lock()
+	s.quotaOverride = &q.QuotaBytes
+	s.quotaMu.Unlock()
+	slog.Info("Using the quota set through the admin API", "bytes", q.QuotaBytes, "configured_bytes", s.QuotaBytes)
+	return nil
+}
+
+// setQuota saves q as the quota, or goes back to QuotaBytes when q is nil.
+func (s *Server) setQuota(q *uint64) error {
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+	if q == nil {
+		if err := os.Remove(s.quotaFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.quotaOverride = nil
+		return nil
+	}
+	data, _ := json.Marshal(quotaSetting{QuotaBytes: *q})
+	tmp := s.quotaFile() + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(tmp), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.quotaFile()); err != nil {
+		return err
+	}
+	v := *q
+	s.quotaOverride = &v
+	return nil
+}
+
+// session is a client that made authenticated requests recently. Basic Auth has no
+// sessions of its own, so requests are grouped by user, address and user agent.
+type session struct {
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Started    time.Time `json:"started"`
+	LastSeen   time.Time `json:"last_seen"`
+	Requests   int64     `json:"requests"`
+}
+
+type sessionKey struct {
+	user, addr, agent string
+}
+
+type sessionTracker struct {
+	mu       sync.Mutex
+	sessions map[sessionKey]*session
+	pruned   time.Time
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{sessions: make(map[sessionKey]*session)}
+}
+
+// seen records an authenticated request.
+func (t *sessionTracker) seen(user, addr, agent string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.pruned) > sessionIdle {
+		t.prune(now)
+	}
+	k := sessionKey{user, addr, agent}
+	sess := t.sessions[k]
+	if sess == nil {
+		sess = &session{User: user, RemoteAddr: addr, UserAgent: agent, Started: now}
+		t.sessions[k] = sess
+	}
+	sess.LastSeen = now
+	sess.Requests++
+}
+
+func (t *sessionTracker) prune(now time.Time) {
+	for k, sess := range t.sessions {
+		if now.Sub(sess.LastSeen) > sessionIdle {
+			delete(t.sessions, k)
+		}
+	}
+	t.pruned = now
+}
+
+// list returns the sessions active at now, most recent first.
+func (t *sessionTracker) list(now time.Time) []session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	out := make([]session, 0, len(t.sessions))
+	for _, sess := range t.sessions {
+		out = append(out, *sess)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastSeen.After(out[j].LastSeen) })
+	return out
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminRole(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+	if resp, _ := request(t, ts, "", http.MethodGet, adminPrefix+"users", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without credentials: %s, want 401", resp.Status)
+	}
+	if resp, _ := request(t, ts, "bob", http.MethodGet, adminPrefix+"users", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("as a user: %s, want 403", resp.Status)
+	}
+
+	resp, body := request(t, ts, "alice", http.MethodGet, adminPrefix+"users", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("as an admin: %s", resp.Status)
+	}
+	var users []adminUser
+	if err := json.Unmarshal([]byte(body), &users); err != nil {
+		t.Fatal(err)
+	}
+	want := []adminUser{{"alice", "admin"}, {"bob", "user"}}
+	if len(users) != len(want) || users[0] != want[0] || users[1] != want[1] {
+		t.Errorf("users = %v, want %v", users, want)
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+	create := `{"username": "carol", "password": "` + testPassword + `"}`
+	if resp, body := request(t, ts, "alice", http.MethodPost, adminPrefix+"users", strings.NewReader(create), nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST: %s %s", resp.Status, body)
+	}
+	if resp, _ := request(t, ts, "alice", http.MethodPost, adminPrefix+"users", strings.NewReader(create), nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("POST of an existing user: %s, want 409", resp.Status)
+	}
+	weak := `{"username": "dave", "password": "short"}`
+	if resp, _ := request(t, ts, "alice", http.MethodPost, adminPrefix+"users", strings.NewReader(weak), nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST with a weak password: %s, want 400", resp.Status)
+	}
+
+	// carol can log in, and becomes an admin.
+	if resp, _ := request(t, ts, "carol", http.MethodGet, adminPrefix+"users", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("carol as a user: %s, want 403", resp.Status)
+	}
+	resp, body := request(t, ts, "alice", http.MethodPatch, adminPrefix+"users/carol", strings.NewReader(`{"role": "admin"}`), nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"role":"admin"`) {
+		t.Fatalf("PATCH: %s %s", resp.Status, body)
+	}
+	if resp, _ := request(t, ts, "carol", http.MethodGet, adminPrefix+"users", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("carol as an admin: %s", resp.Status)
+	}
+
+	if resp, _ := request(t, ts, "alice", http.MethodDelete, adminPrefix+"users/carol", nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: %s", resp.Status)
+	}
+	if resp, _ := request(t, ts, "alice", http.MethodGet, adminPrefix+"users/carol", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of a deleted user: %s, want 404", resp.Status)
+	}
+}
+
+func TestAdminLastAdmin(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+	demote := `{"role": "user"}`
+	if resp, _ := request(t, ts, "alice", http.MethodPatch, adminPrefix+"users/alice", strings.NewReader(demote), nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("demoting the last admin: %s, want 409", resp.Status)
+	}
+	if resp, _ := request(t, ts, "alice", http.MethodDelete, adminPrefix+"users/alice", nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("deleting the last admin: %s, want 409", resp.Status)
+	}
+
+	// With a second admin, either can go.
+	promote := `{"role": "admin"}`
+	if resp, _ := request(t, ts, "alice", http.MethodPatch, adminPrefix+"users/bob", strings.NewReader(promote), nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("promoting bob: %s", resp.Status)
+	}
+	if resp, _ := request(t, ts, "bob", http.MethodPatch, adminPrefix+"users/alice", strings.NewReader(demote), nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("demoting alice: %s", resp.Status)
+	}
+	if resp, _ := request(t, ts, "bob", http.MethodDelete, adminPrefix+"users/bob", nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("deleting the new last admin: %s, want 409", resp.Status)
+	}
+}
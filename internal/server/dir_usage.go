@@ -1,30 +1,94 @@
-package server
-
-import (
-	"os"
-	"path/filepath"
-)
-
-// getDirUsedBytes returns the total size in bytes of all files under dir (recursive).
-// Used for quota reporting so we report space used by the share content, not the host disk.
-func getDirUsedBytes(dir string) (uint64, error) {
-	var total uint64
-	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			if os.IsNotExist(err) {
-				return nil
-			}
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
-		info, err := d.Info()
-		if err != nil {
-			return nil
-		}
-		total += uint64(info.Size())
-		return nil
-	})
-	return total, err
-}
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+)
+
+// ownerMetaKey is the object metadata field naming the user who stored a file, which
+// the usage of each user is counted by.
+const ownerMetaKey = "atlas-owner"
+
+// ownerMeta returns the metadata to store a file with on behalf of the user
+// authMiddleware let in with ctx, if any.
+func ownerMeta(ctx context.Context) map[string]string {
+	if u, ok := ctx.Value(authUserKey{}).(user.User); ok {
+		return map[string]string{ownerMetaKey: u.Username}
+	}
+	return nil
+}
+
+// getDirUsedBytes returns the total size in bytes of all files under dir (recursive).
+// Used for quota reporting so we report space used by the share content, not the host disk.
+func getDirUsedBytes(dir string) (uint64, error) {
+	var total uint64
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += uint64(info.Size())
+		return nil
+	})
+	return total, err
+}
+
+// usedBytes returns the size of DataDir, walking it again only if the last walk is
+// older than maxAge.
+func (s *Server) usedBytes(maxAge time.Duration) (uint64, error) {
+	s.usedMu.Lock()
+	defer s.usedMu.Unlock()
+	if maxAge > 0 && time.Since(s.usedAt) < maxAge {
+		return s.used, nil
+	}
+	used, err := getDirUsedBytes(s.DataDir)
+	if err != nil {
+		return 0, err
+	}
+	s.used, s.usedAt = used, time.Now()
+	return used, nil
+}
+
+// userUsage returns the bytes of the files each user stored, listing the share again
+// only if the last listing is older than maxAge. Files stored before owners were
+// recorded, or put into the data directory by other means, count for nobody.
+func (s *Server) userUsage(ctx context.Context, maxAge time.Duration) (map[string]uint64, error) {
+	s.userUsedMu.Lock()
+	defer s.userUsedMu.Unlock()
+	if maxAge > 0 && time.Since(s.userUsedAt) < maxAge {
+		return s.userUsed, nil
+	}
+	usage := make(map[string]uint64)
+	opts := storage.ListOptions{Recursive: true}
+	for {
+		res, err := s.Driver.List(ctx, "", opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range res.Entries {
+			if owner := e.Metadata[ownerMetaKey]; owner != "" && !e.IsDir() {
+				usage[owner] += uint64(e.Size)
+			}
+		}
+		if res.NextContinuationToken == "" {
+			break
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+	s.userUsed, s.userUsedAt = usage, time.Now()
+	return usage, nil
+}
@@ -0,0 +1,599 @@
+package server
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+// driverFS exposes a storage.Driver as a webdav.FileSystem.
+// The request context handed in by the webdav handler is passed straight to the driver,
+// so a client that disconnects mid-transfer cancels the backend operation too.
+type driverFS struct {
+	driver storage.Driver
+}
+
+var _ webdav.FileSystem = (*driverFS)(nil)
+
+// toKey converts a WebDAV path ("/a/b") to a driver key ("a/b"). The root maps to "".
+func toKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// osError translates driver errors into the os errors the webdav package checks for
+// (it uses os.IsNotExist / os.IsExist, which do not unwrap arbitrary errors).
+func osError(op, name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, storage.ErrNotFound):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case errors.Is(err, storage.ErrExist):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrExist}
+	case errors.Is(err, storage.ErrInvalidKey):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+	}
+	return err
+}
+
+func (fsys *driverFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	key := toKey(name)
+	if key == "" {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	return osError("mkdir", name, fsys.driver.Mkdir(ctx, key))
+}
+
+func (fsys *driverFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	key := toKey(name)
+	if key == "" {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 && flag&os.O_TRUNC != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: storage.ErrIsDir}
+		}
+		return &dirFile{ctx: ctx, fsys: fsys, info: rootInfo().ObjectInfo}, nil
+	}
+
+	info, err := fsys.driver.Stat(ctx, key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, osError("open", name, err)
+	}
+
+	// Only truncating opens (PUT, LOCK on a new resource) or creating a missing file
+	// replace the content. PROPPATCH opens with O_RDWR just to reach the properties,
+	// and must not wipe the object.
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0 && (flag&os.O_TRUNC != 0 || !exists)
+	if write {
+		if exists && info.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: storage.ErrIsDir}
+		}
+		if exists && flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if !exists && flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		// Like os.OpenFile, creating a file requires the parent collection to exist.
+		if parent := path.Dir(key); parent != "." {
+			pi, err := fsys.driver.Stat(ctx, parent)
+			if err != nil {
+				return nil, osError("open", name, err)
+			}
+			if !pi.IsDir() {
+				return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+			}
+		}
+		return newWriteFile(ctx, fsys.driver, key), nil
+	}
+
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if cs := copyFrom(ctx); cs != nil {
+		cs.opened(info.IsDir())
+	}
+	if info.IsDir() {
+		return &dirFile{ctx: ctx, fsys: fsys, info: info}, nil
+	}
+	setChecksumHeaders(ctx, info)
+	return &readFile{ctx: ctx, driver: fsys.driver, info: info}, nil
+}
+
+func (fsys *driverFS) RemoveAll(ctx context.Context, name string) error {
+	key := toKey(name)
+	if key == "" {
+		// Refuse to wipe the whole share, like webdav.Dir does.
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrInvalid}
+	}
+	info, err := fsys.driver.Stat(ctx, key)
+	if err != nil {
+		return osError("remove", name, err)
+	}
+	if cs := copyFrom(ctx); cs != nil && !info.IsDir() && !cs.sourceIsDir() {
+		// A file copied over a file: the write that follows replaces it, or leaves it
+		// in place if the copy fails.
+		return nil
+	}
+	if info.IsDir() {
+		var children []storage.ObjectInfo
+		opts := storage.ListOptions{Recursive: true}
+		for {
+			res, err := fsys.driver.List(ctx, key+"/", opts)
+			if err != nil {
+				return err
+			}
+			children = append(children, res.Entries...)
+			if res.NextContinuationToken == "" {
+				break
+			}
+			opts.ContinuationToken = res.NextContinuationToken
+		}
+		// Listings are sorted by key, so walking backwards deletes children before parents.
+		for i := len(children) - 1; i >= 0; i-- {
+			if err := fsys.driver.Delete(ctx, children[i].Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return osError("remove", name, err)
+			}
+		}
+	}
+	return osError("remove", name, fsys.driver.Delete(ctx, key))
+}
+
+func (fsys *driverFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldKey, newKey := toKey(oldName), toKey(newName)
+	if oldKey == "" || newKey == "" {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrInvalid}
+	}
+	return osError("rename", oldName, fsys.driver.Rename(ctx, oldKey, newKey))
+}
+
+func (fsys *driverFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	key := toKey(name)
+	if key == "" {
+		return rootInfo(), nil
+	}
+	info, err := fsys.driver.Stat(ctx, key)
+	if err != nil {
+		return nil, osError("stat", name, err)
+	}
+	return fileInfo{info}, nil
+}
+
+// fileInfo adapts storage.ObjectInfo to os.FileInfo. It also implements
+// webdav.ContentTyper so PROPFIND uses the stored content type instead of
+// opening and sniffing every file.
+type fileInfo struct {
+	storage.ObjectInfo
+}
+
+func rootInfo() fileInfo {
+	// Drivers have no key for the root itself; report it as a directory modified now.
+	return fileInfo{storage.ObjectInfo{Type: storage.TypeDir, ModTime: time.Now()}}
+}
+
+func (fi fileInfo) Name() string {
+	if fi.Key == "" {
+		return "/"
+	}
+	return path.Base(fi.Key)
+}
+
+func (fi fileInfo) Size() int64        { return fi.ObjectInfo.Size }
+func (fi fileInfo) ModTime() time.Time { return fi.ObjectInfo.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.ObjectInfo.IsDir() }
+func (fi fileInfo) Sys() any           { return fi.ObjectInfo }
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.IsDir() {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi fileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.ObjectInfo.ContentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.ObjectInfo.ContentType, nil
+}
+
+// ETag implements webdav.ETager: objects with a SHA-256 use it, so the ETag only changes
+// with the content. Others fall back to the modification time and size.
+func (fi fileInfo) ETag(ctx context.Context) (string, error) {
+	sum, ok := sha256Hex(fi.Checksum)
+	if !ok {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + sum + `"`, nil
+}
+
+// sha256Hex extracts the hex digest from a "sha256:<hex>" checksum.
+func sha256Hex(checksum string) (string, bool) {
+	sum, ok := strings.CutPrefix(checksum, "sha256:")
+	return sum, ok && sum != ""
+}
+
+// readFile streams an object from the driver. Seeking just moves the offset;
+// the next Read reopens the object with a range request from there, which is
+// what http.ServeContent needs for Range requests.
+type readFile struct {
+	ctx    context.Context
+	driver storage.Driver
+	info   storage.ObjectInfo
+	offset int64
+	rc     io.ReadCloser
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size {
+		return 0, io.EOF
+	}
+	if f.rc == nil {
+		// Whole-object reads go without a range so drivers can cache and verify them.
+		var opts storage.GetOptions
+		if f.offset > 0 {
+			opts.Range = &storage.Range{Offset: f.offset}
+		}
+		rc, _, err := f.driver.Get(f.ctx, f.info.Key, opts)
+		if err != nil {
+			return 0, err
+		}
+		f.rc = rc
+	}
+	n, err := f.rc.Read(p)
+	f.offset += int64(n)
+	if err == io.EOF && f.offset < f.info.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		if cs := copyFrom(f.ctx); cs != nil {
+			cs.fail(err)
+		}
+	}
+	return n, err
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = f.offset + offset
+	case io.SeekEnd:
+		abs = f.info.Size + offset
+	default:
+		return 0, os.ErrInvalid
+	}
+	if abs < 0 {
+		return 0, os.ErrInvalid
+	}
+	if abs != f.offset && f.rc != nil {
+		f.rc.Close()
+		f.rc = nil
+	}
+	f.offset = abs
+	return abs, nil
+}
+
+func (f *readFile) Close() error {
+	if f.rc != nil {
+		return f.rc.Close()
+	}
+	return nil
+}
+
+func (f *readFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.info.Key, Err: os.ErrInvalid}
+}
+
+func (f *readFile) Stat() (fs.FileInfo, error) { return fileInfo{f.info}, nil }
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.info.Key, Err: os.ErrPermission}
+}
+
+// Properties reporting the stored checksum in PROPFIND: our own, and the one
+// ownCloud/Nextcloud clients look for.
+var (
+	propChecksum   = xml.Name{Space: "urn:atlas-drive", Local: "checksum"}
+	propOCChecksum = xml.Name{Space: "http://owncloud.org/ns", Local: "checksums"}
+)
+
+// DeadProps implements webdav.DeadPropsHolder to publish the checksum, and the oc:
+// properties on the Nextcloud routes.
+func (f *readFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := ocProps(f.ctx, f.info)
+	if props == nil {
+		props = make(map[xml.Name]webdav.Property)
+	}
+	if sum, ok := sha256Hex(f.info.Checksum); ok {
+		props[propChecksum] = webdav.Property{XMLName: propChecksum, InnerXML: []byte(f.info.Checksum)}
+		props[propOCChecksum] = webdav.Property{
+			XMLName:  propOCChecksum,
+			InnerXML: []byte("<checksum>SHA256:" + sum + "</checksum>"),
+		}
+	}
+	return props, nil
+}
+
+func (f *readFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return refusePatch(patches), nil
+}
+
+// refusePatch refuses every change, as the webdav package does for files without dead
+// properties.
+func refusePatch(patches []webdav.Proppatch) []webdav.Propstat {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}
+}
+
+// uploadBody records how reading a request body ended, so a writeFile can tell a
+// complete upload from one the client cut off: the webdav package copies the body and
+// closes the file either way.
+type uploadBody struct {
+	io.ReadCloser
+	err error
+}
+
+type uploadBodyKey struct{}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// copyState follows a COPY through the webdav package, which opens the source, removes
+// the destination, then copies the source into a new file and closes it whether or not
+// reading the source failed. With it, driverFS keeps a destination file until the copy
+// replaces it, and the writeFile can tell a failed copy from a complete one.
+type copyState struct {
+	mu    sync.Mutex
+	isDir bool  // whether the source opened last is a directory
+	err   error // the first error reading a source
+}
+
+type copyStateKey struct{}
+
+func copyFrom(ctx context.Context) *copyState {
+	cs, _ := ctx.Value(copyStateKey{}).(*copyState)
+	return cs
+}
+
+func (cs *copyState) opened(isDir bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.isDir = isDir
+}
+
+func (cs *copyState) sourceIsDir() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.isDir
+}
+
+func (cs *copyState) fail(err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.err == nil {
+		cs.err = err
+	}
+}
+
+// trackUpload makes the body of a PUT, or the source of a COPY, visible to the
+// writeFile it ends up in.
+func trackUpload(r *http.Request) *http.Request {
+	if r.Method == "COPY" {
+		return r.WithContext(context.WithValue(r.Context(), copyStateKey{}, &copyState{}))
+	}
+	if r.Method != http.MethodPut || r.Body == nil {
+		return r
+	}
+	b := &uploadBody{ReadCloser: r.Body}
+	r = r.WithContext(context.WithValue(r.Context(), uploadBodyKey{}, b))
+	r.Body = b
+	return r
+}
+
+// uploadErr reports why the upload or copy feeding ctx's request didn't complete, if
+// it didn't.
+func uploadErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cs := copyFrom(ctx); cs != nil {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		if cs.err != nil {
+			return cs.err
+		}
+	}
+	if b, ok := ctx.Value(uploadBodyKey{}).(*uploadBody); ok && b.err != nil {
+		return b.err
+	}
+	return nil
+}
+
+// writeFile pipes everything written to it into a single driver Put running in the
+// background. Close waits for the Put to finish and reports its error.
+type writeFile struct {
+	ctx     context.Context
+	driver  storage.Driver
+	key     string
+	pw      *io.PipeWriter
+	done    chan error
+	size    int64
+	modTime time.Time
+
+	commitOnce sync.Once
+	commitErr  error
+}
+
+func newWriteFile(ctx context.Context, driver storage.Driver, key string) *writeFile {
+	pr, pw := io.Pipe()
+	f := &writeFile{
+		ctx:     ctx,
+		driver:  driver,
+		key:     key,
+		pw:      pw,
+		done:    make(chan error, 1),
+		modTime: time.Now(),
+	}
+	opts := storage.PutOptions{
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		Metadata:    ownerMeta(ctx),
+	}
+	go func() {
+		err := driver.Put(ctx, key, pr, opts)
+		// Unblock the writer if the driver gave up early.
+		pr.CloseWithError(err)
+		f.done <- err
+	}()
+	return f
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	n, err := f.pw.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close commits the object, unless the upload was cut off or cancelled, or the source
+// of a copy couldn't be read: then the Put fails, and the previous version stays.
+func (f *writeFile) Close() error {
+	return f.commit()
+}
+
+func (f *writeFile) commit() error {
+	f.commitOnce.Do(func() {
+		if err := uploadErr(f.ctx); err != nil {
+			f.pw.CloseWithError(err)
+			<-f.done
+			f.commitErr = err
+			return
+		}
+		f.pw.Close()
+		f.commitErr = <-f.done
+	})
+	return f.commitErr
+}
+
+// Stat reports the stored object, so the ETag of a PUT response is the one GET and
+// PROPFIND return. The webdav package calls it once the body is copied but before
+// Close, so it commits the upload first.
+func (f *writeFile) Stat() (fs.FileInfo, error) {
+	if err := f.commit(); err != nil {
+		return nil, err
+	}
+	info, err := f.driver.Stat(f.ctx, f.key)
+	if err != nil {
+		// The object is stored; report what was written rather than fail the PUT.
+		return fileInfo{storage.ObjectInfo{Key: f.key, Size: f.size, ModTime: f.modTime}}, nil
+	}
+	return fileInfo{info}, nil
+}
+
+func (f *writeFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: f.key, Err: os.ErrPermission}
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: f.key, Err: os.ErrInvalid}
+}
+
+func (f *writeFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.key, Err: os.ErrInvalid}
+}
+
+// dirFile lists a collection. Entries are fetched page by page from the driver on demand.
+type dirFile struct {
+	ctx   context.Context
+	fsys  *driverFS
+	info  storage.ObjectInfo
+	token string
+	done  bool
+	buf   []fs.FileInfo
+}
+
+func (f *dirFile) fill() error {
+	prefix := ""
+	if f.info.Key != "" {
+		prefix = f.info.Key + "/"
+	}
+	res, err := f.fsys.driver.List(f.ctx, prefix, storage.ListOptions{ContinuationToken: f.token})
+	if err != nil {
+		return err
+	}
+	for _, e := range res.Entries {
+		f.buf = append(f.buf, fileInfo{e})
+	}
+	f.token = res.NextContinuationToken
+	f.done = f.token == ""
+	return nil
+}
+
+// Readdir follows the os.File semantics: count <= 0 returns everything left,
+// otherwise at most count entries and io.EOF once the listing is exhausted.
+func (f *dirFile) Readdir(count int) ([]fs.FileInfo, error) {
+	for !f.done && (count <= 0 || len(f.buf) < count) {
+		if err := f.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if count <= 0 {
+		out := f.buf
+		f.buf = nil
+		return out, nil
+	}
+	if len(f.buf) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.buf))
+	out := f.buf[:n]
+	f.buf = f.buf[n:]
+	return out, nil
+}
+
+// DeadProps implements webdav.DeadPropsHolder for the oc: properties on the Nextcloud routes.
+func (f *dirFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return ocProps(f.ctx, f.info), nil
+}
+
+func (f *dirFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return refusePatch(patches), nil
+}
+
+func (f *dirFile) Stat() (fs.FileInfo, error) { return fileInfo{f.info}, nil }
+func (f *dirFile) Close() error               { return nil }
+
+func (f *dirFile) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "read", Path: f.info.Key, Err: storage.ErrIsDir}
+}
+
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, &os.PathError{Op: "seek", Path: f.info.Key, Err: storage.ErrIsDir}
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.info.Key, Err: storage.ErrIsDir}
+}
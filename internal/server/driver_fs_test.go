@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+)
+
+// failingReads is a driver whose reads of one key fail after a few bytes, as a
+// checksum mismatch or a backend error halfway would.
+type failingReads struct {
+	storage.Driver
+	key string
+}
+
+var errReadFailed = errors.New("read failed")
+
+func (d *failingReads) Get(ctx context.Context, key string, opts storage.GetOptions) (io.ReadCloser, storage.ObjectInfo, error) {
+	rc, info, err := d.Driver.Get(ctx, key, opts)
+	if err != nil || key != d.key {
+		return rc, info, err
+	}
+	r := io.MultiReader(io.LimitReader(rc, 3), iotest.ErrReader(errReadFailed))
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, rc}, info, nil
+}
+
+func TestCopyKeepsDestinationWhenSourceFails(t *testing.T) {
+	s, plain := newTestServer(t, 0)
+	plain.Close()
+	s.Driver = &failingReads{Driver: s.Driver, key: "src.txt"}
+	ts := httptest.NewServer(s.handler())
+	defer ts.Close()
+
+	for name, data := range map[string]string{"/src.txt": "new content", "/dst.txt": "old content"} {
+		if resp, _ := request(t, ts, "bob", http.MethodPut, name, strings.NewReader(data), nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("PUT %s: %s", name, resp.Status)
+		}
+	}
+
+	header := http.Header{"Destination": {ts.URL + "/dst.txt"}}
+	if resp, _ := request(t, ts, "bob", "COPY", "/src.txt", nil, header); resp.StatusCode < 500 {
+		t.Errorf("COPY of an unreadable source: %s, want a server error", resp.Status)
+	}
+	if _, body := request(t, ts, "bob", http.MethodGet, "/dst.txt", nil, nil); body != "old content" {
+		t.Errorf("destination after a failed COPY = %q, want the old content", body)
+	}
+
+	// Copies that work still replace the destination, and create new files.
+	header.Set("Destination", ts.URL+"/copy.txt")
+	if resp, _ := request(t, ts, "bob", "COPY", "/dst.txt", nil, header); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("COPY: %s", resp.Status)
+	}
+	header.Set("Destination", ts.URL+"/dst.txt")
+	request(t, ts, "bob", http.MethodPut, "/copy.txt", strings.NewReader("newer"), nil)
+	if resp, _ := request(t, ts, "bob", "COPY", "/copy.txt", nil, header); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("COPY over a file: %s", resp.Status)
+	}
+	if _, body := request(t, ts, "bob", http.MethodGet, "/dst.txt", nil, nil); body != "newer" {
+		t.Errorf("destination after COPY = %q, want newer", body)
+	}
+}
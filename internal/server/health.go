@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+)
+
+// Version is the release Atlas was built as, set at build time with
+// -ldflags "-X github.com/IYouKnow/atlas-drive/internal/server.Version=v1.2.3".
+var Version = "dev"
+
+// readyTimeout bounds the backend check of /readyz, so a hung backend fails the probe
+// instead of piling up requests.
+var readyTimeout = 5 * time.Second
+
+// healthMiddleware answers the probes used by Docker and Kubernetes, without
+// authentication: /healthz (the process is up), /readyz (the server can serve requests)
+// and /version. It sits outside metrics and the access log so frequent probes don't
+// drown the real traffic.
+func (s *Server) healthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/version":
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		switch r.URL.Path {
+		case "/healthz":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("ok\n"))
+		case "/readyz":
+			s.serveReady(w, r)
+		case "/version":
+			writeJSON(w, http.StatusOK, versionInfo())
+		}
+	})
+}
+
+// serveReady checks that the data directory is writable, the user store can be read and
+// the storage backend answers, and reports each check.
+func (s *Server) serveReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"data_dir":   "ok",
+		"user_store": "ok",
+		"storage":    "ok",
+	}
+	if err := checkWritable(s.DataDir); err != nil {
+		checks["data_dir"] = err.Error()
+	}
+	if s.UserStore == nil {
+		checks["user_store"] = "not loaded"
+	} else if _, err := s.UserStore.List(); err != nil {
+		checks["user_store"] = err.Error()
+	}
+	if err := s.checkBackend(r.Context()); err != nil {
+		checks["storage"] = err.Error()
+	}
+
+	status, code := "ok", http.StatusOK
+	for name, result := range checks {
+		if result != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+			slog.WarnContext(r.Context(), "Readiness check failed", "check", name, "err", result)
+		}
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+// checkWritable creates and removes a file in the data directory's .atlas folder,
+// where the server keeps its own state.
+func checkWritable(dataDir string) error {
+	dir := filepath.Join(dataDir, ".atlas")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "ready-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	err = f.Close()
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+func (s *Server) checkBackend(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	_, err := s.Driver.List(ctx, "", storage.ListOptions{PageSize: 1})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.New("no answer within " + readyTimeout.String())
+	}
+	return err
+}
+
+// versionInfo describes the running binary: the release, and the commit it was built
+// from when the build recorded it.
+func versionInfo() map[string]string {
+	info := map[string]string{"version": Version, "go": runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info["commit"] = setting.Value
+			case "vcs.time":
+				info["commit_time"] = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+)
+
+// brokenStore is a user store that can't be read.
+type brokenStore struct {
+	user.Store
+}
+
+func (brokenStore) List() ([]string, error) {
+	return nil, errors.New("users.json: input/output error")
+}
+
+// hungDriver is a backend that never answers a listing.
+type hungDriver struct {
+	storage.Driver
+}
+
+func (hungDriver) List(ctx context.Context, prefix string, opts storage.ListOptions) (storage.ListResult, error) {
+	<-ctx.Done()
+	return storage.ListResult{}, ctx.Err()
+}
+
+// failingDriver is a backend that fails every listing.
+type failingDriver struct {
+	storage.Driver
+}
+
+func (failingDriver) List(ctx context.Context, prefix string, opts storage.ListOptions) (storage.ListResult, error) {
+	return storage.ListResult{}, errors.New("bucket unreachable")
+}
+
+// The probes answer without credentials; everything else still needs them.
+func TestHealthSkipsAuth(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+	for _, target := range []string{"/healthz", "/readyz", "/version"} {
+		resp, body := request(t, ts, "", http.MethodGet, target, nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s without credentials: %s %s", target, resp.Status, body)
+		}
+		if resp, _ := request(t, ts, "", http.MethodHead, target, nil, nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("HEAD %s without credentials: %s", target, resp.Status)
+		}
+		if resp, _ := request(t, ts, "", http.MethodPost, target, nil, nil); resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("POST %s: %s, want 405", target, resp.Status)
+		}
+	}
+	if resp, _ := request(t, ts, "", http.MethodGet, "/healthz/x", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /healthz/x without credentials: %s, want 401", resp.Status)
+	}
+
+	_, body := request(t, ts, "", http.MethodGet, "/version", nil, nil)
+	var v map[string]string
+	if err := json.Unmarshal([]byte(body), &v); err != nil || v["version"] != Version || v["go"] == "" {
+		t.Errorf("/version = %s, %v", body, err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	// A data directory whose .atlas is a file, which not even root can write into.
+	unwritable := t.TempDir()
+	if err := os.WriteFile(filepath.Join(unwritable, ".atlas"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration) { readyTimeout = d }(readyTimeout)
+	readyTimeout = 50 * time.Millisecond
+
+	for _, tt := range []struct {
+		name   string
+		setup  func(s *Server)
+		failed string // the check expected to fail, if any
+	}{
+		{"ready", func(s *Server) {}, ""},
+		{"data dir not writable", func(s *Server) { s.DataDir = unwritable }, "data_dir"},
+		{"user store failing", func(s *Server) { s.UserStore = brokenStore{s.UserStore} }, "user_store"},
+		{"backend failing", func(s *Server) { s.Driver = failingDriver{s.Driver} }, "storage"},
+		{"backend hung", func(s *Server) { s.Driver = hungDriver{s.Driver} }, "storage"},
+	} {
+		s, plain := newTestServer(t, 0)
+		plain.Close()
+		tt.setup(s)
+		ts := httptest.NewServer(s.handler())
+
+		resp, body := request(t, ts, "", http.MethodGet, "/readyz", nil, nil)
+		ts.Close()
+		var got struct {
+			Status string            `json:"status"`
+			Checks map[string]string `json:"checks"`
+		}
+		if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Errorf("%s: %s: %v", tt.name, body, err)
+			continue
+		}
+		if tt.failed == "" {
+			if resp.StatusCode != http.StatusOK || got.Status != "ok" {
+				t.Errorf("%s: %s %s, want 200", tt.name, resp.Status, body)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable || got.Status != "unavailable" {
+			t.Errorf("%s: %s %s, want 503", tt.name, resp.Status, body)
+		}
+		for name, result := range got.Checks {
+			if (name == tt.failed) == (result == "ok") {
+				t.Errorf("%s: check %s = %q", tt.name, name, result)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// DefaultQuietNotFound lists the files Windows Explorer keeps asking for. Requests for
+// them that end in "not found" are only logged at debug level.
+var DefaultQuietNotFound = []string{"desktop.ini", "autorun.inf", "thumbs.db", "folder.jpg"}
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request ctx belongs to, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID accepts IDs set by a proxy in front of us, if they look harmless.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware tags every request with an ID, taken from X-Request-ID when a
+// proxy set one, and echoes it in the response so clients can quote it.
+func (s *Server) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = context.WithValue(ctx, requestUserKey{}, new(string))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// NewLogHandler wraps h so that records logged with a request's context carry its
+// request_id.
+func NewLogHandler(h slog.Handler) slog.Handler {
+	return logHandler{h}
+}
+
+type logHandler struct {
+	slog.Handler
+}
+
+func (h logHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return logHandler{h.Handler.WithGroup(name)}
+}
+
+// logWebDAV is the webdav.Handler's Logger.
+func (s *Server) logWebDAV(r *http.Request, err error) {
+	if err == nil {
+		return
+	}
+	level := slog.LevelWarn
+	if os.IsNotExist(err) && s.quietNotFound(r.URL.Path) {
+		level = slog.LevelDebug
+	}
+	slog.Log(r.Context(), level, "WebDAV error", "method", r.Method, "path", r.URL.Path, "err", err)
+}
+
+// quietNotFound reports whether the name of p matches one of QuietNotFound, which are
+// case-insensitive path.Match patterns.
+func (s *Server) quietNotFound(p string) bool {
+	base := strings.ToLower(path.Base(p))
+	for _, pattern := range s.QuietNotFound {
+		if ok, _ := path.Match(strings.ToLower(pattern), base); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+// captureHandler keeps every record logged, at any level.
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *captureHandler) Handle(_ context.Context, rec slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, rec.Clone())
+	return nil
+}
+
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler      { return h }
+
+// find returns the records with message msg whose attribute key is value.
+func (h *captureHandler) find(msg, key, value string) []slog.Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []slog.Record
+	for _, rec := range h.records {
+		if rec.Message == msg && attr(rec, key) == value {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+func attr(rec slog.Record, key string) string {
+	var v string
+	rec.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			v = a.Value.String()
+			return false
+		}
+		return true
+	})
+	return v
+}
+
+// captureLogs sends the default logger, with NewLogHandler as the server sets it up, to
+// a captureHandler for the rest of the test.
+func captureLogs(t *testing.T) *captureHandler {
+	h := &captureHandler{}
+	old := slog.Default()
+	slog.SetDefault(slog.New(NewLogHandler(h)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return h
+}
+
+func TestRequestID(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+	generated := regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+	resp, _ := request(t, ts, "", http.MethodGet, "/healthz", nil, http.Header{"X-Request-Id": {"proxy-id.42"}})
+	if got := resp.Header.Get("X-Request-Id"); got != "proxy-id.42" {
+		t.Errorf("X-Request-Id = %q, want the one sent", got)
+	}
+
+	var seen []string
+	for _, header := range []http.Header{nil, {"X-Request-Id": {"not a valid id!"}}, nil} {
+		resp, _ := request(t, ts, "", http.MethodGet, "/healthz", nil, header)
+		id := resp.Header.Get("X-Request-Id")
+		if !generated.MatchString(id) {
+			t.Errorf("generated X-Request-Id = %q", id)
+		}
+		seen = append(seen, id)
+	}
+	if seen[0] == seen[1] || seen[1] == seen[2] || seen[0] == seen[2] {
+		t.Errorf("generated IDs repeat: %v", seen)
+	}
+}
+
+// Records logged with a request's context, by any middleware, carry its ID.
+func TestRequestIDInLogs(t *testing.T) {
+	logs := captureLogs(t)
+	_, ts := newTestServer(t, 0)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/a.txt", nil)
+	req.SetBasicAuth("bob", "wrong")
+	req.Header.Set("X-Request-Id", "req-auth")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := len(logs.find("Auth failed", "request_id", "req-auth")); n != 1 {
+		t.Errorf("%d auth failures logged with the request ID, want 1", n)
+	}
+
+	request(t, ts, "bob", http.MethodGet, "/missing.txt", nil, http.Header{"X-Request-Id": {"req-dav"}})
+	if n := len(logs.find("WebDAV error", "request_id", "req-dav")); n != 1 {
+		t.Errorf("%d WebDAV errors logged with the request ID, want 1", n)
+	}
+	// Without a request, no ID is made up.
+	slog.Info("outside a request")
+	if recs := logs.find("outside a request", "request_id", ""); len(recs) != 1 {
+		t.Error("a record logged outside a request got a request ID")
+	}
+}
+
+func TestQuietNotFound(t *testing.T) {
+	logs := captureLogs(t)
+	s, plain := newTestServer(t, 0)
+	plain.Close()
+	s.QuietNotFound = []string{"desktop.ini", "*.TMP"}
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+
+	for p, want := range map[string]slog.Level{
+		"/Desktop.INI":     slog.LevelDebug,
+		"/sub/desktop.ini": slog.LevelDebug,
+		"/dir/backup.tmp":  slog.LevelDebug,
+		"/thumbs.db":       slog.LevelWarn, // a default, but not in the configured list
+		"/desktop.ini.bak": slog.LevelWarn,
+		"/missing.txt":     slog.LevelWarn,
+	} {
+		if resp, _ := request(t, ts, "bob", http.MethodGet, p, nil, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: %s, want 404", p, resp.Status)
+			continue
+		}
+		recs := logs.find("WebDAV error", "path", p)
+		if len(recs) != 1 {
+			t.Errorf("GET %s: %d WebDAV errors logged, want 1", p, len(recs))
+			continue
+		}
+		if recs[0].Level != want {
+			t.Errorf("GET %s logged at %v, want %v", p, recs[0].Level, want)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/webdav"
+)
+
+// Metrics collects the server's Prometheus metrics. Set Server.Metrics to enable them
+// and serve Handler on a separate listener; other components can add their own
+// collectors to Registry.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	bytesIn      *prometheus.CounterVec
+	bytesOut     *prometheus.CounterVec
+	userIn       *prometheus.CounterVec
+	userOut      *prometheus.CounterVec
+	connections  prometheus.Gauge
+	authFailures prometheus.Counter
+}
+
+// NewMetrics creates the metrics, along with the Go runtime and process collectors.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "atlas_http_requests_total",
+			Help: "HTTP requests handled, by method and status code.",
+		}, []string{"method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "atlas_http_request_duration_seconds",
+			Help:    "Time to handle an HTTP request, including the transfer, by method and status code.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		}, []string{"method", "status"}),
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "atlas_http_request_bytes_total",
+			Help: "Request body bytes received, by method.",
+		}, []string{"method"}),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "atlas_http_response_bytes_total",
+			Help: "Response body bytes sent, by method.",
+		}, []string{"method"}),
+		userIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "atlas_user_received_bytes_total",
+			Help: "Request body bytes received from each user.",
+		}, []string{"user"}),
+		userOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "atlas_user_sent_bytes_total",
+			Help: "Response body bytes sent to each user.",
+		}, []string{"user"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "atlas_http_active_connections",
+			Help: "Open client connections.",
+		}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "atlas_auth_failures_total",
+			Help: "Requests rejected because of wrong or missing credentials or client certificates.",
+		}),
+	}
+	m.Registry.MustRegister(
+		m.requests, m.duration, m.bytesIn, m.bytesOut, m.userIn, m.userOut,
+		m.connections, m.authFailures,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+}
+
+// registerServer adds the metrics that read the server's state at scrape time.
+func (m *Metrics) registerServer(s *Server, locks *countingLS) {
+	m.Registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "atlas_webdav_locks",
+			Help: "Active WebDAV locks.",
+		}, func() float64 { return float64(locks.count(time.Now())) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "atlas_storage_used_bytes",
+			Help: "Bytes used in the data directory by all users together, as reported to clients against the quota.",
+		}, func() float64 {
+			used, _ := s.usedBytes(usedBytesMaxAge)
+			return float64(used)
+		}),
+		userUsageCollector{s: s, desc: prometheus.NewDesc(
+			"atlas_user_storage_used_bytes",
+			"Bytes of the files each user stored, as of the last listing of the share.",
+			[]string{"user"}, nil,
+		)},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "atlas_storage_quota_bytes",
+			Help: "Configured quota in bytes (0 when the filesystem size is reported instead).",
+		}, func() float64 { return float64(s.quota()) }),
+	)
+}
+
+// usedBytesMaxAge bounds how often scrapes and chunk uploads walk the data directory;
+// exact quota checks refresh the value in between.
+const usedBytesMaxAge = time.Minute
+
+// userUsageCollector exports the usage of each user who has files in the share.
+type userUsageCollector struct {
+	s    *Server
+	desc *prometheus.Desc
+}
+
+func (c userUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c userUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	usage, err := c.s.userUsage(context.Background(), usedBytesMaxAge)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for name, used := range usage {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(used), name)
+	}
+}
+
+// knownMethods bounds the method label; anything else is counted as OTHER.
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "PUT": true, "POST": true, "PATCH": true, "DELETE": true,
+	"OPTIONS": true, "PROPFIND": true, "PROPPATCH": true, "MKCOL": true, "COPY": true,
+	"MOVE": true, "LOCK": true, "UNLOCK": true,
+}
+
+// authFailedKey holds a *bool that authMiddleware sets when it turns a request away
+// for its credentials, be it with a 401 or with a 403 for a missing client certificate.
+type authFailedKey struct{}
+
+func markAuthFailed(r *http.Request) {
+	if p, ok := r.Context().Value(authFailedKey{}).(*bool); ok {
+		*p = true
+	}
+}
+
+// metricsMiddleware records every request. It sits outside authentication so rejected
+// requests are counted too, but only users authMiddleware let in get a label, so
+// requests with made-up user names can't add series.
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	m := s.Metrics
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		method := r.Method
+		if !knownMethods[method] {
+			method = "OTHER"
+		}
+		authFailed := new(bool)
+		r = r.WithContext(context.WithValue(r.Context(), authFailedKey{}, authFailed))
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		mw := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(mw, r)
+
+		if mw.status == 0 {
+			mw.status = http.StatusOK
+		}
+		status := strconv.Itoa(mw.status)
+		m.requests.WithLabelValues(method, status).Inc()
+		m.duration.WithLabelValues(method, status).Observe(time.Since(start).Seconds())
+		m.bytesIn.WithLabelValues(method).Add(float64(body.n))
+		m.bytesOut.WithLabelValues(method).Add(float64(mw.n))
+		if *authFailed {
+			m.authFailures.Inc()
+		} else if user := admittedUser(r); user != "" {
+			m.userIn.WithLabelValues(user).Add(float64(body.n))
+			m.userOut.WithLabelValues(user).Add(float64(mw.n))
+		}
+	})
+}
+
+// connState tracks open connections for the active connections gauge.
+func (m *Metrics) connState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		m.connections.Inc()
+	case http.StateClosed, http.StateHijacked:
+		m.connections.Dec()
+	}
+}
+
+// statusRecorder records the status code and the number of body bytes written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// countingLS wraps a webdav.LockSystem to keep track of the locks it holds, for the
+// metrics and the admin API. The memory lock system drops expired locks without
+// telling anyone, so expiry times are tracked here.
+type countingLS struct {
+	webdav.LockSystem
+
+	mu    sync.Mutex
+	locks map[string]*heldLock
+}
+
+// heldLock describes a lock for the admin API.
+type heldLock struct {
+	Token     string    `json:"token"`
+	Root      string    `json:"root"`
+	Owner     string    `json:"owner,omitempty"`
+	ZeroDepth bool      `json:"zero_depth"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires,omitzero"` // zero for locks that never expire
+}
+
+func newCountingLS(ls webdav.LockSystem) *countingLS {
+	return &countingLS{LockSystem: ls, locks: make(map[string]*heldLock)}
+}
+
+func lockExpiry(now time.Time, d time.Duration) time.Time {
+	if d < 0 {
+		return time.Time{}
+	}
+	return now.Add(d)
+}
+
+func (l *countingLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	token, err := l.LockSystem.Create(now, details)
+	if err == nil {
+		l.mu.Lock()
+		l.locks[token] = &heldLock{
+			Token:     token,
+			Root:      details.Root,
+			Owner:     details.OwnerXML,
+			ZeroDepth: details.ZeroDepth,
+			Created:   now,
+			Expires:   lockExpiry(now, details.Duration),
+		}
+		l.mu.Unlock()
+	}
+	return token, err
+}
+
+func (l *countingLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := l.LockSystem.Refresh(now, token, duration)
+	if err == nil {
+		l.mu.Lock()
+		if h := l.locks[token]; h != nil {
+			h.Expires = lockExpiry(now, details.Duration)
+		}
+		l.mu.Unlock()
+	}
+	return details, err
+}
+
+func (l *countingLS) Unlock(now time.Time, token string) error {
+	err := l.LockSystem.Unlock(now, token)
+	l.mu.Lock()
+	delete(l.locks, token)
+	l.mu.Unlock()
+	return err
+}
+
+// count returns the number of locks held at now, forgetting expired ones.
+func (l *countingLS) count(now time.Time) int {
+	return len(l.list(now))
+}
+
+// list returns the locks held at now, oldest first, forgetting expired ones.
+func (l *countingLS) list(now time.Time) []heldLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]heldLock, 0, len(l.locks))
+	for token, h := range l.locks {
+		if !h.Expires.IsZero() && now.After(h.Expires) {
+			delete(l.locks, token)
+			continue
+		}
+		out = append(out, *h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// ServeMetrics serves m on addr until ctx is cancelled.
+func ServeMetrics(ctx context.Context, addr string, m *Metrics) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withMetrics makes s record metrics, serving it from a new test server.
+func withMetrics(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	s.Metrics = NewMetrics()
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+	s.Metrics.registerServer(s, s.locks)
+	return ts
+}
+
+// scrape returns the metrics served at url.
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scrape: %s %s", resp.Status, data)
+	}
+	return string(data)
+}
+
+// sample returns the value of the series name, labels included as exposed, or "" if
+// metrics has none.
+func sample(metrics, name string) string {
+	for line := range strings.SplitSeq(metrics, "\n") {
+		if v, ok := strings.CutPrefix(line, name+" "); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+func TestMetrics(t *testing.T) {
+	s, plain := newTestServer(t, 0)
+	plain.Close()
+	ts := withMetrics(t, s)
+
+	for _, req := range []struct{ username, target, body string }{
+		{"bob", "/a.txt", "hello"},
+		{"alice", "/b.txt", "hi there"},
+	} {
+		if resp, _ := request(t, ts, req.username, http.MethodPut, req.target, strings.NewReader(req.body), nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("PUT %s: %s", req.target, resp.Status)
+		}
+	}
+	if resp, _ := request(t, ts, "bob", http.MethodGet, "/a.txt", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET: %s", resp.Status)
+	}
+	loc := createUpload(t, ts, "bob", "c.txt", 3)
+	if resp := patchUpload(t, ts, loc, 0, "abc"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PATCH: %s", resp.Status)
+	}
+	// Turned away: no credentials, and a wrong password.
+	if resp, _ := request(t, ts, "", "PROPFIND", "/", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("PROPFIND without credentials: %s", resp.Status)
+	}
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/a.txt", nil)
+	req.SetBasicAuth("bob", "wrong")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	// A user who isn't an admin is refused the admin API, but that is no auth failure.
+	if resp, _ := request(t, ts, "bob", http.MethodGet, adminPrefix+"users", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("admin API as bob: %s", resp.Status)
+	}
+
+	// Scraped on its own listener, as atlas server --metrics-addr does.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- ServeMetrics(ctx, addr, s.Metrics) }()
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatalf("metrics listener not up: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	metrics := scrape(t, "http://"+addr+"/metrics")
+
+	for name, want := range map[string]string{
+		`atlas_http_requests_total{method="PUT",status="201"}`:                            "2",
+		`atlas_http_requests_total{method="GET",status="200"}`:                            "1",
+		`atlas_http_requests_total{method="PROPFIND",status="401"}`:                       "1",
+		`atlas_http_requests_total{method="GET",status="401"}`:                            "1",
+		`atlas_http_requests_total{method="GET",status="403"}`:                            "1",
+		`atlas_http_request_duration_seconds_count{method="PUT",status="201"}`:            "2",
+		`atlas_http_request_duration_seconds_bucket{method="PUT",status="201",le="+Inf"}`: "2",
+		`atlas_http_request_bytes_total{method="PUT"}`:                                    "13",
+		`atlas_http_request_bytes_total{method="PATCH"}`:                                  "3",
+		`atlas_user_received_bytes_total{user="alice"}`:                                   "8",
+		`atlas_user_received_bytes_total{user="bob"}`:                                     "8",
+		`atlas_auth_failures_total`:                                                       "2",
+		`atlas_user_storage_used_bytes{user="alice"}`:                                     "8",
+		`atlas_user_storage_used_bytes{user="bob"}`:                                       "8",
+		`atlas_storage_quota_bytes`:                                                       "0",
+	} {
+		if got := sample(metrics, name); got != want || got == "" {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	// Made-up user names get no series.
+	if strings.Contains(metrics, `user="wrong"`) || strings.Contains(metrics, `user=""`) {
+		t.Error("a series for a user who wasn't let in")
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("ServeMetrics: %v", err)
+	}
+}
+
+// A request turned away for lacking a required client certificate is an auth failure.
+func TestMetricsClientCertFailures(t *testing.T) {
+	ca := newTestCA(t)
+	s, plain := newTestServer(t, 0)
+	plain.Close()
+	s.ClientCerts = &ClientCertAuth{CAs: ca.pool(), Required: true}
+	s.Metrics = NewMetrics()
+	ts := httptest.NewUnstartedServer(s.handler())
+	ts.TLS = s.tlsConfig()
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	if resp := certRequest(t, ts, nil, "bob", "PROPFIND", "/"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("password without a certificate: %s, want 403", resp.Status)
+	}
+	bob := ca.issue(t, "bob")
+	if resp := certRequest(t, ts, &bob, "", http.MethodGet, adminPrefix+"users"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bob's certificate on the admin API: %s, want 403", resp.Status)
+	}
+
+	m := httptest.NewServer(s.Metrics.Handler())
+	defer m.Close()
+	metrics := scrape(t, m.URL)
+	if got := sample(metrics, "atlas_auth_failures_total"); got != "1" {
+		t.Errorf("atlas_auth_failures_total = %q, want 1", got)
+	}
+}
@@ -0,0 +1,519 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"golang.org/x/net/webdav"
+)
+
+// Nextcloud/ownCloud clients find the files of user <u> at /remote.php/dav/files/<u>/
+// (or the legacy /remote.php/webdav/), which both map onto the share. They upload large
+// files with chunking v2: MKCOL /remote.php/dav/uploads/<u>/<id>, a PUT per chunk, then a
+// MOVE of <id>/.file to the destination, which assembles the chunks in name order.
+const (
+	ncFilesPrefix   = "/remote.php/dav/files/"
+	ncUploadsPrefix = "/remote.php/dav/uploads/"
+	ncLegacyPrefix  = "/remote.php/webdav"
+
+	// The Nextcloud release we answer as; clients refuse servers that are too old.
+	ncVersion       = "28.0.4.1"
+	ncVersionString = "28.0.4"
+	// ncInstanceID is appended to file IDs to form oc:id, as Nextcloud does.
+	ncInstanceID = "ocatlas00000"
+)
+
+// ncRequest marks a request made through the Nextcloud routes. It carries the URL prefix
+// the webdav handler strips and memoises directory summaries for the response.
+type ncRequest struct {
+	prefix string
+	driver storage.Driver
+
+	mu    sync.Mutex
+	trees map[string]treeStats
+}
+
+type ncContextKey struct{}
+
+func ncFromContext(ctx context.Context) *ncRequest {
+	nc, _ := ctx.Value(ncContextKey{}).(*ncRequest)
+	return nc
+}
+
+// treePath returns the path of the request within the share, whichever route it took.
+func treePath(r *http.Request) string {
+	p := r.URL.Path
+	if nc := ncFromContext(r.Context()); nc != nil {
+		p = strings.TrimPrefix(p, nc.prefix)
+	}
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+// statusMiddleware answers status.php, which clients query before authenticating.
+func (s *Server) statusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status.php" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]any{
+			"installed":       true,
+			"maintenance":     false,
+			"needsDbUpgrade":  false,
+			"version":         ncVersion,
+			"versionstring":   ncVersionString,
+			"edition":         "",
+			"productname":     "Atlas Storage",
+			"extendedSupport": false,
+		})
+	})
+}
+
+// nextcloudMiddleware serves the OCS endpoints and chunked uploads, and hands requests
+// for /remote.php/dav/files/<user>/ and /remote.php/webdav/ to the WebDAV chain with
+// the prefix recorded in the context.
+func (s *Server) nextcloudMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		user := requestUser(r)
+		switch {
+		case strings.HasPrefix(p, "/ocs/v1.php/cloud/") || strings.HasPrefix(p, "/ocs/v2.php/cloud/"):
+			s.serveOCS(w, r, user)
+			return
+		case p == ncLegacyPrefix || strings.HasPrefix(p, ncLegacyPrefix+"/"):
+			next.ServeHTTP(w, s.withNextcloud(r, ncLegacyPrefix))
+			return
+		case strings.HasPrefix(p, ncFilesPrefix):
+			owner, _, _ := strings.Cut(strings.TrimPrefix(p, ncFilesPrefix), "/")
+			if owner != user {
+				http.NotFound(w, r)
+				return
+			}
+			next.ServeHTTP(w, s.withNextcloud(r, ncFilesPrefix+user))
+			return
+		case strings.HasPrefix(p, ncUploadsPrefix):
+			owner, _, _ := strings.Cut(strings.TrimPrefix(p, ncUploadsPrefix), "/")
+			if owner != user {
+				http.NotFound(w, r)
+				return
+			}
+			s.serveChunkUpload(w, r, user)
+			return
+		case strings.HasPrefix(p, "/remote.php/"):
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) withNextcloud(r *http.Request, prefix string) *http.Request {
+	nc := &ncRequest{prefix: prefix, driver: s.Driver, trees: make(map[string]treeStats)}
+	return r.WithContext(context.WithValue(r.Context(), ncContextKey{}, nc))
+}
+
+// serveOCS answers the OCS calls clients make after logging in: the server
+// capabilities and the user's own details.
+func (s *Server) serveOCS(w http.ResponseWriter, r *http.Request, user string) {
+	v2 := strings.HasPrefix(r.URL.Path, "/ocs/v2.php/")
+	var data map[string]any
+	switch path.Base(r.URL.Path) {
+	case "capabilities":
+		data = map[string]any{
+			"version": map[string]any{
+				"major": 28, "minor": 0, "micro": 4,
+				"string": ncVersionString, "edition": "", "extendedSupport": false,
+			},
+			"capabilities": map[string]any{
+				"core": map[string]any{"pollinterval": 60, "webdav-root": "remote.php/webdav"},
+				"dav":  map[string]any{"chunking": "1.0"},
+				"files": map[string]any{
+					"bigfilechunking": true,
+					"undelete":        false,
+					"versioning":      false,
+				},
+				"checksums": map[string]any{
+					"supportedTypes":      []string{"SHA256"},
+					"preferredUploadType": "SHA256",
+				},
+			},
+		}
+	case "user":
+		data = map[string]any{"id": user, "display-name": user, "enabled": true}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	status := 100
+	if v2 {
+		status = 200
+	}
+	meta := map[string]any{"status": "ok", "statuscode": status, "message": "OK"}
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]any{"ocs": map[string]any{"meta": meta, "data": data}})
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header + "<ocs>")
+	writeOCSXML(&buf, "meta", meta)
+	writeOCSXML(&buf, "data", data)
+	buf.WriteString("</ocs>\n")
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// writeOCSXML renders a value the way OCS does: maps as nested elements with sorted
+// keys, lists as repeated <element>s.
+func writeOCSXML(buf *bytes.Buffer, name string, v any) {
+	buf.WriteString("<" + name + ">")
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeOCSXML(buf, k, v[k])
+		}
+	case []string:
+		for _, e := range v {
+			writeOCSXML(buf, "element", e)
+		}
+	case bool:
+		if v {
+			buf.WriteString("1")
+		}
+	default:
+		xml.EscapeText(buf, []byte(fmt.Sprint(v)))
+	}
+	buf.WriteString("</" + name + ">")
+}
+
+// OwnCloud properties reported in PROPFIND on the Nextcloud routes.
+var (
+	propOCFileID      = xml.Name{Space: "http://owncloud.org/ns", Local: "fileid"}
+	propOCID          = xml.Name{Space: "http://owncloud.org/ns", Local: "id"}
+	propOCSize        = xml.Name{Space: "http://owncloud.org/ns", Local: "size"}
+	propOCPermissions = xml.Name{Space: "http://owncloud.org/ns", Local: "permissions"}
+	propGetETag       = xml.Name{Space: "DAV:", Local: "getetag"}
+)
+
+// fileID derives a stable numeric ID from the key. Drivers have no inode-like IDs, so
+// a renamed file gets a new one, which clients handle like a delete and a create.
+func fileID(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	// 53 bits, so JavaScript clients don't lose precision.
+	return binary.BigEndian.Uint64(sum[:8]) >> 11
+}
+
+// ocProps returns the oc: properties of an object for Nextcloud requests, nil otherwise.
+// Directories also get a getetag, which the webdav package only reports for files.
+func ocProps(ctx context.Context, info storage.ObjectInfo) map[xml.Name]webdav.Property {
+	nc := ncFromContext(ctx)
+	if nc == nil {
+		return nil
+	}
+	prop := func(name xml.Name, value string) webdav.Property {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(value))
+		return webdav.Property{XMLName: name, InnerXML: buf.Bytes()}
+	}
+	id := fileID(info.Key)
+	props := map[xml.Name]webdav.Property{
+		propOCFileID: prop(propOCFileID, strconv.FormatUint(id, 10)),
+		propOCID:     prop(propOCID, fmt.Sprintf("%08d%s", id, ncInstanceID)),
+	}
+
+	// G: readable, D: deletable, N: renamable, V: movable, W: writable,
+	// C/K: can create files/folders inside.
+	perms, size := "GDNVW", info.Size
+	if info.IsDir() {
+		perms = "GDNVCK"
+		if info.Key == "" {
+			perms = "GCK"
+		}
+		if t, err := nc.tree(ctx, info.Key); err == nil {
+			size = t.size
+			props[propGetETag] = prop(propGetETag, `"`+t.etag+`"`)
+		}
+	}
+	props[propOCSize] = prop(propOCSize, strconv.FormatInt(size, 10))
+	props[propOCPermissions] = prop(propOCPermissions, perms)
+	return props
+}
+
+// treeStats summarises everything below a directory.
+type treeStats struct {
+	size int64
+	etag string
+}
+
+// tree summarises the directory at key. Sync clients compare directory ETags to find
+// changes, so unlike plain WebDAV the ETag of a directory has to change when anything
+// below it does; it hashes the key, size and time of every entry. The first directory
+// asked about in a request (the one a PROPFIND is for) is walked once, and the summaries
+// of all directories below it are gathered on the way, so its children come for free.
+func (nc *ncRequest) tree(ctx context.Context, key string) (treeStats, error) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if t, ok := nc.trees[key]; ok {
+		return t, nil
+	}
+	prefix := ""
+	if key != "" {
+		prefix = key + "/"
+	}
+	type acc struct {
+		size int64
+		h    hash.Hash64
+	}
+	accs := map[string]*acc{key: {h: fnv.New64a()}}
+	get := func(dir string) *acc {
+		a := accs[dir]
+		if a == nil {
+			a = &acc{h: fnv.New64a()}
+			accs[dir] = a
+		}
+		return a
+	}
+	opts := storage.ListOptions{Recursive: true}
+	for {
+		res, err := nc.driver.List(ctx, prefix, opts)
+		if err != nil {
+			return treeStats{}, err
+		}
+		for _, e := range res.Entries {
+			if e.IsDir() {
+				get(e.Key)
+			}
+			line := fmt.Sprintf("%s\x00%d\x00%d\x00%s\n", e.Key, e.Size, e.ModTime.UnixNano(), e.Checksum)
+			// Each directory from e's parent up to key.
+			for dir := e.Key; dir != key; {
+				if dir = path.Dir(dir); dir == "." {
+					dir = ""
+				}
+				a := get(dir)
+				if !e.IsDir() {
+					a.size += e.Size
+				}
+				io.WriteString(a.h, line)
+			}
+		}
+		if res.NextContinuationToken == "" {
+			break
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+	for dir, a := range accs {
+		nc.trees[dir] = treeStats{size: a.size, etag: fmt.Sprintf("%016x", a.h.Sum64())}
+	}
+	return nc.trees[key], nil
+}
+
+// ncStaging is where chunked uploads are staged in Server.Staging.
+const ncStaging = "chunks"
+
+// chunkKey is where the chunked uploads of user are staged. The name is hashed so any
+// user name makes a single, harmless key segment.
+func chunkKey(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return ncStaging + "/" + hex.EncodeToString(sum[:16])
+}
+
+// serveChunkUpload implements the uploads collection. Chunks are objects in the
+// staging driver, served by WebDAV like the share so clients can also list what already
+// arrived and resume; only the final MOVE of .file needs handling of its own.
+func (s *Server) serveChunkUpload(w http.ResponseWriter, r *http.Request, user string) {
+	base := chunkKey(user)
+	if err := mkdirStaged(r.Context(), s.Staging, base); err != nil {
+		slog.ErrorContext(r.Context(), "Chunked upload failed", "user", user, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	prefix := ncUploadsPrefix + user
+	if r.Method == "MOVE" && path.Base(r.URL.Path) == ".file" {
+		s.assembleChunks(w, r, user, path.Dir(strings.TrimPrefix(r.URL.Path, prefix+"/")))
+		return
+	}
+	if r.Method == http.MethodPut {
+		// A recent size of the share will do for each chunk; the MOVE checks exactly.
+		if err := s.checkSpace(max(r.ContentLength, 0), usedBytesMaxAge); err != nil {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+	}
+	fsys := &driverFS{driver: &subDriver{d: s.Staging, root: base}}
+	h := &webdav.Handler{Prefix: prefix, FileSystem: fsys, LockSystem: s.chunkLocks}
+	h.ServeHTTP(w, trackUpload(r))
+}
+
+// assembleChunks concatenates the chunks of upload id in name order (chunk numbers or
+// byte offsets, compared numerically) and stores the result at the Destination.
+func (s *Server) assembleChunks(w http.ResponseWriter, r *http.Request, user, id string) {
+	if id == "." || id == ".." || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	dir := chunkKey(user) + "/" + id
+	if info, err := s.Staging.Stat(r.Context(), dir); err != nil || !info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	entries, err := listAll(r.Context(), s.Staging, dir+"/", false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Chunked upload failed", "upload", id, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	filesPrefix := ncFilesPrefix + user + "/"
+	if err != nil || !strings.HasPrefix(dest.Path, filesPrefix) {
+		http.Error(w, "Destination must be below "+filesPrefix, http.StatusBadRequest)
+		return
+	}
+	key := toKey(strings.TrimPrefix(dest.Path, filesPrefix))
+	if key == "" {
+		http.Error(w, "Invalid destination", http.StatusBadRequest)
+		return
+	}
+	if parent := path.Dir(key); parent != "." {
+		if info, err := s.Driver.Stat(r.Context(), parent); err != nil || !info.IsDir() {
+			http.Error(w, "Parent directory does not exist", http.StatusConflict)
+			return
+		}
+	}
+	existing, err := s.Driver.Stat(r.Context(), key)
+	existed := err == nil
+	if existed && existing.IsDir() {
+		http.Error(w, "A directory exists at the destination", http.StatusConflict)
+		return
+	}
+	if existed && r.Header.Get("Overwrite") == "F" {
+		http.Error(w, "Destination exists", http.StatusPreconditionFailed)
+		return
+	}
+
+	var chunks []string
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		chunks = append(chunks, e.Key)
+		total += e.Size
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunkLess(path.Base(chunks[i]), path.Base(chunks[j])) })
+	if want := r.Header.Get("OC-Total-Length"); want != "" && want != strconv.FormatInt(total, 10) {
+		http.Error(w, fmt.Sprintf("Chunks add up to %d bytes, expected %s", total, want), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkSpace(0, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	data := newConcatReader(r.Context(), s.Staging, chunks)
+	defer data.Close()
+	opts := storage.PutOptions{
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		Metadata:    ownerMeta(r.Context()),
+	}
+	if err := s.Driver.Put(r.Context(), key, data, opts); err != nil {
+		slog.ErrorContext(r.Context(), "Chunked upload failed", "upload", id, "path", key, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	removeStaged(context.WithoutCancel(r.Context()), s.Staging, dir)
+	slog.InfoContext(r.Context(), "Chunked upload complete", "upload", id, "path", key, "size", total, "chunks", len(chunks))
+
+	if info, err := s.Driver.Stat(r.Context(), key); err == nil {
+		etag, err := fileInfo{info}.ETag(r.Context())
+		if err != nil {
+			etag = fmt.Sprintf(`"%x%x"`, info.ModTime.UnixNano(), info.Size)
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("OC-ETag", etag)
+		w.Header().Set("OC-FileId", fmt.Sprintf("%08d%s", fileID(key), ncInstanceID))
+	}
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// chunkLess orders chunk names numerically when both are numbers.
+func chunkLess(a, b string) bool {
+	x, errA := strconv.ParseUint(a, 10, 64)
+	y, errB := strconv.ParseUint(b, 10, 64)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	return a < b
+}
+
+// expireChunkUploads removes chunked uploads nothing was added to for UploadExpiry.
+func (s *Server) expireChunkUploads() {
+	ctx := context.Background()
+	users, err := listAll(ctx, s.Staging, ncStaging+"/", false)
+	if err != nil {
+		return
+	}
+	for _, u := range users {
+		uploads, err := listAll(ctx, s.Staging, u.Key+"/", false)
+		if err != nil {
+			continue
+		}
+		for _, up := range uploads {
+			if !up.IsDir() || time.Since(s.lastChunk(ctx, up)) < s.UploadExpiry {
+				continue
+			}
+			if err := removeStaged(ctx, s.Staging, up.Key); err != nil {
+				slog.Error("Chunked upload cleanup failed", "upload", path.Base(up.Key), "err", err)
+				continue
+			}
+			slog.Info("Chunked upload expired", "upload", path.Base(up.Key))
+		}
+	}
+}
+
+// lastChunk returns when something was last added to the upload dir.
+func (s *Server) lastChunk(ctx context.Context, dir storage.ObjectInfo) time.Time {
+	last := dir.ModTime
+	entries, _ := listAll(ctx, s.Staging, dir.Key+"/", false)
+	for _, e := range entries {
+		if e.ModTime.After(last) {
+			last = e.ModTime
+		}
+	}
+	return last
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putChunks starts chunked upload id of username and uploads chunks, named by the keys.
+func putChunks(t *testing.T, ts *httptest.Server, username, id string, chunks map[string]string) {
+	t.Helper()
+	dir := ncUploadsPrefix + username + "/" + id
+	if resp, body := request(t, ts, username, "MKCOL", dir, nil, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MKCOL: %s %s", resp.Status, body)
+	}
+	for name, data := range chunks {
+		if resp, body := request(t, ts, username, http.MethodPut, dir+"/"+name, strings.NewReader(data), nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("PUT %s: %s %s", name, resp.Status, body)
+		}
+	}
+}
+
+// moveChunks assembles chunked upload id of username at name in their files.
+func moveChunks(t *testing.T, ts *httptest.Server, username, id, name string, header http.Header) *http.Response {
+	t.Helper()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Destination", ts.URL+ncFilesPrefix+username+"/"+name)
+	resp, _ := request(t, ts, username, "MOVE", ncUploadsPrefix+username+"/"+id+"/.file", nil, header)
+	return resp
+}
+
+func TestChunkedUpload(t *testing.T) {
+	s, ts := newTestServer(t, 0)
+	// Chunks are put together in numeric order, 10 after 2.
+	putChunks(t, ts, "bob", "up1", map[string]string{"1": "hello ", "2": "big ", "10": "world"})
+
+	resp := moveChunks(t, ts, "bob", "up1", "a.txt", http.Header{"Oc-Total-Length": {"15"}})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("MOVE: %s", resp.Status)
+	}
+	get, body := request(t, ts, "bob", http.MethodGet, ncFilesPrefix+"bob/a.txt", nil, nil)
+	if get.StatusCode != http.StatusOK || body != "hello big world" {
+		t.Fatalf("GET: %s %q", get.Status, body)
+	}
+	if resp.Header.Get("ETag") != get.Header.Get("ETag") {
+		t.Errorf("MOVE ETag %q, GET ETag %q", resp.Header.Get("ETag"), get.Header.Get("ETag"))
+	}
+	if _, err := s.Staging.Stat(context.Background(), chunkKey("bob")+"/up1"); err == nil {
+		t.Error("the chunks are still staged")
+	}
+
+	// A second upload replaces the file.
+	putChunks(t, ts, "bob", "up2", map[string]string{"0": "bye"})
+	if resp := moveChunks(t, ts, "bob", "up2", "a.txt", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("MOVE over a file: %s", resp.Status)
+	}
+	if _, body := request(t, ts, "bob", http.MethodGet, "/a.txt", nil, nil); body != "bye" {
+		t.Errorf("GET = %q, want bye", body)
+	}
+}
+
+func TestChunkedUploadTotalLength(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+	putChunks(t, ts, "bob", "up", map[string]string{"1": "abc"})
+	if resp := moveChunks(t, ts, "bob", "up", "a.txt", http.Header{"Oc-Total-Length": {"4"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("MOVE with a wrong OC-Total-Length: %s, want 400", resp.Status)
+	}
+	if resp, _ := request(t, ts, "bob", http.MethodGet, "/a.txt", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after a refused MOVE: %s, want 404", resp.Status)
+	}
+}
+
+func TestChunkedUploadOtherUser(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+	putChunks(t, ts, "bob", "up", map[string]string{"1": "abc"})
+	resp, _ := request(t, ts, "alice", http.MethodPut, ncUploadsPrefix+"bob/up/2", strings.NewReader("x"), nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("PUT into another user's upload: %s, want 404", resp.Status)
+	}
+	// alice's own uploads don't see bob's.
+	header := http.Header{"Destination": {ts.URL + ncFilesPrefix + "alice/a.txt"}}
+	if resp, _ := request(t, ts, "alice", "MOVE", ncUploadsPrefix+"alice/up/.file", nil, header); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("MOVE of another user's upload: %s, want 404", resp.Status)
+	}
+}
+
+func TestChunkedUploadQuota(t *testing.T) {
+	_, ts := newTestServer(t, 100)
+	dir := ncUploadsPrefix + "bob/up"
+	request(t, ts, "bob", "MKCOL", dir, nil, nil)
+	if resp, _ := request(t, ts, "bob", http.MethodPut, dir+"/1", strings.NewReader(strings.Repeat("x", 101)), nil); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("PUT of a chunk over the quota: %s, want 507", resp.Status)
+	}
+
+	// Chunks are checked against the share size as last measured, so both are taken;
+	// the MOVE counts exactly and refuses the file.
+	for _, name := range []string{"1", "2"} {
+		if resp, _ := request(t, ts, "bob", http.MethodPut, dir+"/"+name, strings.NewReader(strings.Repeat("x", 60)), nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("PUT %s: %s", name, resp.Status)
+		}
+	}
+	if resp := moveChunks(t, ts, "bob", "up", "a.txt", nil); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("MOVE over the quota: %s, want 507", resp.Status)
+	}
+}
+
+func TestChunkedUploadExpire(t *testing.T) {
+	s, ts := newTestServer(t, 0)
+	putChunks(t, ts, "bob", "up", map[string]string{"1": "abc"})
+
+	s.UploadExpiry = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	s.expireChunkUploads()
+	if _, err := s.Staging.Stat(context.Background(), chunkKey("bob")+"/up"); err == nil {
+		t.Error("the expired upload is still staged")
+	}
+}
@@ -1,251 +1,546 @@
-package server
-
-import (
-	"bytes"
-	"context"
-	"fmt"
-	"log"
-	"mime"
-	"net/http"
-	"os"
-	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
-
-	"github.com/IYouKnow/atlas-drive/pkg/user"
-	"golang.org/x/net/webdav"
-)
-
-// Server represents the Atlas storage server.
-type Server struct {
-	Addr       string
-	DataDir    string
-	UserStore  *user.Store
-	QuotaBytes uint64 // If > 0, WebDAV reports this as total quota (used = size of DataDir; available = quota - used).
-	HTTPServer *http.Server
-}
-
-// New creates a new Server instance. quotaBytes is the advertised storage quota in bytes;
-// 0 means report the underlying filesystem's free/used space (previous behaviour).
-func New(addr, dataDir string, store *user.Store, quotaBytes uint64) *Server {
-	return &Server{
-		Addr:       addr,
-		DataDir:    dataDir,
-		UserStore:  store,
-		QuotaBytes: quotaBytes,
-	}
-}
-
-// Start starts the HTTP server.
-func (s *Server) Start() error {
-	// Ensure data directory exists
-	if err := os.MkdirAll(s.DataDir, 0755); err != nil {
-		return err
-	}
-
-	webdavHandler := &webdav.Handler{
-		Prefix:     "/",
-		FileSystem: webdav.Dir(s.DataDir),
-		LockSystem: webdav.NewMemLS(),
-		Logger: func(r *http.Request, err error) {
-			if err != nil {
-				// 1. Log Noise Suppression
-				// Suppress 404 errors for common Windows system files
-				if os.IsNotExist(err) {
-					base := strings.ToLower(filepath.Base(r.URL.Path))
-					switch base {
-					case "desktop.ini", "autorun.inf", "thumbs.db", "folder.jpg":
-						return
-					}
-				}
-				log.Printf("WebDAV Error: %s %s: %v", r.Method, r.URL.Path, err)
-			}
-		},
-	}
-
-	// Chain middlewares: Auth -> MimeFix -> Quota -> WebDAV
-	handler := s.authMiddleware(s.mimeMiddleware(s.quotaMiddleware(webdavHandler)))
-
-	s.HTTPServer = &http.Server{
-		Addr:    s.Addr,
-		Handler: handler,
-	}
-
-	log.Printf("Atlas Server starting on %s serving %s", s.Addr, s.DataDir)
-	if err := s.HTTPServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return err
-	}
-	return nil
-}
-
-// Shutdown gracefully shuts down the server.
-func (s *Server) Shutdown(ctx context.Context) error {
-	return s.HTTPServer.Shutdown(ctx)
-}
-
-// authMiddleware enforces Basic Auth using the UserStore.
-func (s *Server) authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		username, password, ok := r.BasicAuth()
-		if !ok {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Atlas Storage"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		if !s.UserStore.Authenticate(username, password) {
-			log.Printf("Auth failed for user: %s", username)
-			w.Header().Set("WWW-Authenticate", `Basic realm="Atlas Storage"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-// mimeMiddleware ensures Content-Type is set correctly for Windows compatibility.
-func (s *Server) mimeMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Windows WebDAV client often relies on the server providing the correct Content-Type.
-		ext := filepath.Ext(r.URL.Path)
-		if t := mime.TypeByExtension(ext); t != "" {
-			w.Header().Set("Content-Type", t)
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-// responseBuffer captures the response to allow modification.
-type responseBuffer struct {
-	http.ResponseWriter
-	body *bytes.Buffer
-	code int
-}
-
-func (w *responseBuffer) WriteHeader(code int) {
-	w.code = code
-}
-
-func (w *responseBuffer) Write(b []byte) (int, error) {
-	return w.body.Write(b)
-}
-
-// quotaMiddleware implements RFC 4331 by injecting quota properties into PROPFIND responses.
-func (s *Server) quotaMiddleware(next http.Handler) http.Handler {
-	// Pre-compile regex to find the closing prop tag (handling namespaces like D:prop or d:prop or just prop)
-	// We want to insert BEFORE this tag.
-	// Common patterns: </D:prop>, </d:prop>, </prop>
-	propEndRegex := regexp.MustCompile(`(</[a-zA-Z0-9_:]*prop>)`)
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// 2. Disk Space Reporting
-		// We only care about PROPFIND on the root.
-		if r.Method == "PROPFIND" && r.URL.Path == "/" {
-			rb := &responseBuffer{
-				ResponseWriter: w,
-				body:           new(bytes.Buffer),
-				code:           http.StatusOK, // Default to 200 if not set
-			}
-
-			// Pass the buffer to the real handler
-			next.ServeHTTP(rb, r)
-
-			// If the operation wasn't successful MultiStatus, just pass it through
-			if rb.code != http.StatusMultiStatus {
-				w.WriteHeader(rb.code)
-				w.Write(rb.body.Bytes())
-				return
-			}
-
-			// It is MultiStatus. Let's process the XML.
-			bodyBytes := rb.body.Bytes()
-			bodyStr := string(bodyBytes)
-
-			// Determine which namespace prefix is used for quota properties.
-			// Usually "D" or "d". The standard lib uses "D".
-			// We can try to infer or just default to "D".
-			// Let's use "D" but ensure xmlns:D="DAV:" is present.
-			// Actually, we are injecting inside < prop > ... < /prop >
-			// The surrounding tags define the namespace context.
-			// To be safe, we will use <D:quota-...> and trust that <D:multistatus xmlns:D="DAV:"> is at the top.
-			// Most clients (including Windows) are fine if we use the same prefix as the root element.
-
-			// Calculate disk usage: either quota-based (share size) or filesystem-based
-			var free, used uint64
-			var err error
-			if s.QuotaBytes > 0 {
-				used, err = getDirUsedBytes(s.DataDir)
-				if err == nil {
-					if used > s.QuotaBytes {
-						used = s.QuotaBytes
-					}
-					if s.QuotaBytes >= used {
-						free = s.QuotaBytes - used
-					}
-				}
-			} else {
-				absPath, _ := filepath.Abs(s.DataDir)
-				if absPath == "" {
-					absPath = s.DataDir
-				}
-				free, used, err = getDiskUsage(absPath)
-			}
-
-			if err == nil {
-				// Detect usage of namespace prefix for DAV: directly from the XML
-				// Standard lib usually uses "D" or "d".
-				prefix := "D"
-				nsRegex := regexp.MustCompile(`xmlns:([a-zA-Z0-9_]+)="DAV:"`)
-				if match := nsRegex.FindStringSubmatch(bodyStr); len(match) > 1 {
-					prefix = match[1]
-				}
-
-				// Construct insertion string using the MATCHED prefix
-				quotaXML := fmt.Sprintf(
-					"<%s:quota-available-bytes>%d</%s:quota-available-bytes><%s:quota-used-bytes>%d</%s:quota-used-bytes>",
-					prefix, free, prefix, prefix, used, prefix,
-				)
-
-				// Find insertion point: the first closing </...prop> tag.
-				loc := propEndRegex.FindStringIndex(bodyStr)
-				if loc != nil {
-					// Insert before the tag
-					start := loc[0]
-					newBody := bodyStr[:start] + quotaXML + bodyStr[start:]
-					bodyBytes = []byte(newBody)
-				}
-			} else {
-				log.Printf("WebDAV Warning: failed to get disk usage: %v", err)
-			}
-
-			// Write the modified response
-			// IMPORTANT: Update Content-Length to match new size
-			w.Header().Set("Content-Length", strconv.Itoa(len(bodyBytes)))
-			// Ensure Content-Type is set (webdav lib usually sets it, but good to ensure)
-			if w.Header().Get("Content-Type") == "" {
-				w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-			}
-
-			// We do NOT need to set "DAV" or "Allow" headers manually because next.ServeHTTP (the library)
-			// ALREADY set them on the underlying ResponseWriter (w) before writing to rb,
-			// OR it set them on rb (headers map is shared if rb.ResponseWriter is w).
-			// responseBuffer embeds http.ResponseWriter, so rb.Header() IS w.Header().
-			// So headers are fine.
-
-			w.WriteHeader(rb.code)
-			w.Write(bodyBytes)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+	"golang.org/x/net/webdav"
+)
+
+// Server represents the Atlas storage server.
+type Server struct {
+	Addr      string
+	DataDir   string
+	UserStore user.Store
+	// Auth checks logins. If nil, the passwords in UserStore are checked.
+	Auth user.Authenticator
+	// TokenAuth, if set, also lets in requests with an "Authorization: Bearer" token.
+	TokenAuth user.TokenAuthenticator
+	// TLSCertFile and TLSKeyFile, if set, make the server speak HTTPS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ClientCerts, if set, lets clients authenticate with a TLS certificate. It needs
+	// HTTPS.
+	ClientCerts *ClientCertAuth
+	QuotaBytes  uint64         // If > 0, WebDAV reports this as total quota (used = size of DataDir; available = quota - used).
+	Driver      storage.Driver // Backend serving the share. Defaults to a DiskDriver rooted at DataDir.
+	// Staging holds resumable and chunked uploads until they are complete, so it must
+	// protect them like Driver does (encrypt them, for one). Defaults to a DiskDriver
+	// rooted at DataDir/.atlas/staging.
+	Staging    storage.Driver
+	HTTPServer *http.Server
+
+	// UploadExpiry is how long an unfinished resumable upload is kept after its last chunk.
+	UploadExpiry time.Duration
+	// Metrics, if set, records request metrics; serve them with ServeMetrics.
+	Metrics *Metrics
+	// AccessLog, if set, logs every request.
+	AccessLog *AccessLogger
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For/X-Real-IP headers
+	// are believed when logging client addresses.
+	TrustedProxies []netip.Prefix
+	// QuietNotFound are file name patterns (path.Match, case-insensitive) whose "not
+	// found" errors are only logged at debug level. New sets DefaultQuietNotFound.
+	QuietNotFound []string
+
+	tus        *tusHandler
+	chunkLocks webdav.LockSystem
+	locks      *countingLS
+	sessions   *sessionTracker
+	started    time.Time
+	stop       chan struct{}
+
+	quotaMu       sync.RWMutex
+	quotaOverride *uint64 // set through the admin API
+
+	usedMu sync.Mutex // guards the last size of DataDir, see usedBytes
+	used   uint64
+	usedAt time.Time
+
+	userUsedMu sync.Mutex // guards the last usage per user, see userUsage
+	userUsed   map[string]uint64
+	userUsedAt time.Time
+}
+
+// New creates a new Server instance. quotaBytes is the advertised storage quota in bytes;
+// 0 means report the underlying filesystem's free/used space (previous behaviour).
+func New(addr, dataDir string, store user.Store, quotaBytes uint64) *Server {
+	return &Server{
+		Addr:          addr,
+		DataDir:       dataDir,
+		UserStore:     store,
+		QuotaBytes:    quotaBytes,
+		Driver:        storage.NewDiskDriver(dataDir),
+		Staging:       storage.NewDiskDriver(filepath.Join(dataDir, ".atlas", "staging")),
+		UploadExpiry:  DefaultUploadExpiry,
+		QuietNotFound: DefaultQuietNotFound,
+	}
+}
+
+// Start starts the HTTP server.
+func (s *Server) Start() error {
+	if s.ClientCerts != nil {
+		switch {
+		case s.TLSCertFile == "":
+			return errors.New("client certificates need HTTPS (a TLS certificate and key)")
+		case s.ClientCerts.UserField != "" && s.ClientCerts.UserField != CertUserCN &&
+			s.ClientCerts.UserField != CertUserEmail && s.ClientCerts.UserField != CertUserDNS:
+			return fmt.Errorf("unknown client certificate user field %q (want cn, email or dns)", s.ClientCerts.UserField)
+		}
+	}
+
+	// Ensure data directory exists
+	if err := os.MkdirAll(s.DataDir, 0755); err != nil {
+		return err
+	}
+
+	if err := s.loadQuota(); err != nil {
+		return err
+	}
+
+	handler := s.handler()
+	s.stop = make(chan struct{})
+	go s.expireUploads(uploadExpireInterval, s.stop)
+
+	s.HTTPServer = &http.Server{
+		Addr:    s.Addr,
+		Handler: handler,
+	}
+	if s.Metrics != nil {
+		s.Metrics.registerServer(s, s.locks)
+		s.HTTPServer.ConnState = s.Metrics.connState
+	}
+
+	var err error
+	if s.TLSCertFile != "" {
+		s.HTTPServer.TLSConfig = s.tlsConfig()
+		slog.Info("Atlas Server starting", "addr", s.Addr, "data_dir", s.DataDir, "tls", true, "client_certs", s.ClientCerts != nil)
+		err = s.HTTPServer.ListenAndServeTLS(s.TLSCertFile, s.TLSKeyFile)
+	} else {
+		slog.Info("Atlas Server starting", "addr", s.Addr, "data_dir", s.DataDir)
+		err = s.HTTPServer.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// handler sets up the request state and returns the chain of middlewares serving the share.
+func (s *Server) handler() http.Handler {
+	locks := newCountingLS(webdav.NewMemLS())
+	s.locks = locks
+	s.sessions = newSessionTracker()
+	s.started = time.Now()
+	dav := &webdav.Handler{
+		Prefix:     "/",
+		FileSystem: &driverFS{driver: s.Driver},
+		LockSystem: locks,
+		Logger:     s.logWebDAV,
+	}
+
+	// The same tree is served at / and on the Nextcloud routes, whose prefix the handler strips.
+	webdavHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := *dav
+		if nc := ncFromContext(r.Context()); nc != nil {
+			h.Prefix = nc.prefix
+		}
+		h.ServeHTTP(w, trackUpload(r))
+	})
+
+	s.tus = newTusHandler(s)
+	s.chunkLocks = webdav.NewMemLS()
+
+	// Chain middlewares: RequestID -> Health probes -> Metrics -> AccessLog -> Status -> Auth ->
+	// Admin API -> Tus (resumable uploads) -> Nextcloud routes -> MimeFix -> Checksum -> Quota -> WebDAV
+	return s.requestIDMiddleware(s.healthMiddleware(s.metricsMiddleware(s.accessLogMiddleware(s.statusMiddleware(
+		s.authMiddleware(s.adminMiddleware(s.tusMiddleware(s.nextcloudMiddleware(s.mimeMiddleware(
+			s.checksumMiddleware(s.quotaMiddleware(webdavHandler))))))))))))
+}
+
+// uploadExpireInterval is how often abandoned uploads are cleaned up.
+const uploadExpireInterval = 10 * time.Minute
+
+// expireUploads removes expired tus and chunked uploads every interval until stop is closed.
+func (s *Server) expireUploads(interval time.Duration, stop <-chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		s.tus.expire()
+		s.expireChunkUploads()
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Shutdown gracefully shuts down the server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.stop != nil {
+		close(s.stop)
+	}
+	return s.HTTPServer.Shutdown(ctx)
+}
+
+// authMiddleware lets in requests with a client certificate of a user (see ClientCerts),
+// Basic Auth credentials that Auth accepts, or a bearer token that TokenAuth accepts,
+// and records the user in the context.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	auth := s.Auth
+	if auth == nil {
+		auth = user.Local{Users: s.UserStore}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u user.User
+		var name string // as claimed, for the log
+		var err error
+		bearer := false
+		certName, hasCert, certErr := "", false, error(nil)
+		if s.ClientCerts != nil {
+			certName, hasCert, certErr = s.ClientCerts.certUser(r)
+		}
+		if certErr == nil && !hasCert && s.ClientCerts != nil && s.ClientCerts.Required {
+			certErr = errCertRequired
+		}
+		if certErr != nil {
+			slog.WarnContext(r.Context(), "Auth failed", "remote_addr", s.clientIP(r), "err", certErr)
+			markAuthFailed(r)
+			http.Error(w, "Valid client certificate required", http.StatusForbidden)
+			return
+		}
+
+		if hasCert {
+			u, err = s.certAuth(r, auth, certName)
+			name = certName
+		} else if token, ok := bearerToken(r); ok && s.TokenAuth != nil {
+			bearer = true
+			u, err = s.TokenAuth.AuthenticateToken(r.Context(), token)
+			name = u.Username
+		} else if username, password, ok := r.BasicAuth(); ok {
+			u, err = auth.Authenticate(r.Context(), username, password)
+			name = username
+		} else {
+			markAuthFailed(r)
+			s.challenge(w, "")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if err != nil && !errors.Is(err, user.ErrBadCredentials) {
+			// Asking the client for other credentials wouldn't help.
+			slog.ErrorContext(r.Context(), "Authentication backend failed", "user", name, "err", err)
+			http.Error(w, "Authentication unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			slog.WarnContext(r.Context(), "Auth failed", "user", name, "remote_addr", s.clientIP(r), "err", err)
+			markAuthFailed(r)
+			if bearer {
+				s.challenge(w, "invalid_token")
+			} else {
+				s.challenge(w, "")
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if p, ok := r.Context().Value(requestUserKey{}).(*string); ok {
+			*p = u.Username
+		}
+		s.sessions.seen(u.Username, s.clientIP(r), r.UserAgent(), time.Now())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, u)))
+	})
+}
+
+// challenge tells the client which credentials are accepted. tokenError, if set, is
+// the RFC 6750 error code for a bearer token that was rejected.
+func (s *Server) challenge(w http.ResponseWriter, tokenError string) {
+	w.Header().Add("WWW-Authenticate", `Basic realm="Atlas Storage"`)
+	if s.TokenAuth == nil {
+		return
+	}
+	if tokenError != "" {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="Atlas Storage", error="`+tokenError+`"`)
+		return
+	}
+	w.Header().Add("WWW-Authenticate", `Bearer realm="Atlas Storage"`)
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+type authUserKey struct{}
+
+// authUser returns the user authMiddleware let in, with their role.
+func authUser(r *http.Request) (user.User, bool) {
+	u, ok := r.Context().Value(authUserKey{}).(user.User)
+	return u, ok
+}
+
+// requestUserKey holds a *string that authMiddleware fills in with the user it let in,
+// so the middlewares in front of it (access log, metrics) can see who it was.
+type requestUserKey struct{}
+
+// admittedUser returns the user authMiddleware let in, also to the middlewares in
+// front of it, or "" if the request was turned away.
+func admittedUser(r *http.Request) string {
+	if u, ok := authUser(r); ok {
+		return u.Username
+	}
+	if p, ok := r.Context().Value(requestUserKey{}).(*string); ok {
+		return *p
+	}
+	return ""
+}
+
+// requestUser returns the user a request was made by: the one authMiddleware let in,
+// else the Basic Auth username claimed (for requests that were turned away).
+func requestUser(r *http.Request) string {
+	if u, ok := authUser(r); ok {
+		return u.Username
+	}
+	if p, ok := r.Context().Value(requestUserKey{}).(*string); ok && *p != "" {
+		return *p
+	}
+	name, _, _ := r.BasicAuth()
+	return name
+}
+
+// mimeMiddleware ensures Content-Type is set correctly for Windows compatibility.
+func (s *Server) mimeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Windows WebDAV client often relies on the server providing the correct Content-Type.
+		ext := filepath.Ext(r.URL.Path)
+		if t := mime.TypeByExtension(ext); t != "" {
+			w.Header().Set("Content-Type", t)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checksumMiddleware advertises the stored SHA-256 of a file on GET and HEAD, as an
+// RFC 3230 Digest header and the OC-Checksum header ownCloud/Nextcloud clients verify.
+// The headers are set by driverFS.OpenFile from the ObjectInfo it fetches anyway.
+func (s *Server) checksumMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			r = r.WithContext(context.WithValue(r.Context(), checksumHeaderKey{}, w.Header()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type checksumHeaderKey struct{}
+
+// setChecksumHeaders adds the checksum headers for a file opened for a GET or HEAD.
+func setChecksumHeaders(ctx context.Context, info storage.ObjectInfo) {
+	h, ok := ctx.Value(checksumHeaderKey{}).(http.Header)
+	if !ok {
+		return
+	}
+	if sum, ok := sha256Hex(info.Checksum); ok {
+		if raw, err := hex.DecodeString(sum); err == nil {
+			h.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(raw))
+		}
+		h.Set("OC-Checksum", "SHA256:"+sum)
+	}
+}
+
+// responseBuffer captures the response to allow modification.
+type responseBuffer struct {
+	http.ResponseWriter
+	body *bytes.Buffer
+	code int
+}
+
+func (w *responseBuffer) WriteHeader(code int) {
+	w.code = code
+}
+
+func (w *responseBuffer) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// quotaMiddleware implements RFC 4331 by injecting quota properties into PROPFIND responses.
+func (s *Server) quotaMiddleware(next http.Handler) http.Handler {
+	// Pre-compile regex to find the closing prop tag (handling namespaces like D:prop or d:prop or just prop)
+	// We want to insert BEFORE this tag.
+	// Common patterns: </D:prop>, </d:prop>, </prop>
+	propEndRegex := regexp.MustCompile(`(</[a-zA-Z0-9_:]*prop>)`)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 2. Disk Space Reporting
+		// We only care about PROPFIND on the root.
+		if r.Method == "PROPFIND" && treePath(r) == "/" {
+			rb := &responseBuffer{
+				ResponseWriter: w,
+				body:           new(bytes.Buffer),
+				code:           http.StatusOK, // Default to 200 if not set
+			}
+
+			// Pass the buffer to the real handler
+			next.ServeHTTP(rb, r)
+
+			// If the operation wasn't successful MultiStatus, just pass it through
+			if rb.code != http.StatusMultiStatus {
+				w.WriteHeader(rb.code)
+				w.Write(rb.body.Bytes())
+				return
+			}
+
+			// It is MultiStatus. Let's process the XML.
+			bodyBytes := rb.body.Bytes()
+			bodyStr := string(bodyBytes)
+
+			// Determine which namespace prefix is used for quota properties.
+			// Usually "D" or "d". The standard lib uses "D".
+			// We can try to infer or just default to "D".
+			// Let's use "D" but ensure xmlns:D="DAV:" is present.
+			// Actually, we are injecting inside < prop > ... < /prop >
+			// The surrounding tags define the namespace context.
+			// To be safe, we will use <D:quota-...> and trust that <D:multistatus xmlns:D="DAV:"> is at the top.
+			// Most clients (including Windows) are fine if we use the same prefix as the root element.
+
+			// Calculate disk usage: either quota-based (share size) or filesystem-based
+			free, used, err := s.usage()
+
+			if err == nil {
+				// Detect usage of namespace prefix for DAV: directly from the XML
+				// Standard lib usually uses "D" or "d".
+				prefix := "D"
+				nsRegex := regexp.MustCompile(`xmlns:([a-zA-Z0-9_]+)="DAV:"`)
+				if match := nsRegex.FindStringSubmatch(bodyStr); len(match) > 1 {
+					prefix = match[1]
+				}
+
+				// Construct insertion string using the MATCHED prefix
+				quotaXML := fmt.Sprintf(
+					"<%s:quota-available-bytes>%d</%s:quota-available-bytes><%s:quota-used-bytes>%d</%s:quota-used-bytes>",
+					prefix, free, prefix, prefix, used, prefix,
+				)
+
+				// Find insertion point: the first closing </...prop> tag.
+				loc := propEndRegex.FindStringIndex(bodyStr)
+				if loc != nil {
+					// Insert before the tag
+					start := loc[0]
+					newBody := bodyStr[:start] + quotaXML + bodyStr[start:]
+					bodyBytes = []byte(newBody)
+				}
+			} else {
+				slog.WarnContext(r.Context(), "Failed to get disk usage", "err", err)
+			}
+
+			// Write the modified response
+			// IMPORTANT: Update Content-Length to match new size
+			w.Header().Set("Content-Length", strconv.Itoa(len(bodyBytes)))
+			// Ensure Content-Type is set (webdav lib usually sets it, but good to ensure)
+			if w.Header().Get("Content-Type") == "" {
+				w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+			}
+
+			// We do NOT need to set "DAV" or "Allow" headers manually because next.ServeHTTP (the library)
+			// ALREADY set them on the underlying ResponseWriter (w) before writing to rb,
+			// OR it set them on rb (headers map is shared if rb.ResponseWriter is w).
+			// responseBuffer embeds http.ResponseWriter, so rb.Header() IS w.Header().
+			// So headers are fine.
+
+			w.WriteHeader(rb.code)
+			w.Write(bodyBytes)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errNoSpace is returned by checkSpace.
+var errNoSpace = errors.New("insufficient storage")
+
+// usage returns the free and used bytes reported to clients: against the quota when
+// one is set, otherwise those of the filesystem holding DataDir.
+func (s *Server) usage() (free, used uint64, err error) {
+	if quota := s.quota(); quota > 0 {
+		used, err = s.usedBytes(0)
+		if err != nil {
+			return 0, 0, err
+		}
+		if used > quota {
+			used = quota
+		}
+		return quota - used, used, nil
+	}
+	absPath, _ := filepath.Abs(s.DataDir)
+	if absPath == "" {
+		absPath = s.DataDir
+	}
+	return getDiskUsage(absPath)
+}
+
+// checkSpace fails when storing n more bytes would exceed the quota or, without one,
+// the free space of the filesystem holding DataDir. Space reserved for unfinished
+// resumable uploads doesn't count as available. Against a quota, the size of DataDir
+// may be up to maxAge old (0 for an exact check): walking it is too slow to do for
+// every chunk of an upload.
+func (s *Server) checkSpace(n int64, maxAge time.Duration) error {
+	if s.tus != nil {
+		n += s.tus.reservedBytes()
+	}
+	return s.checkFree(n, maxAge)
+}
+
+// checkFree is checkSpace without the reservations.
+func (s *Server) checkFree(n int64, maxAge time.Duration) error {
+	if quota := s.quota(); quota > 0 {
+		used, err := s.usedBytes(maxAge)
+		if err != nil {
+			return err
+		}
+		if used+uint64(n) > quota {
+			return fmt.Errorf("%w: quota of %d bytes exceeded", errNoSpace, quota)
+		}
+		return nil
+	}
+	free, _, err := getDiskUsage(s.DataDir)
+	if err != nil {
+		// Can't tell; the write fails if it has to.
+		return nil
+	}
+	if uint64(n) > free {
+		return fmt.Errorf("%w: %d bytes needed, %d free", errNoSpace, n, free)
+	}
+	return nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+)
+
+// testPassword is the password of the users newTestServer creates.
+const testPassword = "correct horse battery"
+
+// newTestServer serves a share in a temporary directory to the users alice, an admin,
+// and bob. quota, if > 0, is the share's quota in bytes.
+func newTestServer(t *testing.T, quota uint64) (*Server, *httptest.Server) {
+	t.Helper()
+	store, err := user.NewJSONStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx user.Tx) error {
+		for _, name := range []string{"alice", "bob"} {
+			if err := user.Add(tx, name, testPassword); err != nil {
+				return err
+			}
+		}
+		return user.SetRole(tx, "alice", user.RoleAdmin)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New("", t.TempDir(), store, quota)
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// request sends a request as username (none if empty) and returns the response, with
+// its body read.
+func request(t *testing.T, ts *httptest.Server, username, method, target string, body io.Reader, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+target, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if username != "" {
+		req.SetBasicAuth(username, testPassword)
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func TestPutETagMatchesGet(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+
+	put, _ := request(t, ts, "alice", http.MethodPut, "/a.txt", strings.NewReader("hello"), nil)
+	if put.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: %s", put.Status)
+	}
+	get, body := request(t, ts, "alice", http.MethodGet, "/a.txt", nil, nil)
+	if get.StatusCode != http.StatusOK || body != "hello" {
+		t.Fatalf("GET: %s %q", get.Status, body)
+	}
+	if put.Header.Get("ETag") == "" || put.Header.Get("ETag") != get.Header.Get("ETag") {
+		t.Errorf("PUT ETag %q, GET ETag %q", put.Header.Get("ETag"), get.Header.Get("ETag"))
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+)
+
+// Resumable (tus) and chunked (Nextcloud) uploads are staged in Server.Staging, each
+// below a key of its own, and concatenated into the Driver once complete.
+
+// listAll returns every entry below prefix, following continuation tokens.
+func listAll(ctx context.Context, d storage.Driver, prefix string, recursive bool) ([]storage.ObjectInfo, error) {
+	var entries []storage.ObjectInfo
+	opts := storage.ListOptions{Recursive: recursive}
+	for {
+		res, err := d.List(ctx, prefix, opts)
+		if errors.Is(err, storage.ErrNotFound) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, res.Entries...)
+		if res.NextContinuationToken == "" {
+			return entries, nil
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+}
+
+// removeStaged deletes key and everything below it.
+func removeStaged(ctx context.Context, d storage.Driver, key string) error {
+	entries, err := listAll(ctx, d, key+"/", true)
+	if err != nil {
+		return err
+	}
+	// Deepest first, so directories are empty when their turn comes.
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.Count(entries[i].Key, "/") > strings.Count(entries[j].Key, "/")
+	})
+	for _, e := range entries {
+		if err := d.Delete(ctx, e.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	if err := d.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// concatReader reads the objects keys one after another, opening each when it is
+// reached.
+type concatReader struct {
+	ctx  context.Context
+	d    storage.Driver
+	keys []string
+	cur  io.ReadCloser
+}
+
+func newConcatReader(ctx context.Context, d storage.Driver, keys []string) *concatReader {
+	return &concatReader{ctx: ctx, d: d, keys: keys}
+}
+
+func (r *concatReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			rc, _, err := r.d.Get(r.ctx, r.keys[0], storage.GetOptions{})
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.keys = rc, r.keys[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *concatReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	return r.cur.Close()
+}
+
+// mkdirStaged creates the directory key and its parents.
+func mkdirStaged(ctx context.Context, d storage.Driver, key string) error {
+	segs := strings.Split(key, "/")
+	for i := range segs {
+		err := d.Mkdir(ctx, strings.Join(segs[:i+1], "/"))
+		if err != nil && !errors.Is(err, storage.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// subDriver serves the keys below root of another driver as a driver of their own.
+type subDriver struct {
+	d    storage.Driver
+	root string
+}
+
+var _ storage.Driver = (*subDriver)(nil)
+
+func (s *subDriver) key(key string) string {
+	if key == "" {
+		return s.root
+	}
+	return s.root + "/" + key
+}
+
+func (s *subDriver) info(info storage.ObjectInfo) storage.ObjectInfo {
+	info.Key = strings.TrimPrefix(strings.TrimPrefix(info.Key, s.root), "/")
+	return info
+}
+
+func (s *subDriver) Put(ctx context.Context, key string, r io.Reader, opts storage.PutOptions) error {
+	return s.d.Put(ctx, s.key(key), r, opts)
+}
+
+func (s *subDriver) Get(ctx context.Context, key string, opts storage.GetOptions) (io.ReadCloser, storage.ObjectInfo, error) {
+	rc, info, err := s.d.Get(ctx, s.key(key), opts)
+	return rc, s.info(info), err
+}
+
+func (s *subDriver) Stat(ctx context.Context, key string) (storage.ObjectInfo, error) {
+	info, err := s.d.Stat(ctx, s.key(key))
+	return s.info(info), err
+}
+
+func (s *subDriver) List(ctx context.Context, prefix string, opts storage.ListOptions) (storage.ListResult, error) {
+	res, err := s.d.List(ctx, s.root+"/"+prefix, opts)
+	for i := range res.Entries {
+		res.Entries[i] = s.info(res.Entries[i])
+	}
+	return res, err
+}
+
+func (s *subDriver) Delete(ctx context.Context, key string) error {
+	return s.d.Delete(ctx, s.key(key))
+}
+
+func (s *subDriver) Copy(ctx context.Context, src, dst string) error {
+	return s.d.Copy(ctx, s.key(src), s.key(dst))
+}
+
+func (s *subDriver) Rename(ctx context.Context, src, dst string) error {
+	return s.d.Rename(ctx, s.key(src), s.key(dst))
+}
+
+func (s *subDriver) Mkdir(ctx context.Context, key string) error {
+	return s.d.Mkdir(ctx, s.key(key))
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/IYouKnow/atlas-drive/pkg/user"
+)
+
+// Fields of a client certificate that can name the Atlas user.
+const (
+	CertUserCN    = "cn"    // subject common name
+	CertUserEmail = "email" // first e-mail SAN
+	CertUserDNS   = "dns"   // first DNS SAN
+)
+
+// ClientCertAuth authenticates clients by their TLS certificate, for machines that
+// sync without a password. The certificate names a user of the UserStore.
+type ClientCertAuth struct {
+	// CAs are the authorities client certificates must be issued by.
+	CAs *x509.CertPool
+	// Required turns away requests without a valid certificate. Otherwise clients
+	// without one can still use a password or token.
+	Required bool
+	// UserField is the part of the certificate that holds the username: CertUserCN,
+	// CertUserEmail or CertUserDNS.
+	UserField string
+	// AdminPassword makes admins send their password as well as the certificate.
+	AdminPassword bool
+}
+
+// LoadCertPool reads the PEM certificates in file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", file)
+	}
+	return pool, nil
+}
+
+// tlsConfig asks clients for a certificate if ClientCerts is set. Missing certificates
+// are dealt with per request, in authMiddleware, so the health probes keep working
+// without one.
+func (s *Server) tlsConfig() *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.ClientCerts != nil {
+		cfg.ClientCAs = s.ClientCerts.CAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
+
+// certUser returns the username in the verified client certificate of r, if any.
+func (c *ClientCertAuth) certUser(r *http.Request) (string, bool, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false, nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	var name string
+	switch c.UserField {
+	case CertUserCN, "":
+		name = cert.Subject.CommonName
+	case CertUserEmail:
+		if len(cert.EmailAddresses) > 0 {
+			name = cert.EmailAddresses[0]
+		}
+	case CertUserDNS:
+		if len(cert.DNSNames) > 0 {
+			name = cert.DNSNames[0]
+		}
+	}
+	if name == "" {
+		return "", true, fmt.Errorf("client certificate %q has no %s", cert.Subject, c.UserField)
+	}
+	return name, true, nil
+}
+
+// certAuth lets in the user named by a client certificate. If that user is an admin
+// and AdminPassword is set, the request must also carry their password.
+func (s *Server) certAuth(r *http.Request, auth user.Authenticator, name string) (user.User, error) {
+	u, err := s.UserStore.Get(name)
+	if errors.Is(err, user.ErrNotFound) {
+		return user.User{}, fmt.Errorf("%w: client certificate of unknown user %s", user.ErrBadCredentials, name)
+	}
+	if err != nil {
+		return user.User{}, err
+	}
+	if u.EffectiveRole() != user.RoleAdmin || !s.ClientCerts.AdminPassword {
+		return u, nil
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok || username != name {
+		return user.User{}, fmt.Errorf("%w: admin %s must send their password with the certificate", user.ErrBadCredentials, name)
+	}
+	if _, err := auth.Authenticate(r.Context(), username, password); err != nil {
+		return user.User{}, err
+	}
+	return u, nil
+}
+
+// errCertRequired is logged for requests without the client certificate they need.
+var errCertRequired = errors.New("client certificate required")
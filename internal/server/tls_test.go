@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testCA issues client certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a client certificate for the common name cn and DNS names.
+func (ca *testCA) issue(t *testing.T, cn string, dns ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dns,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTLSTestServer is newTestServer over HTTPS, letting clients in by the
+// certificates certs accepts.
+func newTLSTestServer(t *testing.T, certs *ClientCertAuth) *httptest.Server {
+	t.Helper()
+	s, plain := newTestServer(t, 0)
+	plain.Close()
+	s.ClientCerts = certs
+	ts := httptest.NewUnstartedServer(s.handler())
+	ts.TLS = s.tlsConfig()
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// certRequest sends a request with the client certificate cert (none if nil) and, if
+// username is set, their password.
+func certRequest(t *testing.T, ts *httptest.Server, cert *tls.Certificate, username, method, target string) *http.Response {
+	t.Helper()
+	tr := ts.Client().Transport.(*http.Transport).Clone()
+	if cert != nil {
+		tr.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	defer tr.CloseIdleConnections()
+	req, err := http.NewRequest(method, ts.URL+target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "" {
+		req.SetBasicAuth(username, testPassword)
+	}
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestClientCertUser(t *testing.T) {
+	ca := newTestCA(t)
+	ts := newTLSTestServer(t, &ClientCertAuth{CAs: ca.pool()})
+	bob := ca.issue(t, "bob")
+	alice := ca.issue(t, "alice")
+	mallory := ca.issue(t, "mallory")
+
+	if resp := certRequest(t, ts, &bob, "", "PROPFIND", "/"); resp.StatusCode != http.StatusMultiStatus {
+		t.Errorf("bob's certificate: %s, want 207", resp.Status)
+	}
+	// The certificate decides who the request is from: bob isn't an admin, alice is.
+	if resp := certRequest(t, ts, &bob, "", http.MethodGet, adminPrefix+"users"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("bob's certificate on the admin API: %s, want 403", resp.Status)
+	}
+	if resp := certRequest(t, ts, &alice, "", http.MethodGet, adminPrefix+"users"); resp.StatusCode != http.StatusOK {
+		t.Errorf("alice's certificate on the admin API: %s, want 200", resp.Status)
+	}
+	if resp := certRequest(t, ts, &mallory, "", "PROPFIND", "/"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("certificate of an unknown user: %s, want 401", resp.Status)
+	}
+	// Without Required, a password still works.
+	if resp := certRequest(t, ts, nil, "bob", "PROPFIND", "/"); resp.StatusCode != http.StatusMultiStatus {
+		t.Errorf("password without a certificate: %s, want 207", resp.Status)
+	}
+}
+
+func TestClientCertUserField(t *testing.T) {
+	ca := newTestCA(t)
+	ts := newTLSTestServer(t, &ClientCertAuth{CAs: ca.pool(), UserField: CertUserDNS})
+	bob := ca.issue(t, "alice", "bob")
+	if resp := certRequest(t, ts, &bob, "", http.MethodGet, adminPrefix+"users"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("certificate naming bob by DNS name: %s, want 403 (bob, not alice)", resp.Status)
+	}
+	none := ca.issue(t, "bob")
+	if resp := certRequest(t, ts, &none, "", "PROPFIND", "/"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("certificate without a DNS name: %s, want 403", resp.Status)
+	}
+}
+
+func TestClientCertRequired(t *testing.T) {
+	ca := newTestCA(t)
+	ts := newTLSTestServer(t, &ClientCertAuth{CAs: ca.pool(), Required: true})
+	if resp := certRequest(t, ts, nil, "bob", "PROPFIND", "/"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("password without a certificate: %s, want 403", resp.Status)
+	}
+	bob := ca.issue(t, "bob")
+	if resp := certRequest(t, ts, &bob, "", "PROPFIND", "/"); resp.StatusCode != http.StatusMultiStatus {
+		t.Errorf("bob's certificate: %s, want 207", resp.Status)
+	}
+}
+
+func TestClientCertAdminPassword(t *testing.T) {
+	ca := newTestCA(t)
+	ts := newTLSTestServer(t, &ClientCertAuth{CAs: ca.pool(), AdminPassword: true})
+	alice := ca.issue(t, "alice")
+	bob := ca.issue(t, "bob")
+
+	if resp := certRequest(t, ts, &alice, "", http.MethodGet, adminPrefix+"users"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("admin certificate alone: %s, want 401", resp.Status)
+	}
+	if resp := certRequest(t, ts, &alice, "bob", http.MethodGet, adminPrefix+"users"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("admin certificate with another user's password: %s, want 401", resp.Status)
+	}
+	if resp := certRequest(t, ts, &alice, "alice", http.MethodGet, adminPrefix+"users"); resp.StatusCode != http.StatusOK {
+		t.Errorf("admin certificate and password: %s, want 200", resp.Status)
+	}
+	// Users other than admins need no password.
+	if resp := certRequest(t, ts, &bob, "", "PROPFIND", "/"); resp.StatusCode != http.StatusMultiStatus {
+		t.Errorf("user certificate alone: %s, want 207", resp.Status)
+	}
+}
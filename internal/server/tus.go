@@ -0,0 +1,566 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+)
+
+// Resumable uploads (tus 1.0.0, https://tus.io/protocols/resumable-upload) are served
+// under tusPrefix, inside the reserved .atlas directory so the endpoint can't shadow a file.
+// Uploads are staged in Server.Staging and handed to the Driver in one Put once complete,
+// so the file only appears in the tree when all of it has arrived.
+const (
+	tusPrefix     = "/.atlas/uploads/"
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,expiration"
+	tusOctets     = "application/offset+octet-stream"
+
+	// DefaultUploadExpiry is how long an unfinished upload is kept after its last PATCH.
+	DefaultUploadExpiry = 24 * time.Hour
+)
+
+var tusID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// tusUpload is the state of an upload. It is staged as tus/<id>/info.json, next to the
+// data in one part per PATCH, tus/<id>/<offset>. The upload's offset is the size of the
+// parts together.
+type tusUpload struct {
+	ID          string    `json:"id"`
+	Key         string    `json:"key"`
+	Length      int64     `json:"length"`
+	Metadata    string    `json:"metadata,omitempty"` // Upload-Metadata as sent, echoed on HEAD
+	ContentType string    `json:"content_type,omitempty"`
+	Owner       string    `json:"owner"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// tusHandler implements the protocol on top of the staging driver.
+type tusHandler struct {
+	s *Server
+
+	mu   sync.Mutex
+	busy map[string]bool // uploads with a request in progress
+
+	// reserved holds the bytes each unfinished upload declared but hasn't sent yet, so
+	// space promised to one upload isn't handed out again before it arrives.
+	resMu    sync.Mutex
+	reserved map[string]int64
+}
+
+func newTusHandler(s *Server) *tusHandler {
+	return &tusHandler{
+		s:        s,
+		busy:     make(map[string]bool),
+		reserved: make(map[string]int64),
+	}
+}
+
+// tusMiddleware routes requests below tusPrefix to the tus handler.
+func (s *Server) tusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path+"/" != tusPrefix && !strings.HasPrefix(r.URL.Path, tusPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.tus.ServeHTTP(w, r)
+	})
+}
+
+func (t *tusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if quota := t.s.quota(); quota > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatUint(quota, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(tusPrefix, "/")), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "OPTIONS, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		t.create(w, r)
+		return
+	}
+
+	if !tusID.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+	if !t.acquire(id) {
+		http.Error(w, "Upload is busy with another request", http.StatusLocked)
+		return
+	}
+	defer t.release(id)
+
+	u, err := t.load(r.Context(), id)
+	if err == nil && time.Now().After(u.Expires) {
+		t.remove(r.Context(), id)
+		err = storage.ErrNotFound
+	}
+	if err == nil && u.Owner != requestUser(r) {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			slog.ErrorContext(r.Context(), "Upload failed", "upload", id, "err", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		t.head(w, r, u)
+	case http.MethodPatch:
+		t.patch(w, r, u)
+	case http.MethodDelete:
+		t.remove(r.Context(), id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// create handles POST: it validates the destination and the space needed and stages
+// the upload's state, then takes the first chunk if the request carries one.
+func (t *tusHandler) create(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if quota := t.s.quota(); quota > 0 && uint64(length) > quota {
+		http.Error(w, "Upload exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dest := meta["path"]
+	if dest == "" {
+		dest = meta["filename"]
+	}
+	key := toKey(dest)
+	if key == "" || key == ".atlas" || strings.HasPrefix(key, ".atlas/") {
+		http.Error(w, `Upload-Metadata needs a "path" or "filename" for the file`, http.StatusBadRequest)
+		return
+	}
+	if status, msg := t.checkDestination(r, key); status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+
+	contentType := meta["filetype"]
+	if contentType == "" {
+		contentType = meta["type"]
+	}
+	now := time.Now().UTC()
+	u := &tusUpload{
+		ID:          newUploadID(),
+		Key:         key,
+		Length:      length,
+		Metadata:    r.Header.Get("Upload-Metadata"),
+		ContentType: contentType,
+		Owner:       requestUser(r),
+		Created:     now,
+		Expires:     now.Add(t.s.UploadExpiry),
+	}
+	t.acquire(u.ID) // fresh ID, always free
+	defer t.release(u.ID)
+	if err := t.reserve(u.ID, length); err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err := t.save(r.Context(), u); err != nil {
+		t.remove(r.Context(), u.ID)
+		t.fail(w, r, u, err)
+		return
+	}
+
+	w.Header().Set("Location", tusPrefix+u.ID)
+	slog.InfoContext(r.Context(), "Upload started", "upload", u.ID, "user", u.Owner, "path", u.Key, "size", u.Length)
+
+	if r.Header.Get("Content-Type") == tusOctets || length == 0 {
+		offset, status, err := t.write(r, u, 0)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		if err != nil {
+			if status == http.StatusInternalServerError {
+				slog.ErrorContext(r.Context(), "Upload failed", "upload", u.ID, "err", err)
+			}
+			// The upload exists; the client can resume it from the offset.
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// checkDestination refuses destinations the upload could never be moved to, like
+// WebDAV PUT does: a missing parent directory, or a directory in the file's place.
+func (t *tusHandler) checkDestination(r *http.Request, key string) (int, string) {
+	if dir := path.Dir(key); dir != "." {
+		info, err := t.s.Driver.Stat(r.Context(), dir)
+		if err != nil || !info.IsDir() {
+			return http.StatusConflict, "Parent directory does not exist"
+		}
+	}
+	if info, err := t.s.Driver.Stat(r.Context(), key); err == nil && info.IsDir() {
+		return http.StatusConflict, "A directory exists at the destination"
+	}
+	return 0, ""
+}
+
+func (t *tusHandler) head(w http.ResponseWriter, r *http.Request, u *tusUpload) {
+	offset, err := t.offset(r.Context(), u.ID)
+	if err != nil {
+		t.fail(w, r, u, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t *tusHandler) patch(w http.ResponseWriter, r *http.Request, u *tusUpload) {
+	if r.Header.Get("Content-Type") != tusOctets {
+		http.Error(w, "Content-Type must be "+tusOctets, http.StatusUnsupportedMediaType)
+		return
+	}
+	want, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	u.Expires = time.Now().UTC().Add(t.s.UploadExpiry)
+	if err := t.save(r.Context(), u); err != nil {
+		t.fail(w, r, u, err)
+		return
+	}
+	offset, status, err := t.write(r, u, want)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			slog.ErrorContext(r.Context(), "Upload failed", "upload", u.ID, "err", err)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Upload-Expires", u.Expires.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// write appends the request body at offset want and finishes the upload once all of it
+// has arrived. Whatever was received before the client went away is kept, which is what
+// makes the upload resumable. It returns the new offset and, on error, the status to send.
+func (t *tusHandler) write(r *http.Request, u *tusUpload, want int64) (int64, int, error) {
+	offset, err := t.offset(r.Context(), u.ID)
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	if want != offset {
+		return offset, http.StatusConflict, fmt.Errorf("offset %d does not match the upload's offset %d", want, offset)
+	}
+	if r.ContentLength > u.Length-offset {
+		return offset, http.StatusRequestEntityTooLarge, errors.New("request body exceeds Upload-Length")
+	}
+
+	if offset < u.Length {
+		// The part is stored even if the client goes away halfway, with what it sent.
+		body := &partialBody{r: io.LimitReader(r.Body, u.Length-offset)}
+		key := t.partKey(u.ID, offset)
+		err := t.s.Staging.Put(context.WithoutCancel(r.Context()), key, body, storage.PutOptions{})
+		if err != nil {
+			return offset, http.StatusInternalServerError, err
+		}
+		if body.n == 0 {
+			t.s.Staging.Delete(r.Context(), key)
+		}
+		offset += body.n
+		t.setReserved(u.ID, u.Length-offset)
+		if body.err != nil {
+			// Most likely the connection dropped; the client resumes from offset.
+			return offset, http.StatusBadRequest, fmt.Errorf("upload interrupted: %w", body.err)
+		}
+	}
+	if offset < u.Length {
+		return offset, 0, nil
+	}
+	if err := t.finish(r, u); err != nil {
+		if errors.Is(err, errNoSpace) {
+			return offset, http.StatusInsufficientStorage, err
+		}
+		return offset, http.StatusInternalServerError, err
+	}
+	return offset, 0, nil
+}
+
+// partialBody ends at the first read error instead of returning it, so the data that
+// came before it is stored, and records the error.
+type partialBody struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (b *partialBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+		err = io.EOF
+	}
+	return n, err
+}
+
+// finish moves a complete upload into the tree. On failure the upload stays staged and
+// an empty PATCH at the final offset retries.
+func (t *tusHandler) finish(r *http.Request, u *tusUpload) error {
+	// The staged data is already counted as used space, so this only catches a share
+	// that filled up while the upload was in progress.
+	if err := t.s.checkSpace(0, 0); err != nil {
+		return err
+	}
+	parts, err := t.parts(r.Context(), u.ID)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(parts))
+	for i, p := range parts {
+		keys[i] = p.Key
+	}
+	data := newConcatReader(r.Context(), t.s.Staging, keys)
+	err = t.s.Driver.Put(r.Context(), u.Key, data, storage.PutOptions{
+		ContentType: u.ContentType,
+		Metadata:    map[string]string{ownerMetaKey: u.Owner},
+	})
+	data.Close()
+	if err != nil {
+		return fmt.Errorf("failed to store %s: %w", u.Key, err)
+	}
+	t.remove(r.Context(), u.ID)
+	slog.InfoContext(r.Context(), "Upload complete", "upload", u.ID, "path", u.Key, "size", u.Length)
+	return nil
+}
+
+// fail reports an internal error about an upload.
+func (t *tusHandler) fail(w http.ResponseWriter, r *http.Request, u *tusUpload, err error) {
+	slog.ErrorContext(r.Context(), "Upload failed", "upload", u.ID, "err", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// reserve sets aside n bytes for upload id, failing if they aren't available next to
+// what is stored and reserved for the other uploads.
+func (t *tusHandler) reserve(id string, n int64) error {
+	t.resMu.Lock()
+	defer t.resMu.Unlock()
+	var others int64
+	for other, m := range t.reserved {
+		if other != id {
+			others += m
+		}
+	}
+	if err := t.s.checkFree(n+others, 0); err != nil {
+		return err
+	}
+	if n > 0 {
+		t.reserved[id] = n
+	}
+	return nil
+}
+
+// setReserved updates the bytes still to come for upload id, without checking for space.
+func (t *tusHandler) setReserved(id string, n int64) {
+	t.resMu.Lock()
+	defer t.resMu.Unlock()
+	if n > 0 {
+		t.reserved[id] = n
+	} else {
+		delete(t.reserved, id)
+	}
+}
+
+// reservedBytes returns the space reserved for all unfinished uploads.
+func (t *tusHandler) reservedBytes() int64 {
+	t.resMu.Lock()
+	defer t.resMu.Unlock()
+	var n int64
+	for _, m := range t.reserved {
+		n += m
+	}
+	return n
+}
+
+func (t *tusHandler) acquire(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.busy[id] {
+		return false
+	}
+	t.busy[id] = true
+	return true
+}
+
+func (t *tusHandler) release(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.busy, id)
+}
+
+// tusStaging is where uploads are staged in Server.Staging.
+const tusStaging = "tus"
+
+func (t *tusHandler) uploadKey(id string) string { return tusStaging + "/" + id }
+func (t *tusHandler) infoKey(id string) string   { return t.uploadKey(id) + "/info.json" }
+
+// partKey names the part starting at offset so parts sort in order.
+func (t *tusHandler) partKey(id string, offset int64) string {
+	return fmt.Sprintf("%s/%020d", t.uploadKey(id), offset)
+}
+
+// parts lists the staged data of an upload, in order.
+func (t *tusHandler) parts(ctx context.Context, id string) ([]storage.ObjectInfo, error) {
+	entries, err := listAll(ctx, t.s.Staging, t.uploadKey(id)+"/", false)
+	if err != nil {
+		return nil, err
+	}
+	parts := entries[:0]
+	for _, e := range entries {
+		if e.Key != t.infoKey(id) && !e.IsDir() {
+			parts = append(parts, e)
+		}
+	}
+	return parts, nil
+}
+
+func (t *tusHandler) offset(ctx context.Context, id string) (int64, error) {
+	parts, err := t.parts(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, p := range parts {
+		n += p.Size
+	}
+	return n, nil
+}
+
+func (t *tusHandler) load(ctx context.Context, id string) (*tusUpload, error) {
+	rc, _, err := t.s.Staging.Get(ctx, t.infoKey(id), storage.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var u tusUpload
+	if err := json.NewDecoder(rc).Decode(&u); err != nil {
+		return nil, fmt.Errorf("corrupt upload state: %w", err)
+	}
+	return &u, nil
+}
+
+func (t *tusHandler) save(ctx context.Context, u *tusUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return t.s.Staging.Put(ctx, t.infoKey(u.ID), bytes.NewReader(data), storage.PutOptions{})
+}
+
+func (t *tusHandler) remove(ctx context.Context, id string) {
+	t.setReserved(id, 0)
+	removeStaged(context.WithoutCancel(ctx), t.s.Staging, t.uploadKey(id))
+}
+
+// expire removes uploads past their expiry date, and staged data left without state.
+// The uploads it keeps get their space reserved again, which after a restart is the
+// first time.
+func (t *tusHandler) expire() {
+	ctx := context.Background()
+	entries, err := listAll(ctx, t.s.Staging, tusStaging+"/", false)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, e := range entries {
+		id := path.Base(e.Key)
+		if !e.IsDir() || !t.acquire(id) {
+			continue
+		}
+		u, err := t.load(ctx, id)
+		if err != nil || now.After(u.Expires) {
+			t.remove(ctx, id)
+			slog.Info("Upload expired", "upload", id)
+		} else if offset, err := t.offset(ctx, id); err == nil {
+			t.setReserved(id, u.Length-offset)
+		}
+		t.release(id)
+	}
+}
+
+func newUploadID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseUploadMetadata decodes "key base64value,key2 base64value2".
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil || k == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata entry %q", k)
+		}
+		meta[k] = string(value)
+	}
+	return meta, nil
+}
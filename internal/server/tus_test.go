@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tusHeader returns the headers of a tus request, with more as key/value pairs.
+func tusHeader(more ...string) http.Header {
+	h := http.Header{"Tus-Resumable": {tusVersion}}
+	for i := 0; i+1 < len(more); i += 2 {
+		h.Set(more[i], more[i+1])
+	}
+	return h
+}
+
+// createUpload starts an upload of length bytes to name and returns its URL path.
+func createUpload(t *testing.T, ts *httptest.Server, username, name string, length int) string {
+	t.Helper()
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte(name))
+	resp, body := request(t, ts, username, http.MethodPost, tusPrefix, nil,
+		tusHeader("Upload-Length", strconv.Itoa(length), "Upload-Metadata", meta))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST: %s %s", resp.Status, body)
+	}
+	loc := resp.Header.Get("Location")
+	if !strings.HasPrefix(loc, tusPrefix) {
+		t.Fatalf("Location = %q", loc)
+	}
+	return loc
+}
+
+func patchUpload(t *testing.T, ts *httptest.Server, loc string, offset int, data string) *http.Response {
+	t.Helper()
+	resp, _ := request(t, ts, "bob", http.MethodPatch, loc, strings.NewReader(data),
+		tusHeader("Content-Type", tusOctets, "Upload-Offset", strconv.Itoa(offset)))
+	return resp
+}
+
+func uploadOffset(t *testing.T, ts *httptest.Server, loc string) string {
+	t.Helper()
+	resp, _ := request(t, ts, "bob", http.MethodHead, loc, nil, tusHeader())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HEAD: %s", resp.Status)
+	}
+	return resp.Header.Get("Upload-Offset")
+}
+
+func TestTusUpload(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+	loc := createUpload(t, ts, "bob", "a.txt", 11)
+	if got := uploadOffset(t, ts, loc); got != "0" {
+		t.Fatalf("offset after POST = %s, want 0", got)
+	}
+
+	if resp := patchUpload(t, ts, loc, 0, "hello "); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PATCH: %s", resp.Status)
+	}
+	if got := uploadOffset(t, ts, loc); got != "6" {
+		t.Fatalf("offset = %s, want 6", got)
+	}
+	// The file only appears once all of it has arrived.
+	if resp, _ := request(t, ts, "bob", http.MethodGet, "/a.txt", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET of an unfinished upload: %s", resp.Status)
+	}
+
+	resp := patchUpload(t, ts, loc, 3, "world")
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("PATCH at a wrong offset: %s, want 409", resp.Status)
+	}
+	if got := resp.Header.Get("Upload-Offset"); got != "6" {
+		t.Errorf("Upload-Offset of the refused PATCH = %s, want 6", got)
+	}
+
+	if resp := patchUpload(t, ts, loc, 6, "world"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("last PATCH: %s", resp.Status)
+	}
+	if resp, body := request(t, ts, "bob", http.MethodGet, "/a.txt", nil, nil); resp.StatusCode != http.StatusOK || body != "hello world" {
+		t.Fatalf("GET: %s %q", resp.Status, body)
+	}
+	if resp, _ := request(t, ts, "bob", http.MethodHead, loc, nil, tusHeader()); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD of a finished upload: %s, want 404", resp.Status)
+	}
+}
+
+func TestTusOtherUser(t *testing.T) {
+	_, ts := newTestServer(t, 0)
+	loc := createUpload(t, ts, "bob", "a.txt", 5)
+	if resp, _ := request(t, ts, "alice", http.MethodHead, loc, nil, tusHeader()); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD of another user's upload: %s, want 404", resp.Status)
+	}
+}
+
+func TestTusTerminate(t *testing.T) {
+	s, ts := newTestServer(t, 0)
+	loc := createUpload(t, ts, "bob", "a.txt", 10)
+	patchUpload(t, ts, loc, 0, "hello")
+
+	if resp, _ := request(t, ts, "bob", http.MethodDelete, loc, nil, tusHeader()); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: %s", resp.Status)
+	}
+	if resp, _ := request(t, ts, "bob", http.MethodHead, loc, nil, tusHeader()); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD after DELETE: %s, want 404", resp.Status)
+	}
+	id := strings.TrimPrefix(loc, tusPrefix)
+	if _, err := s.Staging.Stat(context.Background(), s.tus.uploadKey(id)); err == nil {
+		t.Error("the staged upload is still there")
+	}
+}
+
+func TestTusExpire(t *testing.T) {
+	s, ts := newTestServer(t, 0)
+	s.UploadExpiry = time.Millisecond
+	loc := createUpload(t, ts, "bob", "a.txt", 10)
+	id := strings.TrimPrefix(loc, tusPrefix)
+
+	time.Sleep(10 * time.Millisecond)
+	s.tus.expire()
+	if _, err := s.Staging.Stat(context.Background(), s.tus.uploadKey(id)); err == nil {
+		t.Error("the expired upload is still staged")
+	}
+	if resp, _ := request(t, ts, "bob", http.MethodHead, loc, nil, tusHeader()); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD of an expired upload: %s, want 404", resp.Status)
+	}
+}
+
+func TestTusQuota(t *testing.T) {
+	s, ts := newTestServer(t, 100)
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("big"))
+	resp, _ := request(t, ts, "bob", http.MethodPost, tusPrefix, nil,
+		tusHeader("Upload-Length", "101", "Upload-Metadata", meta))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("POST over the quota: %s, want 413", resp.Status)
+	}
+
+	// The first upload's length is reserved, so a second doesn't fit next to it.
+	loc := createUpload(t, ts, "bob", "a", 60)
+	resp, _ = request(t, ts, "bob", http.MethodPost, tusPrefix, nil,
+		tusHeader("Upload-Length", "60", "Upload-Metadata", meta))
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("POST past a reservation: %s, want 507", resp.Status)
+	}
+
+	// Nor does it after part of the first has arrived.
+	patchUpload(t, ts, loc, 0, strings.Repeat("x", 30))
+	if got := s.tus.reservedBytes(); got != 30 {
+		t.Errorf("reserved %d bytes, want 30", got)
+	}
+	resp, _ = request(t, ts, "bob", http.MethodPost, tusPrefix, nil,
+		tusHeader("Upload-Length", "60", "Upload-Metadata", meta))
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("POST past a partial upload: %s, want 507", resp.Status)
+	}
+
+	if resp, _ := request(t, ts, "bob", http.MethodDelete, loc, nil, tusHeader()); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE: %s", resp.Status)
+	}
+	createUpload(t, ts, "bob", "b", 60)
+}
+
+// The reservations of uploads left from before a restart are made again.
+func TestTusReserveAfterRestart(t *testing.T) {
+	s, ts := newTestServer(t, 0)
+	loc := createUpload(t, ts, "bob", "a.txt", 10)
+	patchUpload(t, ts, loc, 0, "abc")
+
+	s.tus = newTusHandler(s)
+	s.tus.expire()
+	if got := s.tus.reservedBytes(); got != 7 {
+		t.Errorf("reserved %d bytes, want 7", got)
+	}
+}
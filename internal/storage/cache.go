@@ -0,0 +1,880 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheMode selects how a CachedDriver handles writes.
+type CacheMode int
+
+const (
+	// WriteThrough stores writes in the backend before acknowledging them, keeping a copy in the cache.
+	WriteThrough CacheMode = iota
+	// WriteBack acknowledges writes once they are in the cache and uploads them in the background.
+	WriteBack
+)
+
+// ParseCacheMode accepts "write-through" and "write-back".
+func ParseCacheMode(s string) (CacheMode, error) {
+	switch s {
+	case "write-through", "":
+		return WriteThrough, nil
+	case "write-back":
+		return WriteBack, nil
+	}
+	return 0, fmt.Errorf("storage: unknown cache mode %q (want write-through or write-back)", s)
+}
+
+func (m CacheMode) String() string {
+	if m == WriteBack {
+		return "write-back"
+	}
+	return "write-through"
+}
+
+// cacheRetryInterval is how long the uploader waits after a failed upload.
+const cacheRetryInterval = 10 * time.Second
+
+// CachedDriver keeps recently used objects in a local directory in front of a slower
+// backend, evicting the least recently used ones beyond a size limit.
+//
+// Whole objects are cached when they are written or read from start to end; ranged reads
+// that miss go straight to the backend. Objects larger than a quarter of the cache are
+// never cached. The cache assumes it is the only writer of the backend: changes made
+// behind its back are not noticed until the object is evicted.
+//
+// In WriteBack mode uploads that have not reached the backend yet ("dirty" objects) are
+// journaled in the cache directory and resumed after a restart; they are never evicted.
+// Directories are still created in the backend right away, and deleting, copying or
+// renaming dirty objects uploads them first.
+type CachedDriver struct {
+	backend  Driver
+	dir      string
+	maxBytes int64
+	mode     CacheMode
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	lru     *list.List // of *cacheEntry, most recently used first
+	used    int64
+	fills   map[string]uint64 // objects being cached by a read, by fill token
+	seq     uint64
+
+	// locks orders writes and uploads of a key (shared) against deletes, copies and renames
+	// of it or of a directory above or below it (exclusive), so an object cached or queued
+	// for upload never outlives a rename it raced with. Other keys aren't held up.
+	locks keyLocks
+	// uploadMu serialises the background uploader and Flush.
+	uploadMu  sync.Mutex
+	uploadErr atomic.Pointer[string]
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+
+	hits, misses, evictions atomic.Int64
+}
+
+var _ Driver = (*CachedDriver)(nil)
+
+type cacheEntry struct {
+	info  ObjectInfo
+	name  string
+	elem  *list.Element
+	dirty bool
+	gen   uint64
+}
+
+// cacheJournal records a dirty object so its upload survives a restart.
+type cacheJournal struct {
+	Key         string            `json:"key"`
+	ContentType string            `json:"content_type,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ModTime     time.Time         `json:"mod_time"`
+}
+
+// CacheStats is a snapshot of the cache counters.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	Bytes     int64
+	MaxBytes  int64
+	// Dirty counts objects waiting to be uploaded (WriteBack mode).
+	Dirty int
+	// UploadError is the last upload failure, if the uploader is currently stuck.
+	UploadError string
+}
+
+// HitRatio returns the fraction of reads served from the cache.
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// NewCachedDriver caches objects of backend in dir, up to maxBytes. Objects from an
+// earlier run are discarded, except dirty ones, which are uploaded again.
+// Call Close to stop the background uploader.
+func NewCachedDriver(backend Driver, dir string, maxBytes int64, mode CacheMode) (*CachedDriver, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("cache: size must be positive")
+	}
+	c := &CachedDriver{
+		backend:  backend,
+		dir:      dir,
+		maxBytes: maxBytes,
+		mode:     mode,
+		entries:  make(map[string]*cacheEntry),
+		lru:      list.New(),
+		fills:    make(map[string]uint64),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"objects", "dirty", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.recover(); err != nil {
+		return nil, err
+	}
+
+	go c.uploader()
+	return c, nil
+}
+
+// recover reloads the dirty objects and drops everything else.
+func (c *CachedDriver) recover() error {
+	journals, err := os.ReadDir(filepath.Join(c.dir, "dirty"))
+	if err != nil {
+		return err
+	}
+	for _, de := range journals {
+		name, ok := strings.CutSuffix(de.Name(), ".json")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(c.dir, "dirty", de.Name()))
+		if err != nil {
+			return err
+		}
+		var j cacheJournal
+		fi, statErr := os.Stat(c.objectPath(name))
+		if json.Unmarshal(data, &j) != nil || statErr != nil || cacheName(j.Key) != name {
+			// Interrupted before the object was written: the upload was never acknowledged.
+			os.Remove(filepath.Join(c.dir, "dirty", de.Name()))
+			continue
+		}
+		e := &cacheEntry{
+			info: ObjectInfo{Key: j.Key, Size: fi.Size(), ModTime: j.ModTime, Type: TypeFile,
+				ContentType: j.ContentType, Checksum: j.Checksum, Metadata: j.Metadata},
+			name:  name,
+			dirty: true,
+		}
+		e.elem = c.lru.PushBack(e)
+		c.entries[j.Key] = e
+		c.used += fi.Size()
+	}
+
+	objects, err := os.ReadDir(filepath.Join(c.dir, "objects"))
+	if err != nil {
+		return err
+	}
+	for _, de := range objects {
+		if _, err := os.Stat(c.journalPath(de.Name())); err != nil {
+			os.Remove(c.objectPath(de.Name()))
+		}
+	}
+	return nil
+}
+
+// Close stops the uploader. Dirty objects not uploaded yet are resumed by the next
+// NewCachedDriver on the same directory; use Flush first to upload them now.
+func (c *CachedDriver) Close() error {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+	<-c.done
+	return nil
+}
+
+// Stats returns the current counters.
+func (c *CachedDriver) Stats() CacheStats {
+	c.mu.Lock()
+	s := CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   len(c.entries),
+		Bytes:     c.used,
+		MaxBytes:  c.maxBytes,
+	}
+	for _, e := range c.entries {
+		if e.dirty {
+			s.Dirty++
+		}
+	}
+	c.mu.Unlock()
+	if msg := c.uploadErr.Load(); msg != nil {
+		s.UploadError = *msg
+	}
+	return s
+}
+
+func cacheName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *CachedDriver) objectPath(name string) string {
+	return filepath.Join(c.dir, "objects", name)
+}
+
+func (c *CachedDriver) journalPath(name string) string {
+	return filepath.Join(c.dir, "dirty", name+".json")
+}
+
+// maxEntry is the largest object worth caching.
+func (c *CachedDriver) maxEntry() int64 {
+	return c.maxBytes / 4
+}
+
+// insertLocked makes the file at tmp the cached copy of info.Key.
+func (c *CachedDriver) insertLocked(tmp string, info ObjectInfo, dirty bool) error {
+	name := cacheName(info.Key)
+	if err := os.Rename(tmp, c.objectPath(name)); err != nil {
+		return err
+	}
+	if old := c.entries[info.Key]; old != nil {
+		c.lru.Remove(old.elem)
+		c.used -= old.info.Size
+	}
+	c.seq++
+	e := &cacheEntry{info: info, name: name, dirty: dirty, gen: c.seq}
+	e.elem = c.lru.PushFront(e)
+	c.entries[info.Key] = e
+	c.used += info.Size
+	delete(c.fills, info.Key)
+	c.evictLocked()
+	return nil
+}
+
+// evictLocked drops the least recently used clean objects until the cache fits.
+func (c *CachedDriver) evictLocked() {
+	for el := c.lru.Back(); el != nil && c.used > c.maxBytes; {
+		e := el.Value.(*cacheEntry)
+		el = el.Prev()
+		if e.dirty {
+			continue
+		}
+		c.removeLocked(e)
+		c.evictions.Add(1)
+	}
+}
+
+func (c *CachedDriver) removeLocked(e *cacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.info.Key)
+	c.used -= e.info.Size
+	os.Remove(c.objectPath(e.name))
+	if e.dirty {
+		os.Remove(c.journalPath(e.name))
+	}
+}
+
+// invalidate forgets key, and everything below it if tree is set. Dirty objects are
+// dropped too, so callers must upload whatever they want to keep first.
+func (c *CachedDriver) invalidate(key string, tree bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[key]; e != nil {
+		c.removeLocked(e)
+	}
+	delete(c.fills, key)
+	if !tree {
+		return
+	}
+	for k, e := range c.entries {
+		if strings.HasPrefix(k, key+"/") {
+			c.removeLocked(e)
+		}
+	}
+	for k := range c.fills {
+		if strings.HasPrefix(k, key+"/") {
+			delete(c.fills, k)
+		}
+	}
+}
+
+// dirtyKeys returns the dirty keys equal to key or below it, oldest first.
+func (c *CachedDriver) dirtyKeys(key string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for k, e := range c.entries {
+		if e.dirty && (key == "" || k == key || strings.HasPrefix(k, key+"/")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *CachedDriver) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), "put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if c.mode == WriteBack {
+		return c.putBack(ctx, key, r, opts, f)
+	}
+	defer c.locks.lock(false, key)()
+
+	// Write-through: keep a copy of what the backend receives, unless it grows too big.
+	w := &cacheWriter{f: f, limit: c.maxEntry()}
+	if err := c.backend.Put(ctx, key, io.TeeReader(r, w), opts); err != nil {
+		c.invalidate(key, false)
+		return err
+	}
+	if w.err != nil || f.Close() != nil {
+		c.invalidate(key, false)
+		return nil
+	}
+	opts = opts.Final()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.insertLocked(f.Name(), ObjectInfo{
+		Key:         key,
+		Size:        w.n,
+		ModTime:     time.Now(),
+		Type:        TypeFile,
+		ContentType: opts.ContentType,
+		Checksum:    opts.Checksum,
+		Metadata:    opts.Metadata,
+	}, false); err != nil {
+		// The backend has the object; just don't cache it.
+		if e := c.entries[key]; e != nil {
+			c.removeLocked(e)
+		}
+	}
+	return nil
+}
+
+// putBack stores a write-back object in the cache and queues its upload.
+func (c *CachedDriver) putBack(ctx context.Context, key string, r io.Reader, opts PutOptions, f *os.File) error {
+	c.mu.Lock()
+	_, cached := c.entries[key]
+	c.mu.Unlock()
+	if !cached {
+		if info, err := c.backend.Stat(ctx, key); err == nil && info.IsDir() {
+			return &fs.PathError{Op: "put", Path: key, Err: ErrIsDir}
+		}
+	}
+	// Directories exist in the backend before anything is acknowledged in them.
+	if parent := path.Dir(key); parent != "." {
+		if err := mkdirAll(ctx, c.backend, parent); err != nil {
+			return err
+		}
+	}
+
+	n, err := io.Copy(f, ContextReader(ctx, r))
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	opts = opts.Final()
+	info := ObjectInfo{
+		Key:         key,
+		Size:        n,
+		ModTime:     time.Now(),
+		Type:        TypeFile,
+		ContentType: opts.ContentType,
+		Checksum:    opts.Checksum,
+		Metadata:    opts.Metadata,
+	}
+	journal, err := json.Marshal(cacheJournal{key, opts.ContentType, opts.Checksum, opts.Metadata, info.ModTime})
+	if err != nil {
+		return err
+	}
+
+	defer c.locks.lock(false, key)()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.insertLocked(f.Name(), info, true); err != nil {
+		return err
+	}
+	if err := writeFileSync(c.journalPath(cacheName(key)), journal); err != nil {
+		c.removeLocked(c.entries[key])
+		return err
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeFileSync writes data to path through a temporary file, durably.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// cacheWriter copies a stream into a cache file until it exceeds limit.
+type cacheWriter struct {
+	f     *os.File
+	limit int64
+	n     int64
+	err   error
+}
+
+var errTooBig = errors.New("cache: object too large to cache")
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	w.n += int64(len(p))
+	if w.n > w.limit {
+		w.err = errTooBig
+		return len(p), nil
+	}
+	if _, err := w.f.Write(p); err != nil {
+		w.err = err
+	}
+	// Never fail the caller's stream because of the cache.
+	return len(p), nil
+}
+
+func (c *CachedDriver) Get(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil {
+		c.lru.MoveToFront(e.elem)
+		// Open under the lock so an eviction can't remove the file in between.
+		f, err := os.Open(c.objectPath(e.name))
+		info := e.info
+		c.mu.Unlock()
+		if err == nil {
+			c.hits.Add(1)
+			return rangeFile(ctx, f, info, opts.Range)
+		}
+	} else {
+		c.mu.Unlock()
+	}
+
+	c.misses.Add(1)
+	if opts.Range != nil {
+		return c.backend.Get(ctx, key, opts)
+	}
+	rc, info, err := c.backend.Get(ctx, key, opts)
+	if err != nil || info.Size > c.maxEntry() {
+		return rc, info, err
+	}
+
+	// Cache the object as the caller reads it.
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), "fill-*")
+	if err != nil {
+		return rc, info, nil
+	}
+	c.mu.Lock()
+	c.seq++
+	token := c.seq
+	c.fills[key] = token
+	c.mu.Unlock()
+	return &fillReader{c: c, rc: rc, f: tmp, info: info, token: token}, info, nil
+}
+
+// rangeFile returns the requested part of a cached file.
+func rangeFile(ctx context.Context, f *os.File, info ObjectInfo, rg *Range) (io.ReadCloser, ObjectInfo, error) {
+	var r io.Reader = f
+	if rg != nil {
+		if _, err := f.Seek(rg.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, ObjectInfo{}, err
+		}
+		if rg.Length > 0 {
+			r = io.LimitReader(f, rg.Length)
+		}
+	}
+	return readCloser{ContextReader(ctx, r), f}, info, nil
+}
+
+// fillReader passes a backend object through to the caller while writing it to the cache.
+type fillReader struct {
+	c     *CachedDriver
+	rc    io.ReadCloser
+	f     *os.File
+	info  ObjectInfo
+	token uint64
+	n     int64
+	err   error
+	done  bool
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if n > 0 && r.err == nil {
+		if _, werr := r.f.Write(p[:n]); werr != nil {
+			r.err = werr
+		}
+		r.n += int64(n)
+	}
+	if err == io.EOF && r.err == nil && !r.done && r.n == r.info.Size {
+		r.done = true
+		r.commit()
+	}
+	return n, err
+}
+
+func (r *fillReader) commit() {
+	if r.f.Close() != nil {
+		return
+	}
+	r.c.mu.Lock()
+	defer r.c.mu.Unlock()
+	// A write or delete since the read started makes this copy stale.
+	if r.c.fills[r.info.Key] != r.token {
+		return
+	}
+	r.c.insertLocked(r.f.Name(), r.info, false)
+}
+
+func (r *fillReader) Close() error {
+	r.f.Close()
+	os.Remove(r.f.Name())
+	if !r.done {
+		r.c.mu.Lock()
+		if r.c.fills[r.info.Key] == r.token {
+			delete(r.c.fills, r.info.Key)
+		}
+		r.c.mu.Unlock()
+	}
+	return r.rc.Close()
+}
+
+func (c *CachedDriver) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	clean, err := CleanKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	c.mu.Lock()
+	e := c.entries[clean]
+	c.mu.Unlock()
+	if e != nil {
+		if err := ctx.Err(); err != nil {
+			return ObjectInfo{}, err
+		}
+		return e.info, nil
+	}
+	return c.backend.Stat(ctx, key)
+}
+
+func (c *CachedDriver) List(ctx context.Context, prefix string, opts ListOptions) (ListResult, error) {
+	if c.mode == WriteBack {
+		if dirty := c.dirtyListing(prefix, opts.Recursive); len(dirty) > 0 {
+			return c.listWithDirty(ctx, prefix, opts, dirty)
+		}
+	}
+	return c.backend.List(ctx, prefix, opts)
+}
+
+// dirtyListing returns the dirty objects a listing of prefix would include.
+func (c *CachedDriver) dirtyListing(prefix string, recursive bool) []ObjectInfo {
+	prefix, err := cleanPrefix(prefix)
+	if err != nil {
+		return nil
+	}
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i+1]
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []ObjectInfo
+	for k, e := range c.entries {
+		if !e.dirty || !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if !recursive && strings.Contains(k[len(dir):], "/") {
+			continue
+		}
+		out = append(out, e.info)
+	}
+	return out
+}
+
+// listWithDirty merges the dirty objects the backend doesn't have yet into its listing.
+// The whole backend listing is needed to paginate the result, but this only happens
+// while uploads into the listed directory are pending.
+func (c *CachedDriver) listWithDirty(ctx context.Context, prefix string, opts ListOptions, dirty []ObjectInfo) (ListResult, error) {
+	byKey := make(map[string]ObjectInfo)
+	l := &lister{ctx: ctx, d: c.backend, prefix: prefix, recursive: opts.Recursive}
+	for {
+		e, ok := l.peek()
+		if !ok {
+			break
+		}
+		byKey[e.Key] = e
+		l.next()
+	}
+	if l.err != nil {
+		return ListResult{}, l.err
+	}
+	for _, e := range dirty {
+		byKey[e.Key] = e
+	}
+	entries := make([]ObjectInfo, 0, len(byKey))
+	for _, e := range byKey {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return paginate(entries, opts)
+}
+
+func (c *CachedDriver) Delete(ctx context.Context, key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	defer c.locks.lock(true, key)()
+
+	wasDirty := false
+	for _, k := range c.dirtyKeys(key) {
+		if k != key {
+			// A directory with pending uploads is not empty.
+			return &fs.PathError{Op: "delete", Path: key, Err: ErrNotEmpty}
+		}
+		wasDirty = true
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err = c.backend.Delete(ctx, key)
+	if errors.Is(err, ErrNotFound) && wasDirty {
+		// Never reached the backend.
+		err = nil
+	}
+	// After any other failure the pending upload stays: dropping it would bring back
+	// whatever older version the backend still has.
+	if err == nil || errors.Is(err, ErrNotFound) {
+		c.invalidate(key, false)
+	}
+	return err
+}
+
+func (c *CachedDriver) Copy(ctx context.Context, src, dst string) error {
+	src, err := CleanKey(src)
+	if err != nil {
+		return err
+	}
+	dst, err = CleanKey(dst)
+	if err != nil {
+		return err
+	}
+	defer c.locks.lock(true, src, dst)()
+	if err := c.flushTree(ctx, src); err != nil {
+		return err
+	}
+	if err := c.backend.Copy(ctx, src, dst); err != nil {
+		return err
+	}
+	// This also drops a pending upload of dst, which must not overwrite the copy later.
+	c.invalidate(dst, false)
+	return nil
+}
+
+func (c *CachedDriver) Rename(ctx context.Context, src, dst string) error {
+	src, err := CleanKey(src)
+	if err != nil {
+		return err
+	}
+	dst, err = CleanKey(dst)
+	if err != nil {
+		return err
+	}
+	defer c.locks.lock(true, src, dst)()
+	if err := c.flushTree(ctx, src); err != nil {
+		return err
+	}
+	if err := c.backend.Rename(ctx, src, dst); err != nil {
+		return err
+	}
+	c.invalidate(src, true)
+	c.invalidate(dst, true)
+	return nil
+}
+
+func (c *CachedDriver) Mkdir(ctx context.Context, key string) error {
+	clean, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	_, cached := c.entries[clean]
+	c.mu.Unlock()
+	if cached {
+		return &fs.PathError{Op: "mkdir", Path: clean, Err: ErrExist}
+	}
+	return c.backend.Mkdir(ctx, key)
+}
+
+// Flush uploads every dirty object now.
+func (c *CachedDriver) Flush(ctx context.Context) error {
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+	return c.flushAll(ctx)
+}
+
+// flushAll uploads every dirty object, locking each key while it is uploaded.
+// uploadMu must be held.
+func (c *CachedDriver) flushAll(ctx context.Context) error {
+	for _, k := range c.dirtyKeys("") {
+		unlock := c.locks.lock(false, k)
+		err := c.upload(ctx, k)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushTree uploads the dirty objects at or below key. The caller holds a lock on key.
+func (c *CachedDriver) flushTree(ctx context.Context, key string) error {
+	for _, k := range c.dirtyKeys(key) {
+		if err := c.upload(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload sends one dirty object to the backend. The caller holds a lock on key.
+func (c *CachedDriver) upload(ctx context.Context, key string) error {
+	c.mu.Lock()
+	e := c.entries[key]
+	if e == nil || !e.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	gen, info := e.gen, e.info
+	f, err := os.Open(c.objectPath(e.name))
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	err = c.backend.Put(ctx, key, f, PutOptions{
+		ContentType: info.ContentType,
+		Checksum:    info.Checksum,
+		Metadata:    info.Metadata,
+	})
+	f.Close()
+	if err != nil {
+		msg := fmt.Sprintf("upload %s: %v", key, err)
+		c.uploadErr.Store(&msg)
+		return err
+	}
+	c.uploadErr.Store(nil)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// If it was written again meanwhile, the newer version still needs uploading.
+	if cur := c.entries[key]; cur == e && cur.gen == gen {
+		e.dirty = false
+		os.Remove(c.journalPath(e.name))
+		c.evictLocked()
+	}
+	return nil
+}
+
+// uploader drains dirty objects in the background until Close.
+func (c *CachedDriver) uploader() {
+	defer close(c.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.stop
+		cancel()
+	}()
+
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.wake:
+		case <-retry.C:
+		}
+		c.uploadMu.Lock()
+		err := c.flushAll(ctx)
+		c.uploadMu.Unlock()
+		if err != nil {
+			retry.Reset(cacheRetryInterval)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/internal/storage/drivertest"
+)
+
+func TestCachedDriver(t *testing.T) {
+	for _, mode := range []storage.CacheMode{storage.WriteThrough, storage.WriteBack} {
+		t.Run(mode.String(), func(t *testing.T) {
+			drivertest.Run(t, func(t *testing.T) storage.Driver {
+				c, err := storage.NewCachedDriver(storage.NewDiskDriver(t.TempDir()), t.TempDir(), 64<<20, mode)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() {
+					if err := c.Flush(context.Background()); err != nil {
+						t.Errorf("Flush: %v", err)
+					}
+					c.Close()
+				})
+				return c
+			})
+		})
+	}
+}
+
+// offlineBackend fails every write while offline is set.
+type offlineBackend struct {
+	storage.Driver
+	offline atomic.Bool
+}
+
+var errOffline = errors.New("backend offline")
+
+func (d *offlineBackend) Put(ctx context.Context, key string, r io.Reader, opts storage.PutOptions) error {
+	if d.offline.Load() {
+		io.Copy(io.Discard, r)
+		return errOffline
+	}
+	return d.Driver.Put(ctx, key, r, opts)
+}
+
+func (d *offlineBackend) Delete(ctx context.Context, key string) error {
+	if d.offline.Load() {
+		return errOffline
+	}
+	return d.Driver.Delete(ctx, key)
+}
+
+func readAll(t *testing.T, d storage.Driver, key string) string {
+	t.Helper()
+	rc, _, err := d.Get(context.Background(), key, storage.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(data)
+}
+
+func TestCachedDriverEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	// Room for four 900-byte objects.
+	c, err := storage.NewCachedDriver(storage.NewDiskDriver(t.TempDir()), t.TempDir(), 4000, storage.WriteThrough)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := strings.Repeat("x", 900)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := c.Put(ctx, k, strings.NewReader(data), storage.PutOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := c.Stats(); s.Entries != 4 || s.Bytes != 3600 || s.Evictions != 0 {
+		t.Fatalf("after four puts: %+v", s)
+	}
+	readAll(t, c, "a") // now b is the least recently used
+	if err := c.Put(ctx, "e", strings.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s := c.Stats()
+	if s.Entries != 4 || s.Bytes > 4000 || s.Evictions != 1 {
+		t.Fatalf("after the fifth put: %+v", s)
+	}
+
+	before := c.Stats()
+	readAll(t, c, "a")
+	readAll(t, c, "b")
+	after := c.Stats()
+	if after.Hits-before.Hits != 1 || after.Misses-before.Misses != 1 {
+		t.Errorf("reading a and b: %d hits, %d misses; want a cached and b evicted",
+			after.Hits-before.Hits, after.Misses-before.Misses)
+	}
+
+	// Objects over a quarter of the cache are never kept.
+	if err := c.Put(ctx, "big", strings.NewReader(strings.Repeat("y", 1001)), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	before = c.Stats()
+	readAll(t, c, "big")
+	if c.Stats().Misses != before.Misses+1 {
+		t.Error("an object larger than a quarter of the cache was served from it")
+	}
+}
+
+func TestCachedDriverHitRatio(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewDiskDriver(t.TempDir())
+	c, err := storage.NewCachedDriver(backend, t.TempDir(), 1<<20, storage.WriteThrough)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := backend.Put(ctx, "k", strings.NewReader("behind the cache"), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.Stats(); s.HitRatio() != 0 {
+		t.Errorf("hit ratio before any read = %v", s.HitRatio())
+	}
+	readAll(t, c, "k") // miss, fills the cache
+	readAll(t, c, "k") // hit
+	readAll(t, c, "k") // hit
+	rc, _, err := c.Get(ctx, "missing", storage.GetOptions{})
+	if err == nil {
+		rc.Close()
+	}
+	s := c.Stats()
+	if s.Hits != 2 || s.Misses != 2 {
+		t.Fatalf("Hits = %d, Misses = %d; want 2 and 2", s.Hits, s.Misses)
+	}
+	if s.HitRatio() != 0.5 {
+		t.Errorf("HitRatio = %v, want 0.5", s.HitRatio())
+	}
+}
+
+func TestCachedDriverRecoversPendingUploads(t *testing.T) {
+	ctx := context.Background()
+	disk := storage.NewDiskDriver(t.TempDir())
+	dir := t.TempDir()
+
+	backend := &offlineBackend{Driver: disk}
+	backend.offline.Store(true)
+	c, err := storage.NewCachedDriver(backend, dir, 1<<20, storage.WriteBack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := storage.PutOptions{ContentType: "text/plain", Metadata: map[string]string{"k": "v"}}
+	if err := c.Put(ctx, "docs/pending.txt", strings.NewReader("not uploaded yet"), opts); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := disk.Stat(ctx, "docs/pending.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("backend already has the object: %v", err)
+	}
+
+	// Restarted while the backend is still down: the upload is pending and readable.
+	backend = &offlineBackend{Driver: disk}
+	backend.offline.Store(true)
+	c, err = storage.NewCachedDriver(backend, dir, 1<<20, storage.WriteBack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Dirty != 1 || s.Entries != 1 {
+		t.Errorf("after restart: %+v, want one pending upload", s)
+	}
+	if got := readAll(t, c, "docs/pending.txt"); got != "not uploaded yet" {
+		t.Errorf("pending object reads %q", got)
+	}
+	res, err := c.List(ctx, "docs/", storage.ListOptions{})
+	if err != nil || len(res.Entries) != 1 {
+		t.Errorf("List = %v, %v; want the pending object", res.Entries, err)
+	}
+	c.Close()
+
+	// Restarted with the backend up: the upload completes with its metadata.
+	c, err = storage.NewCachedDriver(disk, dir, 1<<20, storage.WriteBack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.Dirty != 0 {
+		t.Errorf("%d uploads still pending after Flush", s.Dirty)
+	}
+	if got := readAll(t, disk, "docs/pending.txt"); got != "not uploaded yet" {
+		t.Errorf("backend has %q", got)
+	}
+	info, err := disk.Stat(ctx, "docs/pending.txt")
+	if err != nil || info.ContentType != "text/plain" || info.Metadata["k"] != "v" {
+		t.Errorf("backend object %+v, %v; want the journaled metadata", info, err)
+	}
+}
+
+// A Delete the backend fails keeps the pending upload, rather than going back to the
+// older version the backend has.
+func TestCachedDriverFailedDeleteKeepsPendingUpload(t *testing.T) {
+	ctx := context.Background()
+	backend := &offlineBackend{Driver: storage.NewDiskDriver(t.TempDir())}
+	c, err := storage.NewCachedDriver(backend, t.TempDir(), 1<<20, storage.WriteBack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Put(ctx, "k", strings.NewReader("v1"), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	backend.offline.Store(true)
+	if err := c.Put(ctx, "k", strings.NewReader("v2"), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "k"); !errors.Is(err, errOffline) {
+		t.Fatalf("Delete = %v, want the backend's error", err)
+	}
+	if got := readAll(t, c, "k"); got != "v2" {
+		t.Errorf("after a failed Delete k reads %q, want the last write v2", got)
+	}
+
+	backend.offline.Store(false)
+	if err := c.Delete(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(ctx, "k"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Stat after Delete = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrChecksum is returned at the end of a read whose content does not match the
+// recorded checksum, and by Put when the content does not match the checksum supplied
+// with it.
+var ErrChecksum = errors.New("storage: checksum mismatch")
+
+// checksumTimeKey records when the checksum was computed, to tell files modified behind
+// the server's back (newer than that) from silent corruption.
+const checksumTimeKey = "atlas-checksum-time"
+
+// checksumSlack absorbs the gap between computing the checksum and the backend
+// stamping the object's modification time.
+const checksumSlack = 2 * time.Second
+
+// ChecksumDriver records a SHA-256 of every object written through it as
+// ObjectInfo.Checksum ("sha256:<hex>") and checks it whenever an object is read in full.
+// A SHA-256 supplied by the caller is checked against the content instead, failing the
+// Put if they differ; checksums of other algorithms are recorded as given. Verify and
+// Scrub check stored objects on demand.
+type ChecksumDriver struct {
+	inner Driver
+
+	// OnMismatch, if set, is called with the context of the Get when a read through it
+	// finds a checksum mismatch.
+	OnMismatch func(context.Context, CheckResult)
+
+	mu   sync.Mutex
+	last *ScrubSummary
+}
+
+var _ Driver = (*ChecksumDriver)(nil)
+
+// NewChecksumDriver wraps inner.
+func NewChecksumDriver(inner Driver) *ChecksumDriver {
+	return &ChecksumDriver{inner: inner}
+}
+
+// CheckStatus is the outcome of verifying one object.
+type CheckStatus int
+
+const (
+	// CheckOK means the content matches its checksum.
+	CheckOK CheckStatus = iota
+	// CheckMissing means no checksum was recorded (written before checksums were enabled).
+	CheckMissing
+	// CheckCorrupt means the content changed although the object was not rewritten: bit rot.
+	CheckCorrupt
+	// CheckModified means the content changed and the object is newer than its checksum,
+	// i.e. it was modified behind the server's back.
+	CheckModified
+	// CheckUnreadable means the object could not be read at all.
+	CheckUnreadable
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckOK:
+		return "ok"
+	case CheckMissing:
+		return "no checksum"
+	case CheckCorrupt:
+		return "corrupt"
+	case CheckModified:
+		return "modified outside Atlas"
+	case CheckUnreadable:
+		return "unreadable"
+	}
+	return fmt.Sprintf("CheckStatus(%d)", int(s))
+}
+
+// CheckResult describes the verification of one object.
+type CheckResult struct {
+	Key    string
+	Size   int64
+	Status CheckStatus
+	// Want is the recorded checksum and Got the one of the current content.
+	Want, Got string
+	// Err is the read error for CheckUnreadable.
+	Err error
+}
+
+// ScrubSummary counts the results of a Scrub.
+type ScrubSummary struct {
+	Started, Finished time.Time
+	Checked           int
+	Bytes             int64
+	OK                int
+	Missing           int
+	Corrupt           int
+	Modified          int
+	Unreadable        int
+}
+
+// Problems returns the number of objects that failed verification.
+func (s ScrubSummary) Problems() int {
+	return s.Corrupt + s.Modified + s.Unreadable
+}
+
+func (s *ScrubSummary) add(r CheckResult) {
+	s.Checked++
+	s.Bytes += r.Size
+	switch r.Status {
+	case CheckOK:
+		s.OK++
+	case CheckMissing:
+		s.Missing++
+	case CheckCorrupt:
+		s.Corrupt++
+	case CheckModified:
+		s.Modified++
+	case CheckUnreadable:
+		s.Unreadable++
+	}
+}
+
+func checksumOf(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// outerChecksumInfo hides the bookkeeping metadata.
+func outerChecksumInfo(info ObjectInfo) ObjectInfo {
+	if _, ok := info.Metadata[checksumTimeKey]; !ok {
+		return info
+	}
+	md := make(map[string]string, len(info.Metadata))
+	for k, v := range info.Metadata {
+		if k != checksumTimeKey {
+			md[k] = v
+		}
+	}
+	if len(md) == 0 {
+		md = nil
+	}
+	info.Metadata = md
+	return info
+}
+
+func (c *ChecksumDriver) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	cr := &checksumReader{r: r, h: sha256.New(), key: key, opts: opts}
+	iopts := opts
+	iopts.Trailer = func(o *PutOptions) {
+		final := cr.final()
+		o.ContentType = final.ContentType
+		o.Checksum = final.Checksum
+		if o.Checksum == "" || strings.HasPrefix(o.Checksum, "sha256:") {
+			o.Checksum = checksumOf(cr.h)
+		}
+		o.Metadata = map[string]string{checksumTimeKey: time.Now().UTC().Format(time.RFC3339Nano)}
+		for k, v := range final.Metadata {
+			o.Metadata[k] = v
+		}
+	}
+	return c.inner.Put(ctx, key, cr, iopts)
+}
+
+// checksumReader hashes the content of a Put. At EOF it compares the hash with the
+// checksum the caller supplied, which a Trailer may only fill in then, and fails the
+// read on a mismatch so the object is not committed.
+type checksumReader struct {
+	r    io.Reader
+	h    hash.Hash
+	key  string
+	opts PutOptions
+	fin  *PutOptions
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		want := r.final().Checksum
+		if got := checksumOf(r.h); strings.HasPrefix(want, "sha256:") && !strings.EqualFold(want, got) {
+			return n, fmt.Errorf("%s: %w (supplied %s, received %s)", r.key, ErrChecksum, want, got)
+		}
+	}
+	return n, err
+}
+
+// final runs the caller's Trailer once.
+func (r *checksumReader) final() PutOptions {
+	if r.fin == nil {
+		fin := r.opts.Final()
+		r.fin = &fin
+	}
+	return *r.fin
+}
+
+func (c *ChecksumDriver) Get(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, ObjectInfo, error) {
+	rc, info, err := c.inner.Get(ctx, key, opts)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	want := info.Checksum
+	info = outerChecksumInfo(info)
+	if opts.Range != nil || !strings.HasPrefix(want, "sha256:") {
+		return rc, info, nil
+	}
+	return &verifyReader{ctx: ctx, rc: rc, h: sha256.New(), info: info, want: want, onMismatch: c.OnMismatch}, info, nil
+}
+
+// verifyReader hashes an object as it is read and fails the final read on a mismatch.
+// The check runs at EOF or as soon as info.Size bytes are read, since readers that know
+// the size (like http.ServeContent) stop there without reading to EOF.
+type verifyReader struct {
+	ctx        context.Context
+	rc         io.ReadCloser
+	h          hash.Hash
+	info       ObjectInfo
+	want       string
+	onMismatch func(context.Context, CheckResult)
+	n          int64
+	checked    bool
+}
+
+func (r *verifyReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	if !r.checked && (err == io.EOF || r.n == r.info.Size) {
+		r.checked = true
+		if got := checksumOf(r.h); got != r.want {
+			if r.onMismatch != nil {
+				r.onMismatch(r.ctx, CheckResult{Key: r.info.Key, Size: r.info.Size, Status: CheckCorrupt, Want: r.want, Got: got})
+			}
+			return n, fmt.Errorf("%s: %w (stored %s, read %s)", r.info.Key, ErrChecksum, r.want, got)
+		}
+	}
+	return n, err
+}
+
+func (r *verifyReader) Close() error {
+	return r.rc.Close()
+}
+
+func (c *ChecksumDriver) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := c.inner.Stat(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return outerChecksumInfo(info), nil
+}
+
+func (c *ChecksumDriver) List(ctx context.Context, prefix string, opts ListOptions) (ListResult, error) {
+	res, err := c.inner.List(ctx, prefix, opts)
+	if err != nil {
+		return res, err
+	}
+	for i := range res.Entries {
+		res.Entries[i] = outerChecksumInfo(res.Entries[i])
+	}
+	return res, nil
+}
+
+func (c *ChecksumDriver) Delete(ctx context.Context, key string) error {
+	return c.inner.Delete(ctx, key)
+}
+
+func (c *ChecksumDriver) Copy(ctx context.Context, src, dst string) error {
+	return c.inner.Copy(ctx, src, dst)
+}
+
+func (c *ChecksumDriver) Rename(ctx context.Context, src, dst string) error {
+	return c.inner.Rename(ctx, src, dst)
+}
+
+func (c *ChecksumDriver) Mkdir(ctx context.Context, key string) error {
+	return c.inner.Mkdir(ctx, key)
+}
+
+// Verify reads key in full and compares it with its recorded checksum.
+// The error is only set for problems other than the object's content (e.g. cancellation).
+func (c *ChecksumDriver) Verify(ctx context.Context, key string) (CheckResult, error) {
+	rc, info, err := c.inner.Get(ctx, key, GetOptions{})
+	if err != nil {
+		if ctx.Err() != nil {
+			return CheckResult{}, ctx.Err()
+		}
+		return CheckResult{Key: key, Status: CheckUnreadable, Err: err}, nil
+	}
+	defer rc.Close()
+
+	res := CheckResult{Key: info.Key, Size: info.Size, Want: info.Checksum}
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		if ctx.Err() != nil {
+			return CheckResult{}, ctx.Err()
+		}
+		res.Status, res.Err = CheckUnreadable, err
+		return res, nil
+	}
+	res.Got = checksumOf(h)
+
+	switch {
+	case !strings.HasPrefix(res.Want, "sha256:"):
+		res.Status = CheckMissing
+	case res.Got == res.Want:
+		res.Status = CheckOK
+	default:
+		res.Status = CheckCorrupt
+		if at, err := time.Parse(time.RFC3339Nano, info.Metadata[checksumTimeKey]); err == nil &&
+			info.ModTime.After(at.Add(checksumSlack)) {
+			res.Status = CheckModified
+		}
+	}
+	return res, nil
+}
+
+// Update rewrites key so its checksum matches the current content, accepting whatever
+// the object holds now.
+func (c *ChecksumDriver) Update(ctx context.Context, key string) error {
+	rc, info, err := c.inner.Get(ctx, key, GetOptions{})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	info = outerChecksumInfo(info)
+	return c.Put(ctx, key, rc, PutOptions{ContentType: info.ContentType, Metadata: info.Metadata})
+}
+
+// Scrub verifies every object below prefix ("" for all), passing each result to fn.
+func (c *ChecksumDriver) Scrub(ctx context.Context, prefix string, fn func(CheckResult)) (ScrubSummary, error) {
+	sum := ScrubSummary{Started: time.Now()}
+	l := &lister{ctx: ctx, d: c.inner, prefix: prefix, recursive: true}
+	for {
+		e, ok := l.peek()
+		if !ok {
+			break
+		}
+		l.next()
+		if e.IsDir() {
+			continue
+		}
+		res, err := c.Verify(ctx, e.Key)
+		if err != nil {
+			return sum, err
+		}
+		if errors.Is(res.Err, ErrNotFound) {
+			// Deleted since it was listed.
+			continue
+		}
+		sum.add(res)
+		fn(res)
+	}
+	if l.err != nil {
+		return sum, l.err
+	}
+	sum.Finished = time.Now()
+
+	c.mu.Lock()
+	c.last = &sum
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// LastScrub returns the summary of the last complete Scrub, if any.
+func (c *ChecksumDriver) LastScrub() (ScrubSummary, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last == nil {
+		return ScrubSummary{}, false
+	}
+	return *c.last, true
+}
+
+// RunScrubber scrubs the whole store every interval until ctx is cancelled, passing
+// every object that fails verification to problem and each summary to done.
+func (c *ChecksumDriver) RunScrubber(ctx context.Context, interval time.Duration, problem func(CheckResult), done func(ScrubSummary, error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		sum, err := c.Scrub(ctx, "", func(r CheckResult) {
+			if r.Status != CheckOK && r.Status != CheckMissing {
+				problem(r)
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		done(sum, err)
+	}
+}
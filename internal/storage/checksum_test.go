@@ -0,0 +1,78 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/internal/storage/drivertest"
+)
+
+func TestChecksumDriver(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) storage.Driver {
+		return storage.NewChecksumDriver(storage.NewDiskDriver(t.TempDir()))
+	})
+}
+
+// sha256 of "hello"
+const helloSum = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestChecksumPutVerifiesSuppliedChecksum(t *testing.T) {
+	ctx := context.Background()
+	c := storage.NewChecksumDriver(storage.NewDiskDriver(t.TempDir()))
+	if err := c.Put(ctx, "a", strings.NewReader("hello"), storage.PutOptions{Checksum: helloSum}); err != nil {
+		t.Fatal(err)
+	}
+	err := c.Put(ctx, "a", strings.NewReader("jello"), storage.PutOptions{Checksum: helloSum})
+	if !errors.Is(err, storage.ErrChecksum) {
+		t.Fatalf("Put with a wrong checksum: %v, want ErrChecksum", err)
+	}
+	// A checksum only known once the content has been read is checked too.
+	err = c.Put(ctx, "a", strings.NewReader("jello"), storage.PutOptions{
+		Trailer: func(o *storage.PutOptions) { o.Checksum = helloSum },
+	})
+	if !errors.Is(err, storage.ErrChecksum) {
+		t.Fatalf("Put with a wrong trailer checksum: %v, want ErrChecksum", err)
+	}
+
+	rc, info, err := c.Get(ctx, "a", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, _ := io.ReadAll(rc); string(data) != "hello" || info.Checksum != helloSum {
+		t.Errorf("after failed Puts: %q, %s; want the previous object", data, info.Checksum)
+	}
+}
+
+func TestChecksumGetDetectsCorruption(t *testing.T) {
+	ctx := context.Background()
+	disk := storage.NewDiskDriver(t.TempDir())
+	c := storage.NewChecksumDriver(disk)
+	var reported []storage.CheckResult
+	c.OnMismatch = func(_ context.Context, r storage.CheckResult) { reported = append(reported, r) }
+
+	// Written around the ChecksumDriver, so the recorded checksum is wrong.
+	if err := disk.Put(ctx, "a", strings.NewReader("jello"), storage.PutOptions{Checksum: helloSum}); err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := c.Get(ctx, "a", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); !errors.Is(err, storage.ErrChecksum) {
+		t.Errorf("read: %v, want ErrChecksum", err)
+	}
+	if len(reported) != 1 || reported[0].Status != storage.CheckCorrupt {
+		t.Errorf("OnMismatch got %+v", reported)
+	}
+
+	res, err := c.Verify(ctx, "a")
+	if err != nil || res.Status != storage.CheckCorrupt {
+		t.Errorf("Verify = %+v, %v; want corrupt", res, err)
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Content-defined chunking parameters. Boundaries depend only on the bytes around them,
+// so inserting data near the start of a file does not shift every later chunk and
+// identical regions of different files produce identical chunks.
+//
+// Changing any of these (or the gear table) changes where files are cut and therefore
+// which chunks are shared, so they are effectively part of the on-disk format.
+const (
+	minChunkSize = 256 << 10
+	avgChunkBits = 20 // 1 MiB average
+	maxChunkSize = 4 << 20
+)
+
+// gear is the random table of the gear rolling hash, derived deterministically so
+// every build cuts files at the same places.
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(i)})
+		gear[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+}
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int // bytes buffered
+	cut int // length of the chunk returned by the previous Next
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, maxChunkSize)}
+}
+
+// Next returns the next chunk, or io.EOF when the stream is exhausted.
+// The returned slice is only valid until the following call.
+func (c *chunker) Next() ([]byte, error) {
+	// Drop the chunk handed out last time and refill the buffer.
+	c.n = copy(c.buf, c.buf[c.cut:c.n])
+	c.cut = 0
+	for !c.eof && c.n < len(c.buf) {
+		m, err := c.r.Read(c.buf[c.n:])
+		c.n += m
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	c.cut = c.boundary(c.buf[:c.n])
+	return c.buf[:c.cut], nil
+}
+
+// boundary returns the length of the first chunk in b.
+func (c *chunker) boundary(b []byte) int {
+	if len(b) <= minChunkSize {
+		return len(b)
+	}
+	const mask = uint64(1<<avgChunkBits-1) << (64 - avgChunkBits)
+	var h uint64
+	for i := minChunkSize; i < len(b); i++ {
+		h = h<<1 + gear[b[i]]
+		if h&mask == 0 {
+			return i + 1
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Metadata fields the CompressedDriver keeps on the inner object. They are hidden from callers.
+const (
+	compressionKey   = "atlas-compression"
+	originalSizeKey  = "atlas-original-size"
+	compressionProbe = 128 << 10
+	// compressionGain is the largest compressed/original ratio of the probe for which
+	// compression is still considered worth it.
+	compressionGain = 0.9
+)
+
+// Compression algorithms supported by CompressedDriver.
+const (
+	CompressZstd = "zstd"
+	CompressGzip = "gzip"
+)
+
+// incompressibleTypes lists media types (or type/ prefixes) that are already compressed.
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/vnd.rar",
+	"application/x-xz", "application/x-bzip2", "application/x-compress", "application/x-lzma",
+	"application/java-archive", "application/epub+zip", "application/pdf",
+	"application/vnd.openxmlformats-officedocument.", "application/vnd.oasis.opendocument.",
+	"font/woff", "font/woff2",
+}
+
+// compressibleImages are the exceptions among image types: formats that are plain text or raw pixels.
+var compressibleImages = []string{"image/svg+xml", "image/bmp", "image/x-ms-bmp", "image/tiff"}
+
+// CompressedDriver compresses objects before handing them to another Driver and
+// decompresses them on read. Callers always see the original content and size.
+//
+// Objects are stored uncompressed when their type is known to be compressed already
+// (by content type, or by extension via the mime package like the server's mimeMiddleware)
+// or when compressing the first 128 KiB does not save at least 10%.
+// Ranged reads have to decompress from the start of the object up to the range.
+type CompressedDriver struct {
+	inner Driver
+	algo  string
+}
+
+var _ Driver = (*CompressedDriver)(nil)
+
+// NewCompressedDriver wraps inner, compressing with algo (CompressZstd or CompressGzip).
+func NewCompressedDriver(inner Driver, algo string) (*CompressedDriver, error) {
+	if algo != CompressZstd && algo != CompressGzip {
+		return nil, fmt.Errorf("storage: unknown compression %q (want zstd or gzip)", algo)
+	}
+	return &CompressedDriver{inner: inner, algo: algo}, nil
+}
+
+// worthCompressing decides from the media type whether compression can pay off.
+func worthCompressing(key, contentType string) bool {
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+	contentType, _, _ = strings.Cut(strings.ToLower(contentType), ";")
+	contentType = strings.TrimSpace(contentType)
+	for _, t := range compressibleImages {
+		if contentType == t {
+			return true
+		}
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *CompressedDriver) newWriter(w io.Writer) (io.WriteCloser, error) {
+	if c.algo == CompressGzip {
+		return gzip.NewWriter(w), nil
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+func newDecompressor(algo string, r io.Reader) (io.ReadCloser, error) {
+	switch algo {
+	case CompressGzip:
+		return gzip.NewReader(r)
+	case CompressZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("storage: object compressed with unknown algorithm %q", algo)
+}
+
+// beneficial compresses a sample and reports whether it shrank enough.
+func (c *CompressedDriver) beneficial(sample []byte) bool {
+	if len(sample) < 512 {
+		// Not worth the framing overhead.
+		return false
+	}
+	var buf bytes.Buffer
+	w, err := c.newWriter(&buf)
+	if err != nil {
+		return false
+	}
+	w.Write(sample)
+	w.Close()
+	return float64(buf.Len()) <= float64(len(sample))*compressionGain
+}
+
+func (c *CompressedDriver) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	if _, err := CleanKey(key); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, compressionProbe)
+	if !worthCompressing(key, opts.ContentType) {
+		return c.inner.Put(ctx, key, br, opts)
+	}
+	sample, err := br.Peek(compressionProbe)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	if !c.beneficial(sample) {
+		return c.inner.Put(ctx, key, br, opts)
+	}
+
+	// Compress on the fly through a pipe, counting the original bytes for the metadata.
+	src := &countingReader{r: br}
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := c.newWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(w, src); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	// Stop the compressor if the inner driver gives up before reading everything.
+	defer pr.CloseWithError(errors.New("storage: put aborted"))
+
+	iopts := opts
+	iopts.Trailer = func(o *PutOptions) {
+		final := opts.Final()
+		o.ContentType, o.Checksum = final.ContentType, final.Checksum
+		o.Metadata = map[string]string{
+			compressionKey:  c.algo,
+			originalSizeKey: strconv.FormatInt(src.n, 10),
+		}
+		for k, v := range final.Metadata {
+			o.Metadata[k] = v
+		}
+	}
+	return c.inner.Put(ctx, key, pr, iopts)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// outerCompressedInfo reports the original size and hides the bookkeeping metadata.
+func outerCompressedInfo(info ObjectInfo) ObjectInfo {
+	if info.IsDir() || info.Metadata[compressionKey] == "" {
+		return info
+	}
+	if n, err := strconv.ParseInt(info.Metadata[originalSizeKey], 10, 64); err == nil {
+		info.Size = n
+	}
+	md := make(map[string]string, len(info.Metadata))
+	for k, v := range info.Metadata {
+		if k != compressionKey && k != originalSizeKey {
+			md[k] = v
+		}
+	}
+	if len(md) == 0 {
+		md = nil
+	}
+	info.Metadata = md
+	return info
+}
+
+func (c *CompressedDriver) Get(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, ObjectInfo, error) {
+	// The object read decides how to decode it, so an overwrite in between can't switch
+	// it from stored as is to compressed or back.
+	rc, info, err := c.inner.Get(ctx, key, opts)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if info.Metadata[compressionKey] == "" {
+		// Stored as is; the inner driver applied the range.
+		return rc, info, nil
+	}
+	if opts.Range != nil {
+		// The range is in the original content, so the object is decompressed from the start.
+		rc.Close()
+		if rc, info, err = c.inner.Get(ctx, key, GetOptions{}); err != nil {
+			return nil, ObjectInfo{}, err
+		}
+	}
+
+	var src io.ReadCloser = rc
+	if algo := info.Metadata[compressionKey]; algo != "" {
+		dec, err := newDecompressor(algo, rc)
+		if err != nil {
+			rc.Close()
+			return nil, ObjectInfo{}, err
+		}
+		src = readCloser{dec, closers{dec, rc}}
+		info = outerCompressedInfo(info)
+	}
+
+	var r io.Reader = src
+	if rg := opts.Range; rg != nil {
+		if _, err := io.CopyN(io.Discard, src, rg.Offset); err != nil && err != io.EOF {
+			src.Close()
+			return nil, ObjectInfo{}, err
+		}
+		if rg.Length > 0 {
+			r = io.LimitReader(src, rg.Length)
+		}
+	}
+	return readCloser{r, src}, info, nil
+}
+
+// closers closes several io.Closers in order, returning the first error.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (c *CompressedDriver) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := c.inner.Stat(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return outerCompressedInfo(info), nil
+}
+
+func (c *CompressedDriver) Delete(ctx context.Context, key string) error {
+	return c.inner.Delete(ctx, key)
+}
+
+func (c *CompressedDriver) Copy(ctx context.Context, src, dst string) error {
+	return c.inner.Copy(ctx, src, dst)
+}
+
+func (c *CompressedDriver) Rename(ctx context.Context, src, dst string) error {
+	return c.inner.Rename(ctx, src, dst)
+}
+
+func (c *CompressedDriver) Mkdir(ctx context.Context, key string) error {
+	return c.inner.Mkdir(ctx, key)
+}
+
+func (c *CompressedDriver) List(ctx context.Context, prefix string, opts ListOptions) (ListResult, error) {
+	res, err := c.inner.List(ctx, prefix, opts)
+	if err != nil {
+		return res, err
+	}
+	for i := range res.Entries {
+		res.Entries[i] = outerCompressedInfo(res.Entries[i])
+	}
+	return res, nil
+}
@@ -0,0 +1,115 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/internal/storage/drivertest"
+)
+
+func TestCompressedDriver(t *testing.T) {
+	for _, algo := range []string{storage.CompressZstd, storage.CompressGzip} {
+		t.Run(algo, func(t *testing.T) {
+			drivertest.Run(t, func(t *testing.T) storage.Driver {
+				d, err := storage.NewCompressedDriver(storage.NewDiskDriver(t.TempDir()), algo)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return d
+			})
+		})
+	}
+}
+
+func TestCompressedDriverStoresSmaller(t *testing.T) {
+	ctx := context.Background()
+	disk := storage.NewDiskDriver(t.TempDir())
+	c, err := storage.NewCompressedDriver(disk, storage.CompressZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("a very compressible line of text\n"), 10000)
+	if err := c.Put(ctx, "log.txt", bytes.NewReader(data), storage.PutOptions{Metadata: map[string]string{"k": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := disk.Stat(ctx, "log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Size >= int64(len(data))/10 {
+		t.Errorf("stored %d bytes for %d bytes of repetitive text", stored.Size, len(data))
+	}
+
+	info, err := c.Stat(ctx, "log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("Stat size = %d, want the original %d", info.Size, len(data))
+	}
+	if len(info.Metadata) != 1 || info.Metadata["k"] != "v" {
+		t.Errorf("Stat metadata = %v, want only the caller's", info.Metadata)
+	}
+	entries, err := c.List(ctx, "", storage.ListOptions{})
+	if err != nil || len(entries.Entries) != 1 || entries.Entries[0].Size != int64(len(data)) {
+		t.Errorf("List = %+v, %v; want the original size", entries.Entries, err)
+	}
+
+	rc, info, err := c.Get(ctx, "log.txt", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get returned %d bytes, %v", len(got), err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("Get size = %d, want the original %d", info.Size, len(data))
+	}
+}
+
+func TestCompressedDriverSkipsCompressedTypes(t *testing.T) {
+	ctx := context.Background()
+	disk := storage.NewDiskDriver(t.TempDir())
+	c, err := storage.NewCompressedDriver(disk, storage.CompressGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compressible bytes, but the type says they are compressed already.
+	data := bytes.Repeat([]byte{0}, 256<<10)
+	cases := []struct {
+		key         string
+		contentType string
+	}{
+		{"photo", "image/jpeg"},
+		{"clip", "video/mp4; codecs=avc1"},
+		{"archive.zip", ""},
+		{"report.pdf", ""},
+	}
+	for _, tc := range cases {
+		if err := c.Put(ctx, tc.key, bytes.NewReader(data), storage.PutOptions{ContentType: tc.contentType}); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := disk.Stat(ctx, tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Size != int64(len(data)) || len(stored.Metadata) != 0 {
+			t.Errorf("%s (%q) stored as %d bytes with %v, want it as is", tc.key, tc.contentType, stored.Size, stored.Metadata)
+		}
+	}
+
+	// SVG is text, so it is compressed despite being an image type.
+	if err := c.Put(ctx, "drawing.svg", bytes.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := disk.Stat(ctx, "drawing.svg"); err != nil || stored.Size >= int64(len(data)) {
+		t.Errorf("drawing.svg stored as %d bytes, %v; want it compressed", stored.Size, err)
+	}
+}
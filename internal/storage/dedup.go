@@ -0,0 +1,811 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DedupDriver is a content-addressable Driver. Objects are split into content-defined
+// chunks, each chunk is stored once under its SHA-256, and every object is a small
+// manifest listing its chunks. Identical files (and identical regions of similar files)
+// therefore take the space of one copy.
+//
+// Layout under the root:
+//
+//	chunks/ab/abcdef...   chunk data, named by SHA-256
+//	manifests/<key>       one JSON manifest per object, in the same tree as the keys
+//	tmp/                  chunks being written
+//	leases/               one file per open reader, listing the chunks it reads
+//	gc.lock               keeps GC from removing a chunk an upload is reusing
+//
+// Chunks are not reference counted on disk. Counts are kept in memory and rebuilt from
+// the manifests on open, but they only pin chunks in use by this process: other processes
+// (atlas keys rotate, atlas fsck, the CLI) write manifests on the same store without this
+// one seeing them, so a count of zero doesn't mean no manifest refers to a chunk.
+// Unreferenced chunks, whether left by deleted and overwritten objects or by a crash, are
+// removed by GC, a mark and sweep over every manifest that spares recently used chunks.
+// Writers refresh the mtime of each chunk they reuse, and again when they commit the
+// manifest, under a shared lock on gc.lock; GC takes it exclusively to re-check a chunk
+// right before removing it. Readers do the same when they open an object, and hold a
+// lease on its chunks until they are closed, so a download keeps its data however long
+// it takes, even if the object is overwritten meanwhile. A lease is a file in leases/
+// its reader keeps a lock on; GC removes the ones left by a process that is gone.
+type DedupDriver struct {
+	RootPath string
+
+	manifests *DiskDriver
+
+	// commitMu serialises manifest updates so the chunks an object releases are
+	// always the ones its previous manifest referenced.
+	commitMu sync.Mutex
+
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+var _ Driver = (*DedupDriver)(nil)
+
+// manifest describes one object stored by the DedupDriver.
+type manifest struct {
+	Version     int               `json:"version"`
+	Size        int64             `json:"size"`
+	Chunks      []chunkRef        `json:"chunks"`
+	ContentType string            `json:"content_type,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type chunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// DedupStats reports how much space deduplication saves.
+type DedupStats struct {
+	Objects       int64
+	LogicalBytes  int64 // Sum of object sizes as seen by clients.
+	Chunks        int64
+	PhysicalBytes int64 // Bytes actually used by chunk files.
+}
+
+// Ratio is logical/physical; 2.0 means the data takes half the space it would on a plain disk.
+func (s DedupStats) Ratio() float64 {
+	if s.PhysicalBytes == 0 {
+		return 1
+	}
+	return float64(s.LogicalBytes) / float64(s.PhysicalBytes)
+}
+
+// GCResult summarises a garbage collection run.
+type GCResult struct {
+	ChunksRemoved int64
+	BytesFreed    int64
+	TempRemoved   int64
+}
+
+// NewDedupDriver opens (or initialises) a deduplicating store rooted at path.
+func NewDedupDriver(path string) (*DedupDriver, error) {
+	for _, dir := range []string{"chunks", "manifests", "tmp", "leases"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	d := &DedupDriver{
+		RootPath:  path,
+		manifests: NewDiskDriver(filepath.Join(path, "manifests")),
+		refs:      make(map[string]int),
+	}
+
+	// Rebuild reference counts from the manifests.
+	err := d.eachManifest(context.Background(), func(key string, m *manifest) error {
+		for _, c := range m.Chunks {
+			d.refs[c.Hash]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dedup: loading manifests: %w", err)
+	}
+	return d, nil
+}
+
+// IsDedupStore reports whether path looks like a DedupDriver root.
+func IsDedupStore(path string) bool {
+	for _, dir := range []string{"chunks", "manifests"} {
+		if fi, err := os.Stat(filepath.Join(path, dir)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *DedupDriver) chunkPath(hash string) string {
+	return filepath.Join(d.RootPath, "chunks", hash[:2], hash)
+}
+
+// acquire takes a reference on each chunk. Holding a reference guarantees the chunk file
+// is not removed, so callers take it before relying on a chunk being present.
+func (d *DedupDriver) acquire(chunks []chunkRef) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range chunks {
+		d.refs[c.Hash]++
+	}
+}
+
+// release drops references. Chunks nobody uses any more stay until GC removes them.
+func (d *DedupDriver) release(chunks []chunkRef) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range chunks {
+		d.refs[c.Hash]--
+		if d.refs[c.Hash] <= 0 {
+			delete(d.refs, c.Hash)
+		}
+	}
+}
+
+// lockGC locks the store against GC removing chunks (exclusive) or against chunks being
+// reused while GC decides whether to remove them (shared), across processes.
+func (d *DedupDriver) lockGC(exclusive bool) (func(), error) {
+	return lockFile(filepath.Join(d.RootPath, "gc.lock"), exclusive)
+}
+
+// storeChunk writes a chunk unless an identical one already exists.
+// The caller must already hold a reference on it.
+func (d *DedupDriver) storeChunk(hash string, data []byte) error {
+	unlock, err := d.lockGC(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Refresh the mtime of an existing chunk so a concurrent `atlas gc` treats it as
+	// recently used even before the manifest referencing it is committed. If GC removed
+	// it in the meantime, write it again.
+	p := d.chunkPath(hash)
+	now := time.Now()
+	err = os.Chtimes(p, now, now)
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Join(d.RootPath, "tmp"), "chunk-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// commitManifest writes the manifest of key once every chunk it lists has been touched,
+// failing if GC removed one during a long upload rather than committing an object whose
+// data is gone.
+func (d *DedupDriver) commitManifest(ctx context.Context, key string, m *manifest) error {
+	unlock, err := d.lockGC(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	now := time.Now()
+	touched := make(map[string]bool, len(m.Chunks))
+	for _, c := range m.Chunks {
+		if touched[c.Hash] {
+			continue
+		}
+		touched[c.Hash] = true
+		if err := os.Chtimes(d.chunkPath(c.Hash), now, now); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("dedup: chunk %s of %s was removed by gc before the upload finished", c.Hash, key)
+			}
+			return err
+		}
+	}
+	return d.writeManifest(ctx, key, m)
+}
+
+func (d *DedupDriver) readManifest(ctx context.Context, key string) (*manifest, time.Time, error) {
+	rc, info, err := d.manifests.Get(ctx, key, GetOptions{})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rc.Close()
+	var m manifest
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return nil, time.Time{}, fmt.Errorf("dedup: corrupt manifest %s: %w", key, err)
+	}
+	return &m, info.ModTime, nil
+}
+
+func (d *DedupDriver) writeManifest(ctx context.Context, key string, m *manifest) error {
+	m.Version = 1
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return d.manifests.Put(ctx, key, bytes.NewReader(data), PutOptions{})
+}
+
+// oldChunks returns the chunks of the object currently stored at key, if any.
+func (d *DedupDriver) oldChunks(ctx context.Context, key string) ([]chunkRef, error) {
+	m, _, err := d.readManifest(ctx, key)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrIsDir) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.Chunks, nil
+}
+
+func (d *DedupDriver) info(key string, m *manifest, modTime time.Time) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        m.Size,
+		ModTime:     modTime,
+		Type:        TypeFile,
+		ContentType: m.ContentType,
+		Checksum:    m.Checksum,
+		Metadata:    m.Metadata,
+	}
+}
+
+func (d *DedupDriver) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	if info, err := d.manifests.Stat(ctx, key); err == nil && info.IsDir() {
+		return &fs.PathError{Op: "put", Path: key, Err: ErrIsDir}
+	} else if errors.Is(err, ErrInvalidKey) {
+		return err
+	}
+
+	m := &manifest{}
+	committed := false
+	defer func() {
+		if !committed {
+			d.release(m.Chunks)
+		}
+	}()
+
+	ch := newChunker(ContextReader(ctx, r))
+	for {
+		data, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		ref := chunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		d.acquire([]chunkRef{ref})
+		m.Chunks = append(m.Chunks, ref)
+		m.Size += ref.Size
+		if err := d.storeChunk(ref.Hash, data); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	opts = opts.Final()
+	m.ContentType, m.Checksum, m.Metadata = opts.ContentType, opts.Checksum, opts.Metadata
+
+	d.commitMu.Lock()
+	defer d.commitMu.Unlock()
+	old, err := d.oldChunks(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := d.commitManifest(ctx, key, m); err != nil {
+		return err
+	}
+	committed = true
+	d.release(old)
+	return nil
+}
+
+func (d *DedupDriver) Get(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	// Pin the chunks while holding commitMu so a concurrent overwrite or delete
+	// cannot remove them halfway through the read.
+	d.commitMu.Lock()
+	m, modTime, err := d.readManifest(ctx, key)
+	if err != nil {
+		d.commitMu.Unlock()
+		return nil, ObjectInfo{}, err
+	}
+	d.acquire(m.Chunks)
+	unlease, err := d.lease(m.Chunks)
+	d.commitMu.Unlock()
+	if err != nil {
+		d.release(m.Chunks)
+		return nil, ObjectInfo{}, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		unlease()
+		d.release(m.Chunks)
+		return nil, ObjectInfo{}, err
+	}
+
+	cr := &chunkReader{d: d, m: m, unlease: unlease}
+	if rg := opts.Range; rg != nil {
+		cr.skip = rg.Offset
+		if rg.Length > 0 {
+			cr.limit = rg.Length
+		}
+	}
+	return readCloser{ContextReader(ctx, cr), cr}, d.info(key, m, modTime), nil
+}
+
+// lease keeps atlas gc, in this process or another, from removing chunks until the
+// returned function is called. It is taken with the manifest listing them just read.
+func (d *DedupDriver) lease(chunks []chunkRef) (func(), error) {
+	unlock, err := d.lockGC(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// GC may already have listed the leases: the fresh mtimes keep it from removing
+	// the chunks when it checks them again.
+	var list bytes.Buffer
+	now := time.Now()
+	seen := make(map[string]bool, len(chunks))
+	for _, c := range chunks {
+		if seen[c.Hash] {
+			continue
+		}
+		seen[c.Hash] = true
+		list.WriteString(c.Hash + "\n")
+		if err := os.Chtimes(d.chunkPath(c.Hash), now, now); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	// Lock the lease before it appears in leases/, where GC would take it for one
+	// left behind.
+	f, err := os.CreateTemp(filepath.Join(d.RootPath, "tmp"), "lease-*")
+	if err != nil {
+		return nil, err
+	}
+	tmp := f.Name()
+	_, err = f.Write(list.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	var unlockLease func()
+	if err == nil {
+		unlockLease, err = lockFile(tmp, false)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	path := filepath.Join(d.RootPath, "leases", filepath.Base(tmp))
+	if err := os.Rename(tmp, path); err != nil {
+		unlockLease()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return func() {
+		os.Remove(path)
+		unlockLease()
+	}, nil
+}
+
+// markLeased adds the chunks of open readers to live, and removes the leases of readers
+// that are gone.
+func (d *DedupDriver) markLeased(live map[string]bool) error {
+	dir := filepath.Join(d.RootPath, "leases")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		held, err := lockHeld(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !held {
+			os.Remove(path)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, hash := range strings.Fields(string(data)) {
+			live[hash] = true
+		}
+	}
+	return nil
+}
+
+// chunkReader reads an object back chunk by chunk, opening one chunk file at a time.
+type chunkReader struct {
+	d       *DedupDriver
+	m       *manifest
+	unlease func()
+	idx     int
+	skip    int64 // bytes still to skip before the first returned byte
+	limit   int64 // bytes left to return; 0 means unlimited
+	cur     *os.File
+	done    bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if c.done {
+			return 0, io.EOF
+		}
+		if c.cur == nil {
+			// Skip whole chunks that lie before the range.
+			for c.idx < len(c.m.Chunks) && c.skip >= c.m.Chunks[c.idx].Size {
+				c.skip -= c.m.Chunks[c.idx].Size
+				c.idx++
+			}
+			if c.idx >= len(c.m.Chunks) {
+				c.done = true
+				return 0, io.EOF
+			}
+			f, err := os.Open(c.d.chunkPath(c.m.Chunks[c.idx].Hash))
+			if err != nil {
+				return 0, fmt.Errorf("dedup: missing chunk %s: %w", c.m.Chunks[c.idx].Hash, err)
+			}
+			if c.skip > 0 {
+				if _, err := f.Seek(c.skip, io.SeekStart); err != nil {
+					f.Close()
+					return 0, err
+				}
+				c.skip = 0
+			}
+			c.cur = f
+		}
+
+		buf := p
+		if c.limit > 0 && int64(len(buf)) > c.limit {
+			buf = buf[:c.limit]
+		}
+		n, err := c.cur.Read(buf)
+		if c.limit > 0 {
+			c.limit -= int64(n)
+			if c.limit == 0 {
+				c.done = true
+			}
+		}
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			c.idx++
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur != nil {
+		c.cur.Close()
+		c.cur = nil
+	}
+	if c.m != nil {
+		c.unlease()
+		c.d.release(c.m.Chunks)
+		c.m = nil
+	}
+	c.done = true
+	return nil
+}
+
+func (d *DedupDriver) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := d.manifests.Stat(ctx, key)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	m, modTime, err := d.readManifest(ctx, info.Key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return d.info(info.Key, m, modTime), nil
+}
+
+func (d *DedupDriver) Delete(ctx context.Context, key string) error {
+	d.commitMu.Lock()
+	defer d.commitMu.Unlock()
+
+	old, err := d.oldChunks(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := d.manifests.Delete(ctx, key); err != nil {
+		return err
+	}
+	d.release(old)
+	return nil
+}
+
+// Copy only writes a new manifest: the chunks are shared with the source.
+func (d *DedupDriver) Copy(ctx context.Context, src, dst string) error {
+	dst, err := CleanKey(dst)
+	if err != nil {
+		return err
+	}
+
+	d.commitMu.Lock()
+	defer d.commitMu.Unlock()
+
+	m, _, err := d.readManifest(ctx, src)
+	if err != nil {
+		return err
+	}
+	old, err := d.oldChunks(ctx, dst)
+	if err != nil {
+		return err
+	}
+	d.acquire(m.Chunks)
+	if err := d.commitManifest(ctx, dst, m); err != nil {
+		d.release(m.Chunks)
+		return err
+	}
+	d.release(old)
+	return nil
+}
+
+func (d *DedupDriver) Rename(ctx context.Context, src, dst string) error {
+	d.commitMu.Lock()
+	defer d.commitMu.Unlock()
+
+	old, err := d.oldChunks(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if err := d.manifests.Rename(ctx, src, dst); err != nil {
+		return err
+	}
+	d.release(old)
+	return nil
+}
+
+func (d *DedupDriver) Mkdir(ctx context.Context, key string) error {
+	return d.manifests.Mkdir(ctx, key)
+}
+
+func (d *DedupDriver) List(ctx context.Context, prefix string, opts ListOptions) (ListResult, error) {
+	res, err := d.manifests.List(ctx, prefix, opts)
+	if err != nil {
+		return res, err
+	}
+	for i, e := range res.Entries {
+		if e.IsDir() {
+			continue
+		}
+		m, modTime, err := d.readManifest(ctx, e.Key)
+		if errors.Is(err, ErrNotFound) {
+			// Deleted since the listing was taken; keep the entry as it was listed.
+			continue
+		}
+		if err != nil {
+			return ListResult{}, err
+		}
+		res.Entries[i] = d.info(e.Key, m, modTime)
+	}
+	return res, nil
+}
+
+// eachManifest calls fn for every object in the store.
+func (d *DedupDriver) eachManifest(ctx context.Context, fn func(key string, m *manifest) error) error {
+	opts := ListOptions{Recursive: true}
+	for {
+		res, err := d.manifests.List(ctx, "", opts)
+		if err != nil {
+			return err
+		}
+		for _, e := range res.Entries {
+			if e.IsDir() {
+				continue
+			}
+			m, _, err := d.readManifest(ctx, e.Key)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(e.Key, m); err != nil {
+				return err
+			}
+		}
+		if res.NextContinuationToken == "" {
+			return nil
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+}
+
+// eachChunk calls fn for every chunk file on disk.
+func (d *DedupDriver) eachChunk(ctx context.Context, fn func(hash, path string, info fs.FileInfo) error) error {
+	root := filepath.Join(d.RootPath, "chunks")
+	return filepath.WalkDir(root, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if de.IsDir() {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil
+		}
+		return fn(de.Name(), p, info)
+	})
+}
+
+// Stats walks the store and reports logical vs physical usage.
+func (d *DedupDriver) Stats(ctx context.Context) (DedupStats, error) {
+	var s DedupStats
+	err := d.eachManifest(ctx, func(key string, m *manifest) error {
+		s.Objects++
+		s.LogicalBytes += m.Size
+		return nil
+	})
+	if err != nil {
+		return s, err
+	}
+	err = d.eachChunk(ctx, func(hash, path string, info fs.FileInfo) error {
+		s.Chunks++
+		s.PhysicalBytes += info.Size()
+		return nil
+	})
+	return s, err
+}
+
+// GC removes chunks that no manifest references. It is safe to run against a store
+// that a server is using at the same time: chunks (and temporary files) modified
+// within the grace period are kept, which covers uploads whose manifest has not been
+// committed yet, and so are chunks a manifest committed since GC started refers to
+// and chunks leased by readers still open. With dryRun set nothing is deleted.
+func (d *DedupDriver) GC(ctx context.Context, grace time.Duration, dryRun bool) (GCResult, error) {
+	var res GCResult
+	// Filesystems may store mtimes in whole seconds.
+	cutoff := time.Now().Add(-grace).Truncate(time.Second)
+
+	// Wait for commits in progress, so every manifest committed from here on has
+	// touched its chunks after the cutoff, and the mark below sees all the others.
+	unlock, err := d.lockGC(true)
+	if err != nil {
+		return res, err
+	}
+	unlock()
+
+	// Mark.
+	live := make(map[string]bool)
+	err = d.eachManifest(ctx, func(key string, m *manifest) error {
+		for _, c := range m.Chunks {
+			live[c.Hash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	// Chunks still being read, possibly of objects overwritten or deleted since.
+	if err := d.markLeased(live); err != nil {
+		return res, err
+	}
+
+	// Sweep.
+	err = d.eachChunk(ctx, func(hash, path string, info fs.FileInfo) error {
+		if live[hash] || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.refs[hash] > 0 {
+			// Pinned by a reader or an upload in this process.
+			return nil
+		}
+		if !dryRun {
+			removed, err := d.removeChunk(path, cutoff)
+			if err != nil || !removed {
+				return err
+			}
+		}
+		res.ChunksRemoved++
+		res.BytesFreed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	// Leftovers of interrupted uploads.
+	tmp := filepath.Join(d.RootPath, "tmp")
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return res, err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(cutoff) || !strings.HasPrefix(e.Name(), "chunk-") && !strings.HasPrefix(e.Name(), "lease-") {
+			continue
+		}
+		if !dryRun {
+			os.Remove(filepath.Join(tmp, e.Name()))
+		}
+		res.TempRemoved++
+	}
+	return res, nil
+}
+
+// removeChunk deletes an unreferenced chunk unless an upload has reused it since the
+// sweep looked at it. The mtime is checked again with writers locked out, because the
+// one the sweep read may predate a writer's touch.
+func (d *DedupDriver) removeChunk(path string, cutoff time.Time) (bool, error) {
+	unlock, err := d.lockGC(true)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !fi.ModTime().Before(cutoff) {
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,224 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/internal/storage/drivertest"
+)
+
+func TestDedupDriver(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) storage.Driver {
+		d, err := storage.NewDedupDriver(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+// A chunk another process still refers to must survive this process dropping its last
+// reference; only GC, which reads every manifest, may remove it.
+func TestDedupSharedChunks(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	a, err := storage.NewDedupDriver(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := storage.NewDedupDriver(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("shared content "), 1000)
+	if err := a.Put(ctx, "x", bytes.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(ctx, "y", bytes.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Delete(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() ([]byte, error) {
+		rc, _, err := b.Get(ctx, "y", storage.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	if got, err := read(); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("y after x was deleted by another driver: %v", err)
+	}
+
+	res, err := a.GC(ctx, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ChunksRemoved != 0 {
+		t.Fatalf("GC removed %d chunks still used by y", res.ChunksRemoved)
+	}
+	if got, err := read(); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("y after GC: %v", err)
+	}
+
+	if err := b.Delete(ctx, "y"); err != nil {
+		t.Fatal(err)
+	}
+	// GC keeps chunks touched in the second it starts, whatever the grace period.
+	time.Sleep(time.Second)
+	if res, err = a.GC(ctx, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if res.ChunksRemoved == 0 {
+		t.Fatal("GC kept the chunks of deleted objects")
+	}
+}
+
+// An upload that reuses an old unreferenced chunk must keep GC from removing it, and one
+// that finds the chunk already removed must write it again.
+func TestDedupGCSparesReusedChunks(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	d, err := storage.NewDedupDriver(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	age := func() {
+		old := time.Now().Add(-2 * time.Hour)
+		filepath.WalkDir(filepath.Join(root, "chunks"), func(p string, de fs.DirEntry, err error) error {
+			if err == nil && !de.IsDir() {
+				os.Chtimes(p, old, old)
+			}
+			return nil
+		})
+	}
+	read := func(key string) []byte {
+		rc, _, err := d.Get(ctx, key, storage.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("reading %s: %v", key, err)
+		}
+		return data
+	}
+
+	data := bytes.Repeat([]byte("reused content "), 1000)
+	if err := d.Put(ctx, "x", bytes.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "x"); err != nil {
+		t.Fatal(err)
+	}
+	age()
+	if err := d.Put(ctx, "y", bytes.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.GC(ctx, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ChunksRemoved != 0 {
+		t.Fatalf("GC removed %d chunks reused by y", res.ChunksRemoved)
+	}
+	if got := read("y"); !bytes.Equal(got, data) {
+		t.Fatal("y changed after GC")
+	}
+
+	if err := d.Delete(ctx, "y"); err != nil {
+		t.Fatal(err)
+	}
+	age()
+	if res, err = d.GC(ctx, time.Hour, false); err != nil || res.ChunksRemoved == 0 {
+		t.Fatalf("GC = %+v, %v; want the chunks of y removed", res, err)
+	}
+	if err := d.Put(ctx, "z", bytes.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("z"); !bytes.Equal(got, data) {
+		t.Fatal("z doesn't read back after its chunks were collected and written again")
+	}
+}
+
+// A download must keep its chunks, however long it takes, when the object is overwritten
+// meanwhile and atlas gc runs in another process.
+func TestDedupGCSparesLeasedChunks(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	server, err := storage.NewDedupDriver(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc, err := storage.NewDedupDriver(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	age := func() {
+		old := time.Now().Add(-2 * time.Hour)
+		filepath.WalkDir(filepath.Join(root, "chunks"), func(p string, de fs.DirEntry, err error) error {
+			if err == nil && !de.IsDir() {
+				os.Chtimes(p, old, old)
+			}
+			return nil
+		})
+	}
+
+	data := bytes.Repeat([]byte("first version "), 5000)
+	if err := server.Put(ctx, "x", bytes.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := server.Get(ctx, "x", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 100)
+	if _, err := io.ReadFull(rc, head); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Put(ctx, "x", bytes.NewReader([]byte("second version")), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	age()
+	res, err := gc.GC(ctx, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ChunksRemoved != 0 {
+		t.Fatalf("GC removed %d chunks of an open download", res.ChunksRemoved)
+	}
+	rest, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading on after GC: %v", err)
+	}
+	if !bytes.Equal(append(head, rest...), data) {
+		t.Fatal("the download changed after GC")
+	}
+	rc.Close()
+
+	// A lease left by a process that is gone is removed, and pins nothing.
+	stale := filepath.Join(root, "leases", "lease-crashed")
+	if err := os.WriteFile(stale, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	age()
+	if res, err = gc.GC(ctx, time.Hour, false); err != nil || res.ChunksRemoved == 0 {
+		t.Fatalf("GC = %+v, %v; want the chunks of the first version removed", res, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "leases")); len(entries) != 0 {
+		t.Errorf("leases left after the download was closed: %v", entries)
+	}
+}
@@ -1,53 +1,516 @@
-package storage
-
-import (
-	"io"
-	"os"
-	"path/filepath"
-)
-
-type DiskDriver struct {
-	RootPath string
-}
-
-// Garante que DiskDriver cumpre a interface Driver
-var _ Driver = (*DiskDriver)(nil)
-
-func NewDiskDriver(path string) *DiskDriver {
-	os.MkdirAll(path, 0755) // Cria a pasta se não existir
-	return &DiskDriver{RootPath: path}
-}
-
-func (d *DiskDriver) Put(key string, r io.Reader) error {
-	fullPath := filepath.Join(d.RootPath, key)
-
-	// Cria o ficheiro
-	f, err := os.Create(fullPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	// Grava os dados (Stream)
-	_, err = io.Copy(f, r)
-	return err
-}
-
-func (d *DiskDriver) Get(key string) (io.ReadCloser, error) {
-	fullPath := filepath.Join(d.RootPath, key)
-	return os.Open(fullPath)
-}
-
-func (d *DiskDriver) List() ([]string, error) {
-	entries, err := os.ReadDir(d.RootPath)
-	if err != nil {
-		return nil, err
-	}
-	var files []string
-	for _, e := range entries {
-		if !e.IsDir() {
-			files = append(files, e.Name())
-		}
-	}
-	return files, nil
-}
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// internalDir holds the driver's own bookkeeping (metadata sidecars, in-flight uploads)
+// inside the root. It is hidden from listings and cannot be addressed by keys.
+const internalDir = ".atlas"
+
+type DiskDriver struct {
+	RootPath string
+
+	// locks keeps a Put from replacing an object between a reader opening it and
+	// reading its sidecar.
+	locks keyLocks
+}
+
+// Garante que DiskDriver cumpre a interface Driver
+var _ Driver = (*DiskDriver)(nil)
+
+func NewDiskDriver(path string) *DiskDriver {
+	os.MkdirAll(path, 0755) // Cria a pasta se não existir
+	return &DiskDriver{RootPath: path}
+}
+
+// diskMeta is the JSON sidecar stored for objects that carry metadata.
+type diskMeta struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// Size and ModTime (in nanoseconds) identify the data file the sidecar was written
+	// for. A sidecar that doesn't match its file, left behind by a crash between writing
+	// the two, is ignored rather than paired with content it doesn't describe.
+	Size    int64 `json:"size,omitempty"`
+	ModTime int64 `json:"mtime,omitempty"`
+}
+
+func (m diskMeta) empty() bool {
+	return m.ContentType == "" && m.Checksum == "" && len(m.Metadata) == 0
+}
+
+// resolve maps a key to its path on disk.
+func (d *DiskDriver) resolve(key string) (string, string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if key == internalDir || strings.HasPrefix(key, internalDir+"/") {
+		return "", "", ErrInvalidKey
+	}
+	return key, filepath.Join(d.RootPath, filepath.FromSlash(key)), nil
+}
+
+// metaPath returns where the sidecar of key lives. Directory segments get a ".d" suffix
+// and object sidecars a ".json" one, so a file and a directory can never collide and
+// renaming a directory is a single rename in the metadata tree as well.
+func (d *DiskDriver) metaPath(key string, isDir bool) string {
+	segs := strings.Split(key, "/")
+	for i := range segs[:len(segs)-1] {
+		segs[i] += ".d"
+	}
+	if isDir {
+		segs[len(segs)-1] += ".d"
+	} else {
+		segs[len(segs)-1] += ".json"
+	}
+	return filepath.Join(d.RootPath, internalDir, "meta", filepath.Join(segs...))
+}
+
+// readMeta returns the sidecar of key if it was written for the data file fi describes.
+func (d *DiskDriver) readMeta(key string, fi fs.FileInfo) diskMeta {
+	var m diskMeta
+	data, err := os.ReadFile(d.metaPath(key, false))
+	if err != nil {
+		return m
+	}
+	if json.Unmarshal(data, &m) != nil {
+		return diskMeta{}
+	}
+	if m.ModTime != 0 && (m.Size != fi.Size() || m.ModTime != fi.ModTime().UnixNano()) {
+		return diskMeta{}
+	}
+	return m
+}
+
+func (d *DiskDriver) writeMeta(key string, m diskMeta) error {
+	p := d.metaPath(key, false)
+	if m.empty() {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeMetaFile(p, data)
+}
+
+// writeMetaFile replaces a sidecar atomically, so a failed write never leaves half of one.
+func writeMetaFile(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// restoreMeta puts back the sidecar that was in place before a failed Put.
+func restoreMeta(p string, prev []byte, prevErr error) {
+	if prevErr != nil {
+		os.Remove(p)
+		return
+	}
+	writeMetaFile(p, prev)
+}
+
+// keyError rewrites filesystem errors to refer to the key instead of the host path.
+func keyError(op, key string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return &fs.PathError{Op: op, Path: key, Err: pe.Err}
+	}
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		return &fs.PathError{Op: op, Path: key, Err: le.Err}
+	}
+	return err
+}
+
+func (d *DiskDriver) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	key, fullPath, err := d.resolve(key)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(fullPath); err == nil && fi.IsDir() {
+		return &fs.PathError{Op: "put", Path: key, Err: ErrIsDir}
+	}
+
+	// Parent directories are created on demand so hierarchical keys just work.
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return keyError("put", key, err)
+	}
+
+	// Write to a temporary file first and rename it into place, so concurrent
+	// readers never observe a half-written object and a cancelled upload
+	// leaves the previous version untouched.
+	tmpDir := filepath.Join(d.RootPath, internalDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(tmpDir, "put-*")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+
+	// Grava os dados (Stream)
+	if _, err := io.Copy(f, ContextReader(ctx, r)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmpName)
+	if err != nil {
+		return err
+	}
+	opts = opts.Final()
+
+	// The sidecar goes in before the data is renamed over the previous version, and
+	// readers hold the key's lock while they open the file and read its sidecar, so they
+	// see the old pair or the new one. If the rename fails, the old sidecar is put back.
+	unlock := d.locks.lock(true, key)
+	defer unlock()
+	metaPath := d.metaPath(key, false)
+	prev, prevErr := os.ReadFile(metaPath)
+	if err := d.writeMeta(key, diskMeta{
+		ContentType: opts.ContentType,
+		Checksum:    opts.Checksum,
+		Metadata:    opts.Metadata,
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime().UnixNano(),
+	}); err != nil {
+		restoreMeta(metaPath, prev, prevErr)
+		return err
+	}
+	if err := os.Rename(tmpName, fullPath); err != nil {
+		restoreMeta(metaPath, prev, prevErr)
+		return keyError("put", key, err)
+	}
+	return nil
+}
+
+func (d *DiskDriver) Get(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, ObjectInfo, error) {
+	key, fullPath, err := d.resolve(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	unlock := d.locks.lock(false, key)
+	f, err := os.Open(fullPath)
+	if err != nil {
+		unlock()
+		return nil, ObjectInfo{}, keyError("get", key, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		unlock()
+		f.Close()
+		return nil, ObjectInfo{}, keyError("get", key, err)
+	}
+	if fi.IsDir() {
+		unlock()
+		f.Close()
+		return nil, ObjectInfo{}, &fs.PathError{Op: "get", Path: key, Err: ErrIsDir}
+	}
+	info := d.objectInfo(key, fi)
+	unlock()
+
+	var r io.Reader = f
+	if rg := opts.Range; rg != nil {
+		if _, err := f.Seek(rg.Offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, ObjectInfo{}, err
+		}
+		if rg.Length > 0 {
+			r = io.LimitReader(f, rg.Length)
+		}
+	}
+	return readCloser{ContextReader(ctx, r), f}, info, nil
+}
+
+func (d *DiskDriver) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	key, fullPath, err := d.resolve(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return ObjectInfo{}, err
+	}
+	unlock := d.locks.lock(false, key)
+	defer unlock()
+	fi, err := os.Stat(fullPath)
+	if err != nil {
+		return ObjectInfo{}, keyError("stat", key, err)
+	}
+	return d.objectInfo(key, fi), nil
+}
+
+func (d *DiskDriver) Delete(ctx context.Context, key string) error {
+	key, fullPath, err := d.resolve(key)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	unlock := d.locks.lock(true, key)
+	defer unlock()
+	fi, err := os.Lstat(fullPath)
+	if err != nil {
+		return keyError("delete", key, err)
+	}
+
+	if fi.IsDir() {
+		entries, err := os.ReadDir(fullPath)
+		if err != nil {
+			return keyError("delete", key, err)
+		}
+		if len(entries) > 0 {
+			return &fs.PathError{Op: "delete", Path: key, Err: ErrNotEmpty}
+		}
+		if err := os.Remove(fullPath); err != nil {
+			return keyError("delete", key, err)
+		}
+		return os.RemoveAll(d.metaPath(key, true))
+	}
+
+	if err := os.Remove(fullPath); err != nil {
+		return keyError("delete", key, err)
+	}
+	if err := os.Remove(d.metaPath(key, false)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *DiskDriver) Copy(ctx context.Context, src, dst string) error {
+	rc, info, err := d.Get(ctx, src, GetOptions{})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return d.Put(ctx, dst, rc, PutOptions{
+		ContentType: info.ContentType,
+		Checksum:    info.Checksum,
+		Metadata:    info.Metadata,
+	})
+}
+
+func (d *DiskDriver) Rename(ctx context.Context, src, dst string) error {
+	src, srcPath, err := d.resolve(src)
+	if err != nil {
+		return err
+	}
+	dst, dstPath, err := d.resolve(dst)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	unlock := d.locks.lock(true, src, dst)
+	defer unlock()
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return keyError("rename", src, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return keyError("rename", dst, err)
+	}
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		return keyError("rename", src, err)
+	}
+
+	// Move the metadata along with the data.
+	srcMeta, dstMeta := d.metaPath(src, fi.IsDir()), d.metaPath(dst, fi.IsDir())
+	if err := os.RemoveAll(dstMeta); err != nil {
+		return err
+	}
+	if _, err := os.Stat(srcMeta); err != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dstMeta), 0755); err != nil {
+		return err
+	}
+	return os.Rename(srcMeta, dstMeta)
+}
+
+func (d *DiskDriver) Mkdir(ctx context.Context, key string) error {
+	key, fullPath, err := d.resolve(key)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return keyError("mkdir", key, os.Mkdir(fullPath, 0755))
+}
+
+// List returns the entries whose key starts with prefix, sorted by key.
+// A prefix ending in "/" selects the contents of that directory; otherwise it matches
+// key names the way object stores do (e.g. "logs/2024" matches "logs/2024-01.txt").
+func (d *DiskDriver) List(ctx context.Context, prefix string, opts ListOptions) (ListResult, error) {
+	prefix, err := cleanPrefix(prefix)
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	// Only the directory holding the prefix needs to be read.
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+		if dir == "." {
+			dir = ""
+		}
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == internalDir || strings.HasPrefix(dir, internalDir+"/") {
+		return ListResult{}, ErrInvalidKey
+	}
+	base := filepath.Join(d.RootPath, filepath.FromSlash(dir))
+
+	var entries []ObjectInfo
+	if opts.Recursive {
+		entries, err = d.walk(ctx, base, dir, prefix)
+	} else {
+		entries, err = d.readDir(ctx, base, dir, prefix)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ListResult{}, nil
+		}
+		return ListResult{}, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return paginate(entries, opts)
+}
+
+func (d *DiskDriver) readDir(ctx context.Context, base, dir, prefix string) ([]ObjectInfo, error) {
+	des, err := os.ReadDir(base)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ObjectInfo
+	for _, de := range des {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		key := path.Join(dir, de.Name())
+		if key == internalDir || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			// Removed while listing.
+			continue
+		}
+		entries = append(entries, d.objectInfo(key, info))
+	}
+	return entries, nil
+}
+
+func (d *DiskDriver) walk(ctx context.Context, base, dir, prefix string) ([]ObjectInfo, error) {
+	var entries []ObjectInfo
+	err := filepath.WalkDir(base, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p == base {
+			return nil
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		key := path.Join(dir, filepath.ToSlash(rel))
+		if key == internalDir {
+			return fs.SkipDir
+		}
+		if !strings.HasPrefix(key, prefix) {
+			// Skip whole subtrees that cannot contain a match.
+			if de.IsDir() && !strings.HasPrefix(prefix, key+"/") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, d.objectInfo(key, info))
+		return nil
+	})
+	return entries, err
+}
+
+func (d *DiskDriver) objectInfo(key string, info fs.FileInfo) ObjectInfo {
+	o := ObjectInfo{
+		Key:     key,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Type:    TypeFile,
+	}
+	if info.IsDir() {
+		o.Type = TypeDir
+		o.Size = 0
+		return o
+	}
+	m := d.readMeta(key, info)
+	o.ContentType = m.ContentType
+	o.Checksum = m.Checksum
+	o.Metadata = m.Metadata
+	return o
+}
+
+// readCloser pairs a (wrapped) reader with the Close of the underlying file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
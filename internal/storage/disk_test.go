@@ -0,0 +1,14 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/internal/storage/drivertest"
+)
+
+func TestDiskDriver(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) storage.Driver {
+		return storage.NewDiskDriver(t.TempDir())
+	})
+}
@@ -0,0 +1,748 @@
+// Package drivertest is a conformance suite for storage.Driver implementations.
+//
+// Every backend is expected to pass it from its own test file:
+//
+//	func TestDiskDriver(t *testing.T) {
+//		drivertest.Run(t, func(t *testing.T) storage.Driver {
+//			return storage.NewDiskDriver(t.TempDir())
+//		})
+//	}
+package drivertest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+)
+
+// Factory returns a fresh, empty driver for a single subtest.
+type Factory func(t *testing.T) storage.Driver
+
+// Options tweaks the suite for backends with different cost profiles.
+type Options struct {
+	// LargeObjectSize is the size used by the streaming test. 0 means 64 MiB.
+	LargeObjectSize int64
+	// Writers is the number of concurrent writers racing on one key. 0 means 8.
+	Writers int
+}
+
+// Run executes the whole suite with default options.
+func Run(t *testing.T, newDriver Factory) {
+	RunWithOptions(t, newDriver, Options{})
+}
+
+// RunWithOptions executes the whole suite.
+func RunWithOptions(t *testing.T, newDriver Factory, opts Options) {
+	if opts.LargeObjectSize == 0 {
+		opts.LargeObjectSize = 64 << 20
+	}
+	if opts.Writers == 0 {
+		opts.Writers = 8
+	}
+
+	tests := []struct {
+		name string
+		fn   func(*testing.T, storage.Driver)
+	}{
+		{"PutGet", testPutGet},
+		{"Metadata", testMetadata},
+		{"Trailer", testTrailer},
+		{"Overwrite", testOverwrite},
+		{"NestedKeys", testNestedKeys},
+		{"Range", testRange},
+		{"List", testList},
+		{"ListPagination", testListPagination},
+		{"Stat", testStat},
+		{"Delete", testDelete},
+		{"Copy", testCopy},
+		{"Rename", testRename},
+		{"Mkdir", testMkdir},
+		{"MissingKey", testMissingKey},
+		{"InvalidKey", testInvalidKey},
+		{"Cancellation", testCancellation},
+		{"LargeObject", func(t *testing.T, d storage.Driver) { testLargeObject(t, d, opts.LargeObjectSize) }},
+		{"ConcurrentWriters", func(t *testing.T, d storage.Driver) { testConcurrentWriters(t, d, opts.Writers) }},
+		{"ConcurrentOverwriteRead", func(t *testing.T, d storage.Driver) { testConcurrentOverwriteRead(t, d, opts.Writers) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newDriver(t))
+		})
+	}
+}
+
+func put(t *testing.T, d storage.Driver, key string, data []byte) {
+	t.Helper()
+	if err := d.Put(context.Background(), key, bytes.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+}
+
+func get(t *testing.T, d storage.Driver, key string) []byte {
+	t.Helper()
+	rc, _, err := d.Get(context.Background(), key, storage.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return data
+}
+
+func listAll(t *testing.T, d storage.Driver, prefix string, opts storage.ListOptions) []storage.ObjectInfo {
+	t.Helper()
+	var all []storage.ObjectInfo
+	for {
+		res, err := d.List(context.Background(), prefix, opts)
+		if err != nil {
+			t.Fatalf("List(%q): %v", prefix, err)
+		}
+		all = append(all, res.Entries...)
+		if res.NextContinuationToken == "" {
+			return all
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+}
+
+func keys(entries []storage.ObjectInfo) []string {
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		out[i] = e.Key
+		if e.IsDir() {
+			out[i] += "/"
+		}
+	}
+	return out
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func randomBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func testPutGet(t *testing.T, d storage.Driver) {
+	for _, data := range [][]byte{{}, []byte("hello"), randomBytes(1, 256<<10)} {
+		put(t, d, "object", data)
+		if got := get(t, d, "object"); !bytes.Equal(got, data) {
+			t.Fatalf("round trip of %d bytes returned %d bytes", len(data), len(got))
+		}
+	}
+
+	rc, info, err := d.Get(context.Background(), "object", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if info.Key != "object" || info.Size != 256<<10 || info.IsDir() {
+		t.Errorf("Get info = %+v", info)
+	}
+}
+
+func testMetadata(t *testing.T, d storage.Driver) {
+	ctx := context.Background()
+	opts := storage.PutOptions{
+		ContentType: "text/plain",
+		Checksum:    "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		Metadata:    map[string]string{"owner": "bob"},
+	}
+	if err := d.Put(ctx, "meta.txt", bytes.NewReader([]byte("hello")), opts); err != nil {
+		t.Fatal(err)
+	}
+	info, err := d.Stat(ctx, "meta.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != opts.ContentType {
+		t.Errorf("ContentType = %q, want %q", info.ContentType, opts.ContentType)
+	}
+	if info.Checksum != opts.Checksum {
+		t.Errorf("Checksum = %q, want %q", info.Checksum, opts.Checksum)
+	}
+	if info.Metadata["owner"] != "bob" {
+		t.Errorf("Metadata = %v", info.Metadata)
+	}
+
+	// Overwriting without metadata must not leak the old metadata.
+	put(t, d, "meta.txt", []byte("bye"))
+	info, err = d.Stat(ctx, "meta.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType == opts.ContentType || info.Metadata["owner"] != "" {
+		t.Errorf("stale metadata after overwrite: %+v", info)
+	}
+}
+
+func testTrailer(t *testing.T, d storage.Driver) {
+	ctx := context.Background()
+	counter := &countingReader{r: bytes.NewReader(randomBytes(7, 300<<10))}
+	opts := storage.PutOptions{
+		Metadata: map[string]string{"static": "yes"},
+		Trailer: func(o *storage.PutOptions) {
+			o.Checksum = fmt.Sprintf("count:%d", counter.n)
+			o.Metadata["counted"] = fmt.Sprint(counter.n)
+		},
+	}
+	if err := d.Put(ctx, "trailer", counter, opts); err != nil {
+		t.Fatal(err)
+	}
+	info, err := d.Stat(ctx, "trailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprint(300 << 10)
+	if info.Checksum != "count:"+want || info.Metadata["counted"] != want || info.Metadata["static"] != "yes" {
+		t.Errorf("trailer not applied after the content was consumed: %+v", info)
+	}
+	if opts.Metadata["counted"] != "" {
+		t.Error("trailer modified the caller's metadata map")
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func testOverwrite(t *testing.T, d storage.Driver) {
+	put(t, d, "k", randomBytes(2, 100<<10))
+	put(t, d, "k", []byte("short"))
+	if got := get(t, d, "k"); string(got) != "short" {
+		t.Fatalf("after overwrite got %d bytes, want %q", len(got), "short")
+	}
+	info, err := d.Stat(context.Background(), "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 {
+		t.Errorf("Size = %d, want 5", info.Size)
+	}
+}
+
+func testNestedKeys(t *testing.T, d storage.Driver) {
+	put(t, d, "a/b/c/d.txt", []byte("deep"))
+	if got := get(t, d, "a/b/c/d.txt"); string(got) != "deep" {
+		t.Fatalf("got %q", got)
+	}
+	info, err := d.Stat(context.Background(), "a/b")
+	if err != nil {
+		t.Fatalf("intermediate directory: %v", err)
+	}
+	if !info.IsDir() {
+		t.Errorf("a/b is not a directory: %+v", info)
+	}
+	// Equivalent spellings address the same object.
+	if got := get(t, d, "/a//b/./c/d.txt"); string(got) != "deep" {
+		t.Fatalf("non-canonical key returned %q", got)
+	}
+}
+
+func testRange(t *testing.T, d storage.Driver) {
+	data := randomBytes(3, 10000)
+	put(t, d, "r", data)
+
+	cases := []struct {
+		rg   storage.Range
+		want []byte
+	}{
+		{storage.Range{Offset: 0, Length: 10}, data[:10]},
+		{storage.Range{Offset: 5000, Length: 1234}, data[5000:6234]},
+		{storage.Range{Offset: 9990}, data[9990:]},
+		{storage.Range{Offset: 9990, Length: 100}, data[9990:]},
+		{storage.Range{Offset: 10000}, nil},
+	}
+	for _, c := range cases {
+		rg := c.rg
+		rc, info, err := d.Get(context.Background(), "r", storage.GetOptions{Range: &rg})
+		if err != nil {
+			t.Fatalf("Get range %+v: %v", rg, err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("range %+v: got %d bytes, want %d", rg, len(got), len(c.want))
+		}
+		if info.Size != int64(len(data)) {
+			t.Errorf("range %+v: info.Size = %d, want full size %d", rg, info.Size, len(data))
+		}
+	}
+}
+
+func testList(t *testing.T, d storage.Driver) {
+	for _, k := range []string{"a.txt", "b/c.txt", "b/d/e.txt", "bz.txt"} {
+		put(t, d, k, []byte(k))
+	}
+
+	cases := []struct {
+		prefix    string
+		recursive bool
+		want      []string
+	}{
+		{"", false, []string{"a.txt", "b/", "bz.txt"}},
+		{"b", false, []string{"b/", "bz.txt"}},
+		{"b/", false, []string{"b/c.txt", "b/d/"}},
+		{"b/", true, []string{"b/c.txt", "b/d/", "b/d/e.txt"}},
+		{"", true, []string{"a.txt", "b/", "b/c.txt", "b/d/", "b/d/e.txt", "bz.txt"}},
+		{"nope/", true, nil},
+	}
+	for _, c := range cases {
+		got := keys(listAll(t, d, c.prefix, storage.ListOptions{Recursive: c.recursive}))
+		if !equalStrings(got, c.want) {
+			t.Errorf("List(%q, recursive=%v) = %v, want %v", c.prefix, c.recursive, got, c.want)
+		}
+	}
+
+	for _, e := range listAll(t, d, "", storage.ListOptions{}) {
+		if e.Key == "a.txt" && (e.Size != 5 || e.ModTime.IsZero()) {
+			t.Errorf("entry %+v lacks size or mtime", e)
+		}
+	}
+}
+
+func testListPagination(t *testing.T, d storage.Driver) {
+	var want []string
+	for i := 0; i < 25; i++ {
+		k := fmt.Sprintf("p/%02d", i)
+		put(t, d, k, nil)
+		want = append(want, k)
+	}
+
+	var got []string
+	opts := storage.ListOptions{PageSize: 7}
+	pages := 0
+	for {
+		res, err := d.List(context.Background(), "p/", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Entries) > 7 {
+			t.Fatalf("page has %d entries, PageSize is 7", len(res.Entries))
+		}
+		pages++
+		got = append(got, keys(res.Entries)...)
+		if res.NextContinuationToken == "" {
+			break
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+	if pages != 4 {
+		t.Errorf("got %d pages, want 4", pages)
+	}
+	if !sort.StringsAreSorted(got) || !equalStrings(got, want) {
+		t.Errorf("paginated listing = %v, want %v", got, want)
+	}
+
+	if _, err := d.List(context.Background(), "p/", storage.ListOptions{ContinuationToken: "%%%"}); err == nil {
+		t.Error("List accepted a malformed continuation token")
+	}
+}
+
+func testStat(t *testing.T, d storage.Driver) {
+	put(t, d, "dir/file", []byte("12345"))
+	info, err := d.Stat(context.Background(), "dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Key != "dir/file" || info.Size != 5 || info.IsDir() || info.ModTime.IsZero() {
+		t.Errorf("Stat(file) = %+v", info)
+	}
+	info, err = d.Stat(context.Background(), "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Errorf("Stat(dir) = %+v", info)
+	}
+}
+
+func testDelete(t *testing.T, d storage.Driver) {
+	ctx := context.Background()
+	put(t, d, "dir/file", []byte("x"))
+
+	if err := d.Delete(ctx, "dir"); !errors.Is(err, storage.ErrNotEmpty) {
+		t.Errorf("Delete(non-empty dir) = %v, want ErrNotEmpty", err)
+	}
+	if err := d.Delete(ctx, "dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, "dir/file"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Stat after Delete = %v, want ErrNotFound", err)
+	}
+	if err := d.Delete(ctx, "dir"); err != nil {
+		t.Errorf("Delete(empty dir) = %v", err)
+	}
+	if got := listAll(t, d, "", storage.ListOptions{Recursive: true}); len(got) != 0 {
+		t.Errorf("driver not empty after deletes: %v", keys(got))
+	}
+}
+
+func testCopy(t *testing.T, d storage.Driver) {
+	ctx := context.Background()
+	opts := storage.PutOptions{ContentType: "image/png", Metadata: map[string]string{"k": "v"}}
+	if err := d.Put(ctx, "src", bytes.NewReader([]byte("payload")), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Copy(ctx, "src", "copies/dst"); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, d, "copies/dst"); string(got) != "payload" {
+		t.Errorf("copy content = %q", got)
+	}
+	if got := get(t, d, "src"); string(got) != "payload" {
+		t.Errorf("source changed after copy: %q", got)
+	}
+	info, err := d.Stat(ctx, "copies/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "image/png" || info.Metadata["k"] != "v" {
+		t.Errorf("copy lost metadata: %+v", info)
+	}
+	if err := d.Copy(ctx, "missing", "x"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Copy(missing) = %v, want ErrNotFound", err)
+	}
+}
+
+func testRename(t *testing.T, d storage.Driver) {
+	ctx := context.Background()
+	opts := storage.PutOptions{Metadata: map[string]string{"k": "v"}}
+	if err := d.Put(ctx, "old/a", bytes.NewReader([]byte("A")), opts); err != nil {
+		t.Fatal(err)
+	}
+	put(t, d, "old/sub/b", []byte("B"))
+
+	// Objects.
+	if err := d.Rename(ctx, "old/a", "old/a2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, "old/a"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("source still exists after rename: %v", err)
+	}
+	info, err := d.Stat(ctx, "old/a2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Metadata["k"] != "v" {
+		t.Errorf("rename lost metadata: %+v", info)
+	}
+
+	// Replacing an existing object.
+	put(t, d, "target", []byte("old"))
+	if err := d.Rename(ctx, "old/a2", "target"); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, d, "target"); string(got) != "A" {
+		t.Errorf("target = %q after rename over it", got)
+	}
+
+	// Whole directory trees.
+	if err := d.Rename(ctx, "old", "new/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, d, "new/moved/sub/b"); string(got) != "B" {
+		t.Errorf("renamed tree content = %q", got)
+	}
+	if _, err := d.Stat(ctx, "old"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("old tree still exists: %v", err)
+	}
+	if err := d.Rename(ctx, "missing", "x"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Rename(missing) = %v, want ErrNotFound", err)
+	}
+}
+
+func testMkdir(t *testing.T, d storage.Driver) {
+	ctx := context.Background()
+	if err := d.Mkdir(ctx, "empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Mkdir(ctx, "empty"); !errors.Is(err, storage.ErrExist) {
+		t.Errorf("second Mkdir = %v, want ErrExist", err)
+	}
+	if err := d.Mkdir(ctx, "no/parent"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Mkdir without parent = %v, want ErrNotFound", err)
+	}
+	got := keys(listAll(t, d, "", storage.ListOptions{}))
+	if !equalStrings(got, []string{"empty/"}) {
+		t.Errorf("listing = %v, want [empty/]", got)
+	}
+}
+
+func testMissingKey(t *testing.T, d storage.Driver) {
+	ctx := context.Background()
+	if _, _, err := d.Get(ctx, "missing", storage.GetOptions{}); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get = %v, want ErrNotFound", err)
+	}
+	if _, err := d.Stat(ctx, "missing/deeper"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Stat = %v, want ErrNotFound", err)
+	}
+	if err := d.Delete(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Delete = %v, want ErrNotFound", err)
+	}
+	res, err := d.List(ctx, "missing/", storage.ListOptions{})
+	if err != nil || len(res.Entries) != 0 {
+		t.Errorf("List(missing/) = %v, %v; want empty", res, err)
+	}
+}
+
+func testInvalidKey(t *testing.T, d storage.Driver) {
+	ctx := context.Background()
+	for _, key := range []string{"", "/", ".", "..", "../escape", "a/../../escape", "nul\x00byte"} {
+		if err := d.Put(ctx, key, bytes.NewReader(nil), storage.PutOptions{}); !errors.Is(err, storage.ErrInvalidKey) {
+			t.Errorf("Put(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if _, _, err := d.Get(ctx, key, storage.GetOptions{}); !errors.Is(err, storage.ErrInvalidKey) {
+			t.Errorf("Get(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if _, err := d.List(ctx, "../", storage.ListOptions{}); !errors.Is(err, storage.ErrInvalidKey) {
+		t.Errorf("List(../) = %v, want ErrInvalidKey", err)
+	}
+}
+
+// cancelReader cancels its context after n bytes have been read.
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	if c.n <= 0 {
+		c.cancel()
+	}
+	if len(p) > 4096 {
+		p = p[:4096]
+	}
+	n, err := c.r.Read(p)
+	c.n -= n
+	return n, err
+}
+
+func testCancellation(t *testing.T, d storage.Driver) {
+	put(t, d, "keep", []byte("original"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.Put(ctx, "new", bytes.NewReader([]byte("x")), storage.PutOptions{}); err == nil {
+		t.Error("Put with cancelled context succeeded")
+	}
+	if _, _, err := d.Get(ctx, "keep", storage.GetOptions{}); err == nil {
+		t.Error("Get with cancelled context succeeded")
+	}
+
+	// Cancelling mid-upload must leave the previous version intact.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancelReader{r: bytes.NewReader(randomBytes(4, 1<<20)), n: 64 << 10, cancel: cancel}
+	if err := d.Put(ctx, "keep", r, storage.PutOptions{}); err == nil {
+		t.Error("Put survived cancellation mid-stream")
+	}
+	if got := get(t, d, "keep"); string(got) != "original" {
+		t.Errorf("cancelled Put clobbered the object: got %d bytes", len(got))
+	}
+	if _, err := d.Stat(context.Background(), "new"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("cancelled Put created an object: %v", err)
+	}
+
+	// Cancelling while reading stops the stream.
+	ctx, cancel = context.WithCancel(context.Background())
+	put(t, d, "big", randomBytes(5, 1<<20))
+	rc, _, err := d.Get(ctx, "big", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	cancel()
+	if _, err := io.ReadAll(rc); err == nil {
+		t.Error("reading after cancel succeeded")
+	}
+}
+
+// patternReader generates a deterministic stream without holding it in memory.
+type patternReader struct {
+	remaining int64
+	rng       *rand.Rand
+}
+
+func (p *patternReader) Read(b []byte) (int, error) {
+	if p.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > p.remaining {
+		b = b[:p.remaining]
+	}
+	n, _ := p.rng.Read(b)
+	p.remaining -= int64(n)
+	return n, nil
+}
+
+func testLargeObject(t *testing.T, d storage.Driver, size int64) {
+	want := sha256.New()
+	io.Copy(want, &patternReader{remaining: size, rng: rand.New(rand.NewSource(6))})
+
+	src := &patternReader{remaining: size, rng: rand.New(rand.NewSource(6))}
+	if err := d.Put(context.Background(), "large", src, storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, info, err := d.Get(context.Background(), "large", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if info.Size != size {
+		t.Errorf("Size = %d, want %d", info.Size, size)
+	}
+	got := sha256.New()
+	n, err := io.Copy(got, rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size || !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Errorf("streamed %d bytes with a different digest", n)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, d storage.Driver, writers int) {
+	payloads := make([][]byte, writers)
+	for i := range payloads {
+		payloads[i] = randomBytes(int64(100+i), 128<<10+i)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := range payloads {
+		wg.Add(1)
+		go func(p []byte) {
+			defer wg.Done()
+			errs <- d.Put(context.Background(), "contended", bytes.NewReader(p), storage.PutOptions{})
+		}(payloads[i])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent Put: %v", err)
+		}
+	}
+
+	// The winner is arbitrary, but the result must be one complete payload.
+	got := get(t, d, "contended")
+	for _, p := range payloads {
+		if bytes.Equal(got, p) {
+			return
+		}
+	}
+	t.Errorf("final object (%d bytes) matches none of the %d payloads", len(got), writers)
+}
+
+// testConcurrentOverwriteRead overwrites one key while others read it: every read must
+// return one complete payload together with the checksum stored for that payload.
+func testConcurrentOverwriteRead(t *testing.T, d storage.Driver, writers int) {
+	payloads := make([][]byte, writers)
+	sums := make(map[string]string, writers)
+	for i := range payloads {
+		payloads[i] = randomBytes(int64(200+i), 16<<10+i)
+		sum := sha256.Sum256(payloads[i])
+		sums[string(payloads[i])] = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	putPayload := func(p []byte) error {
+		return d.Put(context.Background(), "hot", bytes.NewReader(p), storage.PutOptions{Checksum: sums[string(p)]})
+	}
+	if err := putPayload(payloads[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for i := range payloads {
+		wg.Add(1)
+		go func(p []byte) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				if err := putPayload(p); err != nil {
+					errs <- fmt.Errorf("Put: %w", err)
+					return
+				}
+			}
+		}(payloads[i])
+	}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				rc, info, err := d.Get(context.Background(), "hot", storage.GetOptions{})
+				if err != nil {
+					errs <- fmt.Errorf("Get: %w", err)
+					return
+				}
+				data, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					errs <- fmt.Errorf("read: %w", err)
+					return
+				}
+				want, ok := sums[string(data)]
+				if !ok {
+					errs <- fmt.Errorf("read %d bytes that match no payload", len(data))
+					return
+				}
+				if info.Checksum != "" && info.Checksum != want {
+					errs <- fmt.Errorf("read a %d-byte payload with the checksum of another one", len(data))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	data := get(t, d, "hot")
+	info, err := d.Stat(context.Background(), "hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Checksum != sums[string(data)] {
+		t.Errorf("final object has checksum %q, want %q", info.Checksum, sums[string(data)])
+	}
+}
@@ -0,0 +1,743 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// Encrypted object format:
+//
+//	header:   "ATE1" | key id (8 bytes, ASCII hex) | salt (32 bytes)
+//	segments: AES-256-GCM(seal of up to encSegmentSize plaintext bytes) ...
+//
+// The content key of each object is HKDF(master key, salt), so every object has its own key.
+// Segment i is sealed with nonce = i (big endian) and a final-segment flag in the last nonce
+// byte, which makes reordering, dropping and truncating segments detectable. Because every
+// segment has a fixed size, a byte range maps to a range of segments and can be decrypted
+// without reading the rest of the object. The metadata of an object is sealed separately,
+// with its key id and salt as additional data, so it opens only next to that object's
+// content; Stat and List read the header of each object that has metadata.
+const (
+	encMagic       = "ATE1"
+	encKeyIDLen    = 8
+	encSaltLen     = 32
+	encHeaderLen   = len(encMagic) + encKeyIDLen + encSaltLen
+	encSegmentSize = 64 << 10
+	encTagSize     = 16
+	encSealedSize  = encSegmentSize + encTagSize
+
+	// encMetaKey is the inner metadata field holding the sealed content type, checksum
+	// and user metadata of an object, which would otherwise be stored in the clear.
+	encMetaKey = "atlas-enc"
+)
+
+var (
+	// ErrNoKeys is returned when encryption is enabled without any master key.
+	ErrNoKeys = errors.New("storage: no encryption keys configured")
+	// ErrUnknownKey is returned when an object was encrypted with a key that is not in the keyring.
+	ErrUnknownKey = errors.New("storage: object encrypted with an unknown key")
+	// ErrDecrypt is returned when authentication fails (wrong key, corruption or tampering).
+	ErrDecrypt = errors.New("storage: decryption failed")
+)
+
+// MasterKey is one 256-bit key of a Keyring.
+type MasterKey struct {
+	ID  string
+	key []byte
+}
+
+// Keyring holds the master keys of an encrypted store. The last key is the active one and
+// encrypts new data; older keys are kept so existing objects stay readable until rotated.
+type Keyring struct {
+	keys []MasterKey
+}
+
+// GenerateKey returns a new random master key in the text form used by key files.
+func GenerateKey() (string, error) {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(k), nil
+}
+
+// ParseKeyring parses a key file: one base64-encoded 32-byte key per line (or separated by
+// commas, for environment variables), oldest first. Blank lines and #comments are ignored.
+func ParseKeyring(data string) (*Keyring, error) {
+	kr := &Keyring{}
+	fields := strings.FieldsFunc(data, func(r rune) bool { return r == '\n' || r == '\r' || r == ',' })
+	for _, line := range fields {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(raw) != 32 {
+			return nil, errors.New("storage: encryption keys must be base64-encoded 32-byte values (see `atlas keys generate`)")
+		}
+		kr.keys = append(kr.keys, MasterKey{ID: keyID(raw), key: raw})
+	}
+	if len(kr.keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return kr, nil
+}
+
+// keyID derives a short public identifier for a master key, stored in object headers.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("atlas key id\x00"), key...))
+	return hex.EncodeToString(sum[:encKeyIDLen/2])
+}
+
+// Active returns the key used for new data.
+func (k *Keyring) Active() MasterKey {
+	return k.keys[len(k.keys)-1]
+}
+
+// Keys returns all keys, oldest first.
+func (k *Keyring) Keys() []MasterKey {
+	return k.keys
+}
+
+func (k *Keyring) lookup(id string) (MasterKey, bool) {
+	for _, mk := range k.keys {
+		if mk.ID == id {
+			return mk, true
+		}
+	}
+	return MasterKey{}, false
+}
+
+func deriveKey(master, salt []byte, purpose string, n int) []byte {
+	out, err := hkdf.Key(sha256.New, master, salt, purpose, n)
+	if err != nil {
+		panic(err) // only possible for absurd lengths
+	}
+	return out
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func segmentNonce(i int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[:8], uint64(i))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// plainSize converts the stored size of an encrypted object to the size clients see.
+func plainSize(stored int64) int64 {
+	body := stored - int64(encHeaderLen)
+	if body <= 0 {
+		return 0
+	}
+	segs := (body + encSealedSize - 1) / encSealedSize
+	return body - segs*encTagSize
+}
+
+// EncryptedDriver encrypts objects (and optionally their names) before handing them to
+// another Driver, so the data directory is useless without the master key.
+type EncryptedDriver struct {
+	inner        Driver
+	keys         *Keyring
+	encryptNames bool
+	names        nameCipher
+}
+
+var _ Driver = (*EncryptedDriver)(nil)
+
+// NewEncryptedDriver wraps inner. With encryptNames, every path segment is encrypted too;
+// the name key is derived from the first (oldest) key of the keyring and does not change
+// on rotation, so keep that key in the key file for as long as the store exists.
+func NewEncryptedDriver(inner Driver, keys *Keyring, encryptNames bool) *EncryptedDriver {
+	e := &EncryptedDriver{inner: inner, keys: keys, encryptNames: encryptNames}
+	if encryptNames {
+		e.names = newNameCipher(keys.keys[0].key)
+	}
+	return e
+}
+
+// nameCipher is a deterministic authenticated cipher for path segments (SIV construction):
+// the nonce is an HMAC of the plaintext, so equal names encrypt to equal names and lookups
+// need no index, while tampered names fail authentication.
+type nameCipher struct {
+	mac  []byte
+	aead cipher.AEAD
+}
+
+// Names are encoded in lowercase base32 so they stay distinct on case-insensitive filesystems.
+var nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+func newNameCipher(master []byte) nameCipher {
+	k := deriveKey(master, nil, "atlas names v1", 64)
+	return nameCipher{mac: k[:32], aead: newGCM(k[32:])}
+}
+
+func (c nameCipher) encrypt(name string) string {
+	m := hmac.New(sha256.New, c.mac)
+	m.Write([]byte(name))
+	iv := m.Sum(nil)[:12]
+	return nameEncoding.EncodeToString(c.aead.Seal(iv, iv, []byte(name), nil))
+}
+
+func (c nameCipher) decrypt(enc string) (string, error) {
+	raw, err := nameEncoding.DecodeString(enc)
+	if err != nil || len(raw) < 12+encTagSize {
+		return "", ErrDecrypt
+	}
+	plain, err := c.aead.Open(nil, raw[:12], raw[12:], nil)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plain), nil
+}
+
+// innerKey maps a client key to the key stored in the wrapped driver.
+func (e *EncryptedDriver) innerKey(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil || !e.encryptNames {
+		return key, err
+	}
+	segs := strings.Split(key, "/")
+	for i, s := range segs {
+		segs[i] = e.names.encrypt(s)
+	}
+	return strings.Join(segs, "/"), nil
+}
+
+// outerKey is the inverse of innerKey.
+func (e *EncryptedDriver) outerKey(key string) (string, error) {
+	if !e.encryptNames {
+		return key, nil
+	}
+	segs := strings.Split(key, "/")
+	for i, s := range segs {
+		plain, err := e.names.decrypt(s)
+		if err != nil {
+			return "", err
+		}
+		segs[i] = plain
+	}
+	return strings.Join(segs, "/"), nil
+}
+
+// sealedMeta is the metadata of an object, stored encrypted in the inner metadata.
+type sealedMeta struct {
+	ContentType string            `json:"ct,omitempty"`
+	Checksum    string            `json:"cs,omitempty"`
+	Metadata    map[string]string `json:"md,omitempty"`
+}
+
+// metaAAD binds sealed metadata to the object whose header holds salt, so it can't be
+// moved to another object.
+func metaAAD(id string, salt []byte) []byte {
+	return append([]byte(id), salt...)
+}
+
+func (e *EncryptedDriver) sealMeta(opts PutOptions, mk MasterKey, salt []byte) (map[string]string, error) {
+	if opts.ContentType == "" && opts.Checksum == "" && len(opts.Metadata) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(sealedMeta{opts.ContentType, opts.Checksum, opts.Metadata})
+	if err != nil {
+		return nil, err
+	}
+	aead := newGCM(deriveKey(mk.key, nil, "atlas metadata v1", 32))
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, data, metaAAD(mk.ID, salt))
+	return map[string]string{encMetaKey: mk.ID + ":" + base64.StdEncoding.EncodeToString(sealed)}, nil
+}
+
+// openMeta decrypts the metadata of an object. salt is the one in the object's header.
+func (e *EncryptedDriver) openMeta(info *ObjectInfo, salt []byte) error {
+	v := info.Metadata[encMetaKey]
+	info.ContentType, info.Checksum, info.Metadata = "", "", nil
+	if v == "" {
+		return nil
+	}
+	id, b64, ok := strings.Cut(v, ":")
+	mk, found := e.keys.lookup(id)
+	if !ok || !found {
+		return ErrUnknownKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(sealed) < 12 {
+		return ErrDecrypt
+	}
+	aead := newGCM(deriveKey(mk.key, nil, "atlas metadata v1", 32))
+	data, err := aead.Open(nil, sealed[:12], sealed[12:], metaAAD(id, salt))
+	if err != nil {
+		return ErrDecrypt
+	}
+	var m sealedMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ErrDecrypt
+	}
+	info.ContentType, info.Checksum, info.Metadata = m.ContentType, m.Checksum, m.Metadata
+	return nil
+}
+
+// outerInfo converts the inner description of the object stored under ikey to what
+// clients see. salt is the one in its header; if nil and the object has metadata, the
+// header is read to get it.
+func (e *EncryptedDriver) outerInfo(ctx context.Context, key, ikey string, info ObjectInfo, salt []byte) (ObjectInfo, error) {
+	info.Key = key
+	if info.IsDir() {
+		return info, nil
+	}
+	info.Size = plainSize(info.Size)
+	if salt == nil && info.Metadata[encMetaKey] != "" {
+		_, s, err := e.readHeader(ctx, ikey)
+		if err != nil {
+			return ObjectInfo{}, e.pathError(err, key)
+		}
+		salt = s
+	}
+	return info, e.openMeta(&info, salt)
+}
+
+// readHeader returns the key id and salt in the header of the object stored under ikey.
+func (e *EncryptedDriver) readHeader(ctx context.Context, ikey string) (string, []byte, error) {
+	rc, _, err := e.inner.Get(ctx, ikey, GetOptions{Range: &Range{Length: int64(encHeaderLen)}})
+	if err != nil {
+		return "", nil, err
+	}
+	defer rc.Close()
+	header := make([]byte, encHeaderLen)
+	if _, err := io.ReadFull(rc, header); err != nil || !bytes.HasPrefix(header, []byte(encMagic)) {
+		return "", nil, ErrDecrypt
+	}
+	return string(header[len(encMagic) : len(encMagic)+encKeyIDLen]), header[len(encMagic)+encKeyIDLen:], nil
+}
+
+func (e *EncryptedDriver) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	ikey, err := e.innerKey(key)
+	if err != nil {
+		return err
+	}
+
+	mk := e.keys.Active()
+	salt := make([]byte, encSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	header := make([]byte, 0, encHeaderLen)
+	header = append(header, encMagic...)
+	header = append(header, mk.ID...)
+	header = append(header, salt...)
+
+	enc := &encryptReader{
+		src:    bufio.NewReaderSize(r, encSegmentSize),
+		aead:   newGCM(deriveKey(mk.key, salt, "atlas content v1", 32)),
+		plain:  make([]byte, encSegmentSize),
+		header: header,
+	}
+	var sealErr error
+	err = e.inner.Put(ctx, ikey, enc, PutOptions{
+		// Metadata is sealed once the content is through, so trailers of the caller apply.
+		Trailer: func(o *PutOptions) {
+			o.Metadata, sealErr = e.sealMeta(opts.Final(), mk, salt)
+		},
+	})
+	if err == nil && sealErr != nil {
+		// Should never happen (JSON of strings or random failure); don't leave an object
+		// whose metadata silently went missing.
+		e.inner.Delete(ctx, ikey)
+		return sealErr
+	}
+	return err
+}
+
+// encryptReader turns a plaintext stream into the encrypted object format on the fly.
+type encryptReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	plain  []byte
+	header []byte
+	out    []byte // pending ciphertext
+	seg    int64
+	done   bool
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.header != nil {
+			r.out, r.header = r.header, nil
+			break
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// The segment is final if the source has nothing after it.
+		final := n < len(r.plain)
+		if !final {
+			if _, err := r.src.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		r.out = r.aead.Seal(r.out[:0], segmentNonce(r.seg, final), r.plain[:n], nil)
+		r.seg++
+		r.done = final
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (e *EncryptedDriver) Get(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, ObjectInfo, error) {
+	ikey, err := e.innerKey(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	key, _ = CleanKey(key)
+
+	var offset, length int64
+	if opts.Range != nil {
+		offset, length = opts.Range.Offset, opts.Range.Length
+	}
+	firstSeg := offset / encSegmentSize
+
+	// Fetch the header plus the segments covering the range. When the range starts in the
+	// first segment that is one contiguous read; otherwise header and segments are fetched
+	// separately so the bytes in between are never transferred.
+	irange := &Range{Offset: 0}
+	if firstSeg > 0 {
+		irange.Length = int64(encHeaderLen)
+	} else if length > 0 {
+		lastSeg := (offset + length - 1) / encSegmentSize
+		irange.Length = int64(encHeaderLen) + (lastSeg+1)*encSealedSize
+	}
+	rc, iinfo, err := e.inner.Get(ctx, ikey, GetOptions{Range: irange})
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	header := make([]byte, encHeaderLen)
+	if _, err := io.ReadFull(rc, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		rc.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("%w: %s is not an encrypted object", ErrDecrypt, key)
+	}
+	mk, ok := e.keys.lookup(string(header[len(encMagic) : len(encMagic)+encKeyIDLen]))
+	if !ok {
+		rc.Close()
+		return nil, ObjectInfo{}, &fs.PathError{Op: "get", Path: key, Err: ErrUnknownKey}
+	}
+	salt := header[len(encMagic)+encKeyIDLen:]
+	info, err := e.outerInfo(ctx, key, ikey, iinfo, salt)
+	if err != nil {
+		rc.Close()
+		return nil, ObjectInfo{}, err
+	}
+
+	if firstSeg > 0 {
+		rc.Close()
+		rng := &Range{Offset: int64(encHeaderLen) + firstSeg*encSealedSize}
+		if length > 0 {
+			lastSeg := (offset + length - 1) / encSegmentSize
+			rng.Length = (lastSeg - firstSeg + 1) * encSealedSize
+		}
+		rc, _, err = e.inner.Get(ctx, ikey, GetOptions{Range: rng})
+		if err != nil {
+			return nil, ObjectInfo{}, err
+		}
+	}
+
+	stored := iinfo.Size
+	dr := &decryptReader{
+		src:   rc,
+		aead:  newGCM(deriveKey(mk.key, salt, "atlas content v1", 32)),
+		buf:   make([]byte, encSealedSize),
+		seg:   firstSeg,
+		segs:  (stored - int64(encHeaderLen) + encSealedSize - 1) / encSealedSize,
+		skip:  offset - firstSeg*encSegmentSize,
+		limit: length,
+	}
+	if offset >= info.Size {
+		dr.done = true
+	}
+	return dr, info, nil
+}
+
+// decryptReader authenticates and decrypts segments as they are read.
+type decryptReader struct {
+	src   io.ReadCloser
+	aead  cipher.AEAD
+	buf   []byte
+	plain []byte
+	seg   int64 // index of the next segment to decrypt
+	segs  int64 // total number of segments in the object
+	skip  int64
+	limit int64 // 0 means unlimited
+	done  bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	for len(r.plain) == 0 {
+		if r.seg >= r.segs {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.src, r.buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = fmt.Errorf("%w: object truncated", ErrDecrypt)
+			}
+			return 0, err
+		}
+		final := r.seg == r.segs-1
+		plain, err := r.aead.Open(r.buf[:0], segmentNonce(r.seg, final), r.buf[:n], nil)
+		if err != nil {
+			return 0, ErrDecrypt
+		}
+		r.seg++
+		if r.skip > 0 {
+			plain = plain[min(r.skip, int64(len(plain))):]
+			r.skip = 0
+		}
+		r.plain = plain
+	}
+	if r.limit > 0 && int64(len(p)) > r.limit {
+		p = p[:r.limit]
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	if r.limit > 0 {
+		r.limit -= int64(n)
+		if r.limit == 0 {
+			r.done = true
+		}
+	}
+	return n, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
+
+func (e *EncryptedDriver) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	ikey, err := e.innerKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := e.inner.Stat(ctx, ikey)
+	if err != nil {
+		return ObjectInfo{}, e.pathError(err, key)
+	}
+	key, _ = CleanKey(key)
+	return e.outerInfo(ctx, key, ikey, info, nil)
+}
+
+// pathError keeps encrypted names out of error messages.
+func (e *EncryptedDriver) pathError(err error, key string) error {
+	var pe *fs.PathError
+	if e.encryptNames && errors.As(err, &pe) {
+		return &fs.PathError{Op: pe.Op, Path: key, Err: pe.Err}
+	}
+	return err
+}
+
+func (e *EncryptedDriver) Delete(ctx context.Context, key string) error {
+	ikey, err := e.innerKey(key)
+	if err != nil {
+		return err
+	}
+	return e.pathError(e.inner.Delete(ctx, ikey), key)
+}
+
+// Copy duplicates the ciphertext as is; the object key depends only on the salt in its header.
+func (e *EncryptedDriver) Copy(ctx context.Context, src, dst string) error {
+	isrc, err := e.innerKey(src)
+	if err != nil {
+		return err
+	}
+	idst, err := e.innerKey(dst)
+	if err != nil {
+		return err
+	}
+	return e.pathError(e.inner.Copy(ctx, isrc, idst), src)
+}
+
+func (e *EncryptedDriver) Rename(ctx context.Context, src, dst string) error {
+	isrc, err := e.innerKey(src)
+	if err != nil {
+		return err
+	}
+	idst, err := e.innerKey(dst)
+	if err != nil {
+		return err
+	}
+	return e.pathError(e.inner.Rename(ctx, isrc, idst), src)
+}
+
+func (e *EncryptedDriver) Mkdir(ctx context.Context, key string) error {
+	ikey, err := e.innerKey(key)
+	if err != nil {
+		return err
+	}
+	return e.pathError(e.inner.Mkdir(ctx, ikey), key)
+}
+
+func (e *EncryptedDriver) List(ctx context.Context, prefix string, opts ListOptions) (ListResult, error) {
+	if !e.encryptNames {
+		res, err := e.inner.List(ctx, prefix, opts)
+		if err != nil {
+			return res, err
+		}
+		for i, entry := range res.Entries {
+			if res.Entries[i], err = e.outerInfo(ctx, entry.Key, entry.Key, entry, nil); err != nil {
+				return ListResult{}, err
+			}
+		}
+		return res, nil
+	}
+
+	// Encrypted names do not sort like their plaintext, so the whole directory (or tree)
+	// is listed from the inner driver, decrypted, and paginated here.
+	prefix, err := cleanPrefix(prefix)
+	if err != nil {
+		return ListResult{}, err
+	}
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+	iprefix := ""
+	if dir != "" {
+		if iprefix, err = e.innerKey(dir); err != nil {
+			return ListResult{}, err
+		}
+		iprefix += "/"
+	}
+
+	var entries []ObjectInfo
+	iopts := ListOptions{Recursive: opts.Recursive}
+	for {
+		res, err := e.inner.List(ctx, iprefix, iopts)
+		if err != nil {
+			return ListResult{}, err
+		}
+		for _, entry := range res.Entries {
+			key, err := e.outerKey(entry.Key)
+			if err != nil || !strings.HasPrefix(key, prefix) {
+				// Not ours (e.g. a file dropped into the data dir by hand) or outside the prefix.
+				continue
+			}
+			info, err := e.outerInfo(ctx, key, entry.Key, entry, nil)
+			if err != nil {
+				return ListResult{}, err
+			}
+			entries = append(entries, info)
+		}
+		if res.NextContinuationToken == "" {
+			break
+		}
+		iopts.ContinuationToken = res.NextContinuationToken
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return paginate(entries, opts)
+}
+
+// ObjectKeyID returns the id of the master key an object is encrypted with.
+func (e *EncryptedDriver) ObjectKeyID(ctx context.Context, key string) (string, error) {
+	ikey, err := e.innerKey(key)
+	if err != nil {
+		return "", err
+	}
+	id, _, err := e.readHeader(ctx, ikey)
+	if errors.Is(err, ErrDecrypt) {
+		return "", fmt.Errorf("%w: %s is not an encrypted object", ErrDecrypt, key)
+	}
+	return id, err
+}
+
+// Reencrypt rewrites every object that is not encrypted with the active key, which
+// completes a key rotation. It is idempotent, so an interrupted run can simply be repeated.
+// progress, if not nil, is called for each rewritten object.
+func (e *EncryptedDriver) Reencrypt(ctx context.Context, progress func(key string)) (int, error) {
+	active := e.keys.Active().ID
+	rewritten := 0
+	opts := ListOptions{Recursive: true}
+	for {
+		res, err := e.List(ctx, "", opts)
+		if err != nil {
+			return rewritten, err
+		}
+		for _, entry := range res.Entries {
+			if entry.IsDir() {
+				continue
+			}
+			id, err := e.ObjectKeyID(ctx, entry.Key)
+			if err != nil {
+				return rewritten, err
+			}
+			if id == active {
+				continue
+			}
+			if err := e.rewrite(ctx, entry.Key); err != nil {
+				return rewritten, fmt.Errorf("re-encrypting %s: %w", entry.Key, err)
+			}
+			rewritten++
+			if progress != nil {
+				progress(entry.Key)
+			}
+		}
+		if res.NextContinuationToken == "" {
+			return rewritten, nil
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+}
+
+func (e *EncryptedDriver) rewrite(ctx context.Context, key string) error {
+	rc, info, err := e.Get(ctx, key, GetOptions{})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return e.Put(ctx, key, rc, PutOptions{
+		ContentType: info.ContentType,
+		Checksum:    info.Checksum,
+		Metadata:    info.Metadata,
+	})
+}
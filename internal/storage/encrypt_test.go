@@ -0,0 +1,250 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/internal/storage/drivertest"
+)
+
+func newKeyring(t *testing.T) *storage.Keyring {
+	t.Helper()
+	key, err := storage.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := storage.ParseKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestEncryptedDriver(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) storage.Driver {
+		return storage.NewEncryptedDriver(storage.NewDiskDriver(t.TempDir()), newKeyring(t), false)
+	})
+}
+
+func TestEncryptedDriverNames(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) storage.Driver {
+		return storage.NewEncryptedDriver(storage.NewDiskDriver(t.TempDir()), newKeyring(t), true)
+	})
+}
+
+// rawFiles returns the content of every file below root, keyed by path.
+func rawFiles(t *testing.T, root string) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(root, func(p string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		files[p] = data
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestEncryptedDriverHidesPlaintext(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	e := storage.NewEncryptedDriver(storage.NewDiskDriver(root), newKeyring(t), true)
+
+	secret := []byte("the launch code is 0000")
+	data := bytes.Repeat(secret, 10000)
+	opts := storage.PutOptions{ContentType: "text/x-launch-code", Metadata: map[string]string{"owner": "launch-officer"}}
+	if err := e.Put(ctx, "launch-codes.txt", bytes.NewReader(data), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	files := rawFiles(t, root)
+	if len(files) == 0 {
+		t.Fatal("nothing written to disk")
+	}
+	for p, raw := range files {
+		for _, plain := range []string{string(secret), "launch-codes", "text/x-launch-code", "launch-officer"} {
+			if bytes.Contains(raw, []byte(plain)) || strings.Contains(p, plain) {
+				t.Errorf("%s holds %q in the clear", p, plain)
+			}
+		}
+	}
+}
+
+func TestEncryptedDriverDetectsTampering(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	e := storage.NewEncryptedDriver(storage.NewDiskDriver(root), newKeyring(t), false)
+
+	// Three segments; the middle one is tampered with.
+	data := bytes.Repeat([]byte("x"), 3*64<<10)
+	if err := e.Put(ctx, "f", bytes.NewReader(data), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(root, "f")
+	raw, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)/2] ^= 1
+	if err := os.WriteFile(p, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, _, err := e.Get(ctx, "f", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); !errors.Is(err, storage.ErrDecrypt) {
+		t.Errorf("reading a tampered object: %v, want ErrDecrypt", err)
+	}
+
+	// A range within the intact first segment still reads.
+	rc, _, err = e.Get(ctx, "f", storage.GetOptions{Range: &storage.Range{Length: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if got, err := io.ReadAll(rc); err != nil || !bytes.Equal(got, data[:100]) {
+		t.Errorf("range before the tampered segment: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestEncryptedDriverReencrypt(t *testing.T) {
+	ctx := context.Background()
+	disk := storage.NewDiskDriver(t.TempDir())
+	first, err := storage.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeys, err := storage.ParseKeyring(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := storage.NewEncryptedDriver(disk, oldKeys, true)
+
+	objects := map[string][]byte{
+		"a.txt":         []byte("alpha"),
+		"dir/b.bin":     bytes.Repeat([]byte("beta"), 50000),
+		"dir/sub/c.txt": nil,
+	}
+	for k, v := range objects {
+		opts := storage.PutOptions{ContentType: "text/plain", Metadata: map[string]string{"k": k}}
+		if err := old.Put(ctx, k, bytes.NewReader(v), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	second, err := storage.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := storage.ParseKeyring(first + "\n" + second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Active().ID == oldKeys.Active().ID {
+		t.Fatal("the added key is not the active one")
+	}
+	e := storage.NewEncryptedDriver(disk, keys, true)
+	n, err := e.Reencrypt(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(objects) {
+		t.Errorf("Reencrypt rewrote %d objects, want %d", n, len(objects))
+	}
+
+	for k, v := range objects {
+		id, err := e.ObjectKeyID(ctx, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != keys.Active().ID {
+			t.Errorf("%s is encrypted with %s, want the new key %s", k, id, keys.Active().ID)
+		}
+		rc, info, err := e.Get(ctx, k, storage.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, v) {
+			t.Errorf("%s after re-encryption: %d bytes, %v", k, len(got), err)
+		}
+		if info.ContentType != "text/plain" || info.Metadata["k"] != k {
+			t.Errorf("%s lost its metadata: %+v", k, info)
+		}
+	}
+
+	if n, err := e.Reencrypt(ctx, nil); err != nil || n != 0 {
+		t.Errorf("second Reencrypt = %d, %v; want nothing to do", n, err)
+	}
+}
+
+// The sealed metadata of one object must not open as that of another.
+func TestEncryptedDriverBindsMetadata(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	e := storage.NewEncryptedDriver(storage.NewDiskDriver(root), newKeyring(t), false)
+	for _, key := range []string{"a", "b"} {
+		opts := storage.PutOptions{ContentType: "text/x-" + key, Metadata: map[string]string{"owner": key}}
+		if err := e.Put(ctx, key, strings.NewReader("content of "+key), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, err := e.Stat(ctx, "b"); err != nil || info.ContentType != "text/x-b" {
+		t.Fatalf("Stat(b) = %+v, %v", info, err)
+	}
+
+	// Move the sealed metadata of a, sealed with the same key, into the sidecar of b.
+	sidecar := func(key string) (string, map[string]json.RawMessage) {
+		p := filepath.Join(root, ".atlas", "meta", key+".json")
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		return p, m
+	}
+	_, a := sidecar("a")
+	p, b := sidecar("b")
+	b["metadata"] = a["metadata"]
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Stat(ctx, "b"); !errors.Is(err, storage.ErrDecrypt) {
+		t.Errorf("Stat with moved metadata: %v, want ErrDecrypt", err)
+	}
+	if _, _, err := e.Get(ctx, "b", storage.GetOptions{}); !errors.Is(err, storage.ErrDecrypt) {
+		t.Errorf("Get with moved metadata: %v, want ErrDecrypt", err)
+	}
+	if _, err := e.List(ctx, "", storage.ListOptions{}); !errors.Is(err, storage.ErrDecrypt) {
+		t.Errorf("List with moved metadata: %v, want ErrDecrypt", err)
+	}
+	if info, err := e.Stat(ctx, "a"); err != nil || info.ContentType != "text/x-a" || info.Metadata["owner"] != "a" {
+		t.Errorf("Stat(a) = %+v, %v", info, err)
+	}
+}
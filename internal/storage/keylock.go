@@ -0,0 +1,79 @@
+package storage
+
+import "sync"
+
+// keyLocks is a reader/writer lock per key. A lock on a key also covers the keys below
+// it, so locking "a" exclusively waits for (and then holds off) anyone holding "a/b" and
+// the other way round, while unrelated keys never wait for each other. "" is the root.
+//
+// The zero value is ready to use.
+type keyLocks struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	held map[string]*keyHold
+}
+
+type keyHold struct {
+	shared    int
+	exclusive bool
+}
+
+// lock takes keys together, shared or exclusive, and returns the function that releases them.
+func (l *keyLocks) lock(exclusive bool, keys ...string) (unlock func()) {
+	l.mu.Lock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+		l.held = make(map[string]*keyHold)
+	}
+	for l.conflicts(exclusive, keys) {
+		l.cond.Wait()
+	}
+	for _, k := range keys {
+		h := l.held[k]
+		if h == nil {
+			h = &keyHold{}
+			l.held[k] = h
+		}
+		if exclusive {
+			h.exclusive = true
+		} else {
+			h.shared++
+		}
+	}
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		for _, k := range keys {
+			h := l.held[k]
+			if h == nil {
+				// The same key listed twice, already released.
+				continue
+			}
+			if exclusive {
+				h.exclusive = false
+			} else {
+				h.shared--
+			}
+			if !h.exclusive && h.shared == 0 {
+				delete(l.held, k)
+			}
+		}
+		l.mu.Unlock()
+		l.cond.Broadcast()
+	}
+}
+
+func (l *keyLocks) conflicts(exclusive bool, keys []string) bool {
+	for held, h := range l.held {
+		if !h.exclusive && !exclusive {
+			continue
+		}
+		for _, k := range keys {
+			if relatedKeys(held, k) {
+				return true
+			}
+		}
+	}
+	return false
+}
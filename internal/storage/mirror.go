@@ -0,0 +1,840 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MirrorDriver writes every object to several replicas and reads from the first healthy one
+// that isn't waiting for a repair of the key read.
+//
+// A write succeeds as long as one replica accepted it. Replicas that failed are marked
+// unhealthy and the key is recorded in a repair queue, together with the replica that holds
+// the authoritative copy; ProcessQueue (run periodically by RunRepairs) copies it over once the
+// replica is back. Reconcile compares whole replicas against the primary (the first one)
+// to catch anything the queue doesn't know about, such as changes made behind Atlas' back.
+type MirrorDriver struct {
+	replicas []*replica
+
+	// OnQueueError, if set, is called when the repair queue can't be saved. The queue is
+	// still kept in memory, but repairs that are pending then are lost on restart.
+	OnQueueError func(error)
+
+	// locks keeps writes to a key (shared) out of the way while that key, or one above or
+	// below it, is repaired (exclusive), so a repair never overwrites a newer version with
+	// the one it copied. Writes to other keys go ahead.
+	locks keyLocks
+
+	queueMu   sync.Mutex
+	queue     map[string]*RepairItem
+	queuePath string
+}
+
+var _ Driver = (*MirrorDriver)(nil)
+
+type replica struct {
+	Driver
+
+	mu      sync.Mutex
+	healthy bool
+	lastErr error
+	since   time.Time
+}
+
+// ReplicaHealth describes the state of one replica.
+type ReplicaHealth struct {
+	Index     int
+	Healthy   bool
+	LastError string
+	// Since is when the replica last changed state.
+	Since time.Time
+}
+
+// RepairItem is an entry of the repair queue: Key (an object or a whole directory) must be
+// copied from replica Source to the Targets.
+type RepairItem struct {
+	Key       string    `json:"key"`
+	Source    int       `json:"source"`
+	Targets   []int     `json:"targets"`
+	Added     time.Time `json:"added"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Divergence is a difference between a replica and the primary found by Reconcile.
+type Divergence struct {
+	Key     string
+	Replica int
+	Problem string
+}
+
+// NewMirrorDriver mirrors writes to all replicas; the first one is the primary.
+// The repair queue is persisted in queuePath (kept in memory only if empty).
+func NewMirrorDriver(replicas []Driver, queuePath string) (*MirrorDriver, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("mirror: no replicas")
+	}
+	m := &MirrorDriver{queue: make(map[string]*RepairItem), queuePath: queuePath}
+	now := time.Now()
+	for _, d := range replicas {
+		m.replicas = append(m.replicas, &replica{Driver: d, healthy: true, since: now})
+	}
+
+	if queuePath != "" {
+		data, err := os.ReadFile(queuePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			var items []*RepairItem
+			if err := json.Unmarshal(data, &items); err != nil {
+				return nil, fmt.Errorf("mirror: corrupt repair queue %s: %w", queuePath, err)
+			}
+			for _, it := range items {
+				m.queue[it.Key] = it
+			}
+		}
+	}
+	return m, nil
+}
+
+// Replicas returns the number of replicas.
+func (m *MirrorDriver) Replicas() int {
+	return len(m.replicas)
+}
+
+// Health reports the state of every replica.
+func (m *MirrorDriver) Health() []ReplicaHealth {
+	out := make([]ReplicaHealth, len(m.replicas))
+	for i, r := range m.replicas {
+		r.mu.Lock()
+		out[i] = ReplicaHealth{Index: i, Healthy: r.healthy, Since: r.since}
+		if r.lastErr != nil {
+			out[i].LastError = r.lastErr.Error()
+		}
+		r.mu.Unlock()
+	}
+	return out
+}
+
+// Queue returns the pending repairs, oldest first.
+func (m *MirrorDriver) Queue() []RepairItem {
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+	out := make([]RepairItem, 0, len(m.queue))
+	for _, it := range m.queue {
+		c := *it
+		c.Targets = append([]int(nil), it.Targets...)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Added.Before(out[j].Added) })
+	return out
+}
+
+// isFault tells replica failures apart from errors that are the caller's business
+// (a missing key, a bad name, a cancelled request...).
+func isFault(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, ErrNotFound),
+		errors.Is(err, ErrExist),
+		errors.Is(err, ErrNotEmpty),
+		errors.Is(err, ErrIsDir),
+		errors.Is(err, ErrInvalidKey),
+		errors.Is(err, ErrInvalidToken),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
+
+// observe updates the health of replica r after an operation.
+func (r *replica) observe(err error) {
+	fault := isFault(err)
+	if err != nil && !fault {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fault {
+		r.lastErr = err
+	}
+	if r.healthy == fault {
+		r.healthy = !fault
+		r.since = time.Now()
+	}
+}
+
+func (r *replica) isHealthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.healthy
+}
+
+// readOrder lists the healthy replicas first, then the others as a last resort.
+func (m *MirrorDriver) readOrder() []int {
+	order := make([]int, 0, len(m.replicas))
+	for i, r := range m.replicas {
+		if r.isHealthy() {
+			order = append(order, i)
+		}
+	}
+	for i, r := range m.replicas {
+		if !r.isHealthy() {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// stale returns the replicas that missed a write to key, or to a key above or below it,
+// and haven't been repaired yet. It is nil if no such repair is queued.
+func (m *MirrorDriver) stale(key string) map[int]bool {
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+	var out map[int]bool
+	for k, it := range m.queue {
+		if !relatedKeys(k, key) {
+			continue
+		}
+		if out == nil {
+			out = make(map[int]bool)
+		}
+		for _, t := range it.Targets {
+			out[t] = true
+		}
+	}
+	return out
+}
+
+// relatedKeys reports whether a and b are the same key or one is below the other. ""
+// is the root, above everything.
+func relatedKeys(a, b string) bool {
+	return a == b || a == "" || b == "" || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// read runs fn against replicas in read order until one doesn't fail with a fault.
+// Replicas waiting for a repair of key are skipped, whatever their health: they may
+// serve an old version or miss the object. While repairs of key are queued, a missing
+// object is looked for on the other replicas too.
+func (m *MirrorDriver) read(key string, fn func(d Driver) error) error {
+	stale := m.stale(key)
+	var err error
+	tried := false
+	for _, i := range m.readOrder() {
+		if stale[i] {
+			continue
+		}
+		tried = true
+		r := m.replicas[i]
+		err = fn(r.Driver)
+		r.observe(err)
+		if stale != nil && errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if !isFault(err) {
+			return err
+		}
+	}
+	if !tried {
+		return fmt.Errorf("mirror: no replica has an up-to-date copy of %q", key)
+	}
+	return err
+}
+
+// settle turns the per-replica results of a write into the caller's result, queueing
+// keys for repair on the replicas that failed if at least one succeeded.
+func (m *MirrorDriver) settle(errs []error, keys ...string) error {
+	source := -1
+	var failed []int
+	for i, err := range errs {
+		m.replicas[i].observe(err)
+		if err == nil {
+			if source < 0 {
+				source = i
+			}
+		} else {
+			failed = append(failed, i)
+		}
+	}
+
+	if source < 0 {
+		// Nobody succeeded: prefer an error that means something to the caller.
+		for _, err := range errs {
+			if !isFault(err) {
+				return err
+			}
+		}
+		return errs[0]
+	}
+	if len(failed) > 0 {
+		for _, key := range keys {
+			m.enqueue(key, source, failed)
+		}
+	}
+	return nil
+}
+
+func (m *MirrorDriver) enqueue(key string, source int, targets []int) {
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+	// The latest write decides what the key should look like, so it replaces any older entry.
+	m.queue[key] = &RepairItem{Key: key, Source: source, Targets: targets, Added: time.Now()}
+	m.saveQueue()
+}
+
+// saveQueue persists the queue, reporting failures to OnQueueError. queueMu must be held.
+func (m *MirrorDriver) saveQueue() {
+	if err := m.saveQueueLocked(); err != nil && m.OnQueueError != nil {
+		m.OnQueueError(fmt.Errorf("mirror: saving the repair queue: %w", err))
+	}
+}
+
+func (m *MirrorDriver) saveQueueLocked() error {
+	if m.queuePath == "" {
+		return nil
+	}
+	items := make([]*RepairItem, 0, len(m.queue))
+	for _, it := range m.queue {
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Added.Before(items[j].Added) })
+	data, err := json.MarshalIndent(items, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.queuePath), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(m.queuePath), ".queue-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), m.queuePath)
+}
+
+// lockWrite holds off repairs of keys (and of the keys above and below them) until the
+// returned function is called.
+func (m *MirrorDriver) lockWrite(keys ...string) func() {
+	clean := make([]string, len(keys))
+	for i, k := range keys {
+		clean[i] = k
+		if c, err := CleanKey(k); err == nil {
+			clean[i] = c
+		}
+	}
+	return m.locks.lock(false, clean...)
+}
+
+// each runs fn on every replica in turn and collects the results.
+func (m *MirrorDriver) each(fn func(d Driver) error) []error {
+	errs := make([]error, len(m.replicas))
+	for i, r := range m.replicas {
+		errs[i] = fn(r.Driver)
+	}
+	return errs
+}
+
+// Put streams r to all replicas at once.
+func (m *MirrorDriver) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error {
+	if _, err := CleanKey(key); err != nil {
+		return err
+	}
+	defer m.lockWrite(key)()
+
+	errs := make([]error, len(m.replicas))
+	pipes := make([]*io.PipeWriter, len(m.replicas))
+	var wg sync.WaitGroup
+	for i, rep := range m.replicas {
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = rep.Put(ctx, key, pr, opts)
+			// Unblock the fan-out if the replica gave up before the end of the stream.
+			pr.CloseWithError(errors.New("mirror: replica stopped reading"))
+		}()
+	}
+
+	buf := make([]byte, 256<<10)
+	live := len(pipes)
+	var srcErr error
+	for live > 0 {
+		n, err := r.Read(buf)
+		if n > 0 {
+			for i, pw := range pipes {
+				if pw == nil {
+					continue
+				}
+				if _, err := pw.Write(buf[:n]); err != nil {
+					pipes[i] = nil
+					live--
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			srcErr = err
+			break
+		}
+	}
+	for _, pw := range pipes {
+		if pw != nil {
+			pw.CloseWithError(srcErr)
+		}
+	}
+	wg.Wait()
+
+	if srcErr != nil {
+		// The upload itself failed; no replica has the object.
+		return srcErr
+	}
+	return m.settle(errs, key)
+}
+
+func (m *MirrorDriver) Get(ctx context.Context, key string, opts GetOptions) (rc io.ReadCloser, info ObjectInfo, err error) {
+	err = m.read(key, func(d Driver) error {
+		rc, info, err = d.Get(ctx, key, opts)
+		return err
+	})
+	return rc, info, err
+}
+
+func (m *MirrorDriver) Stat(ctx context.Context, key string) (info ObjectInfo, err error) {
+	err = m.read(key, func(d Driver) error {
+		info, err = d.Stat(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+func (m *MirrorDriver) List(ctx context.Context, prefix string, opts ListOptions) (res ListResult, err error) {
+	err = m.read(strings.TrimSuffix(prefix, "/"), func(d Driver) error {
+		res, err = d.List(ctx, prefix, opts)
+		return err
+	})
+	return res, err
+}
+
+func (m *MirrorDriver) Delete(ctx context.Context, key string) error {
+	defer m.lockWrite(key)()
+	return m.settle(m.each(func(d Driver) error { return d.Delete(ctx, key) }), key)
+}
+
+func (m *MirrorDriver) Copy(ctx context.Context, src, dst string) error {
+	defer m.lockWrite(dst)()
+	return m.settle(m.each(func(d Driver) error { return d.Copy(ctx, src, dst) }), dst)
+}
+
+func (m *MirrorDriver) Rename(ctx context.Context, src, dst string) error {
+	defer m.lockWrite(src, dst)()
+	return m.settle(m.each(func(d Driver) error { return d.Rename(ctx, src, dst) }), src, dst)
+}
+
+func (m *MirrorDriver) Mkdir(ctx context.Context, key string) error {
+	defer m.lockWrite(key)()
+	return m.settle(m.each(func(d Driver) error { return d.Mkdir(ctx, key) }), key)
+}
+
+// RunRepairs probes unhealthy replicas and works through the repair queue every interval
+// until ctx is cancelled.
+func (m *MirrorDriver) RunRepairs(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, r := range m.replicas {
+			if !r.isHealthy() {
+				r.probe(ctx)
+			}
+		}
+		m.ProcessQueue(ctx)
+	}
+}
+
+// Probe checks that every replica can be read and reports their health.
+func (m *MirrorDriver) Probe(ctx context.Context) []ReplicaHealth {
+	for _, r := range m.replicas {
+		r.probe(ctx)
+	}
+	return m.Health()
+}
+
+func (r *replica) probe(ctx context.Context) {
+	_, err := r.List(ctx, "", ListOptions{PageSize: 1})
+	r.observe(err)
+}
+
+// ProcessQueue attempts every queued repair and returns how many were completed and how
+// many are still pending.
+func (m *MirrorDriver) ProcessQueue(ctx context.Context) (repaired, pending int) {
+	for _, item := range m.Queue() {
+		if ctx.Err() != nil {
+			break
+		}
+		var failed []int
+		var lastErr error
+		for _, t := range item.Targets {
+			if err := m.repairKey(ctx, item.Source, t, item.Key); err != nil {
+				failed = append(failed, t)
+				lastErr = err
+			}
+		}
+
+		m.queueMu.Lock()
+		// Leave the entry alone if a newer write replaced it meanwhile.
+		if cur := m.queue[item.Key]; cur != nil && cur.Added.Equal(item.Added) {
+			if len(failed) == 0 {
+				delete(m.queue, item.Key)
+				repaired++
+			} else {
+				cur.Targets = failed
+				cur.Attempts++
+				cur.LastError = lastErr.Error()
+			}
+			m.saveQueue()
+		}
+		m.queueMu.Unlock()
+	}
+	m.queueMu.Lock()
+	pending = len(m.queue)
+	m.queueMu.Unlock()
+	return repaired, pending
+}
+
+// repairKey makes key (and everything below it) on replica dst match replica src.
+func (m *MirrorDriver) repairKey(ctx context.Context, src, dst int, key string) error {
+	if src < 0 || src >= len(m.replicas) || dst < 0 || dst >= len(m.replicas) {
+		return fmt.Errorf("mirror: repair of %s refers to a missing replica", key)
+	}
+	s, d := m.replicas[src].Driver, m.replicas[dst].Driver
+	isDir, err := m.fixKey(ctx, s, d, key)
+	if err != nil || !isDir {
+		return err
+	}
+	return reconcileTree(ctx, s, d, key+"/", false, func(Divergence) {}, m.fixer(ctx, s, d), dst)
+}
+
+// fixKey makes key on d match s, but not what is below it, holding off writes to key
+// while it does. It reports whether key is a directory on s.
+func (m *MirrorDriver) fixKey(ctx context.Context, s, d Driver, key string) (bool, error) {
+	unlock := m.locks.lock(true, key)
+	defer unlock()
+
+	info, err := s.Stat(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, removeAll(ctx, d, key)
+	}
+	if err != nil {
+		return false, err
+	}
+	existing, err := d.Stat(ctx, key)
+	have := err == nil
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+
+	if have && existing.IsDir() != info.IsDir() {
+		if err := removeAll(ctx, d, key); err != nil {
+			return false, err
+		}
+		have = false
+	}
+	if !info.IsDir() {
+		// The write that queued this repair may have kept the size, so copy regardless.
+		return false, copyObject(ctx, s, d, key)
+	}
+	if !have {
+		if err := mkdirAll(ctx, d, key); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// fixer returns the function reconcileTree fixes keys with, one key at a time.
+func (m *MirrorDriver) fixer(ctx context.Context, s, d Driver) func(key string) error {
+	return func(key string) error {
+		_, err := m.fixKey(ctx, s, d, key)
+		return err
+	}
+}
+
+// Reconcile compares every replica with the primary and reports each difference to fn.
+// With fix set, the replicas are brought in line with the primary, locking each key only
+// while it is fixed. With verify set, objects of the same size are also compared byte by
+// byte (which reads everything).
+//
+// Queued repairs may have a different source than the primary, so callers that fix
+// things should run ProcessQueue first.
+func (m *MirrorDriver) Reconcile(ctx context.Context, verify, fix bool, fn func(Divergence)) error {
+	primary := m.replicas[0].Driver
+	for i := 1; i < len(m.replicas); i++ {
+		var fixKey func(string) error
+		if fix {
+			fixKey = m.fixer(ctx, primary, m.replicas[i].Driver)
+		}
+		if err := reconcileTree(ctx, primary, m.replicas[i].Driver, "", verify, fn, fixKey, i); err != nil {
+			return fmt.Errorf("replica %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// reconcileTree walks the listings of src and dst below prefix side by side. If fix is
+// not nil, it is called with every key that differs; it makes the key on dst match src.
+func reconcileTree(ctx context.Context, src, dst Driver, prefix string, verify bool, fn func(Divergence), fix func(key string) error, idx int) error {
+	a := &lister{ctx: ctx, d: src, prefix: prefix, recursive: true}
+	b := &lister{ctx: ctx, d: dst, prefix: prefix, recursive: true}
+	report := func(key, problem string) {
+		fn(Divergence{Key: key, Replica: idx, Problem: problem})
+	}
+	// removed is the last directory deleted from dst; entries below it are gone too.
+	removed := "\x00"
+
+	for {
+		x, okA := a.peek()
+		y, okB := b.peek()
+		if a.err != nil {
+			return a.err
+		}
+		if b.err != nil {
+			return b.err
+		}
+		if !okA && !okB {
+			return nil
+		}
+
+		var err error
+		switch {
+		case okA && (!okB || x.Key < y.Key):
+			// Missing on the replica.
+			a.next()
+			report(x.Key, "missing")
+			if fix != nil {
+				err = fix(x.Key)
+			}
+		case !okA || y.Key < x.Key:
+			// Only on the replica.
+			b.next()
+			if fix != nil && strings.HasPrefix(y.Key, removed) {
+				continue
+			}
+			report(y.Key, "not on primary")
+			if fix != nil {
+				err = fix(y.Key)
+				removed = y.Key + "/"
+			}
+		default:
+			a.next()
+			b.next()
+			problem, cerr := compareObjects(ctx, src, dst, x, y, verify)
+			if cerr != nil {
+				return cerr
+			}
+			if problem == "" {
+				continue
+			}
+			report(x.Key, problem)
+			if fix == nil {
+				continue
+			}
+			if x.IsDir() != y.IsDir() {
+				removed = y.Key + "/"
+			}
+			err = fix(x.Key)
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+}
+
+// compareObjects returns what differs between two entries with the same key, or "".
+func compareObjects(ctx context.Context, src, dst Driver, a, b ObjectInfo, verify bool) (string, error) {
+	switch {
+	case a.IsDir() != b.IsDir():
+		return fmt.Sprintf("is a %s, primary has a %s", b.Type, a.Type), nil
+	case a.IsDir():
+		return "", nil
+	case a.Size != b.Size:
+		return fmt.Sprintf("size %d, primary has %d", b.Size, a.Size), nil
+	}
+	// Listings don't necessarily carry metadata, so look at the objects themselves.
+	a, err := src.Stat(ctx, a.Key)
+	if err != nil {
+		return "", err
+	}
+	b, err = dst.Stat(ctx, b.Key)
+	if err != nil {
+		return "", err
+	}
+	if !sameObject(a, b) {
+		return "checksum, content type or metadata differs", nil
+	}
+	if verify {
+		ha, err := hashObject(ctx, src, a.Key)
+		if err != nil {
+			return "", err
+		}
+		hb, err := hashObject(ctx, dst, b.Key)
+		if err != nil {
+			return "", err
+		}
+		if ha != hb {
+			return "content differs", nil
+		}
+	}
+	return "", nil
+}
+
+// sameObject compares what a replica is expected to store identically (not ModTime).
+func sameObject(a, b ObjectInfo) bool {
+	if a.Size != b.Size || a.ContentType != b.ContentType || !maps.Equal(a.Metadata, b.Metadata) {
+		return false
+	}
+	return a.Checksum == "" || b.Checksum == "" || a.Checksum == b.Checksum
+}
+
+func hashObject(ctx context.Context, d Driver, key string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	rc, _, err := d.Get(ctx, key, GetOptions{})
+	if err != nil {
+		return sum, err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+func copyObject(ctx context.Context, src, dst Driver, key string) error {
+	rc, info, err := src.Get(ctx, key, GetOptions{})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return dst.Put(ctx, key, rc, PutOptions{
+		ContentType: info.ContentType,
+		Checksum:    info.Checksum,
+		Metadata:    info.Metadata,
+	})
+}
+
+// mkdirAll creates key and any missing parents.
+func mkdirAll(ctx context.Context, d Driver, key string) error {
+	err := d.Mkdir(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		if parent := path.Dir(key); parent != "." {
+			if err := mkdirAll(ctx, d, parent); err != nil {
+				return err
+			}
+			err = d.Mkdir(ctx, key)
+		}
+	}
+	if errors.Is(err, ErrExist) {
+		return nil
+	}
+	return err
+}
+
+// removeAll deletes key and, for a directory, everything below it.
+func removeAll(ctx context.Context, d Driver, key string) error {
+	info, err := d.Stat(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		var children []string
+		l := &lister{ctx: ctx, d: d, prefix: key + "/", recursive: true}
+		for {
+			e, ok := l.peek()
+			if !ok {
+				break
+			}
+			children = append(children, e.Key)
+			l.next()
+		}
+		if l.err != nil {
+			return l.err
+		}
+		// Deepest entries first so directories are empty when their turn comes.
+		for i := len(children) - 1; i >= 0; i-- {
+			if err := d.Delete(ctx, children[i]); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+	}
+	if err := d.Delete(ctx, key); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// lister iterates over a listing one page at a time.
+type lister struct {
+	ctx       context.Context
+	d         Driver
+	prefix    string
+	recursive bool
+
+	page  []ObjectInfo
+	token string
+	done  bool
+	err   error
+}
+
+func (l *lister) peek() (ObjectInfo, bool) {
+	for len(l.page) == 0 && !l.done && l.err == nil {
+		res, err := l.d.List(l.ctx, l.prefix, ListOptions{Recursive: l.recursive, ContinuationToken: l.token})
+		if err != nil {
+			l.err = err
+			break
+		}
+		l.page, l.token = res.Entries, res.NextContinuationToken
+		l.done = l.token == ""
+	}
+	if len(l.page) == 0 {
+		return ObjectInfo{}, false
+	}
+	return l.page[0], true
+}
+
+func (l *lister) next() {
+	l.page = l.page[1:]
+}
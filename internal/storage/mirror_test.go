@@ -0,0 +1,211 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/storage"
+	"github.com/IYouKnow/atlas-drive/internal/storage/drivertest"
+)
+
+func TestMirrorDriver(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T) storage.Driver {
+		dir := t.TempDir()
+		m, err := storage.NewMirrorDriver([]storage.Driver{
+			storage.NewDiskDriver(filepath.Join(dir, "a")),
+			storage.NewDiskDriver(filepath.Join(dir, "b")),
+		}, filepath.Join(dir, "queue.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	})
+}
+
+// failingPuts is a replica whose Puts fail while down is set.
+type failingPuts struct {
+	storage.Driver
+	down bool
+}
+
+func (d *failingPuts) Put(ctx context.Context, key string, r io.Reader, opts storage.PutOptions) error {
+	if d.down {
+		io.Copy(io.Discard, r)
+		return errors.New("replica offline")
+	}
+	return d.Driver.Put(ctx, key, r, opts)
+}
+
+// A replica that missed writes must not serve them, even once it looks healthy again.
+func TestMirrorReadSkipsStaleReplica(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	primary := &failingPuts{Driver: storage.NewDiskDriver(filepath.Join(dir, "a"))}
+	m, err := storage.NewMirrorDriver([]storage.Driver{primary, storage.NewDiskDriver(filepath.Join(dir, "b"))}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key, data string) {
+		t.Helper()
+		if err := m.Put(ctx, key, strings.NewReader(data), storage.PutOptions{}); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+	get := func(key string) string {
+		t.Helper()
+		rc, _, err := m.Get(ctx, key, storage.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		defer rc.Close()
+		data, _ := io.ReadAll(rc)
+		return string(data)
+	}
+
+	put("old", "v1")
+	primary.down = true
+	put("old", "v2")
+	put("new", "v1")
+	primary.down = false
+
+	// The primary is readable again, so it is put back in front of the read order.
+	if !m.Probe(ctx)[0].Healthy {
+		t.Fatal("primary still unhealthy")
+	}
+	if got := get("old"); got != "v2" {
+		t.Errorf("Get(old) = %q, want v2", got)
+	}
+	if got := get("new"); got != "v1" {
+		t.Errorf("Get(new) = %q, want v1", got)
+	}
+	res, err := m.List(ctx, "", storage.ListOptions{})
+	if err != nil || len(res.Entries) != 2 {
+		t.Errorf("List = %v, %v; want both objects", res.Entries, err)
+	}
+
+	if _, pending := m.ProcessQueue(ctx); pending != 0 {
+		t.Fatalf("%d repairs still pending", pending)
+	}
+	rc, _, err := primary.Get(ctx, "old", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, _ := io.ReadAll(rc); !bytes.Equal(data, []byte("v2")) {
+		t.Errorf("primary after repair has %q", data)
+	}
+}
+
+// blockingPuts is a replica whose first Put of one key waits until release is closed.
+type blockingPuts struct {
+	storage.Driver
+	key     string
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingPuts) Put(ctx context.Context, key string, r io.Reader, opts storage.PutOptions) error {
+	if key == d.key {
+		d.once.Do(func() {
+			close(d.started)
+			<-d.release
+		})
+	}
+	return d.Driver.Put(ctx, key, r, opts)
+}
+
+// A repair in progress only holds off writes to the key it repairs.
+func TestMirrorRepairLocksOnlyItsKey(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	primary := storage.NewDiskDriver(filepath.Join(dir, "a"))
+	b := storage.NewDiskDriver(filepath.Join(dir, "b"))
+	if err := primary.Put(ctx, "dir/big", strings.NewReader("big"), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	blocking := &blockingPuts{Driver: b, key: "dir/big", started: make(chan struct{}), release: make(chan struct{})}
+	m, err := storage.NewMirrorDriver([]storage.Driver{primary, blocking}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repaired := make(chan error, 1)
+	go func() {
+		repaired <- m.Reconcile(ctx, false, true, func(storage.Divergence) {})
+	}()
+	<-blocking.started
+
+	wrote := make(chan error, 1)
+	go func() {
+		wrote <- m.Put(ctx, "other", strings.NewReader("x"), storage.PutOptions{})
+	}()
+	select {
+	case err := <-wrote:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a write to another key waited for the repair")
+	}
+
+	dirWrote := make(chan error, 1)
+	go func() {
+		dirWrote <- m.Put(ctx, "dir/big", strings.NewReader("newer"), storage.PutOptions{})
+	}()
+	select {
+	case <-dirWrote:
+		t.Fatal("a write to the key being repaired didn't wait for the repair")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(blocking.release)
+	if err := <-repaired; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-dirWrote; err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := b.Get(ctx, "dir/big", storage.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, _ := io.ReadAll(rc); string(data) != "newer" {
+		t.Errorf("replica has %q after the repair and the write, want the write", data)
+	}
+}
+
+func TestMirrorReportsQueueSaveErrors(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	b := &failingPuts{Driver: storage.NewDiskDriver(filepath.Join(dir, "b")), down: true}
+	m, err := storage.NewMirrorDriver([]storage.Driver{storage.NewDiskDriver(filepath.Join(dir, "a")), b}, filepath.Join(dir, "q", "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The queue's directory is a file, so the queue can't be saved.
+	if err := os.WriteFile(filepath.Join(dir, "q"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var queueErrs []error
+	m.OnQueueError = func(err error) { queueErrs = append(queueErrs, err) }
+
+	if err := m.Put(ctx, "k", strings.NewReader("v"), storage.PutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(queueErrs) != 1 {
+		t.Errorf("OnQueueError called %d times, want once", len(queueErrs))
+	}
+	if len(m.Queue()) != 1 {
+		t.Errorf("repair not kept in memory: %v", m.Queue())
+	}
+}
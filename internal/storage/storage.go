@@ -1,11 +1,248 @@
-package storage
-
-import "io"
-
-// Driver é o contrato que qualquer sistema de storage tem de cumprir.
-// Seja disco local, S3 ou Google Drive.
-type Driver interface {
-	Put(key string, r io.Reader) error
-	Get(key string) (io.ReadCloser, error)
-	List() ([]string, error)
-}
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// Driver é o contrato que qualquer sistema de storage tem de cumprir.
+// Seja disco local, S3 ou Google Drive.
+//
+// Keys are slash-separated paths relative to the driver root (e.g. "photos/2024/a.jpg").
+// Drivers create intermediate "directories" on Put as needed. Every method honours
+// ctx cancellation, so an aborted HTTP request stops the transfer it started.
+type Driver interface {
+	// Put stores the content of r under key, replacing any existing object atomically:
+	// readers see either the old or the new content, never a partial write.
+	Put(ctx context.Context, key string, r io.Reader, opts PutOptions) error
+	// Get opens an object for reading. The returned ObjectInfo describes the whole object,
+	// even when opts.Range selects only part of it.
+	Get(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, ObjectInfo, error)
+	// Stat returns information about an object or directory.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Delete removes an object or an empty directory.
+	Delete(ctx context.Context, key string) error
+	// Copy duplicates an object, including its metadata.
+	Copy(ctx context.Context, src, dst string) error
+	// Rename moves an object or a directory tree, replacing dst if it is an object.
+	Rename(ctx context.Context, src, dst string) error
+	// Mkdir creates a directory. The parent must exist (WebDAV MKCOL semantics).
+	Mkdir(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string, opts ListOptions) (ListResult, error)
+}
+
+// PutOptions carries the metadata stored alongside an object.
+type PutOptions struct {
+	ContentType string
+	// Checksum is an algorithm-prefixed digest such as "sha256:<hex>".
+	Checksum string
+	// Metadata holds arbitrary key/value pairs. Drivers that wrap other drivers
+	// use it to keep their own bookkeeping (e.g. the original size of a compressed object).
+	Metadata map[string]string
+	// Trailer, if set, is called after r has been read to the end and before the object is
+	// committed. It may fill in fields that are only known once the content has streamed
+	// through, such as a digest or the original size. Drivers apply it via Final.
+	Trailer func(*PutOptions)
+}
+
+// Final returns the options to commit an object with, running the Trailer if there is one.
+// Drivers call it after consuming the reader passed to Put.
+func (o PutOptions) Final() PutOptions {
+	if o.Trailer == nil {
+		return o
+	}
+	out := o
+	out.Trailer = nil
+	if o.Metadata != nil {
+		out.Metadata = make(map[string]string, len(o.Metadata))
+		for k, v := range o.Metadata {
+			out.Metadata[k] = v
+		}
+	}
+	o.Trailer(&out)
+	return out
+}
+
+// GetOptions controls how an object is read.
+type GetOptions struct {
+	// Range restricts the read to part of the object. nil reads everything.
+	Range *Range
+}
+
+// Range is a byte range within an object. Length <= 0 reads to the end.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// DefaultPageSize is the number of entries returned by List when ListOptions.PageSize is 0.
+const DefaultPageSize = 1000
+
+var (
+	// ErrInvalidKey is returned when a key is empty, absolute or escapes the driver root.
+	ErrInvalidKey = errors.New("storage: invalid key")
+	// ErrInvalidToken is returned by List when the continuation token cannot be decoded.
+	ErrInvalidToken = errors.New("storage: invalid continuation token")
+	// ErrNotFound and ErrExist are the io/fs sentinels, so os.IsNotExist and errors.Is
+	// work the same on driver errors as on filesystem errors.
+	ErrNotFound = fs.ErrNotExist
+	ErrExist    = fs.ErrExist
+	// ErrNotEmpty is returned when deleting a directory that still has children.
+	ErrNotEmpty = errors.New("storage: directory not empty")
+	// ErrIsDir is returned when an object operation targets a directory.
+	ErrIsDir = errors.New("storage: is a directory")
+)
+
+// EntryType tells files and directories apart in listings.
+type EntryType int
+
+const (
+	TypeFile EntryType = iota
+	TypeDir
+)
+
+func (t EntryType) String() string {
+	if t == TypeDir {
+		return "dir"
+	}
+	return "file"
+}
+
+// ObjectInfo describes a stored object or directory.
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	Type        EntryType
+	ContentType string
+	Checksum    string
+	Metadata    map[string]string
+}
+
+// IsDir reports whether the entry is a directory (or a common prefix in delimiter-style listings).
+func (o ObjectInfo) IsDir() bool {
+	return o.Type == TypeDir
+}
+
+// ListOptions controls how List walks the key space.
+type ListOptions struct {
+	// Recursive lists every key under the prefix. When false, listing is delimiter-style:
+	// only direct children are returned and deeper keys are folded into directory entries.
+	Recursive bool
+	// PageSize caps the number of entries returned. 0 means DefaultPageSize.
+	PageSize int
+	// ContinuationToken resumes a previous listing (ListResult.NextContinuationToken).
+	ContinuationToken string
+}
+
+// ListResult is one page of a listing. Entries are sorted by key.
+type ListResult struct {
+	Entries []ObjectInfo
+	// NextContinuationToken is empty when the listing is complete.
+	NextContinuationToken string
+}
+
+// CleanKey normalises a key and rejects keys that are empty or would escape the root.
+func CleanKey(key string) (string, error) {
+	if key == "" || strings.Contains(key, "\x00") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+	key = strings.TrimPrefix(key, "/")
+	for _, seg := range strings.Split(key, "/") {
+		if seg == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+	key = path.Clean(key)
+	if key == "." || key == "/" {
+		return "", ErrInvalidKey
+	}
+	return key, nil
+}
+
+// cleanPrefix validates a listing prefix. Unlike keys, an empty prefix (the root) is allowed
+// and a trailing slash is kept, since "a/" and "a" select different sets of keys.
+func cleanPrefix(prefix string) (string, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	trailing := strings.HasSuffix(prefix, "/")
+	key, err := CleanKey(prefix)
+	if err != nil {
+		return "", err
+	}
+	if trailing {
+		key += "/"
+	}
+	return key, nil
+}
+
+// EncodeToken turns the last key of a page into an opaque continuation token.
+func EncodeToken(lastKey string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+}
+
+// DecodeToken returns the key a continuation token resumes after.
+func DecodeToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	return string(b), nil
+}
+
+// paginate applies the continuation token and page size to a sorted set of entries.
+func paginate(entries []ObjectInfo, opts ListOptions) (ListResult, error) {
+	after, err := DecodeToken(opts.ContinuationToken)
+	if err != nil {
+		return ListResult{}, err
+	}
+	if after != "" {
+		i := 0
+		for i < len(entries) && entries[i].Key <= after {
+			i++
+		}
+		entries = entries[i:]
+	}
+
+	size := opts.PageSize
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+
+	var res ListResult
+	if len(entries) > size {
+		entries = entries[:size]
+		res.NextContinuationToken = EncodeToken(entries[size-1].Key)
+	}
+	res.Entries = entries
+	return res, nil
+}
+
+// ctxReader aborts a stream as soon as its context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ContextReader returns a reader that fails with ctx.Err() once ctx is done.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return ctxReader{ctx: ctx, r: r}
+}
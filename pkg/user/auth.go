@@ -0,0 +1,170 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBadCredentials is returned by an Authenticator for an unknown user or a wrong
+// password.
+var ErrBadCredentials = errors.New("invalid credentials")
+
+// Authenticator checks a username and password against a source of users.
+type Authenticator interface {
+	// Authenticate returns the user if the password is right, ErrBadCredentials if
+	// it isn't, or another error if the source of users couldn't be asked.
+	Authenticate(ctx context.Context, username, password string) (User, error)
+}
+
+// Local authenticates the users of a Store. A password stored under a hash that
+// needs replacing, such as one imported from an htpasswd file or one weaker than
+// PasswordHashing asks for, is hashed again and saved on the first successful login.
+type Local struct {
+	Users Store
+	// OnRehash, if set, is called after a user's password was hashed again, with the
+	// error if saving it failed. The login succeeds either way.
+	OnRehash func(username string, err error)
+}
+
+func (l Local) Authenticate(ctx context.Context, username, password string) (User, error) {
+	u, err := l.Users.Get(username)
+	if errors.Is(err, ErrNotFound) {
+		return User{}, ErrBadCredentials
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if !checkPassword(u.PasswordHash, password) {
+		return User{}, ErrBadCredentials
+	}
+	if needsRehash(u.PasswordHash) {
+		saved, err := l.rehash(u, password)
+		if l.OnRehash != nil && (saved || err != nil) {
+			l.OnRehash(username, err)
+		}
+	}
+	return u, nil
+}
+
+// rehash replaces the password hash of u, unless it was changed in the meantime, such
+// as by a concurrent login doing the same. It reports whether it saved a new hash.
+func (l Local) rehash(u User, password string) (bool, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return false, err
+	}
+	saved := false
+	err = l.Users.Update(func(tx Tx) error {
+		cur, err := tx.Get(u.Username)
+		if err != nil || cur.PasswordHash != u.PasswordHash {
+			return err
+		}
+		cur.PasswordHash = hash
+		saved = true
+		return tx.Put(cur)
+	})
+	return saved && err == nil, err
+}
+
+// Chain tries each Authenticator in turn until one accepts the user. If none does and
+// one of them failed for another reason than bad credentials, that error is returned,
+// so an unreachable directory isn't mistaken for a wrong password.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, username, password string) (User, error) {
+	var errs []error
+	for _, a := range c {
+		u, err := a.Authenticate(ctx, username, password)
+		if err == nil {
+			return u, nil
+		}
+		if !errors.Is(err, ErrBadCredentials) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return User{}, errors.Join(errs...)
+	}
+	return User{}, ErrBadCredentials
+}
+
+// Cache remembers successful logins of an Authenticator for a while, so that clients
+// that send their credentials with every request, as WebDAV clients do, don't cause a
+// round trip to a directory server each time. Failed logins are never cached, and a
+// password that doesn't match the cached one is checked again.
+type Cache struct {
+	auth Authenticator
+	ttl  time.Duration
+	// salt makes the kept password digests useless outside this process.
+	salt [32]byte
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	digest  [sha256.Size]byte
+	user    User
+	expires time.Time
+}
+
+// NewCache caches the successful logins of auth for ttl.
+func NewCache(auth Authenticator, ttl time.Duration) *Cache {
+	c := &Cache{auth: auth, ttl: ttl, entries: make(map[string]cacheEntry)}
+	rand.Read(c.salt[:])
+	return c
+}
+
+func (c *Cache) Authenticate(ctx context.Context, username, password string) (User, error) {
+	digest := c.digest(username, password)
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[username]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) && subtle.ConstantTimeCompare(e.digest[:], digest[:]) == 1 {
+		return e.user, nil
+	}
+
+	u, err := c.auth.Authenticate(ctx, username, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		delete(c.entries, username)
+		return u, err
+	}
+	c.prune(now)
+	c.entries[username] = cacheEntry{digest: digest, user: u, expires: now.Add(c.ttl)}
+	return u, nil
+}
+
+func (c *Cache) digest(username, password string) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(c.salt[:])
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	var d [sha256.Size]byte
+	h.Sum(d[:0])
+	return d
+}
+
+// prune drops expired entries once the cache has grown, so users who stopped logging
+// in don't stay in memory. The caller holds c.mu.
+func (c *Cache) prune(now time.Time) {
+	if len(c.entries) < cachePruneSize {
+		return
+	}
+	for name, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, name)
+		}
+	}
+}
+
+const cachePruneSize = 1024
@@ -0,0 +1,266 @@
+package user
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// New passwords are hashed as PasswordHashing says, with bcrypt or argon2id. Hashes
+// imported from Apache htpasswd files may also be SHA1 ("{SHA}") or MD5-crypt
+// ("$apr1$", "$1$"). All of them are accepted at login, and a hash that is of another
+// algorithm or weaker than PasswordHashing asks for is replaced as soon as the
+// password is known (see Local).
+
+// Algorithms for hashing new passwords.
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// Hashing describes how new passwords are hashed.
+type Hashing struct {
+	// Algorithm is HashBcrypt or HashArgon2id.
+	Algorithm string
+	// BcryptCost is the bcrypt work factor; each step up doubles the time it takes.
+	BcryptCost int
+	// Argon2Memory (in KiB) and Argon2Time (passes over it) are the argon2id settings.
+	Argon2Memory uint32
+	Argon2Time   uint32
+}
+
+// The default argon2id settings are the least OWASP recommends: 19 MiB and 2 passes.
+// Every login of a client, which WebDAV clients make with each request, needs that
+// much memory for a moment.
+const (
+	DefaultArgon2Memory = 19 * 1024
+	DefaultArgon2Time   = 2
+)
+
+const (
+	argon2Threads = 1
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// PasswordHashing is used to hash new passwords. Programs set it up once, before
+// checking or changing any passwords.
+var PasswordHashing = Hashing{
+	Algorithm:    HashBcrypt,
+	BcryptCost:   bcrypt.DefaultCost,
+	Argon2Memory: DefaultArgon2Memory,
+	Argon2Time:   DefaultArgon2Time,
+}
+
+// Validate checks that h can be used.
+func (h Hashing) Validate() error {
+	switch h.Algorithm {
+	case HashBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost %d: want %d to %d", h.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HashArgon2id:
+		if h.Argon2Memory < 8*argon2Threads {
+			return fmt.Errorf("argon2id memory %d KiB: want at least %d", h.Argon2Memory, 8*argon2Threads)
+		}
+		if h.Argon2Time < 1 {
+			return errors.New("argon2id time: want at least 1 pass")
+		}
+	default:
+		return fmt.Errorf("unknown password hash %q (want %s or %s)", h.Algorithm, HashBcrypt, HashArgon2id)
+	}
+	return nil
+}
+
+// hashPassword hashes a new password.
+func hashPassword(password string) (string, error) {
+	h := PasswordHashing
+	if h.Algorithm == HashArgon2id {
+		salt := make([]byte, argon2SaltLen)
+		rand.Read(salt)
+		key := argon2.IDKey([]byte(password), salt, h.Argon2Time, h.Argon2Memory, argon2Threads, argon2KeyLen)
+		return formatArgon2(argon2Params{h.Argon2Memory, h.Argon2Time, argon2Threads}, salt, key), nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword reports whether password matches hash.
+func checkPassword(hash, password string) bool {
+	switch {
+	case isBcrypt(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, argon2Prefix):
+		p, salt, key, err := parseArgon2(hash)
+		if err != nil {
+			return false
+		}
+		got := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(got, key) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+	case strings.HasPrefix(hash, apr1Magic), strings.HasPrefix(hash, md5CryptMagic):
+		magic := apr1Magic
+		if strings.HasPrefix(hash, md5CryptMagic) {
+			magic = md5CryptMagic
+		}
+		salt, _, ok := strings.Cut(strings.TrimPrefix(hash, magic), "$")
+		if !ok {
+			return false
+		}
+		want := md5Crypt(password, salt, magic)
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+	}
+	return false
+}
+
+// needsRehash reports whether hash should be replaced with a fresh one once the
+// password is known: when it is of another algorithm than PasswordHashing, or of the
+// same one with lower settings. Stronger settings are kept.
+func needsRehash(hash string) bool {
+	h := PasswordHashing
+	switch {
+	case isBcrypt(hash) && h.Algorithm == HashBcrypt:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < h.BcryptCost
+	case strings.HasPrefix(hash, argon2Prefix) && h.Algorithm == HashArgon2id:
+		p, _, _, err := parseArgon2(hash)
+		return err != nil || p.memory < h.Argon2Memory || p.time < h.Argon2Time
+	}
+	return true
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// supportedHash reports whether checkPassword can verify hash.
+func supportedHash(hash string) bool {
+	return isBcrypt(hash) || strings.HasPrefix(hash, argon2Prefix) || strings.HasPrefix(hash, "{SHA}") ||
+		strings.HasPrefix(hash, apr1Magic) || strings.HasPrefix(hash, md5CryptMagic)
+}
+
+// argon2id hashes are kept in the PHC string format of the reference implementation:
+// $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<key>, in unpadded base64.
+const argon2Prefix = "$argon2id$"
+
+type argon2Params struct {
+	memory, time uint32
+	threads      uint8
+}
+
+func formatArgon2(p argon2Params, salt, key []byte) string {
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version,
+		p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func parseArgon2(hash string) (p argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(hash, argon2Prefix), "$")
+	if len(parts) != 4 {
+		return p, nil, nil, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2id version %q", parts[0])
+	}
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id parameters %q", parts[1])
+	}
+	if p.time < 1 || p.threads < 1 {
+		return p, nil, nil, fmt.Errorf("invalid argon2id parameters %q", parts[1])
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil || len(key) == 0 {
+		return p, nil, nil, errors.New("malformed argon2id key")
+	}
+	return p, salt, key, nil
+}
+
+const (
+	apr1Magic     = "$apr1$" // Apache's variant of MD5-crypt
+	md5CryptMagic = "$1$"
+)
+
+// md5Crypt is the MD5-based crypt(3) of FreeBSD, as used by Apache with the "$apr1$"
+// magic.
+func md5Crypt(password, salt, magic string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	final := alt.Sum(nil)
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(final[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final = d.Sum(nil)
+
+	// Deliberately slow, as of 1994.
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return out.String()
+}
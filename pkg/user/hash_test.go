@@ -0,0 +1,207 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setHashing makes h the PasswordHashing for the rest of the test.
+func setHashing(t *testing.T, h Hashing) {
+	t.Helper()
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	old := PasswordHashing
+	PasswordHashing = h
+	t.Cleanup(func() { PasswordHashing = old })
+}
+
+// The hashes of "secret" below were made with other implementations: openssl passwd
+// (-apr1, -1), openssl sha1 and glibc crypt(3) for $2y$.
+var htpasswdHashes = []struct{ name, hash string }{
+	{"apr1", "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/"},
+	{"md5-crypt", "$1$xy$mkJt1Ht8AivD6sawHd.Cf1"},
+	{"sha1", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="},
+	{"bcrypt 2y", "$2y$05$abcdefghijklmnopqrstuuOQiyCxlgf/oeuTqixKmWdcYUh4Hjl0a"},
+}
+
+func TestCheckPasswordHtpasswdHashes(t *testing.T) {
+	for _, c := range htpasswdHashes {
+		if !supportedHash(c.hash) {
+			t.Errorf("%s: not supported", c.name)
+		}
+		if !checkPassword(c.hash, "secret") {
+			t.Errorf("%s: the right password was refused", c.name)
+		}
+		for _, wrong := range []string{"Secret", "secret ", ""} {
+			if checkPassword(c.hash, wrong) {
+				t.Errorf("%s: wrong password %q accepted", c.name, wrong)
+			}
+		}
+	}
+	for _, hash := range []string{"", "secret", "$apr1$abcdefgh", "{SHA}", "$5$xy$abc", "crypt:xyAB"} {
+		if checkPassword(hash, "secret") {
+			t.Errorf("malformed or unknown hash %q accepted", hash)
+		}
+	}
+}
+
+func TestLocalRehashesHtpasswdHashes(t *testing.T) {
+	setHashing(t, Hashing{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost})
+	for _, c := range htpasswdHashes {
+		s, err := NewJSONStore(filepath.Join(t.TempDir(), "users.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Update(func(tx Tx) error {
+			return tx.Put(User{Username: "alice", PasswordHash: c.hash})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rehashed []string
+		l := Local{Users: s, OnRehash: func(username string, err error) {
+			if err != nil {
+				t.Errorf("%s: rehash: %v", c.name, err)
+			}
+			rehashed = append(rehashed, username)
+		}}
+		if _, err := l.Authenticate(context.Background(), "alice", "wrong"); !errors.Is(err, ErrBadCredentials) {
+			t.Errorf("%s: wrong password: got %v, want ErrBadCredentials", c.name, err)
+		}
+		if _, err := l.Authenticate(context.Background(), "alice", "secret"); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		u, err := s.Get("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isBcrypt(c.hash) {
+			// It costs more than PasswordHashing asks for, so it is kept.
+			if len(rehashed) != 0 || u.PasswordHash != c.hash {
+				t.Errorf("%s: after login the hash is %q (rehashed %q), want it kept", c.name, u.PasswordHash, rehashed)
+			}
+		} else if len(rehashed) != 1 || !strings.HasPrefix(u.PasswordHash, "$2a$") || !checkPassword(u.PasswordHash, "secret") {
+			t.Errorf("%s: after login the hash is %q (rehashed %q), want a bcrypt one", c.name, u.PasswordHash, rehashed)
+		}
+		s.Close()
+	}
+}
+
+// argon2idHash is "password" with the salt "somesalt", from the test vectors of the
+// argon2 reference implementation.
+const argon2idHash = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+
+func TestCheckPasswordArgon2id(t *testing.T) {
+	if !checkPassword(argon2idHash, "password") {
+		t.Error("the right password was refused")
+	}
+	if checkPassword(argon2idHash, "Password") {
+		t.Error("a wrong password was accepted")
+	}
+	for _, hash := range []string{
+		"$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=0,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$",
+		"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ",
+	} {
+		if checkPassword(hash, "password") {
+			t.Errorf("malformed hash %q accepted", hash)
+		}
+	}
+
+	// Hashes made here are in the same format.
+	setHashing(t, Hashing{Algorithm: HashArgon2id, Argon2Memory: 64, Argon2Time: 1})
+	hash, err := hashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") || !checkPassword(hash, "password") {
+		t.Errorf("hashPassword made %q", hash)
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcrypt5 := htpasswdHashes[3].hash // cost 5
+	bcrypt4, err := bcrypt.GenerateFromPassword([]byte("secret"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptDefault := Hashing{Algorithm: HashBcrypt, BcryptCost: 5}
+	argon2Default := Hashing{Algorithm: HashArgon2id, Argon2Memory: 65536, Argon2Time: 2}
+
+	for _, c := range []struct {
+		name    string
+		hashing Hashing
+		hash    string
+		want    bool
+	}{
+		{"bcrypt at the cost", bcryptDefault, bcrypt5, false},
+		{"bcrypt at a lower cost", bcryptDefault, string(bcrypt4), true},
+		{"bcrypt at a higher cost", Hashing{Algorithm: HashBcrypt, BcryptCost: 4}, bcrypt5, false},
+		{"argon2id when bcrypt is asked for", bcryptDefault, argon2idHash, true},
+		{"bcrypt when argon2id is asked for", argon2Default, bcrypt5, true},
+		{"argon2id at the settings", argon2Default, argon2idHash, false},
+		{"argon2id with less memory", Hashing{Algorithm: HashArgon2id, Argon2Memory: 131072, Argon2Time: 2}, argon2idHash, true},
+		{"argon2id with fewer passes", Hashing{Algorithm: HashArgon2id, Argon2Memory: 65536, Argon2Time: 3}, argon2idHash, true},
+		{"argon2id with stronger settings", Hashing{Algorithm: HashArgon2id, Argon2Memory: 19456, Argon2Time: 1}, argon2idHash, false},
+		{"sha1", bcryptDefault, htpasswdHashes[2].hash, true},
+		{"apr1", argon2Default, htpasswdHashes[0].hash, true},
+	} {
+		setHashing(t, c.hashing)
+		if got := needsRehash(c.hash); got != c.want {
+			t.Errorf("%s: needsRehash = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLocalSwitchesAlgorithm(t *testing.T) {
+	s, err := NewJSONStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	l := Local{Users: s}
+	login := func() string {
+		t.Helper()
+		if _, err := l.Authenticate(context.Background(), "alice", "long enough password"); err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.Get("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.PasswordHash
+	}
+
+	setHashing(t, Hashing{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost})
+	err = s.Update(func(tx Tx) error { return Add(tx, "alice", "long enough password") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := login(); !isBcrypt(hash) {
+		t.Fatalf("hash %q, want bcrypt", hash)
+	}
+
+	setHashing(t, Hashing{Algorithm: HashArgon2id, Argon2Memory: 64, Argon2Time: 1})
+	hash := login()
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,") {
+		t.Fatalf("after switching to argon2id the hash is %q", hash)
+	}
+	if again := login(); again != hash {
+		t.Errorf("a current hash was replaced: %q, then %q", hash, again)
+	}
+
+	setHashing(t, Hashing{Algorithm: HashBcrypt, BcryptCost: bcrypt.MinCost + 1})
+	if hash := login(); !isBcrypt(hash) {
+		t.Errorf("after switching back to bcrypt the hash is %q", hash)
+	} else if cost, _ := bcrypt.Cost([]byte(hash)); cost != bcrypt.MinCost+1 {
+		t.Errorf("bcrypt cost %d, want %d", cost, bcrypt.MinCost+1)
+	}
+}
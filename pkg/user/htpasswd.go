@@ -0,0 +1,39 @@
+package user
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ParseHtpasswd reads the users of an Apache htpasswd file. Entries hashed with
+// bcrypt, SHA1 or MD5-crypt are returned as users with the default role; others
+// (crypt(3), SHA-2 crypt, plain text) can't be verified and are reported in skipped,
+// one message per entry.
+func ParseHtpasswd(r io.Reader) (users []User, skipped []string, err error) {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		switch {
+		case !ok:
+			skipped = append(skipped, fmt.Sprintf("line %d: not a user:hash entry", n))
+			continue
+		case !validUsername(name):
+			skipped = append(skipped, fmt.Sprintf("line %d: invalid username %q", n, name))
+			continue
+		case !supportedHash(hash):
+			skipped = append(skipped, fmt.Sprintf("line %d: %s: unsupported hash (use bcrypt, SHA1 or MD5)", n, name))
+			continue
+		}
+		users = append(users, User{Username: name, PasswordHash: hash})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	return users, skipped, nil
+}
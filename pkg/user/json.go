@@ -0,0 +1,341 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IYouKnow/atlas-drive/internal/atomicfile"
+	"github.com/fsnotify/fsnotify"
+)
+
+// ErrConflict is returned by Update when the user file was changed by a writer that
+// doesn't take the lock (such as an editor) while the update ran, so saving would
+// throw away its changes.
+var ErrConflict = errors.New("users were changed by another process; reload and try again")
+
+// JSONStore keeps the users in a JSON file, users.json. The whole file is read into
+// memory; Watch or Reload pick up changes made to it by others.
+type JSONStore struct {
+	mu       sync.RWMutex
+	filePath string
+	users    map[string]*User
+	// saveMu serialises updates and reloads within the process; lockFile covers others.
+	saveMu sync.Mutex
+}
+
+// NewJSONStore creates a user store backed by the given file path.
+// It loads existing users if the file exists.
+func NewJSONStore(path string) (*JSONStore, error) {
+	s := &JSONStore{
+		filePath: path,
+		users:    make(map[string]*User),
+	}
+
+	users, _, err := readUsers(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	s.users = users
+	return s, nil
+}
+
+// userFile is the layout of users.json. The generation goes up with every save, which
+// lets a writer notice that the file changed under it.
+//
+// Files written before generations existed hold just the users map; they are read as
+// generation 0 and converted on the next save.
+type userFile struct {
+	Generation int64            `json:"generation"`
+	Users      map[string]*User `json:"users"`
+}
+
+// readUsers reads and checks a user file, so a malformed one is never put to use.
+func readUsers(path string) (map[string]*User, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var f userFile
+	if isLegacyFile(data) {
+		err = json.Unmarshal(data, &f.Users)
+	} else {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	if f.Users == nil {
+		f.Users = make(map[string]*User)
+	}
+	for name, u := range f.Users {
+		if u == nil {
+			return nil, 0, fmt.Errorf("%s: user %s: empty entry", path, name)
+		}
+		if u.Username == "" {
+			u.Username = name
+		}
+		if u.Username != name {
+			return nil, 0, fmt.Errorf("%s: user %s: username %q does not match", path, name, u.Username)
+		}
+		if err := u.validate(); err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return f.Users, f.Generation, nil
+}
+
+// isLegacyFile tells a bare users map apart from a userFile: only the latter has a
+// numeric "generation" (a user called "generation" would be an object).
+func isLegacyFile(data []byte) bool {
+	var top map[string]json.RawMessage
+	if json.Unmarshal(data, &top) != nil {
+		return false // let the caller report the syntax error
+	}
+	gen, ok := top["generation"]
+	if !ok {
+		return true
+	}
+	gen = bytes.TrimSpace(gen)
+	return len(gen) == 0 || gen[0] == '{'
+}
+
+// fileGeneration returns the generation of the user file on disk, 0 if there is none.
+func fileGeneration(path string) (int64, error) {
+	_, gen, err := readUsers(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	return gen, err
+}
+
+// Get returns the user called username, as last loaded.
+func (s *JSONStore) Get(username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return jsonTx(s.users).Get(username)
+}
+
+// List returns all usernames, sorted.
+func (s *JSONStore) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return jsonTx(s.users).List()
+}
+
+// Update runs fn on the users and saves the result, with the user file locked against
+// other writers throughout. The users are reloaded from the file first, so changes
+// made elsewhere are kept.
+func (s *JSONStore) Update(fn func(tx Tx) error) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	users, gen, err := readUsers(s.filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		users, gen, err = make(map[string]*User), 0, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(jsonTx(users)); err != nil {
+		return err
+	}
+	if err := s.save(users, gen); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.mu.Unlock()
+	return nil
+}
+
+// Close releases nothing; the file is only open while it is read or written.
+func (s *JSONStore) Close() error {
+	return nil
+}
+
+// lock keeps other writers, in this process or another, away from the user file until
+// the returned function is called.
+func (s *JSONStore) lock() (func(), error) {
+	s.saveMu.Lock()
+	// Ensure directory exists
+	if err := os.MkdirAll(filepath.Dir(s.filePath), 0755); err != nil {
+		s.saveMu.Unlock()
+		return nil, err
+	}
+	unlock, err := lockFile(s.filePath + ".lock")
+	if err != nil {
+		s.saveMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		s.saveMu.Unlock()
+	}, nil
+}
+
+// save writes users, read at generation gen, to a temporary file and renames it over
+// the user file, so readers never see a partial file. The caller holds the file lock.
+func (s *JSONStore) save(users map[string]*User, gen int64) error {
+	onDisk, err := fileGeneration(s.filePath)
+	if err != nil {
+		return err
+	}
+	if onDisk != gen {
+		return ErrConflict
+	}
+	data, err := json.MarshalIndent(userFile{Generation: gen + 1, Users: users}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.filePath, data, 0600)
+}
+
+// jsonTx is the Tx of JSONStore: the users read at the start of the update.
+type jsonTx map[string]*User
+
+func (t jsonTx) Get(username string) (User, error) {
+	u, ok := t[username]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return *u, nil
+}
+
+func (t jsonTx) List() ([]string, error) {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (t jsonTx) Put(u User) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	t[u.Username] = &u
+	return nil
+}
+
+func (t jsonTx) Delete(username string) error {
+	delete(t, username)
+	return nil
+}
+
+// Diff lists the users a reload added, removed or changed (password or role).
+type Diff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// Empty reports whether the reload changed nothing.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Reload replaces the users with those in the file, all at once. If the file can't be
+// read or is malformed, the current users are kept and the error is returned.
+func (s *JSONStore) Reload() (Diff, error) {
+	// Wait for updates in progress, whose changes would otherwise be lost.
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	users, _, err := readUsers(s.filePath)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var d Diff
+	for name, u := range users {
+		old, ok := s.users[name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, name)
+		case *old != *u:
+			d.Changed = append(d.Changed, name)
+		}
+	}
+	for name := range s.users {
+		if _, ok := users[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+	s.users = users
+	return d, nil
+}
+
+// Watch reloads the users whenever the file changes, until ctx is done, and reports
+// each reload to onReload. The directory is watched rather than the file, since
+// editors and atomic saves replace the file instead of writing to it.
+func (s *JSONStore) Watch(ctx context.Context, onReload func(Diff, error)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+		// Writes often come as several events; reload once they settle.
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) == filepath.Clean(s.filePath) && !ev.Has(fsnotify.Chmod) {
+					settle = time.After(reloadSettle)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				onReload(Diff{}, err)
+			case <-settle:
+				settle = nil
+				d, err := s.Reload()
+				if errors.Is(err, os.ErrNotExist) {
+					err = fmt.Errorf("%s was removed: %w", s.filePath, err)
+				}
+				onReload(d, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadSettle is how long Watch waits after the last change before reloading.
+const reloadSettle = 100 * time.Millisecond
@@ -0,0 +1,214 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newJSONStore returns a store holding users in a temporary users.json, and its path.
+func newJSONStore(t *testing.T, users ...User) (*JSONStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.json")
+	s, err := NewJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Update(func(tx Tx) error {
+		for _, u := range users {
+			if err := tx.Put(u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, path
+}
+
+func TestJSONStoreReload(t *testing.T) {
+	s, path := newJSONStore(t,
+		User{Username: "alice", PasswordHash: "hash-a"},
+		User{Username: "bob", PasswordHash: "hash-b"},
+		User{Username: "carol", PasswordHash: "hash-c"},
+	)
+
+	// Another process, like 'atlas user', changes the file.
+	other, err := NewJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Update(func(tx Tx) error {
+		tx.Delete("bob")
+		if err := tx.Put(User{Username: "alice", PasswordHash: "hash-a", Role: RoleAdmin}); err != nil {
+			return err
+		}
+		return tx.Put(User{Username: "dave", PasswordHash: "hash-d"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(d.Added, []string{"dave"}) || !slices.Equal(d.Removed, []string{"bob"}) || !slices.Equal(d.Changed, []string{"alice"}) {
+		t.Errorf("Reload = %+v, want dave added, bob removed, alice changed", d)
+	}
+	if !IsAdmin(s, "alice") {
+		t.Error("alice's new role wasn't picked up")
+	}
+	if d, err := s.Reload(); err != nil || !d.Empty() {
+		t.Errorf("second Reload = %+v, %v; want no changes", d, err)
+	}
+
+	// A malformed file is refused, whole, and the users stay as they were.
+	for _, data := range []string{
+		`{"generation": 3, "users": {`,
+		`{"generation": 3, "users": {"eve": {"password_hash": "hash-e", "role": "root"}}}`,
+	} {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Reload(); err == nil {
+			t.Errorf("Reload of %s succeeded", data)
+		}
+		if names, _ := s.List(); !slices.Equal(names, []string{"alice", "carol", "dave"}) {
+			t.Errorf("users after a failed Reload = %v", names)
+		}
+	}
+}
+
+func TestJSONStoreWatch(t *testing.T) {
+	s, path := newJSONStore(t, User{Username: "alice", PasswordHash: "hash-a"})
+	type reload struct {
+		d   Diff
+		err error
+	}
+	reloads := make(chan reload, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Watch(ctx, func(d Diff, err error) { reloads <- reload{d, err} }); err != nil {
+		t.Fatal(err)
+	}
+	next := func() reload {
+		t.Helper()
+		select {
+		case r := <-reloads:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reload")
+			return reload{}
+		}
+	}
+
+	// Update saves by renaming a new file over the old one.
+	other, err := NewJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Update(func(tx Tx) error { return tx.Put(User{Username: "bob", PasswordHash: "hash-b"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(); r.err != nil || !slices.Equal(r.d.Added, []string{"bob"}) {
+		t.Fatalf("reload = %+v, %v; want bob added", r.d, r.err)
+	}
+	if _, err := s.Get("bob"); err != nil {
+		t.Errorf("Get(bob): %v", err)
+	}
+
+	// So does an editor; a broken save is reported and ignored.
+	tmp := path + ".swp"
+	if err := os.WriteFile(tmp, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	if r := next(); r.err == nil {
+		t.Fatal("reload of a broken file reported no error")
+	}
+	if names, _ := s.List(); !slices.Equal(names, []string{"alice", "bob"}) {
+		t.Errorf("users after a broken save = %v", names)
+	}
+}
+
+func TestJSONStoreSave(t *testing.T) {
+	s, path := newJSONStore(t, User{Username: "alice", PasswordHash: "hash-a"})
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("users.json mode = %v, %v; want 0600", fi.Mode().Perm(), err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".users.json.tmp-*")); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+
+	// Someone edits the file without taking the lock while an update runs: the update
+	// fails instead of overwriting the edit.
+	edited := `{"generation": 7, "users": {"bob": {"password_hash": "hash-b"}}}`
+	err := s.Update(func(tx Tx) error {
+		if err := os.WriteFile(path, []byte(edited), 0600); err != nil {
+			return err
+		}
+		return tx.Put(User{Username: "carol", PasswordHash: "hash-c"})
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Update after an out-of-band edit: %v, want ErrConflict", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != edited {
+		t.Errorf("the edit was overwritten: %s", data)
+	}
+
+	// The next update starts from the edited file.
+	if err := s.Update(func(tx Tx) error { return tx.Put(User{Username: "carol", PasswordHash: "hash-c"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := s.List(); !slices.Equal(names, []string{"bob", "carol"}) {
+		t.Errorf("users = %v, want bob and carol", names)
+	}
+}
+
+func TestJSONStoreConcurrentUpdates(t *testing.T) {
+	_, path := newJSONStore(t)
+	// Two stores on the same file, like the server and 'atlas user'.
+	var stores [2]*JSONStore
+	for i := range stores {
+		s, err := NewJSONStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = s
+	}
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := stores[i%2]
+			err := s.Update(func(tx Tx) error {
+				return tx.Put(User{Username: fmt.Sprintf("user%d", i), PasswordHash: "x"})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s, err := NewJSONStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names, err := s.List(); err != nil || len(names) != 16 {
+		t.Errorf("List = %v, %v; want 16 users", names, err)
+	}
+}
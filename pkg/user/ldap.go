@@ -0,0 +1,230 @@
+package user
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapTimeout bounds each conversation with the directory server.
+const ldapTimeout = 10 * time.Second
+
+// LDAPConfig describes how to find and authenticate users in an LDAP directory, such
+// as Active Directory.
+type LDAPConfig struct {
+	// URL of the server: ldap://host[:port], or ldaps://host[:port] for TLS.
+	URL string
+	// StartTLS upgrades an ldap:// connection to TLS before anything is sent.
+	StartTLS bool
+	// CAFile, if set, holds the PEM certificates to trust for the server's
+	// certificate instead of the system ones.
+	CAFile string
+	// BindDN and BindPassword are the service account that searches for users; both
+	// empty means searching anonymously.
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are searched, including all levels below.
+	BaseDN string
+	// UserFilter finds the entry of a user; every %s is replaced by the (escaped)
+	// username, e.g. "(uid=%s)" or "(sAMAccountName=%s)" for Active Directory.
+	UserFilter string
+	// AdminGroups are the DNs of groups whose members get the admin role.
+	AdminGroups []string
+	// UserGroups, if set, limits logins to members of these groups (and AdminGroups).
+	UserGroups []string
+	// GroupAttribute lists the groups of a user entry. Default: memberOf.
+	GroupAttribute string
+}
+
+// LDAP authenticates users against an LDAP directory: it finds the user's entry with
+// the service account, then binds as that entry with the password given. Roles follow
+// group membership.
+type LDAP struct {
+	cfg         LDAPConfig
+	url         *url.URL
+	tls         *tls.Config
+	adminGroups []*ldap.DN
+	userGroups  []*ldap.DN
+}
+
+// NewLDAP checks cfg and returns an authenticator for it. It doesn't contact the
+// server yet.
+func NewLDAP(cfg LDAPConfig) (*LDAP, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap url: %w", err)
+	}
+	switch {
+	case u.Scheme != "ldap" && u.Scheme != "ldaps":
+		return nil, fmt.Errorf("ldap url %q: want ldap:// or ldaps://", cfg.URL)
+	case u.Scheme == "ldaps" && cfg.StartTLS:
+		return nil, errors.New("ldap: StartTLS is for ldap:// URLs; ldaps:// uses TLS already")
+	case cfg.BaseDN == "":
+		return nil, errors.New("ldap: a base DN is required")
+	case !strings.Contains(cfg.UserFilter, "%s"):
+		return nil, fmt.Errorf("ldap user filter %q: must contain %%s for the username", cfg.UserFilter)
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+
+	l := &LDAP{cfg: cfg, url: u, tls: &tls.Config{ServerName: u.Hostname()}}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", cfg.CAFile)
+		}
+		l.tls.RootCAs = pool
+	}
+	if l.adminGroups, err = parseDNs(cfg.AdminGroups); err != nil {
+		return nil, err
+	}
+	if l.userGroups, err = parseDNs(cfg.UserGroups); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func parseDNs(dns []string) ([]*ldap.DN, error) {
+	out := make([]*ldap.DN, 0, len(dns))
+	for _, s := range dns {
+		dn, err := ldap.ParseDN(s)
+		if err != nil {
+			return nil, fmt.Errorf("ldap group %q: %w", s, err)
+		}
+		out = append(out, dn)
+	}
+	return out, nil
+}
+
+func (l *LDAP) Authenticate(ctx context.Context, username, password string) (User, error) {
+	// An empty password would make the bind an unauthenticated one, which servers
+	// accept for any DN.
+	if password == "" || !validUsername(username) {
+		return User{}, ErrBadCredentials
+	}
+
+	conn, err := l.dial(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+	// The client takes no context: closing the connection is what interrupts the
+	// request in progress once ctx is done.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	u, err := l.authenticate(conn, username, password)
+	if err != nil && ctx.Err() != nil {
+		return User{}, fmt.Errorf("ldap: %w", ctx.Err())
+	}
+	return u, err
+}
+
+// authenticate does the work of Authenticate over conn.
+func (l *LDAP) authenticate(conn *ldap.Conn, username, password string) (User, error) {
+	if l.cfg.StartTLS {
+		if err := conn.StartTLS(l.tls); err != nil {
+			return User{}, fmt.Errorf("ldap: StartTLS: %w", err)
+		}
+	}
+	if l.cfg.BindDN != "" || l.cfg.BindPassword != "" {
+		if err := conn.Bind(l.cfg.BindDN, l.cfg.BindPassword); err != nil {
+			return User{}, fmt.Errorf("ldap: bind as %s: %w", l.cfg.BindDN, err)
+		}
+	}
+	filter := strings.ReplaceAll(l.cfg.UserFilter, "%s", ldap.EscapeFilter(username))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		l.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout/time.Second), false,
+		filter, []string{l.cfg.GroupAttribute}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return User{}, fmt.Errorf("ldap: search %s: %w", filter, err)
+	}
+	switch {
+	case res == nil || len(res.Entries) == 0:
+		return User{}, ErrBadCredentials
+	case len(res.Entries) > 1:
+		return User{}, fmt.Errorf("ldap: %s matches more than one entry", filter)
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return User{}, ErrBadCredentials
+		}
+		return User{}, fmt.Errorf("ldap: bind as %s: %w", entry.DN, err)
+	}
+
+	role, ok := l.role(entry.GetEqualFoldAttributeValues(l.cfg.GroupAttribute))
+	if !ok {
+		return User{}, ErrBadCredentials
+	}
+	return User{Username: username, Role: role}, nil
+}
+
+// role maps the groups of a user to a role; ok is false if the user isn't in any of
+// the groups allowed to log in.
+func (l *LDAP) role(groups []string) (role string, ok bool) {
+	member := func(dns []*ldap.DN) bool {
+		for _, g := range groups {
+			dn, err := ldap.ParseDN(g)
+			if err != nil {
+				continue
+			}
+			for _, want := range dns {
+				if dn.EqualFold(want) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	switch {
+	case member(l.adminGroups):
+		return RoleAdmin, true
+	case len(l.userGroups) == 0 || member(l.userGroups):
+		return RoleUser, true
+	}
+	return "", false
+}
+
+// dial connects to the server, giving up when ctx is done.
+func (l *LDAP) dial(ctx context.Context) (*ldap.Conn, error) {
+	host, port := l.url.Hostname(), l.url.Port()
+	if port == "" {
+		port = ldap.DefaultLdapPort
+		if l.url.Scheme == "ldaps" {
+			port = ldap.DefaultLdapsPort
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+	d := &net.Dialer{Timeout: ldapTimeout}
+	var c net.Conn
+	var err error
+	if l.url.Scheme == "ldaps" {
+		c, err = (&tls.Dialer{NetDialer: d, Config: l.tls}).DialContext(ctx, "tcp", addr)
+	} else {
+		c, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	conn := ldap.NewConn(c, l.url.Scheme == "ldaps")
+	conn.Start()
+	conn.SetTimeout(ldapTimeout)
+	return conn, nil
+}
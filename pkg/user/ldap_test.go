@@ -0,0 +1,408 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapEntry is an entry of the test directory.
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// ldapServer is just enough of a directory server for LDAP: simple binds, and
+// searches whose filter is a single equality match.
+type ldapServer struct {
+	t       *testing.T
+	ln      net.Listener
+	entries []ldapEntry
+
+	mu       sync.Mutex
+	filters  []string // the searches received, as filter strings
+	binds    []string // the DNs bound as
+	searches int
+	// hang, if set, keeps searches waiting until it is closed.
+	hang chan struct{}
+}
+
+const (
+	ldapBaseDN   = "dc=example,dc=org"
+	ldapBindDN   = "cn=atlas,dc=example,dc=org"
+	ldapBindPass = "service secret"
+	ldapAdmins   = "cn=admins,ou=groups,dc=example,dc=org"
+	ldapStaff    = "cn=staff,ou=groups,dc=example,dc=org"
+)
+
+func newLDAPServer(t *testing.T, entries ...ldapEntry) *ldapServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ldapServer{t: t, ln: ln, entries: entries}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(c)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *ldapServer) url() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+// config returns an LDAPConfig for the server, searching with the service account.
+func (s *ldapServer) config() LDAPConfig {
+	return LDAPConfig{
+		URL:          s.url(),
+		BindDN:       ldapBindDN,
+		BindPassword: ldapBindPass,
+		BaseDN:       ldapBaseDN,
+		UserFilter:   "(uid=%s)",
+	}
+}
+
+func (s *ldapServer) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.bind(c, id, op)
+		case ldap.ApplicationSearchRequest:
+			s.search(c, id, op)
+		default: // unbind, or something this server doesn't do
+			return
+		}
+	}
+}
+
+func (s *ldapServer) bind(c net.Conn, id int64, op *ber.Packet) {
+	dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+	s.mu.Lock()
+	s.binds = append(s.binds, dn)
+	s.mu.Unlock()
+
+	code := uint16(ldap.LDAPResultInvalidCredentials)
+	switch {
+	case password == "":
+		// What real servers do: an unauthenticated bind succeeds for any DN.
+		code = ldap.LDAPResultSuccess
+	case dn == ldapBindDN && password == ldapBindPass:
+		code = ldap.LDAPResultSuccess
+	default:
+		for _, e := range s.entries {
+			if strings.EqualFold(e.dn, dn) && e.password == password {
+				code = ldap.LDAPResultSuccess
+			}
+		}
+	}
+	s.reply(c, id, ldapResult(ldap.ApplicationBindResponse, code))
+}
+
+func (s *ldapServer) search(c net.Conn, id int64, op *ber.Packet) {
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	compiled, err := ldap.DecompileFilter(filter)
+	if err != nil {
+		s.t.Errorf("ldap server: %v", err)
+	}
+	s.mu.Lock()
+	s.filters = append(s.filters, compiled)
+	s.searches++
+	hang := s.hang
+	s.mu.Unlock()
+	if hang != nil {
+		<-hang
+	}
+
+	var matched []ldapEntry
+	if filter.Tag == ldap.FilterEqualityMatch {
+		attr, value := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+		for _, e := range s.entries {
+			for _, v := range e.attrs[attr] {
+				if v == value {
+					matched = append(matched, e)
+					break
+				}
+			}
+		}
+	}
+	code := uint16(ldap.LDAPResultSuccess)
+	if sizeLimit > 0 && int64(len(matched)) > sizeLimit {
+		matched, code = matched[:sizeLimit], ldap.LDAPResultSizeLimitExceeded
+	}
+	for _, e := range matched {
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+		attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		for name, values := range e.attrs {
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+			}
+			attr.AppendChild(set)
+			attrs.AppendChild(attr)
+		}
+		entry.AppendChild(attrs)
+		s.reply(c, id, entry)
+	}
+	s.reply(c, id, ldapResult(ldap.ApplicationSearchResultDone, code))
+}
+
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return p
+}
+
+func (s *ldapServer) reply(c net.Conn, id int64, op *ber.Packet) {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	c.Write(p.Bytes())
+}
+
+func ldapUser(uid, password string, groups ...string) ldapEntry {
+	return ldapEntry{
+		dn:       "uid=" + uid + ",ou=people," + ldapBaseDN,
+		password: password,
+		attrs:    map[string][]string{"uid": {uid}, "memberOf": groups},
+	}
+}
+
+func newTestLDAP(t *testing.T, cfg LDAPConfig) *LDAP {
+	t.Helper()
+	l, err := NewLDAP(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	srv := newLDAPServer(t,
+		ldapUser("alice", "alice password"),
+		ldapUser("bob", "bob password", ldapStaff),
+	)
+	l := newTestLDAP(t, srv.config())
+	ctx := context.Background()
+
+	u, err := l.Authenticate(ctx, "alice", "alice password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "alice" || u.Role != RoleUser {
+		t.Errorf("got %+v, want alice with role %s", u, RoleUser)
+	}
+	for _, c := range []struct{ username, password string }{
+		{"alice", "wrong"},
+		{"carol", "alice password"},
+	} {
+		if _, err := l.Authenticate(ctx, c.username, c.password); !errors.Is(err, ErrBadCredentials) {
+			t.Errorf("Authenticate(%q, %q) = %v, want ErrBadCredentials", c.username, c.password, err)
+		}
+	}
+
+	cfg := srv.config()
+	cfg.BindPassword = "wrong"
+	_, err = newTestLDAP(t, cfg).Authenticate(ctx, "alice", "alice password")
+	if err == nil || errors.Is(err, ErrBadCredentials) {
+		t.Errorf("with a wrong service password: got %v, want a server error", err)
+	}
+}
+
+func TestLDAPEscapesFilter(t *testing.T) {
+	srv := newLDAPServer(t, ldapUser("alice", "alice password"))
+	l := newTestLDAP(t, srv.config())
+
+	// Unescaped, this would match every entry with a uid.
+	_, err := l.Authenticate(context.Background(), "*)(uid=*", "alice password")
+	if !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("got %v, want ErrBadCredentials", err)
+	}
+	want := `(uid=\2a\29\28uid=\2a)`
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.filters) != 1 || srv.filters[0] != want {
+		t.Errorf("searched %q, want [%s]", srv.filters, want)
+	}
+}
+
+func TestLDAPRefusesEmptyPassword(t *testing.T) {
+	srv := newLDAPServer(t, ldapUser("alice", "alice password"))
+	l := newTestLDAP(t, srv.config())
+
+	// The server would take an empty password as an unauthenticated bind.
+	_, err := l.Authenticate(context.Background(), "alice", "")
+	if !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("got %v, want ErrBadCredentials", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.binds) != 0 {
+		t.Errorf("bound as %q", srv.binds)
+	}
+}
+
+func TestLDAPRoles(t *testing.T) {
+	srv := newLDAPServer(t,
+		ldapUser("alice", "alice password", ldapStaff, "CN=Admins, OU=Groups, DC=Example, DC=Org"),
+		ldapUser("bob", "bob password", ldapStaff),
+		ldapUser("carol", "carol password", "cn=guests,ou=groups,dc=example,dc=org", "not a dn"),
+		ldapUser("dave", "dave password", ldapAdmins),
+	)
+	cfg := srv.config()
+	cfg.AdminGroups = []string{ldapAdmins}
+	cfg.UserGroups = []string{ldapStaff}
+	l := newTestLDAP(t, cfg)
+
+	for _, c := range []struct {
+		username, role string
+		ok             bool
+	}{
+		{"alice", RoleAdmin, true}, // DNs compare without regard to case and spacing
+		{"bob", RoleUser, true},
+		{"carol", "", false}, // in neither group
+		{"dave", RoleAdmin, true},
+	} {
+		u, err := l.Authenticate(context.Background(), c.username, c.username+" password")
+		switch {
+		case !c.ok:
+			if !errors.Is(err, ErrBadCredentials) {
+				t.Errorf("%s: got %v, want ErrBadCredentials", c.username, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", c.username, err)
+		case u.Role != c.role:
+			t.Errorf("%s: role %q, want %q", c.username, u.Role, c.role)
+		}
+	}
+}
+
+func TestLDAPMultipleEntries(t *testing.T) {
+	for _, n := range []int{2, 3} { // 3 goes past the size limit of the search
+		entries := make([]ldapEntry, n)
+		for i := range entries {
+			entries[i] = ldapUser("alice", "alice password")
+			entries[i].dn = "cn=" + string(rune('a'+i)) + "," + entries[i].dn
+		}
+		srv := newLDAPServer(t, entries...)
+		l := newTestLDAP(t, srv.config())
+
+		_, err := l.Authenticate(context.Background(), "alice", "alice password")
+		if err == nil || errors.Is(err, ErrBadCredentials) || !strings.Contains(err.Error(), "more than one entry") {
+			t.Errorf("%d entries: got %v, want the multiple entries error", n, err)
+		}
+	}
+}
+
+func TestLDAPHonoursContext(t *testing.T) {
+	srv := newLDAPServer(t, ldapUser("alice", "alice password"))
+	hang := make(chan struct{})
+	defer close(hang)
+	srv.mu.Lock()
+	srv.hang = hang
+	srv.mu.Unlock()
+	l := newTestLDAP(t, srv.config())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := l.Authenticate(ctx, "alice", "alice password")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %v to give up", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Authenticate(ctx, "alice", "alice password"); !errors.Is(err, context.Canceled) {
+		t.Errorf("with a canceled context: got %v, want context.Canceled", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	srv := newLDAPServer(t, ldapUser("alice", "alice password"))
+	c := NewCache(newTestLDAP(t, srv.config()), time.Hour)
+	ctx := context.Background()
+	searches := func() int {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.searches
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Authenticate(ctx, "alice", "alice password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := searches(); n != 1 {
+		t.Errorf("3 logins asked the server %d times, want 1", n)
+	}
+
+	// Another password is checked again, and a failure is not remembered.
+	for i := 0; i < 2; i++ {
+		if _, err := c.Authenticate(ctx, "alice", "wrong"); !errors.Is(err, ErrBadCredentials) {
+			t.Errorf("wrong password: got %v, want ErrBadCredentials", err)
+		}
+	}
+	if n := searches(); n != 3 {
+		t.Errorf("after 2 failed logins the server was asked %d times, want 3", n)
+	}
+	// The failure also dropped the remembered login.
+	if _, err := c.Authenticate(ctx, "alice", "alice password"); err != nil {
+		t.Fatal(err)
+	}
+	if n := searches(); n != 4 {
+		t.Errorf("server asked %d times, want 4", n)
+	}
+
+	// Logins are remembered for the ttl only.
+	c = NewCache(newTestLDAP(t, srv.config()), time.Nanosecond)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Authenticate(ctx, "alice", "alice password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := searches(); n != 6 {
+		t.Errorf("with an expired login the server was asked %d times, want 6", n)
+	}
+}
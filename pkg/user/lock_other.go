@@ -0,0 +1,9 @@
+//go:build !unix
+
+package user
+
+// lockFile is a no-op where flock is not available. Saves are still atomic and
+// conflicting ones are still detected through the generation.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,250 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// TokenAuthenticator checks bearer tokens.
+type TokenAuthenticator interface {
+	// AuthenticateToken returns the user a token was issued to if it is valid,
+	// ErrBadCredentials if it isn't, or another error if it couldn't be checked.
+	AuthenticateToken(ctx context.Context, token string) (User, error)
+}
+
+// oidcAlgorithms are the signature algorithms accepted in tokens. Shared-secret (HS*)
+// algorithms are left out: the keys come from a JWKS, which only holds public keys.
+var oidcAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+const (
+	// jwksMaxAge is how long the keys are used before they are read again, to pick up
+	// rotations by the issuer.
+	jwksMaxAge = time.Hour
+	// jwksMinAge is how long after reading the keys a token signed with an unknown key
+	// may cause them to be read again, so bogus tokens can't hammer the issuer.
+	jwksMinAge = time.Minute
+	// oidcLeeway allows for clock skew when checking exp, nbf and iat.
+	oidcLeeway = time.Minute
+)
+
+// OIDCConfig describes which OpenID Connect (or other JWT) access tokens to accept.
+type OIDCConfig struct {
+	// JWKS is the file or http(s):// URL of the issuer's signing keys (its jwks_uri).
+	JWKS string
+	// Issuer must match the "iss" claim exactly.
+	Issuer string
+	// Audience must be one of the "aud" claim's values.
+	Audience string
+	// UsernameClaim holds the Atlas username. Default: preferred_username.
+	UsernameClaim string
+	// GroupsClaim holds the user's groups, a string or a list. Default: groups.
+	GroupsClaim string
+	// AdminGroups are the groups whose members get the admin role.
+	AdminGroups []string
+	// UserGroups, if set, limits access to members of these groups (and AdminGroups).
+	UserGroups []string
+}
+
+// OIDC authenticates signed JWT access tokens against the keys of their issuer.
+type OIDC struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    jose.JSONWebKeySet
+	fetched time.Time
+}
+
+// NewOIDC checks cfg and reads the issuer's keys.
+func NewOIDC(cfg OIDCConfig) (*OIDC, error) {
+	switch {
+	case cfg.JWKS == "":
+		return nil, errors.New("oidc: a JWKS file or URL is required")
+	case cfg.Issuer == "":
+		return nil, errors.New("oidc: an issuer is required")
+	case cfg.Audience == "":
+		return nil, errors.New("oidc: an audience is required")
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	o := &OIDC{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := o.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *OIDC) AuthenticateToken(ctx context.Context, token string) (User, error) {
+	tok, err := jwt.ParseSigned(token, oidcAlgorithms)
+	if err != nil {
+		return User{}, fmt.Errorf("%w: %v", ErrBadCredentials, err)
+	}
+	kid := tok.Headers[0].KeyID
+	keys, err := o.keysFor(ctx, kid)
+	if err != nil {
+		return User{}, err
+	}
+
+	var std jwt.Claims
+	var claims map[string]any
+	verified := false
+	for _, k := range keys {
+		if tok.Claims(k, &std, &claims) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return User{}, fmt.Errorf("%w: token not signed by a key of the issuer (kid %q)", ErrBadCredentials, kid)
+	}
+	if std.Expiry == nil {
+		return User{}, fmt.Errorf("%w: token has no expiry", ErrBadCredentials)
+	}
+	err = std.ValidateWithLeeway(jwt.Expected{
+		Issuer:      o.cfg.Issuer,
+		AnyAudience: jwt.Audience{o.cfg.Audience},
+		Time:        time.Now(),
+	}, oidcLeeway)
+	if err != nil {
+		return User{}, fmt.Errorf("%w: %v", ErrBadCredentials, err)
+	}
+
+	username, _ := claims[o.cfg.UsernameClaim].(string)
+	if !validUsername(username) {
+		return User{}, fmt.Errorf("%w: claim %s: invalid username %q", ErrBadCredentials, o.cfg.UsernameClaim, username)
+	}
+	role, ok := groupRole(stringList(claims[o.cfg.GroupsClaim]), o.cfg.AdminGroups, o.cfg.UserGroups)
+	if !ok {
+		return User{}, fmt.Errorf("%w: %s is not in an allowed group", ErrBadCredentials, username)
+	}
+	return User{Username: username, Role: role}, nil
+}
+
+// keysFor returns the keys that may have signed a token with the given key ID, all
+// signing keys if it has none. An unknown key ID makes it read the keys again, since
+// the issuer may have rotated them.
+func (o *OIDC) keysFor(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	age := time.Since(o.fetched)
+	if age > jwksMaxAge || (kid != "" && len(o.keys.Key(kid)) == 0 && age > jwksMinAge) {
+		if err := o.refreshLocked(ctx); err != nil && len(o.keys.Keys) == 0 {
+			return nil, err
+		}
+	}
+
+	candidates := o.keys.Keys
+	if kid != "" {
+		candidates = o.keys.Key(kid)
+	}
+	var keys []jose.JSONWebKey
+	for _, k := range candidates {
+		if k.Use == "" || k.Use == "sig" {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (o *OIDC) refresh(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.refreshLocked(ctx)
+}
+
+// refreshLocked reads the keys from the JWKS file or URL. On failure the previous
+// keys are kept; they are tried again no sooner than jwksMinAge.
+func (o *OIDC) refreshLocked(ctx context.Context) error {
+	o.fetched = time.Now()
+	data, err := o.readJWKS(ctx)
+	if err != nil {
+		return fmt.Errorf("oidc: jwks: %w", err)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("oidc: jwks %s: %w", o.cfg.JWKS, err)
+	}
+	if len(set.Keys) == 0 {
+		return fmt.Errorf("oidc: jwks %s: no keys", o.cfg.JWKS)
+	}
+	o.keys = set
+	return nil
+}
+
+func (o *OIDC) readJWKS(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(o.cfg.JWKS, "https://") && !strings.HasPrefix(o.cfg.JWKS, "http://") {
+		return os.ReadFile(o.cfg.JWKS)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.cfg.JWKS, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", o.cfg.JWKS, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// stringList reads a claim that holds a string or a list of strings.
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// groupRole maps a user's groups to a role; ok is false if the user isn't in any of
+// the groups allowed in.
+func groupRole(groups, adminGroups, userGroups []string) (role string, ok bool) {
+	member := func(want []string) bool {
+		for _, g := range groups {
+			for _, w := range want {
+				if g == w {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	switch {
+	case member(adminGroups):
+		return RoleAdmin, true
+	case len(userGroups) == 0 || member(userGroups):
+		return RoleUser, true
+	}
+	return "", false
+}
@@ -0,0 +1,234 @@
+package user
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	oidcIssuer   = "https://issuer.example"
+	oidcAudience = "atlas"
+)
+
+// oidcKey is a signing key of the test issuer.
+type oidcKey struct {
+	kid  string
+	priv *ecdsa.PrivateKey
+}
+
+func newOIDCKey(t *testing.T, kid string) oidcKey {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oidcKey{kid: kid, priv: priv}
+}
+
+// writeJWKS publishes the public halves of keys in the JWKS file at path.
+func writeJWKS(t *testing.T, path string, keys ...oidcKey) {
+	t.Helper()
+	var set jose.JSONWebKeySet
+	for _, k := range keys {
+		set.Keys = append(set.Keys, jose.JSONWebKey{Key: &k.priv.PublicKey, KeyID: k.kid, Algorithm: string(jose.ES256), Use: "sig"})
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sign returns a token with the given claims, signed by k.
+func (k oidcKey) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: k.priv, KeyID: k.kid}}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(sig).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// oidcClaims returns valid claims for username, with the given changes: a nil value
+// removes the claim.
+func oidcClaims(username string, changes map[string]any) map[string]any {
+	now := time.Now()
+	claims := map[string]any{
+		"iss":                oidcIssuer,
+		"aud":                []string{"other", oidcAudience},
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"preferred_username": username,
+	}
+	for name, v := range changes {
+		if v == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = v
+	}
+	return claims
+}
+
+// newTestOIDC returns an OIDC for the test issuer whose keys are in the returned JWKS
+// file, initially just key.
+func newTestOIDC(t *testing.T, key oidcKey, cfg OIDCConfig) (*OIDC, string) {
+	t.Helper()
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwks, key)
+	cfg.JWKS, cfg.Issuer, cfg.Audience = jwks, oidcIssuer, oidcAudience
+	o, err := NewOIDC(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, jwks
+}
+
+func TestOIDCAuthenticateToken(t *testing.T) {
+	key := newOIDCKey(t, "k1")
+	o, _ := newTestOIDC(t, key, OIDCConfig{})
+	ctx := context.Background()
+
+	u, err := o.AuthenticateToken(ctx, key.sign(t, oidcClaims("alice", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "alice" || u.Role != RoleUser {
+		t.Errorf("got %+v, want alice with role %s", u, RoleUser)
+	}
+
+	past := time.Now().Add(-2 * oidcLeeway)
+	for name, changes := range map[string]map[string]any{
+		"wrong issuer":     {"iss": "https://other.example"},
+		"wrong audience":   {"aud": "other"},
+		"expired":          {"exp": past.Unix()},
+		"missing exp":      {"exp": nil},
+		"not yet valid":    {"nbf": time.Now().Add(2 * oidcLeeway).Unix()},
+		"no username":      {"preferred_username": nil},
+		"invalid username": {"preferred_username": "../alice"},
+	} {
+		_, err := o.AuthenticateToken(ctx, key.sign(t, oidcClaims("alice", changes)))
+		if !errors.Is(err, ErrBadCredentials) {
+			t.Errorf("%s: got %v, want ErrBadCredentials", name, err)
+		}
+	}
+
+	other := newOIDCKey(t, "")
+	if _, err := o.AuthenticateToken(ctx, other.sign(t, oidcClaims("alice", nil))); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("signed by another key: got %v, want ErrBadCredentials", err)
+	}
+	if _, err := o.AuthenticateToken(ctx, "not a token"); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("malformed: got %v, want ErrBadCredentials", err)
+	}
+}
+
+func TestOIDCRejectsHS256(t *testing.T) {
+	key := newOIDCKey(t, "k1")
+	o, _ := newTestOIDC(t, key, OIDCConfig{})
+
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("a shared secret of enough length")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(sig).Claims(oidcClaims("alice", nil)).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.AuthenticateToken(context.Background(), token); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("got %v, want ErrBadCredentials", err)
+	}
+}
+
+func TestOIDCUnknownKeyRefresh(t *testing.T) {
+	k1, k2, k3 := newOIDCKey(t, "k1"), newOIDCKey(t, "k2"), newOIDCKey(t, "k3")
+	o, jwks := newTestOIDC(t, k1, OIDCConfig{})
+	ctx := context.Background()
+	token := k2.sign(t, oidcClaims("alice", nil))
+
+	// The issuer rotates to k2, but the keys were read too recently to read them again.
+	writeJWKS(t, jwks, k1, k2)
+	if _, err := o.AuthenticateToken(ctx, token); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("right after reading the keys: got %v, want ErrBadCredentials", err)
+	}
+
+	o.mu.Lock()
+	o.fetched = time.Now().Add(-jwksMinAge - time.Second)
+	o.mu.Unlock()
+	if _, err := o.AuthenticateToken(ctx, token); err != nil {
+		t.Errorf("once jwksMinAge passed: %v", err)
+	}
+
+	// That read the keys, so another unknown key doesn't cause a read for a while.
+	writeJWKS(t, jwks, k3)
+	if _, err := o.AuthenticateToken(ctx, k3.sign(t, oidcClaims("alice", nil))); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("unknown key right after a read: got %v, want ErrBadCredentials", err)
+	}
+	if _, err := o.AuthenticateToken(ctx, token); err != nil {
+		t.Errorf("known key: %v", err)
+	}
+
+	// A JWKS that can't be read keeps the keys there were.
+	if err := os.Remove(jwks); err != nil {
+		t.Fatal(err)
+	}
+	o.mu.Lock()
+	o.fetched = time.Now().Add(-jwksMaxAge - time.Second)
+	o.mu.Unlock()
+	if _, err := o.AuthenticateToken(ctx, token); err != nil {
+		t.Errorf("with the JWKS gone: %v", err)
+	}
+}
+
+func TestOIDCClaimMapping(t *testing.T) {
+	key := newOIDCKey(t, "k1")
+	o, _ := newTestOIDC(t, key, OIDCConfig{
+		UsernameClaim: "email",
+		GroupsClaim:   "roles",
+		AdminGroups:   []string{"atlas-admins"},
+		UserGroups:    []string{"atlas-users"},
+	})
+
+	for _, c := range []struct {
+		name   string
+		claims map[string]any
+		want   User
+		ok     bool
+	}{
+		{"admin", map[string]any{"email": "alice@example.org", "roles": []string{"staff", "atlas-admins"}},
+			User{Username: "alice@example.org", Role: RoleAdmin}, true},
+		{"user, groups as a string", map[string]any{"email": "bob@example.org", "roles": "atlas-users"},
+			User{Username: "bob@example.org", Role: RoleUser}, true},
+		{"in no allowed group", map[string]any{"email": "carol@example.org", "roles": []string{"staff"}}, User{}, false},
+		{"no groups", map[string]any{"email": "dave@example.org"}, User{}, false},
+		{"username only in preferred_username", map[string]any{"roles": "atlas-users"}, User{}, false},
+	} {
+		u, err := o.AuthenticateToken(context.Background(), key.sign(t, oidcClaims("someone", c.claims)))
+		switch {
+		case !c.ok:
+			if !errors.Is(err, ErrBadCredentials) {
+				t.Errorf("%s: got %v, want ErrBadCredentials", c.name, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case u != c.want:
+			t.Errorf("%s: got %+v, want %+v", c.name, u, c.want)
+		}
+	}
+}
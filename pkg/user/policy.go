@@ -0,0 +1,121 @@
+package user
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrWeakPassword is returned for a password the password policy doesn't allow.
+var ErrWeakPassword = errors.New("password rejected by the password policy")
+
+// DefaultMinLength is the shortest password allowed unless configured otherwise.
+const DefaultMinLength = 8
+
+// Policy is what new passwords must satisfy.
+type Policy struct {
+	// MinLength is the least number of characters.
+	MinLength int
+	// breached holds the SHA1 digests of passwords known from breaches.
+	breached map[[sha1.Size]byte]struct{}
+}
+
+// PasswordPolicy is enforced by Add and SetPassword. Programs set it up once, before
+// changing any passwords.
+var PasswordPolicy = &Policy{MinLength: DefaultMinLength}
+
+// LoadBreached reads a list of breached passwords, one per line: either the password
+// itself, or its SHA1 digest in hex as in the Have I Been Pwned downloads (anything
+// after a ":" is ignored). Lines starting with "#" are comments.
+func (p *Policy) LoadBreached(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	set := make(map[[sha1.Size]byte]struct{})
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var sum [sha1.Size]byte
+		digest, _, _ := strings.Cut(line, ":")
+		if b, err := hex.DecodeString(digest); err == nil && len(b) == sha1.Size {
+			copy(sum[:], b)
+		} else {
+			sum = sha1.Sum([]byte(line))
+		}
+		set[sum] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	p.breached = set
+	return nil
+}
+
+// Breached returns how many passwords the breached list holds.
+func (p *Policy) Breached() int {
+	return len(p.breached)
+}
+
+// Check returns an error wrapping ErrWeakPassword if password isn't allowed.
+func (p *Policy) Check(password string) error {
+	if password == "" {
+		return fmt.Errorf("%w: password must not be empty", ErrWeakPassword)
+	}
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		return fmt.Errorf("%w: password must be at least %d characters", ErrWeakPassword, p.MinLength)
+	}
+	if _, ok := p.breached[sha1.Sum([]byte(password))]; ok {
+		return fmt.Errorf("%w: password is on the list of breached passwords", ErrWeakPassword)
+	}
+	return nil
+}
+
+// generatedLength is the length of generated passwords, unless the policy asks for
+// more. 20 characters of the alphabet below are about 115 bits.
+const generatedLength = 20
+
+// passwordAlphabet leaves out characters that are easily mistaken for one another.
+const passwordAlphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// GeneratePassword returns a random password that satisfies the policy.
+func (p *Policy) GeneratePassword() string {
+	n := max(generatedLength, p.MinLength)
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = passwordAlphabet[randIntn(len(passwordAlphabet))]
+	}
+	return string(b)
+}
+
+// randIntn returns a uniform random number in [0, n), for n <= 256.
+func randIntn(n int) int {
+	limit := 256 - 256%n
+	var b [1]byte
+	for {
+		rand.Read(b[:])
+		if int(b[0]) < limit {
+			return int(b[0]) % n
+		}
+	}
+}
+
+// ResetPassword gives an existing user a new random password and returns it.
+func ResetPassword(tx Tx, username string) (string, error) {
+	password := PasswordPolicy.GeneratePassword()
+	if err := SetPassword(tx, username, password); err != nil {
+		return "", err
+	}
+	return password, nil
+}
@@ -0,0 +1,89 @@
+package user
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyMinLength(t *testing.T) {
+	p := &Policy{MinLength: 8}
+	for password, ok := range map[string]bool{
+		"":          false,
+		"1234567":   false,
+		"12345678":  true,
+		"ééééééé":   false, // 7 characters, 14 bytes
+		"éééééééé":  true,
+		"long one!": true,
+	} {
+		err := p.Check(password)
+		if ok && err != nil {
+			t.Errorf("Check(%q): %v", password, err)
+		}
+		if !ok && !errors.Is(err, ErrWeakPassword) {
+			t.Errorf("Check(%q) = %v, want ErrWeakPassword", password, err)
+		}
+	}
+}
+
+func TestPolicyLoadBreached(t *testing.T) {
+	sum := sha1.Sum([]byte("hunter2hunter2"))
+	list := strings.Join([]string{
+		"# a comment, not a password",
+		"password123",
+		// As in the Have I Been Pwned downloads: upper-case SHA1 and a count.
+		strings.ToUpper(hex.EncodeToString(sum[:])) + ":4242",
+		"",
+		"letmein!!\r",
+	}, "\n")
+	file := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(file, []byte(list), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Policy{MinLength: 8}
+	if err := p.LoadBreached(file); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Breached(); n != 3 {
+		t.Errorf("Breached = %d, want 3", n)
+	}
+	for _, password := range []string{"password123", "hunter2hunter2", "letmein!!"} {
+		if err := p.Check(password); !errors.Is(err, ErrWeakPassword) {
+			t.Errorf("Check(%q) = %v, want ErrWeakPassword", password, err)
+		}
+	}
+	for _, password := range []string{"correct horse battery", "# a comment, not a password"} {
+		if err := p.Check(password); err != nil {
+			t.Errorf("Check(%q) of a password not on the list: %v", password, err)
+		}
+	}
+
+	if err := p.LoadBreached(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("LoadBreached of a missing file succeeded")
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	for _, minLength := range []int{0, 8, 32} {
+		p := &Policy{MinLength: minLength}
+		seen := make(map[string]bool)
+		for range 50 {
+			password := p.GeneratePassword()
+			if err := p.Check(password); err != nil {
+				t.Fatalf("MinLength %d: generated %q: %v", minLength, password, err)
+			}
+			if len(password) != max(generatedLength, minLength) || strings.Trim(password, passwordAlphabet) != "" {
+				t.Fatalf("MinLength %d: generated %q", minLength, password)
+			}
+			if seen[password] {
+				t.Fatalf("MinLength %d: %q generated twice", minLength, password)
+			}
+			seen[password] = true
+		}
+	}
+}
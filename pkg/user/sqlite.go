@@ -0,0 +1,150 @@
+package user
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite" // pure-Go driver, registered as "sqlite"
+)
+
+// sqliteBusyTimeout is how long SQLiteStore waits, in milliseconds, for another
+// process to finish writing to the database.
+const sqliteBusyTimeout = 5000
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS users (
+	username      TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	role          TEXT NOT NULL DEFAULT ''
+)`
+
+// SQLiteStore keeps the users in an SQLite database, one row per user, so lookups and
+// updates don't read or rewrite all the users. SQLite takes care of concurrent access,
+// so 'atlas user' can change users while the server runs and the server sees the
+// changes at the next lookup.
+type SQLiteStore struct {
+	path string
+	db   *sql.DB
+}
+
+// NewSQLiteStore opens the database at path, creating it if needed.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// Created here so the password hashes are private to the owner; SQLite would
+	// create the file world-readable.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	// Write transactions take the lock when they begin ("immediate"), so two writers
+	// wait for each other instead of one failing halfway.
+	dsn := fmt.Sprintf("%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_txlock=immediate", path, sqliteBusyTimeout)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	// Also fails early on a file that isn't an SQLite database.
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &SQLiteStore{path: path, db: db}, nil
+}
+
+// Get returns the user called username.
+func (s *SQLiteStore) Get(username string) (User, error) {
+	return sqliteGet(s.db, username)
+}
+
+// List returns all usernames, sorted.
+func (s *SQLiteStore) List() ([]string, error) {
+	return sqliteList(s.db)
+}
+
+// Update runs fn in an SQLite transaction, which also keeps other writers out.
+func (s *SQLiteStore) Update(fn func(tx Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	if err := fn(sqliteTx{tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the database.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// querier is what reads need of *sql.DB and *sql.Tx.
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func sqliteGet(q querier, username string) (User, error) {
+	u := User{Username: username}
+	err := q.QueryRow(`SELECT password_hash, role FROM users WHERE username = ?`, username).Scan(&u.PasswordHash, &u.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+func sqliteList(q querier) ([]string, error) {
+	// The default (BINARY) collation orders by bytes, as sort.Strings does.
+	rows, err := q.Query(`SELECT username FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// sqliteTx is the Tx of SQLiteStore.
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+func (t sqliteTx) Get(username string) (User, error) {
+	return sqliteGet(t.tx, username)
+}
+
+func (t sqliteTx) List() ([]string, error) {
+	return sqliteList(t.tx)
+}
+
+func (t sqliteTx) Put(u User) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	_, err := t.tx.Exec(`INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET password_hash = excluded.password_hash, role = excluded.role`,
+		u.Username, u.PasswordHash, u.Role)
+	return err
+}
+
+func (t sqliteTx) Delete(username string) error {
+	_, err := t.tx.Exec(`DELETE FROM users WHERE username = ?`, username)
+	return err
+}
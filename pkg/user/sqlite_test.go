@@ -0,0 +1,130 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("database mode = %v, %v; want 0600", fi.Mode().Perm(), err)
+	}
+
+	err = s.Update(func(tx Tx) error {
+		for _, u := range []User{
+			{Username: "bob", PasswordHash: "$2a$hash-b"},
+			{Username: "alice", PasswordHash: "$2a$hash-a", Role: RoleAdmin},
+			{Username: "Zed", PasswordHash: "$2a$hash-z"},
+		} {
+			if err := tx.Put(u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second handle, like 'atlas user' next to the server, sees the same users.
+	other, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if names, err := other.List(); err != nil || !slices.Equal(names, []string{"Zed", "alice", "bob"}) {
+		t.Errorf("List = %v, %v", names, err)
+	}
+	if u, err := other.Get("alice"); err != nil || u.PasswordHash != "$2a$hash-a" || u.Role != RoleAdmin {
+		t.Errorf("Get(alice) = %+v, %v", u, err)
+	}
+	if _, err := other.Get("carol"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(carol): %v, want ErrNotFound", err)
+	}
+
+	// A failing update changes nothing.
+	boom := errors.New("boom")
+	err = s.Update(func(tx Tx) error {
+		if err := tx.Delete("bob"); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, err := s.Get("bob"); err != nil {
+		t.Errorf("bob after rolled back delete: %v", err)
+	}
+	if err := s.Update(func(tx Tx) error { return tx.Put(User{Username: "..", PasswordHash: "x"}) }); err == nil {
+		t.Error("Put of an invalid user succeeded")
+	}
+}
+
+func TestSQLiteStoreConcurrentUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := NewSQLiteStore(path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer s.Close()
+			err = s.Update(func(tx Tx) error {
+				names, err := tx.List()
+				if err != nil {
+					return err
+				}
+				return tx.Put(User{Username: fmt.Sprintf("user%d-after-%d", i, len(names)), PasswordHash: "x"})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	names, err := s.List()
+	if err != nil || len(names) != 8 {
+		t.Fatalf("List = %v, %v; want 8 users", names, err)
+	}
+	// Each update saw all the ones before it.
+	seen := make(map[int]bool)
+	for _, name := range names {
+		var i, n int
+		fmt.Sscanf(name, "user%d-after-%d", &i, &n)
+		seen[n] = true
+	}
+	if len(seen) != 8 {
+		t.Errorf("updates overlapped: %v", names)
+	}
+}
+
+func TestSQLiteStoreRejectsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	os.WriteFile(path, []byte(`{"users": {}}`), 0600)
+	if s, err := NewSQLiteStore(path); err == nil {
+		s.Close()
+		t.Error("opened a JSON file as a database")
+	}
+}
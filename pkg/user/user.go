@@ -1,144 +1,176 @@
-package user
-
-import (
-	"encoding/json"
-	"fmt"
-	"os"
-	"path/filepath"
-	"sync"
-
-	"golang.org/x/crypto/bcrypt"
-)
-
-// User represents a system user.
-type User struct {
-	Username     string `json:"username"`
-	PasswordHash string `json:"password_hash"`
-	// Add permissions later if needed
-}
-
-// Store manages user persistence.
-type Store struct {
-	mu       sync.RWMutex
-	filePath string
-	Users    map[string]*User `json:"users"`
-}
-
-// NewStore creates a new user store backed by the given file path.
-// It loads existing users if the file exists.
-func NewStore(path string) (*Store, error) {
-	s := &Store{
-		filePath: path,
-		Users:    make(map[string]*User),
-	}
-
-	if err := s.load(); err != nil {
-		if os.IsNotExist(err) {
-			return s, nil
-		}
-		return nil, err
-	}
-
-	return s, nil
-}
-
-func (s *Store) load() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	data, err := os.ReadFile(s.filePath)
-	if err != nil {
-		return err
-	}
-
-	// We define a temporary struct to match the JSON structure expected:
-	// either root level map, or a list.
-	// The plan said "users.json", usually a list or map.
-	// Let's use a simple map for direct lookup by username during auth.
-	// But for JSON editability, a list is sometimes nicer?
-	// User said "facilidade de poder editar o ficheiro manualmente".
-	// A map `{"username": {"password_hash": "..."}}` is easy to read.
-	// Or a list `[{"username": "...", ...}]`.
-	// Let's stick effectively to a map serialized, or a list serialized to a map in memory.
-	// Let's support a simple map structure in JSON for O(1) lookups and easy editing.
-	// { "users": { "bob": { ... } } } - maybe too nested.
-	// Simple map: { "bob": { "username": "bob", "password_hash": "..." } }
-
-	return json.Unmarshal(data, &s.Users)
-}
-
-// Save persists the users to disk.
-func (s *Store) Save() error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	data, err := json.MarshalIndent(s.Users, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	// Ensure directory exists
-	dir := filepath.Dir(s.filePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
-
-	return os.WriteFile(s.filePath, data, 0644)
-}
-
-// Add creates a new user.
-func (s *Store) Add(username, password string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, exists := s.Users[username]; exists {
-		return fmt.Errorf("user %s already exists", username)
-	}
-
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-
-	s.Users[username] = &User{
-		Username:     username,
-		PasswordHash: string(hash),
-	}
-
-	return nil // Caller must call Save() explicitly to persist? Or we do it here?
-	// Better to separate concern, but for a CLI command "Add", we expect instant persistence.
-	// Let's not call Save() inside Add() to allow bulk ops, but for CLI usage we will call Add then Save.
-}
-
-// Delete removes a user.
-func (s *Store) Delete(username string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.Users, username)
-}
-
-// Authenticate verifies password for a user.
-func (s *Store) Authenticate(username, password string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	u, ok := s.Users[username]
-	if !ok {
-		return false
-	}
-
-	err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
-	return err == nil
-}
-
-// List returns all usernames.
-func (s *Store) List() []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	keys := make([]string, 0, len(s.Users))
-	for k := range s.Users {
-		keys = append(keys, k)
-	}
-	return keys
-}
+package user
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Roles a user can have. Admins can also use the admin API.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// ErrNotFound is returned for a user that doesn't exist.
+var ErrNotFound = errors.New("no such user")
+
+// User represents a system user.
+type User struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	// Role is RoleAdmin or RoleUser; empty means RoleUser.
+	Role string `json:"role,omitempty"`
+}
+
+// EffectiveRole returns the role of the user, RoleUser if none is set.
+func (u User) EffectiveRole() string {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
+}
+
+// validUsername rejects names that can't be used with Basic Auth (":") or as a
+// segment of the /remote.php/dav/files/<user>/ paths ("/", ".", "..").
+func validUsername(username string) bool {
+	return username != "" && username != "." && username != ".." &&
+		!strings.ContainsAny(username, ":/\\") && strings.TrimSpace(username) == username
+}
+
+// validate checks a user before it is stored, or after it is read back.
+func (u *User) validate() error {
+	switch {
+	case !validUsername(u.Username):
+		return fmt.Errorf("invalid username %q", u.Username)
+	case u.PasswordHash == "":
+		return fmt.Errorf("user %s: missing password_hash", u.Username)
+	case u.Role != "" && !ValidRole(u.Role):
+		return fmt.Errorf("user %s: unknown role %q", u.Username, u.Role)
+	}
+	return nil
+}
+
+// Reader looks up users.
+type Reader interface {
+	// Get returns the user called username, or ErrNotFound.
+	Get(username string) (User, error)
+	// List returns all usernames, sorted.
+	List() ([]string, error)
+}
+
+// Tx is a read-write view of the users within Store.Update.
+type Tx interface {
+	Reader
+	// Put creates or replaces a user.
+	Put(u User) error
+	// Delete removes a user, if there is one.
+	Delete(username string) error
+}
+
+// Store keeps the users. Implementations are safe for concurrent use, and can be
+// changed by other processes (such as 'atlas user') while in use.
+type Store interface {
+	Reader
+	// Update runs fn in a transaction: either all of its changes are saved or, if fn
+	// or the save fails, none are.
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// IsAdmin reports whether username exists and has the admin role.
+func IsAdmin(r Reader, username string) bool {
+	u, err := r.Get(username)
+	return err == nil && u.EffectiveRole() == RoleAdmin
+}
+
+// Add creates a new user. The password must satisfy PasswordPolicy.
+func Add(tx Tx, username, password string) error {
+	if !validUsername(username) {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	if _, err := tx.Get(username); err == nil {
+		return fmt.Errorf("user %s already exists", username)
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err := PasswordPolicy.Check(password); err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return tx.Put(User{
+		Username:     username,
+		PasswordHash: hash,
+	})
+}
+
+// SetPassword replaces the password of an existing user. The password must satisfy
+// PasswordPolicy.
+func SetPassword(tx Tx, username, password string) error {
+	u, err := get(tx, username)
+	if err != nil {
+		return err
+	}
+	if err := PasswordPolicy.Check(password); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = hash
+	return tx.Put(u)
+}
+
+// SetRole changes the role of an existing user.
+func SetRole(tx Tx, username, role string) error {
+	if !ValidRole(role) {
+		return fmt.Errorf("unknown role %q (want %s or %s)", role, RoleUser, RoleAdmin)
+	}
+	u, err := get(tx, username)
+	if err != nil {
+		return err
+	}
+	if role == RoleUser {
+		role = ""
+	}
+	u.Role = role
+	return tx.Put(u)
+}
+
+// get is Get with an error message naming the user.
+func get(r Reader, username string) (User, error) {
+	u, err := r.Get(username)
+	if errors.Is(err, ErrNotFound) {
+		err = fmt.Errorf("user %s: %w", username, err)
+	}
+	return u, err
+}
+
+// Copy puts every user of src into tx, for moving users between backends.
+func Copy(tx Tx, src Reader) (int, error) {
+	names, err := src.List()
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		u, err := src.Get(name)
+		if err != nil {
+			return 0, err
+		}
+		if err := tx.Put(u); err != nil {
+			return 0, err
+		}
+	}
+	return len(names), nil
+}
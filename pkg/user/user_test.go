@@ -0,0 +1,41 @@
+package user
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValidUsername(t *testing.T) {
+	for name, want := range map[string]bool{
+		"alice":       true,
+		"alice.smith": true,
+		"..alice":     true,
+		"a@b.example": true,
+		"":            false,
+		".":           false,
+		"..":          false,
+		"a/b":         false,
+		`a\b`:         false,
+		"a:b":         false,
+		" alice":      false,
+		"alice\t":     false,
+	} {
+		if got := validUsername(name); got != want {
+			t.Errorf("validUsername(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestAddRejectsDotNames(t *testing.T) {
+	s, err := NewJSONStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, name := range []string{".", ".."} {
+		err := s.Update(func(tx Tx) error { return Add(tx, name, "long enough password") })
+		if err == nil {
+			t.Errorf("Add(%q) succeeded", name)
+		}
+	}
+}